@@ -3,6 +3,7 @@ package cli
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -28,7 +29,7 @@ func newDebugCmd() *cobra.Command {
 
 			debugServices(ctx)
 			debugIPSet(ctx, cfg)
-			debugIPTables(ctx)
+			debugIPTables(ctx, cfg)
 			debugConfig(cfg)
 
 			return nil
@@ -51,7 +52,7 @@ func debugServices(ctx context.Context) {
 
 func debugIPSet(ctx context.Context, cfg *config.Config) {
 	fmt.Println("--- IPSet ---")
-	ipset := netfilter.NewIPSet(cfg.IPSet.TableName)
+	ipset := netfilter.NewSet(netfilter.ResolveBackend(cfg.Netfilter.Backend), cfg.IPSet.TableName)
 	entries, err := ipset.List(ctx)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
@@ -64,7 +65,19 @@ func debugIPSet(ctx context.Context, cfg *config.Config) {
 	fmt.Println()
 }
 
-func debugIPTables(ctx context.Context) {
+func debugIPTables(ctx context.Context, cfg *config.Config) {
+	if netfilter.ResolveBackend(cfg.Netfilter.Backend) == netfilter.BackendNFTables {
+		fmt.Println("--- NFTables ---")
+		out, err := platform.Run(ctx, "nft", "list", "table", "inet", netfilter.NFTTable)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println(out)
+		}
+		fmt.Println()
+		return
+	}
+
 	fmt.Println("--- IPTables NAT ---")
 	out, err := platform.Run(ctx, "iptables", "-t", "nat", "-L", "-n", "--line-numbers")
 	if err != nil {
@@ -77,9 +90,21 @@ func debugIPTables(ctx context.Context) {
 
 func debugConfig(cfg *config.Config) {
 	fmt.Println("--- Config ---")
+	fmt.Printf("Routing mode:      %s\n", cfg.Routing.Mode)
 	fmt.Printf("Routing port:      %d\n", cfg.Routing.LocalPort)
-	fmt.Printf("DNSCrypt port:     %d\n", cfg.DNSCrypt.Port)
-	fmt.Printf("Interface:         %s\n", cfg.Network.EntwareInterface)
+	fmt.Printf("Netfilter backend: %s (%s)\n", cfg.Netfilter.Backend, netfilter.ResolveBackend(cfg.Netfilter.Backend))
+	if cfg.DNS.UsesDNSCrypt() {
+		fmt.Printf("DNSCrypt port:     %d\n", cfg.DNSCrypt.Port)
+	} else {
+		fmt.Printf("DNS upstreams:     %s\n", strings.Join(cfg.DNS.Upstreams, ", "))
+		fmt.Printf("DNS bootstrap:     %s\n", strings.Join(cfg.DNS.BootstrapServers(), ", "))
+	}
+	if cfg.DNS.MatchedUpstream != "" {
+		fmt.Printf("Matched upstream:  %s\n", cfg.DNS.MatchedUpstream)
+	}
+	for _, i := range cfg.Network.LANInterfaces() {
+		fmt.Printf("Interface:         %s (route: %v, dns: %v)\n", i.Name, i.Route, i.DNS)
+	}
 	fmt.Printf("Web listen:        %s\n", cfg.Daemon.WebListen)
 	fmt.Printf("Setup finished:    %v\n", cfg.SetupFinished)
 	fmt.Println()
@@ -42,7 +42,7 @@ func newTestCmd() *cobra.Command {
 			ensureDomainInShunt(cfg, probeDomain)
 
 			fmt.Println()
-			if !printDomainProbe(ctx, cfg, probeDomain) {
+			if !printDomainProbe(ctx, cfg, store, probeDomain) {
 				allPassed = false
 			}
 
@@ -107,9 +107,9 @@ func printWarn(msg string) {
 }
 
 // printDomainProbe runs a domain probe and prints the results. Returns true if all IPs are in the ipset.
-func printDomainProbe(ctx context.Context, cfg *config.Config, domain string) bool {
+func printDomainProbe(ctx context.Context, cfg *config.Config, store *shunt.Store, domain string) bool {
 	fmt.Printf("  Domain probe: %s\n", domain)
-	probe, err := healthcheck.ProbeDomain(ctx, cfg, domain)
+	probe, err := healthcheck.ProbeDomain(ctx, cfg, store, domain)
 	if err != nil {
 		fmt.Printf("    \033[31m✗\033[0m %v\n", err)
 		return false
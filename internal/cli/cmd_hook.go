@@ -1,16 +1,21 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 
 	"github.com/spf13/cobra"
 
 	"github.com/egorlepa/netshunt/internal/config"
 	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/platform"
 	"github.com/egorlepa/netshunt/internal/routing"
+	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
 func newHookCmd() *cobra.Command {
@@ -34,7 +39,68 @@ func hookLogger() *slog.Logger {
 	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
 }
 
-// hook fs start — create ipset table on filesystem mount.
+// loadMode returns the configured routing mode with routing targets loaded
+// from the shunt store.
+func loadMode(cfg *config.Config, logger *slog.Logger) routing.Mode {
+	mode := routing.New(cfg, logger)
+	if targets, err := shunt.NewDefaultStore().Targets(); err == nil {
+		mode.SetTargets(targets)
+	} else {
+		logger.Warn("failed to load routing targets", "error", err)
+	}
+	return mode
+}
+
+// daemonAction runs an action of the running daemon through its web API.
+// reached is false if the daemon could not be reached.
+func daemonAction(ctx context.Context, cfg *config.Config, action string) (reached bool, err error) {
+	apiURL := fmt.Sprintf("http://127.0.0.1%s/actions/%s", cfg.Daemon.WebListen, action)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("daemon %s: %s", action, resp.Status)
+	}
+	return true, nil
+}
+
+// setupRules has the daemon set the routing rules up again with the given
+// action ("rules" or, when a LAN interface comes up, "setup"), so they keep
+// its live state: a failover port, an enforced proxy-down policy, a pause or
+// LAN interfaces that are down. Only without a running daemon are the rules
+// set up from config.
+func setupRules(ctx context.Context, cfg *config.Config, logger *slog.Logger, action string) error {
+	reached, err := daemonAction(ctx, cfg, action)
+	if reached {
+		return err
+	}
+	logger.Warn("daemon not reachable, setting up rules from config", "error", err)
+	if until, ok := platform.PausedUntil(); ok {
+		logger.Info("routing paused, skipping rules", "until", until)
+		return nil
+	}
+	return loadMode(cfg, logger).SetupRules(ctx)
+}
+
+// teardownRules has the daemon tear the routing rules down and keep them
+// down until a LAN interface comes up, so its drift watch doesn't restore
+// them. Only without a running daemon are they torn down here.
+func teardownRules(ctx context.Context, cfg *config.Config, logger *slog.Logger) error {
+	reached, err := daemonAction(ctx, cfg, "teardown")
+	if reached {
+		return err
+	}
+	logger.Warn("daemon not reachable, tearing down rules from config", "error", err)
+	return loadMode(cfg, logger).TeardownRules(ctx)
+}
+
+// hook fs start — create ipset tables (default + per-target) on filesystem mount.
 func newHookFsCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "fs <start|stop>",
@@ -49,11 +115,21 @@ func newHookFsCmd() *cobra.Command {
 				return err
 			}
 			ctx := cmd.Context()
-			if err := netfilter.NewIPSet(cfg.IPSet.TableName).EnsureTable(ctx); err != nil {
+			targets, err := shunt.NewDefaultStore().Targets()
+			if err != nil {
 				return err
 			}
-			if cfg.IPv6 {
-				return netfilter.NewIPSet6(cfg.IPSet.TableName + "6").EnsureTable(ctx)
+			backend := netfilter.ResolveBackend(cfg.Netfilter.Backend)
+			for _, t := range append([]shunt.Target{{}}, targets...) {
+				name4, name6 := cfg.IPSet.Names(t.Suffix())
+				if err := netfilter.NewSet(backend, name4).EnsureTable(ctx); err != nil {
+					return err
+				}
+				if cfg.IPv6 {
+					if err := netfilter.NewSet6(backend, name6).EnsureTable(ctx); err != nil {
+						return err
+					}
+				}
 			}
 			return nil
 		},
@@ -71,9 +147,7 @@ func newHookNetfilterCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			logger := hookLogger()
-			mode := routing.New(cfg, logger)
-			return mode.SetupRules(cmd.Context())
+			return setupRules(cmd.Context(), cfg, hookLogger(), "rules")
 		},
 	}
 }
@@ -100,21 +174,32 @@ func newHookIfstateCmd() *cobra.Command {
 				name = id // last-resort fallback
 			}
 
-			if name != cfg.Network.EntwareInterface {
+			lan := cfg.Network.LANInterfaces()
+			if !slices.ContainsFunc(lan, func(i config.LANInterface) bool { return i.Name == name }) {
 				return nil
 			}
 
 			logger := hookLogger()
-			mode := routing.New(cfg, logger)
 
 			if connected == "yes" && link == "up" {
 				logger.Info("interface up, setting up rules", "system-name", name)
-				return mode.SetupRules(cmd.Context())
+				return setupRules(cmd.Context(), cfg, logger, "setup")
 			}
 
 			if link == "down" {
+				// The rules serve every LAN interface; keep them while another
+				// one is still up.
+				for _, i := range lan {
+					if i.Name == name {
+						continue
+					}
+					if iface, err := net.InterfaceByName(i.Name); err == nil && iface.Flags&net.FlagUp != 0 {
+						logger.Info("interface down, keeping rules for other interfaces", "system-name", name, "up", i.Name)
+						return nil
+					}
+				}
 				logger.Info("interface down, tearing down rules", "system-name", name)
-				return mode.TeardownRules(cmd.Context())
+				return teardownRules(cmd.Context(), cfg, logger)
 			}
 
 			_ = up // available for future use
@@ -150,14 +235,12 @@ func newHookWanCmd() *cobra.Command {
 				return err
 			}
 
-			apiURL := fmt.Sprintf("http://127.0.0.1%s/actions/reconcile", cfg.Daemon.WebListen)
-			resp, err := http.Post(apiURL, "", nil)
-			if err != nil {
+			reached, err := daemonAction(cmd.Context(), cfg, "reconcile")
+			if !reached {
 				hookLogger().Warn("daemon not reachable, skipping reconcile", "error", err)
 				return nil
 			}
-			resp.Body.Close()
-			return nil
+			return err
 		},
 	}
 }
@@ -0,0 +1,121 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/daemon"
+	"github.com/egorlepa/netshunt/internal/routing"
+	"github.com/egorlepa/netshunt/internal/web"
+)
+
+// fakeMode records the proxy state every SetupRules ran with and counts
+// the teardowns.
+type fakeMode struct {
+	routing.Mode
+
+	mu        sync.Mutex
+	down      bool
+	setups    []bool
+	teardowns int
+}
+
+func (m *fakeMode) Name() string { return routing.ModeRedirect }
+
+func (m *fakeMode) SetProxyDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = down
+}
+
+func (m *fakeMode) SetupRules(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.setups = append(m.setups, m.down)
+	return nil
+}
+
+func (m *fakeMode) TeardownRules(context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.teardowns++
+	return nil
+}
+
+func TestHookSetupRulesKeepsProxyDown(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Defaults()
+	cfg.Routing.ProxyDown.Policy = routing.PolicyFailClosed
+
+	mode := &fakeMode{}
+	rec := &daemon.Reconciler{Config: &cfg, Mode: mode, Logger: logger}
+	if err := rec.SetProxyDown(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(web.NewServer(web.Deps{Reconciler: rec, Logger: logger}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	cfg.Daemon.WebListen = ":" + port
+
+	// A netfilter event while the kill switch is on: the daemon sets the
+	// rules up again with the proxy still down.
+	if err := setupRules(ctx, &cfg, logger, "rules"); err != nil {
+		t.Fatal(err)
+	}
+	mode.mu.Lock()
+	defer mode.mu.Unlock()
+	if want := []bool{true, true}; !slices.Equal(mode.setups, want) {
+		t.Errorf("rules set up with proxy down %v, want %v", mode.setups, want)
+	}
+}
+
+func TestHookTeardownRulesStaysDown(t *testing.T) {
+	ctx := context.Background()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.Defaults()
+
+	mode := &fakeMode{}
+	rec := &daemon.Reconciler{Config: &cfg, Mode: mode, Logger: logger}
+
+	srv := httptest.NewServer(web.NewServer(web.Deps{Reconciler: rec, Logger: logger}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	cfg.Daemon.WebListen = ":" + port
+
+	// The last LAN link goes down: the daemon tears the rules down, and its
+	// drift watch leaves them down.
+	if err := teardownRules(ctx, &cfg, logger); err != nil {
+		t.Fatal(err)
+	}
+	if drifts, err := rec.Heal(ctx); err != nil || len(drifts) != 0 {
+		t.Errorf("heal after teardown = %v, %v, want nothing", drifts, err)
+	}
+	// Neither does a netfilter event.
+	if err := setupRules(ctx, &cfg, logger, "rules"); err != nil {
+		t.Fatal(err)
+	}
+	mode.mu.Lock()
+	if mode.teardowns != 1 || len(mode.setups) != 0 {
+		t.Errorf("%d teardowns and %d setups, want 1 and 0", mode.teardowns, len(mode.setups))
+	}
+	mode.mu.Unlock()
+
+	// The link comes back up.
+	if err := setupRules(ctx, &cfg, logger, "setup"); err != nil {
+		t.Fatal(err)
+	}
+	mode.mu.Lock()
+	defer mode.mu.Unlock()
+	if len(mode.setups) != 1 {
+		t.Errorf("%d setups after link up, want 1", len(mode.setups))
+	}
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/egorlepa/netshunt/internal/config"
+)
+
+func newPauseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause [duration]",
+		Short: "Pause routing for a while (default 10m); DNS keeps working",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d := 10 * time.Minute
+			if len(args) > 0 {
+				var err error
+				if d, err = time.ParseDuration(args[0]); err != nil || d <= 0 {
+					return fmt.Errorf("invalid duration %q (e.g. 10m, 1h)", args[0])
+				}
+			}
+			if err := postAction("pause", url.Values{"duration": {d.String()}}); err != nil {
+				return err
+			}
+			fmt.Printf("Routing paused until %s.\n", time.Now().Add(d).Format("15:04:05"))
+			return nil
+		},
+	}
+}
+
+func newResumeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resume",
+		Short: "Resume paused routing",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := postAction("resume", nil); err != nil {
+				return err
+			}
+			fmt.Println("Routing resumed.")
+			return nil
+		},
+	}
+}
+
+// postAction posts to an /actions endpoint of the daemon.
+func postAction(action string, form url.Values) error {
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	apiURL := fmt.Sprintf("http://127.0.0.1%s/actions/%s", cfg.Daemon.WebListen, action)
+	resp, err := http.PostForm(apiURL, form)
+	if err != nil {
+		return fmt.Errorf("daemon not reachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+	return nil
+}
@@ -7,7 +7,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,11 +17,12 @@ import (
 
 	"github.com/egorlepa/netshunt/internal/config"
 	"github.com/egorlepa/netshunt/internal/deploy"
-	"github.com/egorlepa/netshunt/internal/shunt"
 	"github.com/egorlepa/netshunt/internal/healthcheck"
 	"github.com/egorlepa/netshunt/internal/platform"
 	"github.com/egorlepa/netshunt/internal/router"
+	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/service"
+	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
 func newSetupCmd() *cobra.Command {
@@ -107,21 +110,69 @@ func newSetupCmd() *cobra.Command {
 				return err
 			}
 
-			// 4. Transparent proxy configuration.
-			fmt.Println("Transparent proxy configuration:")
-			fmt.Println("  Set up your proxy (ss-redir, xray, etc.) separately.")
-			fmt.Println("  netshunt will redirect matched TCP and UDP traffic to the specified port.")
-			cfg.Routing.LocalPort = promptInt(reader, "  Local port your proxy listens on", cfg.Routing.LocalPort)
+			// 4. Routing mode.
+			fmt.Println("Routing mode:")
+			fmt.Println("  1) redirect  — send matched traffic to a local transparent proxy (ss-redir, xray, sing-box, ...)")
+			fmt.Println("  2) tproxy    — same, but TPROXY for TCP too (needs a TPROXY-capable inbound; no IPv6 NAT required)")
+			fmt.Println("  3) interface — route matched traffic out a router interface (WireGuard, OpenVPN, ...)")
+			defaultMode := "1"
+			switch cfg.Routing.Mode {
+			case routing.ModeTproxy:
+				defaultMode = "2"
+			case routing.ModeInterface:
+				defaultMode = "3"
+			}
+			switch prompt(reader, "  Pick mode", defaultMode) {
+			case "2":
+				cfg.Routing.Mode = routing.ModeTproxy
+			case "3":
+				cfg.Routing.Mode = routing.ModeInterface
+			default:
+				cfg.Routing.Mode = routing.ModeRedirect
+			}
 			fmt.Println()
 
-			// 5. DNS configuration (informational).
-			fmt.Println("DNS configuration:")
-			fmt.Printf("  DNS queries: netshunt forwarder -> dnscrypt-proxy (:%d) -> encrypted upstream\n", cfg.DNSCrypt.Port)
+			if cfg.Routing.Mode == routing.ModeInterface {
+				// 4a. Outbound interface.
+				fmt.Println("Outbound interface:")
+				fmt.Println("  netshunt will mark matched traffic and route it out the chosen interface.")
+				cfg.Routing.Interface = promptOutboundInterface(reader, ctx, cfg.Routing.Interface)
+				fmt.Println()
+			} else {
+				// 4a. Transparent proxy configuration.
+				fmt.Println("Transparent proxy configuration:")
+				fmt.Println("  Set up your proxy (ss-redir, xray, etc.) separately.")
+				fmt.Println("  netshunt will redirect matched TCP and UDP traffic to the specified port.")
+				cfg.Routing.LocalPort = promptInt(reader, "  Local port your proxy listens on", cfg.Routing.LocalPort)
+				fmt.Println()
+			}
+
+			// 5. DNS upstream.
+			fmt.Println("DNS upstream:")
+			fmt.Println("  1) built-in  — netshunt queries DNS-over-HTTPS / DNS-over-TLS resolvers itself")
+			fmt.Printf("  2) dnscrypt-proxy — netshunt forwards to dnscrypt-proxy (:%d)\n", cfg.DNSCrypt.Port)
+			defaultDNS := "1"
+			if cfg.DNS.UsesDNSCrypt() && deploy.DNSCryptDep.IsInstalled() {
+				defaultDNS = "2"
+			}
+			if prompt(reader, "  Pick upstream", defaultDNS) == "2" {
+				cfg.DNS.Upstreams = nil
+				if !deploy.DNSCryptDep.IsInstalled() {
+					if err := deploy.InstallOpkgDeps(ctx, []string{deploy.DNSCryptDep.Package}); err != nil {
+						printFail(fmt.Sprintf("dnscrypt-proxy: %v (install manually: opkg install %s)", err, deploy.DNSCryptDep.Package))
+					} else {
+						printPass("dnscrypt-proxy: installed")
+					}
+				}
+			} else {
+				cfg.DNS.Upstreams = promptUpstreams(reader, cfg.DNS.Upstreams)
+			}
 			fmt.Println()
 
 			// 6. Network interface.
-			fmt.Println("Network interface:")
-			cfg.Network.EntwareInterface = promptInterface(reader, ctx, cfg.Network.EntwareInterface)
+			fmt.Println("LAN interfaces:")
+			cfg.Network.Interfaces = promptInterfaces(reader, ctx, cfg.Network.LANInterfaces())
+			cfg.Network.EntwareInterface = ""
 			fmt.Println()
 
 			// 7. IPv6.
@@ -140,11 +191,13 @@ func newSetupCmd() *cobra.Command {
 
 			fmt.Println()
 
-			// 8. Start dnscrypt-proxy.
-			if err := service.DNSCrypt.EnsureRunning(ctx); err != nil {
-				printFail(fmt.Sprintf("dnscrypt-proxy: %v", err))
-			} else {
-				printPass("dnscrypt-proxy: running")
+			// 8. Start dnscrypt-proxy if it is the upstream.
+			if cfg.DNS.UsesDNSCrypt() {
+				if err := service.DNSCrypt.EnsureRunning(ctx); err != nil {
+					printFail(fmt.Sprintf("dnscrypt-proxy: %v", err))
+				} else {
+					printPass("dnscrypt-proxy: running")
+				}
 			}
 
 			// 9. Install NDM hooks.
@@ -195,7 +248,7 @@ func newSetupCmd() *cobra.Command {
 			// 16. Domain probe: verify ifconfig.me resolves through the pipeline.
 			fmt.Println()
 			fmt.Println("Domain probe: ifconfig.me")
-			probe, err := healthcheck.ProbeDomain(ctx, cfg, "ifconfig.me")
+			probe, err := healthcheck.ProbeDomain(ctx, cfg, store, "ifconfig.me")
 			if err != nil {
 				printFail(fmt.Sprintf("ifconfig.me: %v", err))
 			} else if len(probe.IPs) == 0 {
@@ -216,7 +269,11 @@ func newSetupCmd() *cobra.Command {
 			fmt.Println("  You should see your VPN/proxy IP, not your real IP.")
 			fmt.Println()
 			fmt.Println("Next steps:")
-			fmt.Printf("  Web UI: http://%s%s\n", interfaceIP(cfg.Network.EntwareInterface), cfg.Daemon.WebListen)
+			webIface := "br0"
+			if ifaces := cfg.Network.LANInterfaces(); len(ifaces) > 0 {
+				webIface = ifaces[0].Name
+			}
+			fmt.Printf("  Web UI: http://%s%s\n", interfaceIP(webIface), cfg.Daemon.WebListen)
 
 			return nil
 		},
@@ -237,6 +294,33 @@ func prompt(reader *bufio.Reader, label, defaultVal string) string {
 	return line
 }
 
+// promptUpstreams asks for the resolvers of the built-in DNS client,
+// comma or space separated, until all of them are valid.
+func promptUpstreams(reader *bufio.Reader, defaults []string) []string {
+	if len(defaults) == 0 {
+		defaults = config.DefaultUpstreams
+	}
+	for {
+		answer := prompt(reader, "  Resolvers (https://..., tls://... or IPs)", strings.Join(defaults, ", "))
+		var upstreams []string
+		var invalid error
+		for _, f := range strings.Fields(strings.ReplaceAll(answer, ",", " ")) {
+			u, err := shunt.NormalizeUpstream(f)
+			if err != nil {
+				invalid = err
+				break
+			}
+			upstreams = append(upstreams, u)
+		}
+		if invalid == nil && len(upstreams) > 0 {
+			return upstreams
+		}
+		if invalid != nil {
+			fmt.Printf("  %v\n", invalid)
+		}
+	}
+}
+
 func promptInt(reader *bufio.Reader, label string, defaultVal int) int {
 	s := prompt(reader, label, fmt.Sprintf("%d", defaultVal))
 	var n int
@@ -246,57 +330,83 @@ func promptInt(reader *bufio.Reader, label string, defaultVal int) int {
 	return n
 }
 
-// promptInterface lists available bridge interfaces and lets the user pick one.
-// Falls back to a plain text prompt if interface detection fails.
-func promptInterface(reader *bufio.Reader, ctx context.Context, defaultVal string) string {
+// promptInterfaces lists available bridge interfaces and lets the user pick
+// one or more (home, guest, IoT bridges, ...). Picked interfaces get routing
+// and DNS interception. Falls back to a plain text prompt if interface
+// detection fails.
+func promptInterfaces(reader *bufio.Reader, ctx context.Context, defaults []config.LANInterface) []config.LANInterface {
+	var defaultNames []string
+	for _, i := range defaults {
+		defaultNames = append(defaultNames, i.Name)
+	}
 	bridges := detectBridgeInterfaces(ctx)
 
 	if len(bridges) == 0 {
-		return prompt(reader, "  Entware interface (e.g., br0)", defaultVal)
+		s := prompt(reader, "  LAN interfaces, comma-separated (e.g., br0,br1)", strings.Join(defaultNames, ","))
+		return lanInterfaces(strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }), defaults)
 	}
 
-	// Ensure the current default is in the list, or prepend it.
-	if defaultVal != "" {
-		found := false
-		for _, b := range bridges {
-			if b == defaultVal {
-				found = true
-				break
-			}
-		}
-		if !found {
-			bridges = append([]string{defaultVal}, bridges...)
+	// Ensure the current defaults are in the list, or prepend them.
+	for _, d := range slices.Backward(defaultNames) {
+		if !slices.Contains(bridges, d) {
+			bridges = append([]string{d}, bridges...)
 		}
 	}
+	if len(defaultNames) == 0 {
+		defaultNames = bridges[:1]
+	}
 
 	fmt.Println("  Available bridge interfaces:")
-	defaultIdx := 1
+	var defaultIdx []string
 	for i, b := range bridges {
 		marker := ""
-		if b == defaultVal || (defaultVal == "" && i == 0) {
+		if slices.Contains(defaultNames, b) {
 			marker = " (default)"
-			defaultIdx = i + 1
+			defaultIdx = append(defaultIdx, strconv.Itoa(i+1))
 		}
 		fmt.Printf("    %d) %s%s\n", i+1, b, marker)
 	}
 
 	for {
-		s := prompt(reader, fmt.Sprintf("  Pick interface [%d]", defaultIdx), "")
+		s := prompt(reader, fmt.Sprintf("  Pick interfaces, comma-separated [%s]", strings.Join(defaultIdx, ",")), "")
 		if s == "" {
-			return bridges[defaultIdx-1]
+			return lanInterfaces(defaultNames, defaults)
 		}
-		var n int
-		if _, err := fmt.Sscanf(s, "%d", &n); err == nil && n >= 1 && n <= len(bridges) {
-			return bridges[n-1]
-		}
-		// Accept a typed interface name directly.
-		for _, b := range bridges {
-			if b == s {
-				return s
+		var picked []string
+		valid := true
+		for _, item := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+			name := item // accept a typed interface name directly
+			var n int
+			if _, err := fmt.Sscanf(item, "%d", &n); err == nil && n >= 1 && n <= len(bridges) {
+				name = bridges[n-1]
+			} else if !slices.Contains(bridges, item) {
+				valid = false
+				break
+			}
+			if !slices.Contains(picked, name) {
+				picked = append(picked, name)
 			}
 		}
-		fmt.Printf("  Invalid choice. Enter a number between 1 and %d.\n", len(bridges))
+		if valid && len(picked) > 0 {
+			return lanInterfaces(picked, defaults)
+		}
+		fmt.Printf("  Invalid choice. Enter numbers between 1 and %d, e.g. 1,2.\n", len(bridges))
+	}
+}
+
+// lanInterfaces returns names as LAN interfaces, keeping the routing and DNS
+// switches of those already in defaults and enabling both for new ones.
+func lanInterfaces(names []string, defaults []config.LANInterface) []config.LANInterface {
+	var out []config.LANInterface
+	for _, name := range names {
+		i := slices.IndexFunc(defaults, func(d config.LANInterface) bool { return d.Name == name })
+		if i >= 0 {
+			out = append(out, defaults[i])
+		} else {
+			out = append(out, config.LANInterface{Name: name, Route: true, DNS: true})
+		}
 	}
+	return out
 }
 
 // detectBridgeInterfaces returns bridge interface names (Linux system names, e.g., "br0").
@@ -336,6 +446,91 @@ func detectBridgeInterfaces(ctx context.Context) []string {
 	return bridges
 }
 
+// promptOutboundInterface lists tunnel-like interfaces and lets the user pick
+// one. Falls back to a plain text prompt if none are detected.
+func promptOutboundInterface(reader *bufio.Reader, ctx context.Context, defaultVal string) string {
+	tunnels := detectTunnelInterfaces(ctx)
+	if len(tunnels) == 0 {
+		for {
+			if s := prompt(reader, "  Outbound interface (e.g., nwg0)", defaultVal); s != "" {
+				return s
+			}
+			fmt.Println("  An interface is required in interface mode.")
+		}
+	}
+
+	fmt.Println("  Available tunnel interfaces:")
+	defaultIdx := 1
+	for i, t := range tunnels {
+		marker := ""
+		if t == defaultVal {
+			marker = " (default)"
+			defaultIdx = i + 1
+		}
+		fmt.Printf("    %d) %s%s\n", i+1, t, marker)
+	}
+
+	for {
+		s := prompt(reader, fmt.Sprintf("  Pick interface [%d]", defaultIdx), "")
+		if s == "" {
+			return tunnels[defaultIdx-1]
+		}
+		var n int
+		if _, err := fmt.Sscanf(s, "%d", &n); err == nil && n >= 1 && n <= len(tunnels) {
+			return tunnels[n-1]
+		}
+		// Accept any typed interface name; it may not be up yet.
+		if !strings.ContainsAny(s, " \t") {
+			return s
+		}
+		fmt.Printf("  Invalid choice. Enter a number between 1 and %d.\n", len(tunnels))
+	}
+}
+
+// tunnelPrefixes are Linux interface name prefixes of VPN tunnels on Keenetic
+// (nwg = WireGuard, ovpn_br/tun = OpenVPN, ppp = L2TP/PPTP/SSTP, ...).
+var tunnelPrefixes = []string{"nwg", "wg", "tun", "ovpn", "ppp", "ipsec", "t2s"}
+
+// detectTunnelInterfaces returns tunnel interface names (Linux system names).
+// Tries the Keenetic RCI API first, then falls back to /sys/class/net/.
+func detectTunnelInterfaces(ctx context.Context) []string {
+	isTunnel := func(name string) bool {
+		for _, p := range tunnelPrefixes {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	rci := router.NewClient()
+	if ifaces, err := rci.GetInterfaces(ctx); err == nil {
+		var tunnels []string
+		for _, iface := range ifaces {
+			if iface.SystemName != "" && isTunnel(iface.SystemName) {
+				tunnels = append(tunnels, iface.SystemName)
+			}
+		}
+		if len(tunnels) > 0 {
+			sort.Strings(tunnels)
+			return tunnels
+		}
+	}
+
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		return nil
+	}
+	var tunnels []string
+	for _, e := range entries {
+		if isTunnel(e.Name()) {
+			tunnels = append(tunnels, e.Name())
+		}
+	}
+	sort.Strings(tunnels)
+	return tunnels
+}
+
 // waitForDaemon polls the daemon's /ready endpoint until it returns 200 or times out.
 func waitForDaemon(cfg *config.Config) error {
 	listen := cfg.Daemon.WebListen
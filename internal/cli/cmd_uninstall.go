@@ -13,6 +13,7 @@ import (
 	"github.com/egorlepa/netshunt/internal/router"
 	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/service"
+	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
 func newUninstallCmd() *cobra.Command {
@@ -33,10 +34,12 @@ func newUninstallCmd() *cobra.Command {
 				fmt.Printf("  Warning: %v\n", err)
 			}
 
-			// 2. Stop dnscrypt-proxy.
-			fmt.Println("Stopping dnscrypt-proxy...")
-			if err := service.DNSCrypt.Stop(ctx); err != nil {
-				fmt.Printf("  Warning: %v\n", err)
+			// 2. Stop dnscrypt-proxy, if installed.
+			if service.DNSCrypt.IsInstalled() {
+				fmt.Println("Stopping dnscrypt-proxy...")
+				if err := service.DNSCrypt.Stop(ctx); err != nil {
+					fmt.Printf("  Warning: %v\n", err)
+				}
 			}
 
 			// 3. Remove iptables rules.
@@ -47,11 +50,20 @@ func newUninstallCmd() *cobra.Command {
 				fmt.Printf("  Warning: %v\n", err)
 			}
 
-			// 4. Flush and destroy ipset table.
-			fmt.Println("Removing ipset table...")
-			ipset := netfilter.NewIPSet(cfg.IPSet.TableName)
-			_ = ipset.Flush(ctx)
-			_ = ipset.Destroy(ctx)
+			// 4. Flush and destroy ipset tables (default + per-target).
+			fmt.Println("Removing ipset tables...")
+			targets, _ := shunt.NewDefaultStore().Targets()
+			backend := netfilter.ResolveBackend(cfg.Netfilter.Backend)
+			for _, t := range append([]shunt.Target{{}}, targets...) {
+				name4, name6 := cfg.IPSet.Names(t.Suffix())
+				for _, ipset := range []netfilter.Set{netfilter.NewSet(backend, name4), netfilter.NewSet6(backend, name6)} {
+					_ = ipset.Flush(ctx)
+					_ = ipset.Destroy(ctx)
+				}
+			}
+			if backend == netfilter.BackendNFTables {
+				_ = netfilter.NewNFTables().DeleteTable(ctx)
+			}
 
 			// 5. Disable dns-override so Keenetic reclaims DNS after reboot.
 			fmt.Println("Disabling dns-override...")
@@ -77,7 +89,11 @@ func newUninstallCmd() *cobra.Command {
 			fmt.Println()
 			fmt.Println("netshunt removed. Shunts preserved in " + platform.ShuntsFile)
 			fmt.Println("Next steps:")
-			fmt.Println("  opkg remove netshunt dnscrypt-proxy2")
+			if service.DNSCrypt.IsInstalled() {
+				fmt.Println("  opkg remove netshunt dnscrypt-proxy2")
+			} else {
+				fmt.Println("  opkg remove netshunt")
+			}
 			return nil
 		},
 	}
@@ -21,6 +21,8 @@ func NewRootCmd() *cobra.Command {
 		newDebugCmd(),
 		newSetupCmd(),
 		newDNSCmd(),
+		newPauseCmd(),
+		newResumeCmd(),
 		newHookCmd(),
 		newInstallHooksCmd(),
 		newUninstallCmd(),
@@ -0,0 +1,24 @@
+package config
+
+import "sync/atomic"
+
+// Live is the daemon's current config, shared by its goroutines. Saving the
+// settings swaps in a new Config with Store instead of changing the one in
+// use; readers Load the current one each time they need it and never modify
+// it.
+type Live struct {
+	cfg atomic.Pointer[Config]
+}
+
+// NewLive returns a Live holding cfg.
+func NewLive(cfg *Config) *Live {
+	l := &Live{}
+	l.Store(cfg)
+	return l
+}
+
+// Load returns the current config.
+func (l *Live) Load() *Config { return l.cfg.Load() }
+
+// Store makes cfg the current config.
+func (l *Live) Store(cfg *Config) { l.cfg.Store(cfg) }
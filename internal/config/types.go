@@ -1,15 +1,24 @@
 package config
 
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
 // Config is the top-level application configuration.
 type Config struct {
 	Version int `yaml:"version"`
 
-	Routing  RoutingConfig  `yaml:"routing"`
-	Network  NetworkConfig  `yaml:"network"`
-	DNS      DNSConfig      `yaml:"dns"`
-	DNSCrypt DNSCryptConfig `yaml:"dnscrypt"`
-	IPSet    IPSetConfig    `yaml:"ipset"`
-	Daemon   DaemonConfig   `yaml:"daemon"`
+	Routing   RoutingConfig   `yaml:"routing"`
+	Network   NetworkConfig   `yaml:"network"`
+	DNS       DNSConfig       `yaml:"dns"`
+	DNSCrypt  DNSCryptConfig  `yaml:"dnscrypt"`
+	IPSet     IPSetConfig     `yaml:"ipset"`
+	Netfilter NetfilterConfig `yaml:"netfilter"`
+	Daemon    DaemonConfig    `yaml:"daemon"`
+
+	Clients ClientsConfig `yaml:"clients,omitempty"`
 
 	ExcludedNetworks []string `yaml:"excluded_networks"`
 	IPv6             bool     `yaml:"ipv6"`
@@ -19,18 +28,362 @@ type Config struct {
 // RoutingConfig describes how matched traffic is forwarded.
 // netshunt does not manage the proxy software itself — the user sets up their own.
 type RoutingConfig struct {
+	// Mode selects the routing mechanism: "redirect" (local transparent proxy,
+	// nat REDIRECT for TCP), "tproxy" (local transparent proxy, TPROXY for TCP
+	// and UDP) or "interface" (policy routing out a router interface).
+	Mode string `yaml:"mode"`
+
 	// LocalPort is the port the transparent proxy listens on.
 	LocalPort int `yaml:"local_port"`
+
+	// Interface is the outbound interface for "interface" mode (e.g. nwg0).
+	Interface string `yaml:"interface,omitempty"`
+
+	// Inverse flips the meaning of shunts in "redirect" mode: all LAN
+	// traffic goes through the proxy except destinations of enabled shunts,
+	// which go direct.
+	Inverse bool `yaml:"inverse,omitempty"`
+
+	// Local shunts traffic originating on the router itself in "redirect"
+	// mode.
+	Local LocalTrafficConfig `yaml:"local,omitempty"`
+
+	// Failover switches traffic of LocalPort to a backup proxy when the
+	// primary stops responding ("redirect" and "tproxy" modes).
+	Failover FailoverConfig `yaml:"failover,omitempty"`
+
+	// ProxyDown decides what happens to matched traffic while the proxy (or
+	// the outbound interface) is down.
+	ProxyDown ProxyDownConfig `yaml:"proxy_down,omitempty"`
+}
+
+// ProxyDownConfig is the kill switch / fail-open policy. The daemon checks
+// the routing mode's proxy every Interval seconds; while it is down, Policy
+// "fail-closed" rejects matched traffic so connections fail fast instead of
+// hanging, and "fail-open" removes the proxy rules so matched traffic goes
+// direct. Normal rules are restored when the proxy returns. Empty keeps the
+// rules unchanged.
+type ProxyDownConfig struct {
+	Policy string `yaml:"policy,omitempty"`
+
+	// Interval is the check interval in seconds (default 5).
+	Interval int `yaml:"interval,omitempty"`
+}
+
+// CheckInterval returns the check interval with the default applied.
+func (c ProxyDownConfig) CheckInterval() time.Duration {
+	if c.Interval <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// FailoverConfig lists backup transparent proxies for routing.local_port.
+// The daemon probes every port with a TCP connect and, for ports listed in
+// ProbeProxies, a request for ProbeURL through the proxy. When the active
+// port fails, the REDIRECT/TPROXY rules are rewritten to the most preferred
+// healthy port; a more preferred port is switched back to once it has stayed
+// healthy for HoldDown seconds. Shunts with a port of their own are not
+// affected.
+type FailoverConfig struct {
+	// Ports are the backup proxy ports in order of preference. Failover is
+	// off when empty.
+	Ports []int `yaml:"ports,omitempty"`
+
+	// Interval is the probe interval in seconds (default 10).
+	Interval int `yaml:"interval,omitempty"`
+
+	// HoldDown is how long in seconds a recovered port must stay healthy
+	// before traffic switches back to it (default 60).
+	HoldDown int `yaml:"hold_down,omitempty"`
+
+	// ProbeURL is requested through the proxies in ProbeProxies, e.g.
+	// "http://cp.cloudflare.com/generate_204".
+	ProbeURL string `yaml:"probe_url,omitempty"`
+
+	// ProbeProxies maps a proxy port to a SOCKS5 or HTTP inbound of the same
+	// proxy instance, e.g. 1080: "socks5://127.0.0.1:1081", since a
+	// transparent port cannot be asked for a URL directly. Ports without an
+	// entry are only checked with a TCP connect.
+	ProbeProxies map[int]string `yaml:"probe_proxies,omitempty"`
+}
+
+// ProbeInterval returns the probe interval with the default applied.
+func (c FailoverConfig) ProbeInterval() time.Duration {
+	if c.Interval <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// HoldDownPeriod returns the hold-down period with the default applied.
+func (c FailoverConfig) HoldDownPeriod() time.Duration {
+	if c.HoldDown <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.HoldDown) * time.Second
+}
+
+// LocalTrafficConfig routes connections made by the router itself (opkg,
+// curl, geosite downloads, Entware services) to matched destinations through
+// the proxy via the nat OUTPUT chain. Only TCP is proxied. DNS queries of the
+// router are sent to the forwarder so their answers are tracked.
+//
+// The proxy's own connections must be recognizable by at least one of
+// ProxyUser, ProxyGroup or ProxyMark; they bypass the OUTPUT rules, as does
+// their DNS. Without any of them local routing stays off, since the proxy
+// would loop into itself.
+type LocalTrafficConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// ProxyUser is the user name or uid the proxy runs as.
+	ProxyUser string `yaml:"proxy_user,omitempty"`
+
+	// ProxyGroup is the group name or gid the proxy runs as.
+	ProxyGroup string `yaml:"proxy_group,omitempty"`
+
+	// ProxyMark is the fwmark the proxy sets on its outbound connections,
+	// e.g. "0xff" (xray sockopt.mark, sing-box routing_mark).
+	ProxyMark string `yaml:"proxy_mark,omitempty"`
+}
+
+// ClientsConfig selects the LAN clients whose traffic is shunted. Shunts
+// with their own client list override it.
+type ClientsConfig struct {
+	// List holds client IPs, CIDRs or MAC addresses. Empty shunts every client.
+	List []string `yaml:"list,omitempty"`
+
+	// Exclude shunts every client except those listed.
+	Exclude bool `yaml:"exclude,omitempty"`
 }
 
 // NetworkConfig holds network interface settings.
 type NetworkConfig struct {
+	// EntwareInterface is the single LAN interface of older configs: its
+	// traffic is routed and its DNS intercepted. Empty routes traffic from
+	// every interface and intercepts DNS on br0. Ignored when Interfaces is
+	// set.
 	EntwareInterface string `yaml:"entware_interface"`
+
+	// Interfaces lists the LAN interfaces (home, guest, IoT bridges, ...)
+	// with per-interface routing and DNS interception.
+	Interfaces []LANInterface `yaml:"interfaces,omitempty"`
+}
+
+// LANInterface is a LAN interface netshunt serves.
+type LANInterface struct {
+	// Name is the Linux interface name, e.g. br0.
+	Name string `yaml:"name"`
+
+	// Route applies the shunts to traffic entering on the interface.
+	Route bool `yaml:"route"`
+
+	// DNS intercepts the interface's DNS queries, so clients using other
+	// resolvers are still shunted.
+	DNS bool `yaml:"dns"`
+}
+
+// LANInterfaces returns the configured LAN interfaces, with EntwareInterface
+// standing in for Interfaces in older configs.
+func (c NetworkConfig) LANInterfaces() []LANInterface {
+	if len(c.Interfaces) > 0 {
+		return c.Interfaces
+	}
+	if c.EntwareInterface != "" {
+		return []LANInterface{{Name: c.EntwareInterface, Route: true, DNS: true}}
+	}
+	return nil
+}
+
+// RouteInterfaces returns the interfaces whose traffic is routed. Without
+// any configured interface it returns "", which stands for all interfaces.
+func (c NetworkConfig) RouteInterfaces() []string {
+	if len(c.Interfaces) == 0 {
+		return []string{c.EntwareInterface}
+	}
+	var names []string
+	for _, i := range c.Interfaces {
+		if i.Route {
+			names = append(names, i.Name)
+		}
+	}
+	return names
+}
+
+// DNSInterfaces returns the interfaces whose DNS queries are intercepted,
+// br0 without any configured interface.
+func (c NetworkConfig) DNSInterfaces() []string {
+	if len(c.Interfaces) == 0 {
+		if c.EntwareInterface != "" {
+			return []string{c.EntwareInterface}
+		}
+		return []string{"br0"}
+	}
+	var names []string
+	for _, i := range c.Interfaces {
+		if i.DNS {
+			names = append(names, i.Name)
+		}
+	}
+	return names
 }
 
 // DNSConfig holds DNS forwarder settings.
 type DNSConfig struct {
 	ListenAddr string `yaml:"listen_addr"`
+	// BlockResponse is how domains of block shunts are answered: "nxdomain"
+	// (default) or "zero" (0.0.0.0 and ::).
+	BlockResponse string `yaml:"block_response,omitempty"`
+
+	// FakeIP answers queries for proxied domains with addresses from a
+	// reserved pool instead of their real ones.
+	FakeIP FakeIPConfig `yaml:"fake_ip,omitempty"`
+
+	// Upstreams are the resolvers queries are forwarded to, healthy ones
+	// first in this order: DNS-over-HTTPS ("https://dns.google/dns-query"),
+	// DNS-over-TLS ("tls://1.1.1.1", "tls://dns.quad9.net:853") or plain
+	// DNS ("9.9.9.9", "192.168.1.1:53"). Empty forwards to dnscrypt-proxy.
+	Upstreams []string `yaml:"upstreams,omitempty"`
+
+	// Bootstrap are plain DNS servers (ip[:port]) that resolve the host
+	// names of upstreams (default 1.1.1.1 and 8.8.8.8).
+	Bootstrap []string `yaml:"bootstrap,omitempty"`
+
+	// MatchedUpstream is the resolver (any upstream form) for domains of
+	// proxied shunts without an upstream of their own, e.g. one reachable
+	// through the tunnel so CDNs answer with addresses near the proxy exit.
+	// Empty uses Upstreams like every other query. Not used in inverse mode.
+	MatchedUpstream string `yaml:"matched_upstream,omitempty"`
+
+	// Cache keeps upstream answers for their TTL.
+	Cache DNSCacheConfig `yaml:"cache,omitempty"`
+
+	// QueryLog keeps the latest client queries for the web UI.
+	QueryLog DNSQueryLogConfig `yaml:"query_log,omitempty"`
+
+	// TrackExpiry drops tracked IPs from the ipsets once their TTL has
+	// passed.
+	TrackExpiry TrackExpiryConfig `yaml:"track_expiry,omitempty"`
+}
+
+// DefaultUpstreams are suggested by the setup wizard for the built-in
+// encrypted DNS client.
+var DefaultUpstreams = []string{"https://cloudflare-dns.com/dns-query", "tls://dns.quad9.net"}
+
+// DefaultBootstrap are the bootstrap servers used when DNSConfig.Bootstrap
+// is empty.
+var DefaultBootstrap = []string{"1.1.1.1:53", "8.8.8.8:53"}
+
+// UsesDNSCrypt reports whether queries are forwarded to dnscrypt-proxy, i.e.
+// no upstreams are configured.
+func (c DNSConfig) UsesDNSCrypt() bool {
+	return len(c.Upstreams) == 0
+}
+
+// BootstrapServers returns the bootstrap servers with the default applied.
+func (c DNSConfig) BootstrapServers() []string {
+	if len(c.Bootstrap) == 0 {
+		return DefaultBootstrap
+	}
+	return c.Bootstrap
+}
+
+// DNSCacheConfig is the response cache of the DNS forwarder.
+type DNSCacheConfig struct {
+	// Size is the maximum number of cached answers (default 4096, negative
+	// disables the cache).
+	Size int `yaml:"size,omitempty"`
+
+	// ServeStale answers from expired entries, for up to a day, when the
+	// upstream fails.
+	ServeStale bool `yaml:"serve_stale,omitempty"`
+}
+
+// Entries returns the cache size with the default applied, 0 if the cache
+// is disabled.
+func (c DNSCacheConfig) Entries() int {
+	switch {
+	case c.Size < 0:
+		return 0
+	case c.Size == 0:
+		return 4096
+	}
+	return c.Size
+}
+
+// TrackExpiryConfig is the opt-in expiry of tracked IPs. Without it, the
+// IPs of a matched domain stay in the ipsets until the next full reconcile,
+// so long-lived connections keep their route; with it, a domain's IP is
+// dropped once its DNS TTL plus Grace has passed without a new answer.
+type TrackExpiryConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Grace is added to the TTL, in seconds (default 3600, negative adds
+	// none).
+	Grace int `yaml:"grace,omitempty"`
+}
+
+// GracePeriod returns the grace period with the default applied.
+func (c TrackExpiryConfig) GracePeriod() time.Duration {
+	switch {
+	case c.Grace < 0:
+		return 0
+	case c.Grace == 0:
+		return time.Hour
+	}
+	return time.Duration(c.Grace) * time.Second
+}
+
+// DNSQueryLogConfig is the in-memory query log of the DNS forwarder.
+type DNSQueryLogConfig struct {
+	// Size is the number of queries kept (default 1000, negative disables
+	// the log).
+	Size int `yaml:"size,omitempty"`
+}
+
+// Entries returns the log size with the default applied, 0 if the log is
+// disabled.
+func (c DNSQueryLogConfig) Entries() int {
+	switch {
+	case c.Size < 0:
+		return 0
+	case c.Size == 0:
+		return 1000
+	}
+	return c.Size
+}
+
+// DefaultFakeIPRange is the fake-IP pool used when FakeIPConfig.Range is
+// empty: the benchmarking range, which is never routed on the internet.
+const DefaultFakeIPRange = "198.18.0.0/15"
+
+// FakeIPConfig is the fake-IP mode of the DNS forwarder. A matched domain
+// gets a fixed address from Range, which is routed to the proxy; the proxy
+// looks the domain up by that address and connects to it by name, so shared
+// CDN addresses and rotating IPs no longer matter. The mapping survives
+// restarts.
+type FakeIPConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Range is the IPv4 pool fake addresses are taken from (default
+	// 198.18.0.0/15). Takes effect on daemon restart.
+	Range string `yaml:"range,omitempty"`
+}
+
+// Pool returns the parsed fake-IP pool with the default applied.
+func (c FakeIPConfig) Pool() (netip.Prefix, error) {
+	r := c.Range
+	if r == "" {
+		r = DefaultFakeIPRange
+	}
+	p, err := netip.ParsePrefix(r)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid fake-ip range %q: %w", r, err)
+	}
+	if !p.Addr().Is4() || p.Bits() > 30 {
+		return netip.Prefix{}, fmt.Errorf("invalid fake-ip range %q: expected an IPv4 network of at least /30", r)
+	}
+	return p.Masked(), nil
 }
 
 // DNSCryptConfig holds dnscrypt-proxy2 settings.
@@ -43,10 +396,43 @@ type IPSetConfig struct {
 	TableName string `yaml:"table_name"`
 }
 
+// Names returns the IPv4 and IPv6 ipset table names for a routing target
+// with the given name suffix (see shunt.Target.Suffix). The default target
+// has an empty suffix and uses the bare table name; other targets get the
+// suffix appended, e.g. "bypass_1081" / "bypass6_1081".
+func (c IPSetConfig) Names(suffix string) (v4, v6 string) {
+	return c.TableName + suffix, c.TableName + "6" + suffix
+}
+
+// NetfilterConfig selects the packet filtering backend.
+type NetfilterConfig struct {
+	// Backend is "iptables" (iptables/ip6tables + ipset), "nftables" (one
+	// nft table with native sets) or "auto" (iptables if installed,
+	// otherwise nftables). Takes effect on daemon restart.
+	Backend string `yaml:"backend"`
+}
+
 // DaemonConfig holds daemon/web UI settings.
 type DaemonConfig struct {
 	WebListen string `yaml:"web_listen"`
 	LogLevel  string `yaml:"log_level"`
+
+	// DriftInterval is the interval in seconds at which the daemon compares
+	// the live iptables/nftables rules, policy routing and ipsets with what
+	// it applied and repairs what drifted (default 60, -1 disables).
+	DriftInterval int `yaml:"drift_interval,omitempty"`
+}
+
+// DriftCheckInterval returns the drift check interval with the default
+// applied, 0 if the check is disabled.
+func (c DaemonConfig) DriftCheckInterval() time.Duration {
+	switch {
+	case c.DriftInterval < 0:
+		return 0
+	case c.DriftInterval == 0:
+		return time.Minute
+	}
+	return time.Duration(c.DriftInterval) * time.Second
 }
 
 // Defaults returns a Config with sensible default values.
@@ -54,6 +440,7 @@ func Defaults() Config {
 	return Config{
 		Version: 1,
 		Routing: RoutingConfig{
+			Mode:      "redirect",
 			LocalPort: 1080,
 		},
 		DNS: DNSConfig{
@@ -65,6 +452,9 @@ func Defaults() Config {
 		IPSet: IPSetConfig{
 			TableName: "bypass",
 		},
+		Netfilter: NetfilterConfig{
+			Backend: "auto",
+		},
 		Daemon: DaemonConfig{
 			WebListen: ":8765",
 			LogLevel:  "info",
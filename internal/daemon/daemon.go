@@ -14,6 +14,7 @@ import (
 	"github.com/egorlepa/netshunt/internal/dns"
 	"github.com/egorlepa/netshunt/internal/netfilter"
 	"github.com/egorlepa/netshunt/internal/platform"
+	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/shunt"
 	"github.com/egorlepa/netshunt/internal/web"
 )
@@ -21,10 +22,15 @@ import (
 // Daemon is the long-lived process that runs the DNS forwarder, reconciles
 // routing state, and serves the web UI.
 type Daemon struct {
-	Config     *config.Config
+	Config     *config.Live
 	Shunts     *shunt.Store
 	Reconciler *Reconciler
 	Forwarder  *dns.Forwarder
+	FakeIP     *dns.FakeIPPool
+	Failover   *routing.Failover
+	ProxyWatch *routing.ProxyWatch
+	DriftWatch *routing.DriftWatch
+	Scheduler  *Scheduler
 	Logger     *slog.Logger
 	LogBuf     *platform.LogBuffer
 	Version    string
@@ -32,20 +38,41 @@ type Daemon struct {
 
 // New creates a new Daemon with the DNS forwarder and reconciler wired up.
 func New(cfg *config.Config, shunts *shunt.Store, logger *slog.Logger, logBuf *platform.LogBuffer, version string) *Daemon {
-	ipset4 := netfilter.NewIPSet(cfg.IPSet.TableName)
-	var ipset6 *netfilter.IPSet
+	backend := netfilter.ResolveBackend(cfg.Netfilter.Backend)
+	ipset4 := netfilter.NewSet(backend, cfg.IPSet.TableName)
+	var ipset6 netfilter.Set
 	if cfg.IPv6 {
-		ipset6 = netfilter.NewIPSet6(cfg.IPSet.TableName + "6")
+		ipset6 = netfilter.NewSet6(backend, cfg.IPSet.TableName+"6")
 	}
 	tracker := dns.NewTracker(ipset4, ipset6, logger)
-	upstream := fmt.Sprintf("127.0.0.1:%d", cfg.DNSCrypt.Port)
-	forwarder := dns.NewForwarder(cfg.DNS.ListenAddr, upstream, cfg.IPv6, tracker, logger)
+	tracker.SetStateFile(platform.TrackerFile)
+	forwarder := dns.NewForwarder(cfg.DNS.ListenAddr, cfg.IPv6, tracker, logger)
+	if err := forwarder.SetUpstream(dnsUpstreams(cfg, logger)); err != nil {
+		logger.Error("invalid dns upstreams, using dnscrypt-proxy", "error", err)
+		forwarder.SetUpstream([]string{dnscryptAddr(cfg)}, nil)
+	}
+
+	pool, err := cfg.DNS.FakeIP.Pool()
+	if err != nil {
+		logger.Warn("using the default fake-ip range", "error", err)
+		pool, _ = config.FakeIPConfig{}.Pool()
+	}
+	fakeIP := dns.NewFakeIPPool(pool, platform.FakeIPFile, logger)
+	forwarder.SetFakeIPPool(fakeIP)
+
+	live := config.NewLive(cfg)
+	reconciler := NewReconciler(live, shunts, forwarder, logger)
 
 	return &Daemon{
-		Config:     cfg,
+		Config:     live,
 		Shunts:     shunts,
-		Reconciler: NewReconciler(cfg, shunts, forwarder, logger),
+		Reconciler: reconciler,
 		Forwarder:  forwarder,
+		FakeIP:     fakeIP,
+		Failover:   routing.NewFailover(live, reconciler.SetLocalPort, logger),
+		ProxyWatch: routing.NewProxyWatch(live, reconciler.ProxyActive, reconciler.SetProxyDown, logger),
+		DriftWatch: routing.NewDriftWatch(live, reconciler.Heal, logger),
+		Scheduler:  NewScheduler(shunts, reconciler.ApplyMutation, logger),
 		Logger:     logger,
 		LogBuf:     logBuf,
 		Version:    version,
@@ -64,25 +91,62 @@ func (d *Daemon) Run(ctx context.Context) error {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	// A pause that outlived a restart goes on; the reconcile leaves the
+	// rules down.
+	if until, ok := platform.PausedUntil(); ok {
+		if err := d.Reconciler.Pause(ctx, time.Until(until)); err != nil {
+			d.Logger.Warn("failed to restore pause", "error", err)
+		}
+	}
+
 	// 1. Initial reconcile — populates matcher + ipset before DNS starts.
+	// The IPs tracked before the restart go back into the flushed ipsets,
+	// so clients that still cache them keep their route.
 	if err := d.Reconciler.Reconcile(ctx); err != nil {
 		d.Logger.Error("initial reconcile failed", "error", err)
 	}
+	d.Forwarder.RestoreTracked(ctx)
 
 	// 2. Start DNS forwarder (now has domain list ready).
 	if err := d.Forwarder.Start(); err != nil {
 		return fmt.Errorf("start dns forwarder: %w", err)
 	}
 
+	// 3. Start probing the proxy ports for failover, watching the proxy for
+	// the proxy-down policy, checking the rules for drift, saving the
+	// fake-IP table, applying shunt schedules, and expiring and saving
+	// tracked IPs.
+	go d.Failover.Run(ctx)
+	go d.ProxyWatch.Run(ctx)
+	go d.DriftWatch.Run(ctx)
+	go d.FakeIP.Run(ctx)
+	go d.Scheduler.Run(ctx)
+	go d.Forwarder.TrackerRef().Run(ctx)
+
 	// 4. Start web server.
-	webServer := web.NewServer(d.Config, d.Shunts, d.Reconciler, d.Forwarder.TrackerRef(), d.LogBuf, d.Logger, d.Version)
+	webServer := web.NewServer(web.Deps{
+		Config:     d.Config,
+		Shunts:     d.Shunts,
+		Reconciler: d.Reconciler,
+		Tracker:    d.Forwarder.TrackerRef(),
+		Failover:   d.Failover,
+		Proxy:      d.ProxyWatch,
+		Drift:      d.DriftWatch,
+		FakeIP:     d.FakeIP,
+		DNS:        d.Forwarder,
+		Queries:    d.Forwarder.QueryLog(),
+		Logs:       d.LogBuf,
+		Logger:     d.Logger,
+		Version:    d.Version,
+	})
+	listen := d.Config.Load().Daemon.WebListen
 	httpServer := &http.Server{
-		Addr:    d.Config.Daemon.WebListen,
+		Addr:    listen,
 		Handler: webServer,
 	}
 
 	go func() {
-		d.Logger.Info("web UI started", "listen", d.Config.Daemon.WebListen)
+		d.Logger.Info("web UI started", "listen", listen)
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			d.Logger.Error("web server error", "error", err)
 		}
@@ -95,6 +159,8 @@ func (d *Daemon) Run(ctx context.Context) error {
 	d.Logger.Info("shutting down")
 
 	d.Forwarder.Stop()
+	d.FakeIP.Save()
+	d.Forwarder.TrackerRef().Save()
 
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
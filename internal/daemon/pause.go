@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/egorlepa/netshunt/internal/platform"
+)
+
+// Pause stops routing for d: the rules are torn down and the forwarder
+// passes DNS through without matching, until Resume or the automatic resume
+// after d. The pause is recorded in platform.PauseFile, so NDM hooks leave
+// the rules down and a restarted daemon keeps pausing.
+func (r *Reconciler) Pause(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("invalid pause duration %s", d)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	until := time.Now().Add(d).Truncate(time.Second)
+	r.pausedUntil = until
+	r.Forwarder.SetPaused(true)
+	if r.resumeTimer != nil {
+		r.resumeTimer.Stop()
+	}
+	r.resumeTimer = time.AfterFunc(time.Until(until), r.resumeIfDue)
+	if err := os.WriteFile(platform.PauseFile, []byte(until.Format(time.RFC3339)), 0644); err != nil {
+		r.Logger.Warn("failed to write pause file", "error", err)
+	}
+
+	r.Logger.Info("routing paused", "until", until.Format(time.TimeOnly))
+	if err := r.Mode.TeardownRules(ctx); err != nil {
+		return fmt.Errorf("teardown rules: %w", err)
+	}
+	return nil
+}
+
+// Resume ends a pause and sets the rules up again. It does nothing if
+// routing is not paused.
+func (r *Reconciler) Resume(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resume(ctx)
+}
+
+// PausedUntil returns the end of the current pause, zero if routing is not
+// paused.
+func (r *Reconciler) PausedUntil() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pausedUntil
+}
+
+// resumeIfDue is the automatic resume. A pause extended in the meantime is
+// left alone.
+func (r *Reconciler) resumeIfDue() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pausedUntil.IsZero() || time.Now().Before(r.pausedUntil) {
+		return
+	}
+	if err := r.resume(context.Background()); err != nil {
+		r.Logger.Error("automatic resume failed", "error", err)
+	}
+}
+
+// resume ends a pause. Caller must hold r.mu.
+func (r *Reconciler) resume(ctx context.Context) error {
+	if r.pausedUntil.IsZero() {
+		return nil
+	}
+	r.pausedUntil = time.Time{}
+	if r.resumeTimer != nil {
+		r.resumeTimer.Stop()
+		r.resumeTimer = nil
+	}
+	if err := os.Remove(platform.PauseFile); err != nil && !os.IsNotExist(err) {
+		r.Logger.Warn("failed to remove pause file", "error", err)
+	}
+	r.Forwarder.SetPaused(false)
+
+	r.Logger.Info("routing resumed")
+	if r.lanDown {
+		return nil // set up again by SetupRules
+	}
+	if err := r.Mode.SetupRules(ctx); err != nil {
+		return fmt.Errorf("setup rules: %w", err)
+	}
+	return nil
+}
+
+// paused reports whether routing is paused. Caller must hold r.mu.
+func (r *Reconciler) paused() bool {
+	return !r.pausedUntil.IsZero()
+}
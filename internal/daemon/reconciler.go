@@ -4,8 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/egorlepa/netshunt/internal/config"
 	"github.com/egorlepa/netshunt/internal/dns"
@@ -17,41 +21,91 @@ import (
 // Reconciler performs state reconciliation between shunt entries, the DNS
 // forwarder matcher, the kernel ipsets (v4 + v6), and iptables/ip6tables rules.
 //
-// Full reconcile: flush ipsets, reload matcher, repopulate IP/CIDR entries,
-// setup iptables. DNS-resolved IPs repopulate naturally as queries flow in.
+// Full reconcile: reload matcher, track the IPs of still matched domains
+// again, repopulate IP/CIDR entries, delete the ipset entries nothing needs
+// anymore, apply iptables rules (an atomic replacement of the previous ones).
+// Only the first full reconcile flushes the ipsets.
 //
 // Mutation reconcile: update matcher (diff removed domains via tracker),
-// ensure ipset tables, populate IP/CIDRs.
+// ensure ipset tables, populate IP/CIDRs. iptables is only touched when the
+// set of routing targets changes.
+//
+// Every routing target (a distinct shunt action, port, client selection and
+// entry port qualifier; the zero Target is the default) has its own pair of
+// ipsets named by config.IPSetConfig.Names.
 type Reconciler struct {
-	mu        sync.Mutex
+	mu sync.Mutex
+	// Config is the config of the last full reconcile, taken from live.
 	Config    *config.Config
 	Shunts    *shunt.Store
-	IPSet     *netfilter.IPSet
-	IPSet6    *netfilter.IPSet
+	IPSet     netfilter.Set
+	IPSet6    netfilter.Set
 	Forwarder *dns.Forwarder
 	Mode      routing.Mode
 	Logger    *slog.Logger
 
-	// lastDomains tracks the domain entries from the previous mutation
-	// reconcile so we can detect removals.
-	lastDomains map[string]struct{}
+	// live is the daemon's current config.
+	live *config.Live
+
+	// backend is the resolved netfilter backend the sets are created on.
+	backend netfilter.Backend
+
+	// targets holds the ipsets of non-default routing targets.
+	targets map[shunt.Target]targetSets
+
+	// localPort is the failover override of routing.local_port, 0 if none.
+	localPort int
+
+	// proxyDown records the proxy state reported by the proxy watch.
+	proxyDown bool
+
+	// lanDown is set while every LAN interface is down: the rules stay torn
+	// down (see TeardownRules) until SetupRules.
+	lanDown bool
+
+	// pausedUntil is the end of a pause (see Pause), zero while routing is
+	// active; resumeTimer resumes routing when it is reached.
+	pausedUntil time.Time
+	resumeTimer *time.Timer
+
+	// lastDomains tracks the domain entries (and their target) from the
+	// previous mutation reconcile so we can detect removals and re-targets.
+	lastDomains map[string]shunt.Target
+
+	// static holds the IP/CIDR entries added to each ipset since the last
+	// full reconcile, which deletes those no shunt has anymore. reconciled
+	// is set once the first full reconcile flushed the ipsets.
+	static     map[netfilter.Set]map[string]bool
+	reconciled bool
+}
+
+// targetSets holds the v4/v6 ipsets of a routing target. ipset6 is nil when
+// IPv6 is disabled.
+type targetSets struct {
+	ipset4 netfilter.Set
+	ipset6 netfilter.Set
 }
 
 // NewReconciler creates a Reconciler from the given configuration.
-func NewReconciler(cfg *config.Config, shunts *shunt.Store, forwarder *dns.Forwarder, logger *slog.Logger) *Reconciler {
-	var ipset6 *netfilter.IPSet
+func NewReconciler(live *config.Live, shunts *shunt.Store, forwarder *dns.Forwarder, logger *slog.Logger) *Reconciler {
+	cfg := live.Load()
+	backend := netfilter.ResolveBackend(cfg.Netfilter.Backend)
+	var ipset6 netfilter.Set
 	if cfg.IPv6 {
-		ipset6 = netfilter.NewIPSet6(cfg.IPSet.TableName + "6")
+		ipset6 = netfilter.NewSet6(backend, cfg.IPSet.TableName+"6")
 	}
 	return &Reconciler{
 		Config:      cfg,
 		Shunts:      shunts,
-		IPSet:       netfilter.NewIPSet(cfg.IPSet.TableName),
+		IPSet:       netfilter.NewSet(backend, cfg.IPSet.TableName),
 		IPSet6:      ipset6,
 		Forwarder:   forwarder,
 		Mode:        routing.New(cfg, logger),
 		Logger:      logger,
-		lastDomains: make(map[string]struct{}),
+		live:        live,
+		backend:     backend,
+		targets:     make(map[shunt.Target]targetSets),
+		lastDomains: make(map[string]shunt.Target),
 	}
 }
 
@@ -62,68 +116,350 @@ func (r *Reconciler) Reconcile(ctx context.Context) error {
 
 	r.Logger.Info("starting full reconcile")
 
-	// 1. Load all enabled entries.
-	entries, err := r.Shunts.EnabledEntries()
+	// Pick up a config saved since the last reconcile.
+	cfg := r.live.Load()
+	cfgChanged := cfg != r.Config
+	r.Config = cfg
+
+	// 1. Load all enabled entries, grouped by routing target.
+	byTarget, err := r.Shunts.EnabledEntriesByTarget()
 	if err != nil {
 		return fmt.Errorf("load enabled entries: %w", err)
 	}
-	r.Logger.Info("loaded entries", "count", len(entries))
+	r.Logger.Info("loaded entries", "count", entryCount(byTarget), "targets", len(byTarget))
 
 	// 2. Update forwarder matcher with domain entries.
-	r.Forwarder.UpdateMatcher(entries)
-	r.lastDomains = domainSet(entries)
-
-	// 3. Ensure ipset tables exist.
-	if err := r.IPSet.EnsureTable(ctx); err != nil {
-		return fmt.Errorf("ensure ipset table: %w", err)
+	r.Forwarder.UpdateMatcher(byTarget)
+	if err := r.updateUpstreams(); err != nil {
+		return err
 	}
-	if r.IPSet6 != nil {
-		if err := r.IPSet6.EnsureTable(ctx); err != nil {
-			return fmt.Errorf("ensure ipset6 table: %w", err)
-		}
+	if err := r.updateQueryLog(); err != nil {
+		return err
+	}
+	r.Forwarder.SetBlockResponse(r.Config.DNS.BlockResponse)
+	r.Forwarder.SetFakeIP(routing.FakeIP(r.Config))
+	r.Forwarder.SetCache(r.Config.DNS.Cache.Entries(), r.Config.DNS.Cache.ServeStale)
+	r.Forwarder.TrackerRef().SetExpiry(r.Config.DNS.TrackExpiry.Enabled, r.Config.DNS.TrackExpiry.GracePeriod())
+	r.lastDomains = domainTargets(byTarget)
+
+	// 3. Ensure ipset tables exist for every target.
+	if err := r.ensureTables(ctx, byTarget); err != nil {
+		return err
 	}
 
-	// 4. Flush ipsets — full reconcile clears stale state.
-	// DNS-resolved IPs will repopulate as queries flow through the forwarder.
-	r.Forwarder.TrackerRef().Flush(ctx)
+	// 4. Track the IPs of the domains that are still matched again and
+	// delete the others from the ipsets, which are never empty meanwhile.
+	// The first reconcile flushes them instead, dropping what the previous
+	// run left behind.
+	if r.reconciled {
+		r.Forwarder.RefreshTracked(ctx)
+	} else {
+		r.Forwarder.TrackerRef().Flush(ctx)
+		r.reconciled = true
+	}
 
-	// 5. Populate ipsets with direct IP/CIDR entries.
-	r.populateIPSet(ctx, entries)
+	// 5. Populate ipsets with direct IP/CIDR entries, and with the fake IPs
+	// clients may still hold, then delete the entries of removed ones.
+	stale := r.static
+	r.static = nil
+	r.populateIPSet(ctx, byTarget)
+	r.Forwarder.RetrackFakeIPs(ctx)
+	r.deleteStatic(ctx, stale)
 
-	// 6. Teardown then re-setup iptables/ip6tables rules.
-	_ = r.Mode.TeardownRules(ctx)
-	if err := r.Mode.SetupRules(ctx); err != nil {
+	// 6. Apply iptables/ip6tables rules, which atomically replace the
+	// previous ones. A new config gets a new mode; a different routing mode
+	// is torn down first.
+	if cfgChanged {
+		mode := routing.New(r.Config, r.Logger)
+		if mode.Name() != r.Mode.Name() {
+			r.Logger.Info("routing mode changed", "from", r.Mode.Name(), "to", mode.Name())
+			_ = r.Mode.TeardownRules(ctx)
+		}
+		r.Mode = mode
+	}
+	r.Mode.SetLocalPort(r.localPort)
+	r.Mode.SetProxyDown(r.proxyDown)
+	r.Mode.SetTargets(targetList(byTarget))
+	if r.paused() {
+		r.Logger.Info("routing paused, rules stay down", "until", r.pausedUntil.Format(time.TimeOnly))
+	} else if r.lanDown {
+		r.Logger.Info("LAN interfaces down, rules stay down")
+	} else if err := r.Mode.SetupRules(ctx); err != nil {
 		return fmt.Errorf("setup rules: %w", err)
 	}
 
-	r.Logger.Info("reconcile complete")
+	// 7. Drop ipsets of targets no longer referenced by any rule.
+	r.dropStaleTargets(ctx, byTarget)
+
+	r.Logger.Info("reconcile complete", "mode", routing.Label(r.Config))
 	return nil
 }
 
 // ApplyMutation updates the matcher and ipsets after a shunt change.
 // It diffs the domain list against the previous snapshot and removes
-// stale domains from the tracker. Never flushes ipsets or touches iptables.
+// stale or re-targeted domains from the tracker. Never flushes ipsets;
+// iptables rules are rebuilt only when the set of targets changed.
 func (r *Reconciler) ApplyMutation(ctx context.Context) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	entries, err := r.Shunts.EnabledEntries()
+	byTarget, err := r.Shunts.EnabledEntriesByTarget()
 	if err != nil {
 		return fmt.Errorf("load entries: %w", err)
 	}
 
-	// Build new domain set and detect removals.
-	newDomains := domainSet(entries)
-	for domain := range r.lastDomains {
-		if _, ok := newDomains[domain]; !ok {
+	// Build new domain set and detect removals and target changes.
+	newDomains := domainTargets(byTarget)
+	for domain, oldTarget := range r.lastDomains {
+		if newTarget, ok := newDomains[domain]; !ok || newTarget != oldTarget {
 			r.Forwarder.TrackerRef().RemoveDomain(ctx, domain)
 		}
 	}
 
 	// Update matcher and snapshot.
-	r.Forwarder.UpdateMatcher(entries)
+	r.Forwarder.UpdateMatcher(byTarget)
+	if err := r.updateUpstreams(); err != nil {
+		return err
+	}
+	if err := r.updateQueryLog(); err != nil {
+		return err
+	}
 	r.lastDomains = newDomains
 
+	targetsChanged := !slices.Equal(targetList(byTarget), slices.SortedFunc(maps.Keys(r.targets), shunt.CompareTargets))
+	if err := r.ensureTables(ctx, byTarget); err != nil {
+		return err
+	}
+	r.populateIPSet(ctx, byTarget)
+
+	if targetsChanged {
+		r.Logger.Info("routing targets changed, rebuilding rules", "targets", targetList(byTarget))
+		r.Mode.SetTargets(targetList(byTarget))
+		// While the rules are down, they are set up with the new targets
+		// when they come back.
+		if !r.rulesDown() {
+			if err := r.Mode.SetupRules(ctx); err != nil {
+				return fmt.Errorf("setup rules: %w", err)
+			}
+		}
+		r.dropStaleTargets(ctx, byTarget)
+	}
+	return nil
+}
+
+// updateQueryLog sizes the forwarder's query log and gives it the shunts
+// to name matched queries after.
+func (r *Reconciler) updateQueryLog() error {
+	log := r.Forwarder.QueryLog()
+	log.Configure(r.Config.DNS.QueryLog.Entries())
+	shunts, err := r.Shunts.List()
+	if err != nil {
+		return fmt.Errorf("load shunts: %w", err)
+	}
+	log.SetShunts(shunts)
+	return nil
+}
+
+// updateUpstreams points the forwarder at dns.upstreams (or dnscrypt-proxy)
+// and its queries for proxied domains at their shunt's upstream or
+// dns.matched_upstream. In inverse mode matched domains go direct, so they
+// keep the default upstream.
+func (r *Reconciler) updateUpstreams() error {
+	if err := r.Forwarder.SetUpstream(dnsUpstreams(r.Config, r.Logger)); err != nil {
+		return fmt.Errorf("set dns upstreams: %w", err)
+	}
+	if r.Config.Routing.Inverse {
+		return r.Forwarder.SetMatchedUpstreams("", nil)
+	}
+	byUpstream, err := r.Shunts.EnabledUpstreams()
+	if err != nil {
+		return fmt.Errorf("load shunt upstreams: %w", err)
+	}
+	matched, err := shunt.NormalizeUpstream(r.Config.DNS.MatchedUpstream)
+	if err != nil {
+		r.Logger.Warn("ignoring dns.matched_upstream", "error", err)
+	}
+	if err := r.Forwarder.SetMatchedUpstreams(matched, byUpstream); err != nil {
+		return fmt.Errorf("set shunt upstreams: %w", err)
+	}
+	return nil
+}
+
+// dnsUpstreams returns the upstreams and bootstrap servers of the
+// forwarder: dns.upstreams, or dnscrypt-proxy if none are set. Invalid
+// entries are logged and skipped.
+func dnsUpstreams(cfg *config.Config, logger *slog.Logger) (upstreams, bootstrap []string) {
+	normalize := func(what string, addrs []string) []string {
+		var out []string
+		for _, addr := range addrs {
+			n, err := shunt.NormalizeUpstream(addr)
+			if err == nil && what == "bootstrap server" && strings.Contains(n, "://") {
+				err = fmt.Errorf("bootstrap servers are plain DNS")
+			}
+			if err != nil || n == "" {
+				logger.Warn("ignoring invalid dns "+what, "address", addr, "error", err)
+				continue
+			}
+			out = append(out, n)
+		}
+		return out
+	}
+	upstreams = normalize("upstream", cfg.DNS.Upstreams)
+	if len(upstreams) == 0 {
+		upstreams = []string{dnscryptAddr(cfg)}
+	}
+	return upstreams, normalize("bootstrap server", cfg.DNS.BootstrapServers())
+}
+
+// dnscryptAddr returns the address of dnscrypt-proxy.
+func dnscryptAddr(cfg *config.Config) string {
+	return fmt.Sprintf("127.0.0.1:%d", cfg.DNSCrypt.Port)
+}
+
+// SetLocalPort sends traffic of routing.local_port to port instead (0
+// restores it) and reapplies the rules. Called by the proxy failover.
+func (r *Reconciler) SetLocalPort(ctx context.Context, port int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.localPort = port
+	r.Mode.SetLocalPort(port)
+	if r.rulesDown() {
+		return nil
+	}
+	if err := r.Mode.SetupRules(ctx); err != nil {
+		return fmt.Errorf("setup rules: %w", err)
+	}
+	return nil
+}
+
+// SetProxyDown records whether the proxy is down and, if a proxy-down policy
+// is configured, reapplies the rules to enforce or lift it. Called by the
+// proxy watch.
+func (r *Reconciler) SetProxyDown(ctx context.Context, down bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.proxyDown = down
+	r.Mode.SetProxyDown(down)
+	if !routing.HasPolicy(r.Config) || r.rulesDown() {
+		return nil
+	}
+	if err := r.Mode.SetupRules(ctx); err != nil {
+		return fmt.Errorf("setup rules: %w", err)
+	}
+	return nil
+}
+
+// ApplyRules sets the routing rules up again with the live state: the
+// failover port, the proxy state and the targets of the last reconcile. It
+// does nothing while the rules are down on purpose. Called for NDM
+// netfilter events, after which the rules may be gone.
+func (r *Reconciler) ApplyRules(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rulesDown() {
+		return nil
+	}
+	if err := r.Mode.SetupRules(ctx); err != nil {
+		return fmt.Errorf("setup rules: %w", err)
+	}
+	return nil
+}
+
+// SetupRules ends a TeardownRules and sets the rules up again like
+// ApplyRules. Called when a LAN interface comes up.
+func (r *Reconciler) SetupRules(ctx context.Context) error {
+	r.mu.Lock()
+	r.lanDown = false
+	r.mu.Unlock()
+	return r.ApplyRules(ctx)
+}
+
+// TeardownRules tears the routing rules down because every LAN interface
+// is down. They stay down, also for reconciles and the drift watch, until
+// SetupRules. Called when the last LAN interface goes down.
+func (r *Reconciler) TeardownRules(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	down := r.rulesDown()
+	r.lanDown = true
+	if down {
+		return nil // already down
+	}
+	if err := r.Mode.TeardownRules(ctx); err != nil {
+		return fmt.Errorf("teardown rules: %w", err)
+	}
+	return nil
+}
+
+// rulesDown reports whether the rules are down on purpose: routing is
+// paused or the LAN interfaces are down. Caller must hold r.mu.
+func (r *Reconciler) rulesDown() bool {
+	return r.paused() || r.lanDown
+}
+
+// ProxyActive reports whether the proxy of the current routing mode is
+// available, see routing.Mode.IsActive.
+func (r *Reconciler) ProxyActive(ctx context.Context) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Mode.IsActive(ctx)
+}
+
+// Heal compares the ipsets and the routing rules with what the last reconcile
+// applied and repairs only what drifted. A missing ipset is recreated with
+// the IP/CIDR entries of its target; domain IPs return as the domains are
+// resolved again, fake IPs right away. Called by the drift watch.
+func (r *Reconciler) Heal(ctx context.Context) ([]routing.Drift, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rulesDown() {
+		return nil, nil // the rules are down on purpose
+	}
+	byTarget, err := r.Shunts.EnabledEntriesByTarget()
+	if err != nil {
+		return nil, fmt.Errorf("load entries: %w", err)
+	}
+
+	// Sets first: the rules reference them.
+	var drifts []routing.Drift
+	missing := make(map[shunt.Target][]shunt.Entry)
+	check := func(t shunt.Target, set netfilter.Set) {
+		if set == nil {
+			return
+		}
+		if _, err := set.Count(ctx); err != nil {
+			drifts = append(drifts, routing.Drift{Part: "ipset " + set.Name(), Detail: "set missing"})
+			missing[t] = byTarget[t]
+		}
+	}
+	check(shunt.Target{}, r.IPSet)
+	check(shunt.Target{}, r.IPSet6)
+	for _, t := range slices.SortedFunc(maps.Keys(r.targets), shunt.CompareTargets) {
+		check(t, r.targets[t].ipset4)
+		check(t, r.targets[t].ipset6)
+	}
+	if len(missing) > 0 {
+		if err := r.ensureTables(ctx, missing); err != nil {
+			for i := range drifts {
+				drifts[i].Error = err.Error()
+			}
+		} else {
+			r.populateIPSet(ctx, missing)
+			r.Forwarder.RetrackFakeIPs(ctx)
+		}
+	}
+
+	return append(drifts, r.Mode.RepairRules(ctx)...), nil
+}
+
+// ensureTables creates the default ipsets and those of every target in
+// byTarget, registering new targets with the tracker.
+func (r *Reconciler) ensureTables(ctx context.Context, byTarget map[shunt.Target][]shunt.Entry) error {
 	if err := r.IPSet.EnsureTable(ctx); err != nil {
 		return fmt.Errorf("ensure ipset table: %w", err)
 	}
@@ -132,33 +468,113 @@ func (r *Reconciler) ApplyMutation(ctx context.Context) error {
 			return fmt.Errorf("ensure ipset6 table: %w", err)
 		}
 	}
-	r.populateIPSet(ctx, entries)
+
+	for _, t := range targetList(byTarget) {
+		sets, ok := r.targets[t]
+		if !ok {
+			name4, name6 := r.Config.IPSet.Names(t.Suffix())
+			sets.ipset4 = netfilter.NewSet(r.backend, name4)
+			if r.IPSet6 != nil {
+				sets.ipset6 = netfilter.NewSet6(r.backend, name6)
+			}
+		}
+		if err := sets.ipset4.EnsureTable(ctx); err != nil {
+			return fmt.Errorf("ensure ipset table %s: %w", sets.ipset4.Name(), err)
+		}
+		if sets.ipset6 != nil {
+			if err := sets.ipset6.EnsureTable(ctx); err != nil {
+				return fmt.Errorf("ensure ipset6 table %s: %w", sets.ipset6.Name(), err)
+			}
+		}
+		if !ok {
+			r.targets[t] = sets
+			r.Forwarder.TrackerRef().SetTarget(t, sets.ipset4, sets.ipset6)
+		}
+	}
 	return nil
 }
 
-// populateIPSet adds direct IP/CIDR entries to the appropriate ipset (v4 or v6).
-// Domain entries are handled by the DNS forwarder at query time.
-func (r *Reconciler) populateIPSet(ctx context.Context, entries []shunt.Entry) {
-	for _, e := range entries {
-		switch e.Type() {
-		case shunt.EntryIP, shunt.EntryCIDR:
-			if r.IPSet6 == nil && isIPv6Entry(e.Value) {
-				continue // skip IPv6 entries when IPv6 is disabled
+// dropStaleTargets destroys the ipsets of targets that are no longer used by
+// any enabled shunt. Must run after the rules referencing them are removed.
+func (r *Reconciler) dropStaleTargets(ctx context.Context, byTarget map[shunt.Target][]shunt.Entry) {
+	for t, sets := range r.targets {
+		if _, ok := byTarget[t]; ok {
+			continue
+		}
+		r.Forwarder.TrackerRef().RemoveTarget(t)
+		delete(r.targets, t)
+		if err := sets.ipset4.Destroy(ctx); err != nil {
+			r.Logger.Warn("failed to destroy ipset", "ipset", sets.ipset4.Name(), "error", err)
+		}
+		if sets.ipset6 != nil {
+			if err := sets.ipset6.Destroy(ctx); err != nil {
+				r.Logger.Warn("failed to destroy ipset", "ipset", sets.ipset6.Name(), "error", err)
 			}
-			ipset := r.ipsetFor(e.Value)
-			if err := ipset.Add(ctx, e.Value); err != nil {
-				r.Logger.Warn("failed to add to ipset", "entry", e.Value, "error", err)
+		}
+	}
+}
+
+// populateIPSet adds direct IP/CIDR entries to the ipset (v4 or v6) of their
+// target. Domain entries are handled by the DNS forwarder at query time.
+// Each ipset is filled in one transaction.
+func (r *Reconciler) populateIPSet(ctx context.Context, byTarget map[shunt.Target][]shunt.Entry) {
+	hosts := make(map[netfilter.Set][]string)
+	for t, entries := range byTarget {
+		for _, e := range entries {
+			switch e.Type() {
+			case shunt.EntryIP, shunt.EntryCIDR:
+				host := e.Host()
+				if r.IPSet6 == nil && isIPv6Entry(host) {
+					continue // skip IPv6 entries when IPv6 is disabled
+				}
+				ipset := r.ipsetFor(t, host)
+				hosts[ipset] = append(hosts[ipset], host)
 			}
 		}
 	}
+	if r.static == nil {
+		r.static = make(map[netfilter.Set]map[string]bool)
+	}
+	for ipset, entries := range hosts {
+		if r.static[ipset] == nil {
+			r.static[ipset] = make(map[string]bool)
+		}
+		for _, e := range entries {
+			r.static[ipset][e] = true
+		}
+		for entry, err := range ipset.AddAll(ctx, entries) {
+			r.Logger.Warn("failed to add to ipset", "entry", entry, "error", err)
+		}
+	}
 }
 
-// ipsetFor returns the appropriate ipset for the given IP or CIDR string.
-func (r *Reconciler) ipsetFor(entry string) *netfilter.IPSet {
-	if isIPv6Entry(entry) && r.IPSet6 != nil {
-		return r.IPSet6
+// deleteStatic deletes the IP/CIDR entries of stale from their ipsets, except
+// those still added by a shunt or tracked for a domain.
+func (r *Reconciler) deleteStatic(ctx context.Context, stale map[netfilter.Set]map[string]bool) {
+	tracker := r.Forwarder.TrackerRef()
+	for ipset, entries := range stale {
+		var dels []string
+		for e := range entries {
+			if !r.static[ipset][e] && !tracker.Tracks(ipset, e) {
+				dels = append(dels, e)
+			}
+		}
+		for entry, err := range ipset.DelAll(ctx, dels) {
+			r.Logger.Warn("failed to delete from ipset", "entry", entry, "error", err)
+		}
 	}
-	return r.IPSet
+}
+
+// ipsetFor returns the appropriate ipset of a target for the given IP or CIDR string.
+func (r *Reconciler) ipsetFor(t shunt.Target, entry string) netfilter.Set {
+	ipset4, ipset6 := r.IPSet, r.IPSet6
+	if sets, ok := r.targets[t]; ok {
+		ipset4, ipset6 = sets.ipset4, sets.ipset6
+	}
+	if isIPv6Entry(entry) && ipset6 != nil {
+		return ipset6
+	}
+	return ipset4
 }
 
 // isIPv6Entry reports whether the given IP or CIDR string is IPv6.
@@ -172,12 +588,35 @@ func isIPv6Entry(entry string) bool {
 	return false
 }
 
-func domainSet(entries []shunt.Entry) map[string]struct{} {
-	set := make(map[string]struct{})
-	for _, e := range entries {
-		if e.IsDomain() {
-			set[e.DomainValue()] = struct{}{}
+// domainTargets maps every domain entry to its target.
+func domainTargets(byTarget map[shunt.Target][]shunt.Entry) map[string]shunt.Target {
+	set := make(map[string]shunt.Target)
+	for t, entries := range byTarget {
+		for _, e := range entries {
+			if e.IsDomain() {
+				set[e.DomainValue()] = t
+			}
 		}
 	}
 	return set
 }
+
+// targetList returns the sorted non-default targets present in byTarget.
+func targetList(byTarget map[shunt.Target][]shunt.Entry) []shunt.Target {
+	var targets []shunt.Target
+	for t := range byTarget {
+		if !t.IsDefault() {
+			targets = append(targets, t)
+		}
+	}
+	slices.SortFunc(targets, shunt.CompareTargets)
+	return targets
+}
+
+func entryCount(byTarget map[shunt.Target][]shunt.Entry) int {
+	n := 0
+	for _, entries := range byTarget {
+		n += len(entries)
+	}
+	return n
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// scheduleCheckInterval bounds the wait between schedule checks, so edited
+// schedules are picked up without a restart.
+const scheduleCheckInterval = 30 * time.Second
+
+// Scheduler applies shunt schedules: at each boundary of a shunt's schedule
+// it enables or disables the shunt and applies the change through apply.
+type Scheduler struct {
+	shunts *shunt.Store
+	apply  func(ctx context.Context) error
+	logger *slog.Logger
+
+	// checked is the time of the previous check; transitions up to it have
+	// been applied.
+	checked time.Time
+}
+
+// NewScheduler creates a Scheduler that applies shunt changes with apply.
+func NewScheduler(shunts *shunt.Store, apply func(ctx context.Context) error, logger *slog.Logger) *Scheduler {
+	return &Scheduler{shunts: shunts, apply: apply, logger: logger}
+}
+
+// Run applies schedules until ctx is done. The first check puts every
+// scheduled shunt in the state of its last transition, which may have
+// passed while the daemon was not running.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		wait := scheduleCheckInterval
+		if next, ok := s.check(ctx, time.Now()); ok {
+			wait = min(wait, time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// check applies the transitions since the previous check and returns the
+// next transition of any schedule.
+func (s *Scheduler) check(ctx context.Context, now time.Time) (next time.Time, ok bool) {
+	shunts, err := s.shunts.List()
+	if err != nil {
+		s.logger.Warn("schedule check failed", "error", err)
+		return time.Time{}, false
+	}
+
+	changed := false
+	for _, sh := range shunts {
+		if sh.Schedule == "" {
+			continue
+		}
+		sched, err := shunt.ParseSchedule(sh.Schedule)
+		if err != nil {
+			if s.checked.IsZero() {
+				s.logger.Warn("invalid shunt schedule", "shunt", sh.Name, "error", err)
+			}
+			continue
+		}
+		if tr, found := sched.Next(now); found && (!ok || tr.At.Before(next)) {
+			next, ok = tr.At, true
+		}
+
+		last, found := sched.Last(now)
+		if !found || (!s.checked.IsZero() && !last.At.After(s.checked)) || last.Enabled == sh.Enabled {
+			continue
+		}
+		if err := s.shunts.SetEnabled(sh.Name, last.Enabled); err != nil {
+			s.logger.Error("scheduled shunt change failed", "shunt", sh.Name, "enabled", last.Enabled, "error", err)
+			continue
+		}
+		s.logger.Info("shunt switched by schedule", "shunt", sh.Name, "enabled", last.Enabled, "schedule", sh.Schedule)
+		changed = true
+	}
+	s.checked = now
+
+	if changed {
+		if err := s.apply(ctx); err != nil {
+			s.logger.Error("apply scheduled shunt changes failed", "error", err)
+		}
+	}
+	return next, ok
+}
@@ -22,9 +22,12 @@ var requiredDeps = []Dependency{
 	{Name: "ipset", Binary: "ipset", Package: "ipset"},
 	{Name: "iptables", Binary: "iptables", Package: "iptables"},
 	{Name: "ip", Binary: "ip", Package: "ip-full"},
-	{Name: "dnscrypt-proxy", Binary: "dnscrypt-proxy", Package: "dnscrypt-proxy2"},
 }
 
+// DNSCryptDep is dnscrypt-proxy, needed only when no dns.upstreams are
+// configured.
+var DNSCryptDep = Dependency{Name: "dnscrypt-proxy", Binary: "dnscrypt-proxy", Package: "dnscrypt-proxy2"}
+
 // CheckResult holds the result of a dependency check.
 type CheckResult struct {
 	Dep       Dependency
@@ -42,6 +45,11 @@ func CheckDependencies() []CheckResult {
 	return missing
 }
 
+// IsInstalled reports whether the dependency's binary is available.
+func (d Dependency) IsInstalled() bool {
+	return binaryExists(d.Binary)
+}
+
 func binaryExists(name string) bool {
 	_, err := lookPath(name)
 	return err == nil
@@ -0,0 +1,253 @@
+package dns
+
+import (
+	"container/list"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+const (
+	// maxNegativeTTL caps how long NXDOMAIN and empty answers are cached.
+	maxNegativeTTL = time.Hour
+	// staleWindow is how long after expiry an answer may still be served
+	// stale when the upstream fails.
+	staleWindow = 24 * time.Hour
+	// staleTTL is the TTL of stale answers (RFC 8767 recommends 30s).
+	staleTTL = 30
+)
+
+// CacheStats are the counters of the response cache.
+type CacheStats struct {
+	Enabled bool
+	Entries int
+	Hits    uint64
+	Misses  uint64
+	// Stale counts expired answers served because the upstream failed.
+	Stale uint64
+}
+
+// HitRate returns the share of cache lookups answered from the cache, in
+// percent.
+func (s CacheStats) HitRate() int {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return int(s.Hits * 100 / (s.Hits + s.Misses))
+}
+
+// Cache is the forwarder's response cache. It keeps the upstream answers as
+// received, for their TTL (negative answers for the SOA minimum), and drops
+// the least recently used ones beyond its size. Matching and tracking run on
+// every answer, cached or not.
+type Cache struct {
+	mu         sync.Mutex
+	size       int // maximum entries, 0 disables the cache
+	serveStale bool
+	entries    map[cacheKey]*list.Element
+	lru        *list.List // of *cacheEntry, most recently used first
+	stats      CacheStats
+	now        func() time.Time
+}
+
+// cacheKey identifies a question to an upstream. DNSSEC-aware clients get
+// answers of their own.
+type cacheKey struct {
+	upstream string
+	name     string
+	qtype    uint16
+	class    uint16
+	do       bool
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	data    []byte // packed upstream response
+	stored  time.Time
+	expires time.Time
+}
+
+// NewCache creates a cache of at most size responses; 0 disables it.
+func NewCache(size int, serveStale bool) *Cache {
+	return &Cache{
+		size:       size,
+		serveStale: serveStale,
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// Configure changes the size and the serve-stale option, dropping entries
+// beyond the new size.
+func (c *Cache) Configure(size int, serveStale bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.serveStale = serveStale
+	c.evict()
+}
+
+// Stats returns the cache counters.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Enabled = c.size > 0
+	s.Entries = c.lru.Len()
+	return s
+}
+
+// Get returns a fresh cached answer of upstream to r, its TTLs reduced by
+// its age.
+func (c *Cache) Get(upstream string, r *dns.Msg) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return nil, false
+	}
+	e, ok := c.lookup(keyOf(upstream, r))
+	if !ok || !c.now().Before(e.expires) {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	return e.answer(r, uint32(c.now().Sub(e.stored)/time.Second), 0)
+}
+
+// Stale returns an expired answer of upstream to r for use when it failed,
+// if serve-stale is on and the answer expired less than staleWindow ago.
+func (c *Cache) Stale(upstream string, r *dns.Msg) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 || !c.serveStale {
+		return nil, false
+	}
+	e, ok := c.lookup(keyOf(upstream, r))
+	if !ok || c.now().Sub(e.expires) > staleWindow {
+		return nil, false
+	}
+	c.stats.Stale++
+	return e.answer(r, 0, staleTTL)
+}
+
+// Put caches the answer resp of upstream to r if it is cacheable: a
+// non-truncated answer with a TTL, or NXDOMAIN or an empty answer with an
+// SOA.
+func (c *Cache) Put(upstream string, r, resp *dns.Msg) {
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return
+	}
+	if err := resp.Pack(); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size == 0 {
+		return
+	}
+	key := keyOf(upstream, r)
+	now := c.now()
+	e := &cacheEntry{key: key, data: slices.Clone(resp.Data), stored: now, expires: now.Add(ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.evict()
+}
+
+// lookup returns the entry of key, marking it used. Entries past the stale
+// window are dropped. Caller must hold c.mu.
+func (c *Cache) lookup(key cacheKey) (*cacheEntry, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.now().Sub(e.expires) > staleWindow {
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// evict drops the least recently used entries beyond the size. Caller must
+// hold c.mu.
+func (c *Cache) evict() {
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*cacheEntry).key)
+	}
+}
+
+// answer unpacks the cached response as an answer to r: r's ID and question
+// (keeping the client's name case), TTLs reduced by age, or set to ttl if
+// it is not 0.
+func (e *cacheEntry) answer(r *dns.Msg, age, ttl uint32) (*dns.Msg, bool) {
+	m := &dns.Msg{Data: slices.Clone(e.data)}
+	if err := m.Unpack(); err != nil {
+		return nil, false
+	}
+	m.ID = r.ID
+	m.Question = r.Question
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			switch {
+			case ttl != 0:
+				h.TTL = ttl
+			case h.TTL > age:
+				h.TTL -= age
+			default:
+				h.TTL = 0
+			}
+		}
+	}
+	return m, true
+}
+
+// keyOf returns the cache key of a query to upstream.
+func keyOf(upstream string, r *dns.Msg) cacheKey {
+	q := r.Question[0]
+	return cacheKey{
+		upstream: upstream,
+		name:     strings.ToLower(q.Header().Name),
+		qtype:    dns.RRToType(q),
+		class:    q.Header().Class,
+		do:       r.Security,
+	}
+}
+
+// cacheTTL returns how long resp may be cached.
+func cacheTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated {
+		return 0, false
+	}
+	switch {
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		ttl := resp.Answer[0].Header().TTL
+		for _, rr := range resp.Answer[1:] {
+			ttl = min(ttl, rr.Header().TTL)
+		}
+		return time.Duration(ttl) * time.Second, ttl > 0
+	case resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError:
+		// Negative answer: cached for the SOA minimum (RFC 2308).
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := time.Duration(min(soa.Hdr.TTL, soa.Minttl)) * time.Second
+				return min(ttl, maxNegativeTTL), ttl > 0
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+const testUpstream = "127.0.0.1:9153"
+
+// testClock is a settable clock for the cache.
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time { return c.t }
+
+func newTestCache(size int, serveStale bool) (*Cache, *testClock) {
+	clock := &testClock{t: time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)}
+	c := NewCache(size, serveStale)
+	c.now = clock.now
+	return c, clock
+}
+
+func answer(t *testing.T, q *dns.Msg, rcode uint16, records ...string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.ID = q.ID
+	m.Response = true
+	m.Rcode = rcode
+	m.Question = q.Question
+	for _, s := range records {
+		rr, err := dns.New(s)
+		if err != nil {
+			t.Fatalf("dns.New(%q): %v", s, err)
+		}
+		if _, ok := rr.(*dns.SOA); ok {
+			m.Ns = append(m.Ns, rr)
+		} else {
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	return m
+}
+
+func TestCacheGet(t *testing.T) {
+	c, clock := newTestCache(10, false)
+	q := dns.NewMsg("example.com", dns.TypeA)
+	c.Put(testUpstream, q, answer(t, q, dns.RcodeSuccess, "example.com. 300 IN A 192.0.2.1", "example.com. 60 IN A 192.0.2.2"))
+
+	clock.t = clock.t.Add(20 * time.Second)
+	again := dns.NewMsg("EXAMPLE.com", dns.TypeA)
+	resp, ok := c.Get(testUpstream, again)
+	if !ok {
+		t.Fatal("Get missed a fresh entry")
+	}
+	if resp.ID != again.ID || resp.Question[0].Header().Name != "EXAMPLE.com." {
+		t.Errorf("answer has ID %d, name %q, want the query's", resp.ID, resp.Question[0].Header().Name)
+	}
+	if len(resp.Answer) != 2 || resp.Answer[0].Header().TTL != 280 || resp.Answer[1].Header().TTL != 40 {
+		t.Errorf("answer = %v, want 2 records with TTLs 280 and 40", resp.Answer)
+	}
+
+	// The entry expires with the lowest TTL.
+	clock.t = clock.t.Add(40 * time.Second)
+	if _, ok := c.Get(testUpstream, again); ok {
+		t.Error("Get returned an expired entry")
+	}
+	if _, ok := c.Get(testUpstream, dns.NewMsg("example.com", dns.TypeAAAA)); ok {
+		t.Error("Get returned an answer for another type")
+	}
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 2 || s.Entries != 1 {
+		t.Errorf("stats = %+v, want 1 hit, 2 misses, 1 entry", s)
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	c, clock := newTestCache(10, false)
+	soa := "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120"
+
+	nx := dns.NewMsg("missing.example.com", dns.TypeA)
+	c.Put(testUpstream, nx, answer(t, nx, dns.RcodeNameError, soa))
+	nodata := dns.NewMsg("example.com", dns.TypeAAAA)
+	c.Put(testUpstream, nodata, answer(t, nodata, dns.RcodeSuccess, soa))
+	bare := dns.NewMsg("bare.example.com", dns.TypeA)
+	c.Put(testUpstream, bare, answer(t, bare, dns.RcodeNameError))
+	fail := dns.NewMsg("fail.example.com", dns.TypeA)
+	c.Put(testUpstream, fail, answer(t, fail, dns.RcodeServerFailure))
+
+	if resp, ok := c.Get(testUpstream, nx); !ok || resp.Rcode != dns.RcodeNameError {
+		t.Error("NXDOMAIN with SOA was not cached")
+	}
+	if _, ok := c.Get(testUpstream, nodata); !ok {
+		t.Error("empty answer with SOA was not cached")
+	}
+	if _, ok := c.Get(testUpstream, bare); ok {
+		t.Error("NXDOMAIN without SOA was cached")
+	}
+	if _, ok := c.Get(testUpstream, fail); ok {
+		t.Error("SERVFAIL was cached")
+	}
+
+	// Negative answers live for the SOA minimum.
+	clock.t = clock.t.Add(2 * time.Minute)
+	if _, ok := c.Get(testUpstream, nx); ok {
+		t.Error("NXDOMAIN outlived the SOA minimum")
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	q := dns.NewMsg("example.com", dns.TypeA)
+	for _, serveStale := range []bool{false, true} {
+		c, clock := newTestCache(10, serveStale)
+		c.Put(testUpstream, q, answer(t, q, dns.RcodeSuccess, "example.com. 60 IN A 192.0.2.1"))
+
+		clock.t = clock.t.Add(time.Hour)
+		resp, ok := c.Stale(testUpstream, q)
+		if ok != serveStale {
+			t.Fatalf("serveStale=%v: Stale ok = %v", serveStale, ok)
+		}
+		if ok && resp.Answer[0].Header().TTL != staleTTL {
+			t.Errorf("stale TTL = %d, want %d", resp.Answer[0].Header().TTL, staleTTL)
+		}
+
+		clock.t = clock.t.Add(staleWindow)
+		if _, ok := c.Stale(testUpstream, q); ok {
+			t.Errorf("serveStale=%v: served an answer past the stale window", serveStale)
+		}
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, _ := newTestCache(2, false)
+	put := func(name string) *dns.Msg {
+		q := dns.NewMsg(name, dns.TypeA)
+		c.Put(testUpstream, q, answer(t, q, dns.RcodeSuccess, name+". 300 IN A 192.0.2.1"))
+		return q
+	}
+	a := put("a.com")
+	b := put("b.com")
+	c.Get(testUpstream, a)
+	put("c.com")
+
+	if _, ok := c.Get(testUpstream, b); ok {
+		t.Error("least recently used entry was kept")
+	}
+	if _, ok := c.Get(testUpstream, a); !ok {
+		t.Error("recently used entry was evicted")
+	}
+
+	c.Configure(0, false)
+	if s := c.Stats(); s.Enabled || s.Entries != 0 {
+		t.Errorf("stats after disabling = %+v, want disabled and empty", s)
+	}
+}
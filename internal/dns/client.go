@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+// upstreamTimeout bounds one exchange with an upstream.
+const upstreamTimeout = 5 * time.Second
+
+// Upstream is a resolver the forwarder sends queries to.
+type Upstream interface {
+	// Exchange sends m and returns the answer. It may change m.Data.
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	// String returns the upstream address as configured.
+	String() string
+	// Close drops idle connections.
+	Close()
+}
+
+// NewUpstream creates the upstream of an address in the forms accepted by
+// shunt.NormalizeUpstream. Host names of DoH and DoT upstreams are resolved
+// with bootstrap.
+func NewUpstream(addr string, bootstrap *Bootstrap) (Upstream, error) {
+	scheme, _, ok := strings.Cut(addr, "://")
+	if !ok {
+		if _, err := netip.ParseAddrPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", addr, err)
+		}
+		return newPlainUpstream(addr), nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %q: %w", addr, err)
+	}
+	switch scheme {
+	case "https":
+		return newDoHUpstream(u, bootstrap), nil
+	case "tls":
+		return newDoTUpstream(u, bootstrap), nil
+	}
+	return nil, fmt.Errorf("invalid upstream %q: unsupported scheme %s", addr, scheme)
+}
+
+// plainUpstream is a DNS server queried over UDP, retrying with TCP if the
+// answer is truncated.
+type plainUpstream struct {
+	addr   string
+	client *dns.Client
+}
+
+func newPlainUpstream(addr string) *plainUpstream {
+	client := dns.NewClient()
+	client.ReadTimeout = upstreamTimeout
+	client.WriteTimeout = upstreamTimeout
+	return &plainUpstream{addr: addr, client: client}
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.Exchange(ctx, m, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		m.Data = nil
+		resp, _, err = u.client.Exchange(ctx, m, "tcp", u.addr)
+		if err != nil {
+			return nil, fmt.Errorf("tcp retry: %w", err)
+		}
+	}
+	return resp, nil
+}
+
+func (u *plainUpstream) String() string { return u.addr }
+
+func (u *plainUpstream) Close() {}
+
+// bootstrapTTL is how long bootstrap answers are used.
+const bootstrapTTL = 10 * time.Minute
+
+// Bootstrap resolves the host names of encrypted upstreams with plain DNS
+// servers. It never uses the system resolver, which may be the forwarder
+// itself. Answers are kept for bootstrapTTL, and past it while the servers
+// fail.
+type Bootstrap struct {
+	servers []string
+
+	mu    sync.Mutex
+	hosts map[string]bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// NewBootstrap creates a Bootstrap querying servers (ip[:port]) in turn.
+func NewBootstrap(servers []string) *Bootstrap {
+	return &Bootstrap{servers: servers, hosts: make(map[string]bootstrapEntry)}
+}
+
+// Lookup returns the addresses of host; an IP is returned as is.
+func (b *Bootstrap) Lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	if b == nil {
+		return nil, fmt.Errorf("bootstrap %s: no bootstrap servers", host)
+	}
+
+	b.mu.Lock()
+	cached, ok := b.hosts[host]
+	b.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+
+	addrs, err := b.resolve(ctx, host)
+	if err != nil {
+		if ok {
+			return cached.addrs, nil
+		}
+		return nil, err
+	}
+	b.mu.Lock()
+	b.hosts[host] = bootstrapEntry{addrs: addrs, expires: time.Now().Add(bootstrapTTL)}
+	b.mu.Unlock()
+	return addrs, nil
+}
+
+func (b *Bootstrap) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if len(b.servers) == 0 {
+		return nil, fmt.Errorf("bootstrap %s: no bootstrap servers", host)
+	}
+	var lastErr error
+	for _, server := range b.servers {
+		ips, err := NewResolver(server).Resolve(ctx, host)
+		if err == nil && len(ips) == 0 {
+			err = fmt.Errorf("no addresses")
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addrs := make([]netip.Addr, 0, len(ips))
+		for _, ip := range ips {
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("bootstrap %s: %w", host, lastErr)
+}
+
+// dial connects to port of host, trying its bootstrapped addresses in turn.
+func (b *Bootstrap) dial(ctx context.Context, network, host, port string) (net.Conn, error) {
+	addrs, err := b.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: upstreamTimeout, KeepAlive: 30 * time.Second}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := d.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// hostPort returns the host and port of u, defaultPort if it has none.
+func hostPort(u *url.URL, defaultPort string) (string, string) {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return u.Hostname(), port
+}
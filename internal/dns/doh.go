@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/dnshttp"
+)
+
+// dohUpstream is a DNS-over-HTTPS resolver (RFC 8484). Queries are POSTed
+// over a kept-alive HTTP/2 connection.
+type dohUpstream struct {
+	url       string
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newDoHUpstream(u *url.URL, bootstrap *Bootstrap) *dohUpstream {
+	host, port := hostPort(u, "443")
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return bootstrap.dial(ctx, network, host, port)
+		},
+		TLSClientConfig:     &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12, NextProtos: dnshttp.NextProtos},
+		TLSHandshakeTimeout: upstreamTimeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     2 * time.Minute,
+	}
+	return &dohUpstream{
+		url:       u.String(),
+		transport: transport,
+		client:    &http.Client{Transport: transport, Timeout: upstreamTimeout},
+	}
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The ID is 0 on the wire so HTTP caches can share answers.
+	id := m.ID
+	m.ID = 0
+	m.Data = nil
+	err := m.Pack()
+	m.ID = id
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(m.Data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnshttp.MimeType)
+	req.Header.Set("Accept", dnshttp.MimeType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("doh: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	answer := &dns.Msg{Data: data}
+	if err := answer.Unpack(); err != nil {
+		return nil, fmt.Errorf("doh: %w", err)
+	}
+	answer.ID = id
+	return answer, nil
+}
+
+func (u *dohUpstream) String() string { return u.url }
+
+func (u *dohUpstream) Close() { u.transport.CloseIdleConnections() }
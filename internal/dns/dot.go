@@ -0,0 +1,104 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+
+	"codeberg.org/miekg/dns"
+)
+
+// dotIdleConns is how many idle connections a DNS-over-TLS upstream keeps.
+const dotIdleConns = 4
+
+// dotUpstream is a DNS-over-TLS resolver (RFC 7858). Connections are kept
+// open and reused for later queries.
+type dotUpstream struct {
+	addr      string
+	host      string
+	port      string
+	bootstrap *Bootstrap
+	tlsConfig *tls.Config
+	client    *dns.Client
+	idle      chan net.Conn
+}
+
+func newDoTUpstream(u *url.URL, bootstrap *Bootstrap) *dotUpstream {
+	host, port := hostPort(u, "853")
+	client := dns.NewClient()
+	client.ReadTimeout = upstreamTimeout
+	client.WriteTimeout = upstreamTimeout
+	return &dotUpstream{
+		addr:      u.String(),
+		host:      host,
+		port:      port,
+		bootstrap: bootstrap,
+		tlsConfig: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12},
+		client:    client,
+		idle:      make(chan net.Conn, dotIdleConns),
+	}
+}
+
+// Exchange sends m over an idle connection, or a new one. A reused
+// connection the server has closed in the meantime is retried once on a
+// new one.
+func (u *dotUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	for {
+		conn, reused, err := u.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		m.Data = nil
+		resp, _, err := u.client.ExchangeWithConn(ctx, m, conn)
+		if err == nil {
+			u.release(conn)
+			return resp, nil
+		}
+		conn.Close()
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// conn returns an idle connection, or dials a new one.
+func (u *dotUpstream) conn(ctx context.Context) (conn net.Conn, reused bool, err error) {
+	select {
+	case conn := <-u.idle:
+		return conn, true, nil
+	default:
+	}
+	raw, err := u.bootstrap.dial(ctx, "tcp", u.host, u.port)
+	if err != nil {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(raw, u.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, false, err
+	}
+	return tlsConn, false, nil
+}
+
+// release keeps conn for reuse, closing it if enough are idle.
+func (u *dotUpstream) release(conn net.Conn) {
+	select {
+	case u.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (u *dotUpstream) String() string { return u.addr }
+
+func (u *dotUpstream) Close() {
+	for {
+		select {
+		case conn := <-u.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
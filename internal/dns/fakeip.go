@@ -0,0 +1,240 @@
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeIPTTL is the TTL of fake-IP answers. The mapping is stable, but a short
+// TTL keeps clients asking, so a domain that stops matching gets its real
+// addresses quickly.
+const fakeIPTTL = 1
+
+// fakeIPSaveInterval is how often FakeIPPool.Run writes new mappings to disk.
+const fakeIPSaveInterval = time.Minute
+
+// FakeIPMapping is one fake address and the domain it stands for.
+type FakeIPMapping struct {
+	IP     string `json:"ip"`
+	Domain string `json:"domain"`
+}
+
+// FakeIPPool hands out addresses of a reserved network to domains and maps
+// them back. Addresses are allocated in turn; once the pool is exhausted the
+// oldest mapping is reused. The table is kept in a file so clients holding
+// a fake address from before a restart still reach their domain.
+type FakeIPPool struct {
+	prefix netip.Prefix
+	path   string
+	logger *slog.Logger
+
+	mu       sync.Mutex
+	byIP     map[netip.Addr]string
+	byDomain map[string]netip.Addr
+	next     netip.Addr // next address to hand out
+	dirty    bool       // mappings changed since the last save
+}
+
+// fakeIPFile is the on-disk form of a FakeIPPool.
+type fakeIPFile struct {
+	Range    string          `json:"range"`
+	Next     string          `json:"next"`
+	Mappings []FakeIPMapping `json:"mappings"`
+}
+
+// NewFakeIPPool creates a pool over prefix persisted at path, loading the
+// mappings saved there. Mappings outside prefix, e.g. after a range change,
+// are dropped.
+func NewFakeIPPool(prefix netip.Prefix, path string, logger *slog.Logger) *FakeIPPool {
+	p := &FakeIPPool{
+		prefix:   prefix,
+		path:     path,
+		logger:   logger,
+		byIP:     make(map[netip.Addr]string),
+		byDomain: make(map[string]netip.Addr),
+		next:     firstFakeIP(prefix),
+	}
+	if err := p.load(); err != nil {
+		logger.Warn("fake-ip: failed to load mappings", "file", path, "error", err)
+	}
+	return p
+}
+
+// Prefix returns the network of the pool.
+func (p *FakeIPPool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Allocate returns the fake address of domain, handing out a new one if it
+// has none yet. When the pool is exhausted and the address is taken from
+// another domain, evicted is that domain, otherwise it is empty.
+func (p *FakeIPPool) Allocate(domain string) (addr netip.Addr, evicted string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if addr, ok := p.byDomain[domain]; ok {
+		return addr, ""
+	}
+	addr = p.next
+	if old, ok := p.byIP[addr]; ok {
+		delete(p.byDomain, old) // pool exhausted: reuse the oldest address
+		evicted = old
+	}
+	p.byIP[addr] = domain
+	p.byDomain[domain] = addr
+	p.next = p.following(addr)
+	p.dirty = true
+	return addr, evicted
+}
+
+// Lookup returns the domain a fake address stands for.
+func (p *FakeIPPool) Lookup(addr netip.Addr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	domain, ok := p.byIP[addr]
+	return domain, ok
+}
+
+// Mappings returns every mapping, ordered by address.
+func (p *FakeIPPool) Mappings() []FakeIPMapping {
+	p.mu.Lock()
+	addrs := make([]netip.Addr, 0, len(p.byIP))
+	for addr := range p.byIP {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	out := make([]FakeIPMapping, len(addrs))
+	for i, addr := range addrs {
+		out[i] = FakeIPMapping{IP: addr.String(), Domain: p.byIP[addr]}
+	}
+	p.mu.Unlock()
+	return out
+}
+
+// Run saves new mappings every fakeIPSaveInterval until ctx is done. Call
+// Save on shutdown for the last ones.
+func (p *FakeIPPool) Run(ctx context.Context) {
+	ticker := time.NewTicker(fakeIPSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Save()
+		}
+	}
+}
+
+// Save writes the mappings to the pool file if they changed, replacing it
+// atomically.
+func (p *FakeIPPool) Save() {
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return
+	}
+	p.dirty = false
+	next := p.next
+	p.mu.Unlock()
+
+	data, err := json.Marshal(fakeIPFile{Range: p.prefix.String(), Next: next.String(), Mappings: p.Mappings()})
+	if err == nil {
+		err = writeFileAtomic(p.path, data)
+	}
+	if err != nil {
+		p.logger.Warn("fake-ip: failed to save mappings", "file", p.path, "error", err)
+		p.mu.Lock()
+		p.dirty = true
+		p.mu.Unlock()
+	}
+}
+
+// load reads the mappings saved in the pool file. A missing file is not an
+// error.
+func (p *FakeIPPool) load() error {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var f fakeIPFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parse %s: %w", p.path, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range f.Mappings {
+		addr, err := netip.ParseAddr(m.IP)
+		if err != nil || !p.usable(addr) || m.Domain == "" {
+			continue
+		}
+		domain := strings.ToLower(m.Domain)
+		if _, dup := p.byDomain[domain]; dup {
+			continue
+		}
+		p.byIP[addr] = domain
+		p.byDomain[domain] = addr
+	}
+	if next, err := netip.ParseAddr(f.Next); err == nil && p.usable(next) {
+		p.next = next
+	}
+	return nil
+}
+
+// usable reports whether addr is a host address of the pool: inside the
+// prefix, not its network or broadcast address.
+func (p *FakeIPPool) usable(addr netip.Addr) bool {
+	return p.prefix.Contains(addr) && addr != p.prefix.Addr() && addr != lastAddr(p.prefix)
+}
+
+// following returns the address handed out after addr, wrapping around at
+// the end of the pool.
+func (p *FakeIPPool) following(addr netip.Addr) netip.Addr {
+	if next := addr.Next(); p.usable(next) {
+		return next
+	}
+	return firstFakeIP(p.prefix)
+}
+
+// firstFakeIP returns the first host address of prefix.
+func firstFakeIP(prefix netip.Prefix) netip.Addr {
+	return prefix.Addr().Next()
+}
+
+// lastAddr returns the last (broadcast) address of an IPv4 prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().As4()
+	hostBits := 32 - prefix.Bits()
+	for i := 3; i >= 0 && hostBits > 0; i-- {
+		n := min(hostBits, 8)
+		b[i] |= byte(1<<n - 1)
+		hostBits -= n
+	}
+	return netip.AddrFrom4(b)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it over path, creating the directory if needed.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
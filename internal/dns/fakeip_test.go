@@ -0,0 +1,75 @@
+package dns
+
+import (
+	"log/slog"
+	"net/netip"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFakeIPPool(t *testing.T, prefix string) (*FakeIPPool, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fakeip.json")
+	return NewFakeIPPool(netip.MustParsePrefix(prefix), path, slog.Default()), path
+}
+
+func TestFakeIPPoolAllocate(t *testing.T) {
+	p, _ := newTestFakeIPPool(t, "198.18.0.0/15")
+
+	a, _ := p.Allocate("example.com")
+	b, _ := p.Allocate("other.com")
+	if a.String() != "198.18.0.1" || b.String() != "198.18.0.2" {
+		t.Errorf("allocated %s, %s, want 198.18.0.1, 198.18.0.2", a, b)
+	}
+	if again, _ := p.Allocate("example.com"); again != a {
+		t.Errorf("second allocation = %s, want stable %s", again, a)
+	}
+	if d, ok := p.Lookup(b); !ok || d != "other.com" {
+		t.Errorf("Lookup(%s) = %q, %v, want other.com", b, d, ok)
+	}
+	if _, ok := p.Lookup(netip.MustParseAddr("198.18.0.9")); ok {
+		t.Error("Lookup of an unallocated address succeeded")
+	}
+}
+
+func TestFakeIPPoolWrapsAround(t *testing.T) {
+	// A /30 has two host addresses.
+	p, _ := newTestFakeIPPool(t, "10.0.0.0/30")
+
+	p.Allocate("a.com")
+	p.Allocate("b.com")
+	c, evicted := p.Allocate("c.com")
+	if c.String() != "10.0.0.1" || evicted != "a.com" {
+		t.Errorf("third allocation = %s evicting %q, want 10.0.0.1 reused from a.com", c, evicted)
+	}
+	if d, _ := p.Lookup(c); d != "c.com" {
+		t.Errorf("reused address maps to %q, want c.com", d)
+	}
+	if got, _ := p.Allocate("a.com"); got.String() != "10.0.0.2" {
+		t.Errorf("evicted domain got %s, want the next address 10.0.0.2", got)
+	}
+	if n := len(p.Mappings()); n != 2 {
+		t.Errorf("mappings = %d, want 2", n)
+	}
+}
+
+func TestFakeIPPoolPersists(t *testing.T) {
+	p, path := newTestFakeIPPool(t, "198.18.0.0/15")
+	a, _ := p.Allocate("example.com")
+	p.Allocate("other.com")
+	p.Save()
+
+	loaded := NewFakeIPPool(netip.MustParsePrefix("198.18.0.0/15"), path, slog.Default())
+	if d, ok := loaded.Lookup(a); !ok || d != "example.com" {
+		t.Errorf("after reload Lookup(%s) = %q, %v, want example.com", a, d, ok)
+	}
+	if next, _ := loaded.Allocate("new.com"); next.String() != "198.18.0.3" {
+		t.Errorf("after reload allocated %s, want 198.18.0.3", next)
+	}
+
+	// A range change drops mappings outside the new range.
+	moved := NewFakeIPPool(netip.MustParsePrefix("100.64.0.0/16"), path, slog.Default())
+	if n := len(moved.Mappings()); n != 0 {
+		t.Errorf("mappings after range change = %d, want 0", n)
+	}
+}
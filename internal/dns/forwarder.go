@@ -5,44 +5,81 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"codeberg.org/miekg/dns"
+	"codeberg.org/miekg/dns/rdata"
 
 	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
+// Block responses for domains of block shunts (config dns.block_response).
+const (
+	BlockNXDomain = "nxdomain" // answer NXDOMAIN (default)
+	BlockZero     = "zero"     // answer 0.0.0.0 for A and :: for AAAA
+)
+
+// blockTTL is the TTL of locally generated block answers.
+const blockTTL = 60
+
 // Forwarder is a DNS proxy that intercepts responses and tracks matched
-// domains in the ipset. When IPv6 is enabled, both A and AAAA records are
-// tracked. When disabled, AAAA records are stripped from matched responses
-// to prevent IPv6 bypass.
+// domains in the ipset. A domain also matches through the CNAME chain of
+// its answer, with its IPs tracked for the queried name. When IPv6 is
+// enabled, both A and AAAA records are tracked. When disabled, AAAA records
+// are stripped from matched responses to prevent IPv6 bypass. Domains of
+// block shunts are answered locally without asking the upstream. In fake-IP
+// mode, proxied domains are answered with an address of the FakeIPPool
+// instead, which is tracked in place of the real ones. Upstream answers are
+// kept in a Cache, and answered queries in a QueryLog.
 type Forwarder struct {
 	listenAddr string // e.g. ":53"
-	upstream   string // e.g. "127.0.0.1:9153"
 	ipv6       bool
 	matcher    *Matcher
 	tracker    *Tracker
-	client     *dns.Client
+	cache      *Cache
+	queryLog   *QueryLog
 	udpServer  *dns.Server
 	tcpServer  *dns.Server
 	logger     *slog.Logger
-}
 
-// NewForwarder creates a forwarder that listens on listenAddr and forwards
-// queries to upstream.
-func NewForwarder(listenAddr, upstream string, ipv6 bool, tracker *Tracker, logger *slog.Logger) *Forwarder {
-	client := dns.NewClient()
-	client.ReadTimeout = 5 * time.Second
-	client.WriteTimeout = 5 * time.Second
+	// blockZero answers blocked domains with unspecified addresses instead
+	// of NXDOMAIN.
+	blockZero atomic.Bool
+
+	// fakeIP is the fake-IP pool, nil if none was set; fakeIPOn switches
+	// fake-IP answers on.
+	fakeIP   *FakeIPPool
+	fakeIPOn atomic.Bool
+
+	// paused passes every query through untouched while routing is paused.
+	paused atomic.Bool
+
+	// upstream is where queries go (see SetUpstream), nil until set;
+	// upstreams sends queries for proxied domains to other upstreams (see
+	// SetMatchedUpstreams), nil until set. upstreamMu serializes changes to
+	// both.
+	upstream    atomic.Pointer[UpstreamGroup]
+	upstreams   atomic.Pointer[upstreamRules]
+	upstreamMu  sync.Mutex
+	upstreamKey string
+	bootstrap   *Bootstrap
+}
 
+// NewForwarder creates a forwarder that listens on listenAddr. Set its
+// upstreams with SetUpstream before Start.
+func NewForwarder(listenAddr string, ipv6 bool, tracker *Tracker, logger *slog.Logger) *Forwarder {
 	return &Forwarder{
 		listenAddr: listenAddr,
-		upstream:   upstream,
 		ipv6:       ipv6,
 		matcher:    NewMatcher(),
 		tracker:    tracker,
-		client:     client,
+		cache:      NewCache(0, false),
+		queryLog:   NewQueryLog(0),
 		logger:     logger,
 	}
 }
@@ -85,7 +122,11 @@ func (f *Forwarder) Start() error {
 		}
 	}
 
-	f.logger.Info("dns forwarder started", "listen", f.listenAddr, "upstream", f.upstream)
+	upstream := "none"
+	if u := f.upstream.Load(); u != nil {
+		upstream = u.String()
+	}
+	f.logger.Info("dns forwarder started", "listen", f.listenAddr, "upstream", upstream)
 	return nil
 }
 
@@ -101,9 +142,87 @@ func (f *Forwarder) Stop() {
 	}
 }
 
-// UpdateMatcher replaces the domain matching rules.
-func (f *Forwarder) UpdateMatcher(entries []shunt.Entry) {
-	f.matcher.Update(entries)
+// UpdateMatcher replaces the domain matching rules with entries grouped by
+// routing target.
+func (f *Forwarder) UpdateMatcher(byTarget map[shunt.Target][]shunt.Entry) {
+	f.matcher.UpdateTargets(byTarget)
+}
+
+// SetBlockResponse selects how blocked domains are answered: BlockNXDomain
+// (also for an empty or unknown mode) or BlockZero.
+func (f *Forwarder) SetBlockResponse(mode string) {
+	f.blockZero.Store(mode == BlockZero)
+}
+
+// SetCache sizes the response cache (0 disables it) and switches serving
+// stale answers when the upstream fails on or off.
+func (f *Forwarder) SetCache(size int, serveStale bool) {
+	f.cache.Configure(size, serveStale)
+}
+
+// CacheStats returns the response cache counters.
+func (f *Forwarder) CacheStats() CacheStats {
+	return f.cache.Stats()
+}
+
+// SetPaused stops (or resumes) matching queries: while paused, queries are
+// forwarded without blocking, tracking, fake IPs or AAAA stripping.
+func (f *Forwarder) SetPaused(paused bool) {
+	f.paused.Store(paused)
+}
+
+// SetFakeIPPool sets the pool of fake-IP answers. Call before Start.
+func (f *Forwarder) SetFakeIPPool(pool *FakeIPPool) {
+	f.fakeIP = pool
+}
+
+// SetFakeIP switches fake-IP answers for proxied domains on or off. It has
+// no effect without a pool.
+func (f *Forwarder) SetFakeIP(on bool) {
+	f.fakeIPOn.Store(on && f.fakeIP != nil)
+}
+
+// RetrackFakeIPs tracks the fake addresses of domains that are still proxied
+// again, e.g. after the tracker was flushed, so clients that cached them keep
+// reaching the proxy.
+func (f *Forwarder) RetrackFakeIPs(ctx context.Context) {
+	if !f.fakeIPOn.Load() {
+		return
+	}
+	var fakes []trackedDomain
+	for _, m := range f.fakeIP.Mappings() {
+		fakes = append(fakes, trackedDomain{Domain: m.Domain, IPs: []trackedIP{{IP: m.IP}}})
+	}
+	f.tracker.retrack(ctx, fakes, func(domain string) (shunt.Target, bool) {
+		target, matched := f.matcher.MatchTarget(domain)
+		return target, matched && target.IsProxy()
+	})
+}
+
+// QueryLog returns the forwarder's query log.
+func (f *Forwarder) QueryLog() *QueryLog {
+	return f.queryLog
+}
+
+// RestoreTracked tracks the IPs the tracker saved before a restart again,
+// for the domains that are still matched.
+func (f *Forwarder) RestoreTracked(ctx context.Context) {
+	n, err := f.tracker.Restore(ctx, f.matcher.MatchTarget)
+	if err != nil {
+		f.logger.Warn("failed to restore tracked ips", "error", err)
+		return
+	}
+	if n > 0 {
+		f.logger.Info("restored tracked domains", "domains", n)
+	}
+}
+
+// RefreshTracked tracks the IPs tracked so far again for the domains that
+// are still matched and deletes the others, see Tracker.Refresh.
+func (f *Forwarder) RefreshTracked(ctx context.Context) {
+	if n := f.tracker.Refresh(ctx, f.matcher.MatchTarget); n > 0 {
+		f.logger.Info("tracked domains kept across reconcile", "domains", n)
+	}
 }
 
 // Matcher returns the forwarder's matcher for external use.
@@ -111,7 +230,7 @@ func (f *Forwarder) Matcher() *Matcher {
 	return f.matcher
 }
 
-// Tracker returns the forwarder's tracker for external use.
+// TrackerRef returns the forwarder's tracker for external use.
 func (f *Forwarder) TrackerRef() *Tracker {
 	return f.tracker
 }
@@ -126,50 +245,202 @@ func (f *Forwarder) handleQuery(ctx context.Context, w dns.ResponseWriter, r *dn
 		return
 	}
 
-	// Forward to upstream via UDP.
-	resp, _, err := f.client.Exchange(ctx, r, "udp", f.upstream)
-	if err != nil {
-		f.logger.Debug("upstream exchange failed", "error", err)
-		f.sendServFail(w, r)
-		return
+	// Extract queried domain (lowercase, without trailing dot).
+	qname := strings.TrimSuffix(r.Question[0].Header().Name, ".")
+	qname = strings.ToLower(qname)
+
+	start := time.Now()
+	m := queryMatch{name: qname}
+	paused := f.paused.Load()
+	if !paused {
+		m.target, m.matched = f.matcher.MatchTarget(qname)
 	}
+	rcode, ips := f.answer(ctx, w, r, qname, &m, !paused)
 
-	// If truncated over UDP, retry with TCP.
-	if resp.Truncated {
-		resp, _, err = f.client.Exchange(ctx, r, "tcp", f.upstream)
-		if err != nil {
-			f.logger.Debug("upstream TCP exchange failed", "error", err)
-			f.sendServFail(w, r)
-			return
+	if f.queryLog.Enabled() {
+		e := QueryLogEntry{
+			Time:    start,
+			Client:  clientAddr(w),
+			Name:    qname,
+			Type:    dns.TypeToString[dns.RRToType(r.Question[0])],
+			Rcode:   dns.RcodeToString[rcode],
+			Latency: time.Since(start),
+			IPs:     ips,
 		}
+		if m.matched {
+			e.Shunt = f.queryLog.shuntFor(m.name, m.target)
+			e.Action = m.target.Action
+			if e.Action == "" {
+				e.Action = shunt.ActionProxy
+			}
+		}
+		f.queryLog.Add(e)
 	}
+}
 
-	// Extract queried domain (lowercase, without trailing dot).
-	qname := strings.TrimSuffix(r.Question[0].Header().Name, ".")
-	qname = strings.ToLower(qname)
+// queryMatch is the shunt match of a query.
+type queryMatch struct {
+	target  shunt.Target
+	matched bool
+	// name is the name that matched: the queried domain, or a CNAME target
+	// in the answer.
+	name string
+}
+
+// answer answers a query for domain and returns the rcode of the answer and
+// the addresses tracked from it. An unmatched domain whose answer has a
+// CNAME target matching a shunt is treated as matched when cnames is set,
+// updating m: it is blocked, answered with a fake IP or asked again from
+// the upstream of the matched name like a matched domain, and its IPs are
+// tracked for domain all the same.
+func (f *Forwarder) answer(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, domain string, m *queryMatch, cnames bool) (uint16, []string) {
+	if rcode, ips, ok := f.answerLocally(ctx, w, r, domain, m); ok {
+		return rcode, ips
+	}
 
-	if f.matcher.Match(qname) {
-		f.processMatchedResponse(ctx, qname, resp)
+	upstream := f.upstreamFor(m.name, m.target, m.matched)
+	if upstream == nil {
+		return f.sendServFail(w, r), nil
+	}
+	resp, err := f.resolve(ctx, r, upstream)
+	if err != nil {
+		f.logger.Debug("upstream exchange failed", "upstream", upstream.String(), "error", err)
+		return f.sendServFail(w, r), nil
+	}
+
+	if !m.matched && cnames {
+		f.matchCNAMEs(resp, m)
+		if rcode, ips, ok := f.answerLocally(ctx, w, r, domain, m); ok {
+			return rcode, ips
+		}
+		if u := f.upstreamFor(m.name, m.target, m.matched); u != nil && u != upstream {
+			if again, err := f.resolve(ctx, r, u); err == nil {
+				resp = again
+			} else {
+				f.logger.Debug("upstream exchange failed", "upstream", u.String(), "error", err)
+			}
+		}
+	}
+	var ips []string
+	if m.matched {
+		ips = f.processMatchedResponse(ctx, m.target, domain, resp)
 	}
 
 	resp.Pack()
 	io.Copy(w, resp)
+	return resp.Rcode, ips
+}
+
+// answerLocally answers a query for a matched domain without the upstream:
+// blocked, or with a fake IP. ok is false if the upstream has to answer.
+func (f *Forwarder) answerLocally(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, domain string, m *queryMatch) (rcode uint16, ips []string, ok bool) {
+	if !m.matched {
+		return 0, nil, false
+	}
+	if m.target.Action == shunt.ActionBlock {
+		return f.sendBlocked(w, r), nil, true
+	}
+	if m.target.IsProxy() && f.fakeIPOn.Load() {
+		if ips, ok := f.sendFakeIP(ctx, w, r, m.target, domain); ok {
+			return dns.RcodeSuccess, ips, true
+		}
+	}
+	return 0, nil, false
 }
 
-// processMatchedResponse extracts A records for tracking. When IPv6 is
-// enabled, AAAA records are also tracked. When disabled, AAAA records are
-// stripped from the response to prevent IPv6 bypass.
-func (f *Forwarder) processMatchedResponse(ctx context.Context, domain string, resp *dns.Msg) {
+// matchCNAMEs matches the CNAME targets in resp, so aliases of shunt
+// domains (e.g. www.example.com → example.cdn.net) are routed too. The
+// strongest action wins, as in Matcher.MatchTarget; m is set to the match.
+func (f *Forwarder) matchCNAMEs(resp *dns.Msg, m *queryMatch) {
+	for _, rr := range resp.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSuffix(cname.Target, "."))
+		if target, ok := f.matcher.MatchTarget(name); ok && (!m.matched || target.Outranks(m.target)) {
+			m.target, m.matched, m.name = target, true, name
+		}
+	}
+}
+
+// clientAddr returns the IP address of the client of w.
+func clientAddr(w dns.ResponseWriter) string {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap().String()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap().String()
+	case nil:
+		return ""
+	default:
+		return a.String()
+	}
+}
+
+// resolve answers r from the cache, or from upstream, caching the
+// answer. When the upstream fails or answers SERVFAIL, an expired answer may
+// be served stale.
+func (f *Forwarder) resolve(ctx context.Context, r *dns.Msg, upstream *UpstreamGroup) (*dns.Msg, error) {
+	key := upstream.String()
+	if resp, ok := f.cache.Get(key, r); ok {
+		return resp, nil
+	}
+	resp, err := upstream.Exchange(ctx, r)
+	if err != nil || resp.Rcode == dns.RcodeServerFailure {
+		if stale, ok := f.cache.Stale(key, r); ok {
+			f.logger.Debug("serving stale answer", "name", r.Question[0].Header().Name, "error", err)
+			return stale, nil
+		}
+		return resp, err
+	}
+	f.cache.Put(key, r, resp)
+	return resp, nil
+}
+
+// processMatchedResponse extracts A records for tracking under the matched
+// routing target and returns the tracked addresses. When IPv6 is enabled,
+// AAAA records are also tracked. When disabled, AAAA records are stripped
+// from the response to prevent IPv6 bypass, except for direct exceptions,
+// which never go through the proxy. The addresses of the answer are added
+// to the ipsets together.
+func (f *Forwarder) processMatchedResponse(ctx context.Context, target shunt.Target, domain string, resp *dns.Msg) []string {
+	ips := f.answerIPs(target, resp)
+	f.tracker.TrackAll(ctx, target, domain, ips)
+	tracked := make([]string, len(ips))
+	for i, ip := range ips {
+		tracked[i] = ip.IP
+	}
+	return tracked
+}
+
+// answerIPs returns the addresses of resp to track for target, stripping
+// AAAA records as described at processMatchedResponse.
+func (f *Forwarder) answerIPs(target shunt.Target, resp *dns.Msg) []AnswerIP {
+	var ips []AnswerIP
+	track := func(ip string, rr dns.RR) {
+		ips = append(ips, AnswerIP{IP: ip, TTL: time.Duration(rr.Header().TTL) * time.Second})
+	}
+
+	if !f.ipv6 && target.Action == shunt.ActionDirect {
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				track(a.A.Addr.String(), a)
+			}
+		}
+		return ips
+	}
+
 	if f.ipv6 {
 		for _, rr := range resp.Answer {
 			switch a := rr.(type) {
 			case *dns.A:
-				f.tracker.Track(ctx, domain, a.A.Addr.String())
+				track(a.A.Addr.String(), a)
 			case *dns.AAAA:
-				f.tracker.Track(ctx, domain, a.AAAA.Addr.String())
+				track(a.AAAA.Addr.String(), a)
 			}
 		}
-		return
+		return ips
 	}
 
 	// IPv6 disabled: track A records, strip AAAA records.
@@ -177,7 +448,7 @@ func (f *Forwarder) processMatchedResponse(ctx context.Context, domain string, r
 	for _, rr := range resp.Answer {
 		switch a := rr.(type) {
 		case *dns.A:
-			f.tracker.Track(ctx, domain, a.A.Addr.String())
+			track(a.A.Addr.String(), a)
 			filtered = append(filtered, rr)
 		case *dns.AAAA:
 			// Strip AAAA records.
@@ -186,9 +457,46 @@ func (f *Forwarder) processMatchedResponse(ctx context.Context, domain string, r
 		}
 	}
 	resp.Answer = filtered
+	return ips
+}
+
+// sendFakeIP answers a query for a proxied domain in fake-IP mode: A with
+// the domain's fake address, which is tracked for the target, and AAAA,
+// HTTPS and SVCB with an empty answer so clients fall back to it. Other
+// types are left to the upstream; it returns the tracked address and
+// whether it answered.
+func (f *Forwarder) sendFakeIP(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, target shunt.Target, domain string) ([]string, bool) {
+	q := r.Question[0]
+	m := new(dns.Msg)
+	m.ID = r.ID
+	m.Response = true
+	m.Question = r.Question
+	m.RecursionDesired = r.RecursionDesired
+	m.RecursionAvailable = true
+	var tracked []string
+	switch dns.RRToType(q) {
+	case dns.TypeA:
+		// Fake IPs never expire: the mapping outlives the short TTL.
+		addr, evicted := f.fakeIP.Allocate(domain)
+		if evicted != "" {
+			// The address changes hands: it must leave the ipset of the
+			// domain it stood for, which may be of another target.
+			f.tracker.Untrack(ctx, evicted, addr.String())
+		}
+		f.tracker.TrackTarget(ctx, target, domain, addr.String(), 0)
+		tracked = append(tracked, addr.String())
+		hdr := dns.Header{Name: q.Header().Name, Class: dns.ClassINET, TTL: fakeIPTTL}
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: rdata.A{Addr: addr}})
+	case dns.TypeAAAA, dns.TypeHTTPS, dns.TypeSVCB:
+	default:
+		return nil, false
+	}
+	m.Pack()
+	io.Copy(w, m)
+	return tracked, true
 }
 
-func (f *Forwarder) sendServFail(w dns.ResponseWriter, r *dns.Msg) {
+func (f *Forwarder) sendServFail(w dns.ResponseWriter, r *dns.Msg) uint16 {
 	m := new(dns.Msg)
 	m.ID = r.ID
 	m.Response = true
@@ -198,4 +506,32 @@ func (f *Forwarder) sendServFail(w dns.ResponseWriter, r *dns.Msg) {
 	m.RecursionAvailable = true
 	m.Pack()
 	io.Copy(w, m)
+	return m.Rcode
+}
+
+// sendBlocked answers a query for a blocked domain locally: NXDOMAIN, or with
+// BlockZero an unspecified address for A and AAAA questions (an empty answer
+// for other types). It returns the rcode of the answer.
+func (f *Forwarder) sendBlocked(w dns.ResponseWriter, r *dns.Msg) uint16 {
+	m := new(dns.Msg)
+	m.ID = r.ID
+	m.Response = true
+	m.Question = r.Question
+	m.RecursionDesired = r.RecursionDesired
+	m.RecursionAvailable = true
+	if !f.blockZero.Load() {
+		m.Rcode = dns.RcodeNameError
+	} else {
+		q := r.Question[0]
+		hdr := dns.Header{Name: q.Header().Name, Class: dns.ClassINET, TTL: blockTTL}
+		switch dns.RRToType(q) {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: rdata.A{Addr: netip.IPv4Unspecified()}})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: rdata.AAAA{Addr: netip.IPv6Unspecified()}})
+		}
+	}
+	m.Pack()
+	io.Copy(w, m)
+	return m.Rcode
 }
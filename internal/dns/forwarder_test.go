@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+func TestForwarderMatchCNAMEs(t *testing.T) {
+	f := NewForwarder(":0", false, newTestTracker(), slog.Default())
+	f.UpdateMatcher(map[shunt.Target][]shunt.Entry{
+		{}:                           {{Value: "cdn-provider.net"}},
+		{Action: shunt.ActionDirect}: {{Value: "direct.cdn-provider.net"}},
+	})
+
+	q := dns.NewMsg("www.service.com", dns.TypeA)
+	resp := answer(t, q, dns.RcodeSuccess,
+		"www.service.com. 60 IN CNAME service.cdn-provider.net.",
+		"service.cdn-provider.net. 60 IN A 192.0.2.1")
+	m := queryMatch{name: "www.service.com"}
+	f.matchCNAMEs(resp, &m)
+	if !m.matched || !m.target.IsDefault() || m.name != "service.cdn-provider.net" {
+		t.Fatalf("match = %+v, want the default target via service.cdn-provider.net", m)
+	}
+
+	// The IPs are tracked for the queried name.
+	if ips := f.processMatchedResponse(context.Background(), m.target, "www.service.com", resp); len(ips) != 1 {
+		t.Errorf("tracked %v, want 192.0.2.1", ips)
+	}
+	if ips := f.tracker.forward["www.service.com"]; len(ips) != 1 || ips[0] != "192.0.2.1" {
+		t.Errorf("www.service.com IPs = %v, want [192.0.2.1]", ips)
+	}
+
+	// A direct exception further down the chain wins.
+	resp = answer(t, q, dns.RcodeSuccess,
+		"www.service.com. 60 IN CNAME edge.cdn-provider.net.",
+		"edge.cdn-provider.net. 60 IN CNAME direct.cdn-provider.net.",
+		"direct.cdn-provider.net. 60 IN A 192.0.2.2")
+	m = queryMatch{name: "www.service.com"}
+	f.matchCNAMEs(resp, &m)
+	if m.target.Action != shunt.ActionDirect {
+		t.Errorf("target = %+v, want direct", m.target)
+	}
+
+	// Answers without a matching alias stay unmatched.
+	resp = answer(t, q, dns.RcodeSuccess, "www.service.com. 60 IN CNAME other.net.", "other.net. 60 IN A 192.0.2.3")
+	m = queryMatch{name: "www.service.com"}
+	f.matchCNAMEs(resp, &m)
+	if m.matched {
+		t.Errorf("matched %+v through an unrelated alias", m)
+	}
+}
+
+// recorder is a ResponseWriter without a connection, keeping the answer
+// written to it.
+type recorder struct {
+	dns.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *recorder) Conn() net.Conn { return nil }
+
+func (w *recorder) Write(b []byte) (int, error) { return w.buf.Write(b) }
+
+func TestForwarderCNAMEMatchUpstream(t *testing.T) {
+	// The default upstream and the shunt's upstream both alias the name to
+	// the CDN, with different addresses.
+	cdn := func(ip string) func(r *dns.Msg) *dns.Msg {
+		return func(r *dns.Msg) *dns.Msg {
+			return answer(t, r, dns.RcodeSuccess,
+				"www.service.com. 60 IN CNAME service.cdn-provider.net.",
+				"service.cdn-provider.net. 60 IN A "+ip)
+		}
+	}
+	def, shunted := startServer(t, cdn("192.0.2.1")), startServer(t, cdn("192.0.2.9"))
+
+	f := NewForwarder(":0", false, newTestTracker(), slog.Default())
+	if err := f.SetUpstream([]string{def}, nil); err != nil {
+		t.Fatal(err)
+	}
+	f.UpdateMatcher(map[shunt.Target][]shunt.Entry{{}: {{Value: "cdn-provider.net"}}})
+	if err := f.SetMatchedUpstreams("", map[string][]shunt.Entry{shunted: {{Value: "cdn-provider.net"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &recorder{}
+	m := queryMatch{name: "www.service.com"}
+	_, ips := f.answer(context.Background(), w, dns.NewMsg("www.service.com", dns.TypeA), "www.service.com", &m, true)
+	if !m.matched || m.name != "service.cdn-provider.net" {
+		t.Fatalf("match = %+v, want service.cdn-provider.net", m)
+	}
+	if !slices.Equal(ips, []string{"192.0.2.9"}) {
+		t.Errorf("tracked %v, want the address from the shunt's upstream", ips)
+	}
+	if !bytes.Contains(w.buf.Bytes(), []byte{192, 0, 2, 9}) {
+		t.Error("the client did not get the answer of the shunt's upstream")
+	}
+}
+
+func TestForwarderFakeIPPoolExhausted(t *testing.T) {
+	ctx := context.Background()
+	proxy := shunt.Target{Port: 1081}
+	f := NewForwarder(":0", false, newTestTracker(), slog.Default())
+	f.tracker.SetTarget(proxy, netfilter.NewIPSet("test_tracker_1081"), nil)
+	// A /30 has two host addresses.
+	pool, _ := newTestFakeIPPool(t, "10.0.0.0/30")
+	f.SetFakeIPPool(pool)
+
+	for _, q := range []struct {
+		domain string
+		target shunt.Target
+	}{{"a.com", shunt.Target{}}, {"b.com", shunt.Target{}}, {"c.com", proxy}} {
+		if _, ok := f.sendFakeIP(ctx, &recorder{}, dns.NewMsg(q.domain, dns.TypeA), q.target, q.domain); !ok {
+			t.Fatalf("no fake-IP answer for %s", q.domain)
+		}
+	}
+
+	// c.com took 10.0.0.1 from a.com, which no longer holds it.
+	if _, ok := f.tracker.forward["a.com"]; ok {
+		t.Errorf("a.com still tracks %v", f.tracker.forward["a.com"])
+	}
+	if domains := f.tracker.reverse["10.0.0.1"]; !slices.Equal(domains, []string{"c.com"}) {
+		t.Errorf("10.0.0.1 is tracked for %v, want only c.com", domains)
+	}
+	if target := f.tracker.targets["c.com"]; target != proxy {
+		t.Errorf("c.com target = %+v, want %+v", target, proxy)
+	}
+}
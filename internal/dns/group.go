@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"codeberg.org/miekg/dns"
+)
+
+const (
+	// upstreamRetryMin and upstreamRetryMax bound how long a failing
+	// upstream is skipped; the wait doubles with each consecutive failure.
+	upstreamRetryMin = 5 * time.Second
+	upstreamRetryMax = 2 * time.Minute
+)
+
+// UpstreamStatus is the health of one upstream.
+type UpstreamStatus struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+	// Since is when the upstream last became healthy or unhealthy, zero if
+	// it never changed.
+	Since     time.Time     `json:"since,omitzero"`
+	Queries   uint64        `json:"queries"`
+	Failures  uint64        `json:"failures"`
+	LastError string        `json:"last_error,omitempty"`
+	RTT       time.Duration `json:"rtt"`
+}
+
+// UpstreamGroup sends queries to the first healthy of its upstreams. An
+// upstream that fails is skipped for a while, and the next one is tried;
+// when all are failing, they are tried in order anyway.
+type UpstreamGroup struct {
+	members []*groupMember
+	logger  *slog.Logger
+}
+
+type groupMember struct {
+	Upstream
+
+	mu      sync.Mutex
+	status  UpstreamStatus
+	fails   int       // consecutive failures
+	retryAt time.Time // the member is skipped until then
+}
+
+// NewUpstreamGroup creates a group of the upstreams at addrs, resolving
+// their host names with bootstrap.
+func NewUpstreamGroup(addrs []string, bootstrap *Bootstrap, logger *slog.Logger) (*UpstreamGroup, error) {
+	g := &UpstreamGroup{logger: logger}
+	for _, addr := range addrs {
+		u, err := NewUpstream(addr, bootstrap)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.members = append(g.members, &groupMember{Upstream: u, status: UpstreamStatus{Address: addr, Healthy: true}})
+	}
+	if len(g.members) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	return g, nil
+}
+
+// Exchange sends m to the upstreams until one answers.
+func (g *UpstreamGroup) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	now := time.Now()
+	var ready, failing []*groupMember
+	for _, mb := range g.members {
+		mb.mu.Lock()
+		if now.Before(mb.retryAt) {
+			failing = append(failing, mb)
+		} else {
+			ready = append(ready, mb)
+		}
+		mb.mu.Unlock()
+	}
+
+	var errs []error
+	for _, mb := range append(ready, failing...) {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		exCtx, cancel := context.WithTimeout(ctx, upstreamTimeout)
+		m.Data = nil // a failed exchange may leave a partial answer in it
+		resp, err := mb.Exchange(exCtx, m)
+		cancel()
+		mb.record(err, time.Since(start), g.logger)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, ctx.Err()
+	}
+	return nil, errors.Join(errs...)
+}
+
+// record updates the member's health after an exchange.
+func (mb *groupMember) record(err error, rtt time.Duration, logger *slog.Logger) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	now := time.Now()
+	mb.status.Queries++
+	if err == nil {
+		if !mb.status.Healthy {
+			logger.Info("dns upstream recovered", "upstream", mb.status.Address)
+			mb.status.Since = now
+		}
+		mb.status.Healthy = true
+		mb.status.RTT = rtt
+		mb.fails = 0
+		mb.retryAt = time.Time{}
+		return
+	}
+
+	mb.status.Failures++
+	mb.status.LastError = err.Error()
+	mb.fails++
+	mb.retryAt = now.Add(min(upstreamRetryMin<<min(mb.fails-1, 10), upstreamRetryMax))
+	if mb.status.Healthy {
+		logger.Warn("dns upstream failing", "upstream", mb.status.Address, "error", err)
+		mb.status.Healthy = false
+		mb.status.Since = now
+	}
+}
+
+// Status returns the health of the upstreams, in order.
+func (g *UpstreamGroup) Status() []UpstreamStatus {
+	out := make([]UpstreamStatus, len(g.members))
+	for i, mb := range g.members {
+		mb.mu.Lock()
+		out[i] = mb.status
+		mb.mu.Unlock()
+	}
+	return out
+}
+
+// String returns the addresses of the upstreams.
+func (g *UpstreamGroup) String() string {
+	addrs := make([]string, len(g.members))
+	for i, mb := range g.members {
+		addrs[i] = mb.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Close drops the idle connections of all upstreams.
+func (g *UpstreamGroup) Close() {
+	for _, mb := range g.members {
+		mb.Close()
+	}
+}
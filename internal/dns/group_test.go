@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+
+	"codeberg.org/miekg/dns"
+)
+
+// startTestServer runs a UDP DNS server answering every A query with
+// 192.0.2.1 and returns its address.
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	return startServer(t, func(r *dns.Msg) *dns.Msg {
+		return answer(t, r, dns.RcodeSuccess, r.Question[0].Header().Name+" 60 IN A 192.0.2.1")
+	})
+}
+
+// startServer runs a UDP DNS server answering every query with reply and
+// returns its address.
+func startServer(t *testing.T, reply func(r *dns.Msg) *dns.Msg) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		PacketConn: pc,
+		Net:        "udp",
+		Handler: dns.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) {
+			r.Unpack()
+			m := reply(r)
+			m.Pack()
+			io.Copy(w, m)
+		}),
+	}
+	ready := make(chan struct{})
+	srv.NotifyStartedFunc = func(context.Context) { close(ready) }
+	go srv.ListenAndServe()
+	<-ready
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return pc.LocalAddr().String()
+}
+
+// closedAddr returns a local UDP address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	return addr
+}
+
+func TestUpstreamGroupFailover(t *testing.T) {
+	down, up := closedAddr(t), startTestServer(t)
+	g, err := NewUpstreamGroup([]string{down, up}, nil, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	for range 2 {
+		resp, err := g.Exchange(context.Background(), dns.NewMsg("example.com", dns.TypeA))
+		if err != nil {
+			t.Fatalf("Exchange: %v", err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Fatalf("answer = %v, want one record", resp.Answer)
+		}
+	}
+
+	status := g.Status()
+	if status[0].Healthy || status[0].Failures != 1 || status[0].LastError == "" {
+		t.Errorf("failing upstream status = %+v, want unhealthy after one failure and then skipped", status[0])
+	}
+	if !status[1].Healthy || status[1].Queries != 2 {
+		t.Errorf("working upstream status = %+v, want healthy with 2 queries", status[1])
+	}
+}
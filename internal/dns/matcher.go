@@ -1,19 +1,34 @@
 package dns
 
 import (
+	"maps"
 	"regexp"
+	"slices"
 	"strings"
 	"sync/atomic"
 
 	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
+// keywordRule is a keyword pattern bound to a routing target.
+type keywordRule struct {
+	keyword string
+	target  shunt.Target
+}
+
+// regexpRule is a compiled pattern bound to a routing target.
+type regexpRule struct {
+	re     *regexp.Regexp
+	target shunt.Target
+}
+
 // matcherRules holds an immutable snapshot of domain matching rules.
+// Each rule maps to the routing target of the shunt it came from.
 type matcherRules struct {
-	suffixes map[string]struct{}
-	exact    map[string]struct{}
-	keywords []string
-	regexps  []*regexp.Regexp
+	suffixes map[string]shunt.Target
+	exact    map[string]shunt.Target
+	keywords []keywordRule
+	regexps  []regexpRule
 }
 
 // Matcher tests domain names against a set of rules loaded from shunt entries.
@@ -27,8 +42,8 @@ type Matcher struct {
 func NewMatcher() *Matcher {
 	m := &Matcher{}
 	m.rules.Store(&matcherRules{
-		suffixes: make(map[string]struct{}),
-		exact:    make(map[string]struct{}),
+		suffixes: make(map[string]shunt.Target),
+		exact:    make(map[string]shunt.Target),
 	})
 	return m
 }
@@ -36,19 +51,40 @@ func NewMatcher() *Matcher {
 // Match reports whether domain matches any loaded rule.
 // The domain should be in lowercase without a trailing dot.
 func (m *Matcher) Match(domain string) bool {
+	_, ok := m.MatchTarget(domain)
+	return ok
+}
+
+// MatchTarget returns the routing target of the winning rule matching
+// domain. The strongest action wins: a direct exception beats block, which
+// beats proxy. Among rules with the same action the most specific one wins:
+// exact rules over suffixes, longer suffixes over shorter ones, then
+// keywords and regexps in load order.
+func (m *Matcher) MatchTarget(domain string) (shunt.Target, bool) {
 	r := m.rules.Load()
 
+	var best shunt.Target
+	found := false
+	// consider records a candidate in specificity order and reports whether
+	// the search can stop because nothing can outrank the current winner.
+	consider := func(target shunt.Target) bool {
+		if !found || target.Outranks(best) {
+			best, found = target, true
+		}
+		return best.Action == shunt.ActionDirect
+	}
+
 	// Exact match.
-	if _, ok := r.exact[domain]; ok {
-		return true
+	if target, ok := r.exact[domain]; ok && consider(target) {
+		return best, true
 	}
 
 	// Suffix match: walk up parent domains.
 	// For "a.b.example.com", check "a.b.example.com", "b.example.com", "example.com".
 	d := domain
 	for {
-		if _, ok := r.suffixes[d]; ok {
-			return true
+		if target, ok := r.suffixes[d]; ok && consider(target) {
+			return best, true
 		}
 		i := strings.IndexByte(d, '.')
 		if i < 0 {
@@ -59,40 +95,49 @@ func (m *Matcher) Match(domain string) bool {
 
 	// Keyword match.
 	for _, kw := range r.keywords {
-		if strings.Contains(domain, kw) {
-			return true
+		if strings.Contains(domain, kw.keyword) && consider(kw.target) {
+			return best, true
 		}
 	}
 
 	// Regexp match.
 	for _, re := range r.regexps {
-		if re.MatchString(domain) {
-			return true
+		if re.re.MatchString(domain) && consider(re.target) {
+			return best, true
 		}
 	}
 
-	return false
+	return best, found
 }
 
-// Update replaces all matching rules from the given entries.
-// Only domain-type entries are used; IP/CIDR entries are ignored.
+// Update replaces all matching rules from the given entries, binding them to
+// the default target. Only domain-type entries are used; IP/CIDR entries
+// are ignored.
 func (m *Matcher) Update(entries []shunt.Entry) {
+	m.UpdateTargets(map[shunt.Target][]shunt.Entry{{}: entries})
+}
+
+// UpdateTargets replaces all matching rules from entries grouped by routing
+// target.
+func (m *Matcher) UpdateTargets(byTarget map[shunt.Target][]shunt.Entry) {
 	r := &matcherRules{
-		suffixes: make(map[string]struct{}),
-		exact:    make(map[string]struct{}),
+		suffixes: make(map[string]shunt.Target),
+		exact:    make(map[string]shunt.Target),
 	}
 
-	for _, e := range entries {
-		switch e.Type() {
-		case shunt.EntryDomainSuffix:
-			r.suffixes[strings.ToLower(e.DomainValue())] = struct{}{}
-		case shunt.EntryDomainFull:
-			r.exact[strings.ToLower(e.DomainValue())] = struct{}{}
-		case shunt.EntryDomainKeyword:
-			r.keywords = append(r.keywords, strings.ToLower(e.DomainValue()))
-		case shunt.EntryDomainRegexp:
-			if re, err := regexp.Compile(e.DomainValue()); err == nil {
-				r.regexps = append(r.regexps, re)
+	for _, target := range slices.SortedFunc(maps.Keys(byTarget), shunt.CompareTargets) {
+		for _, e := range byTarget[target] {
+			switch e.Type() {
+			case shunt.EntryDomainSuffix:
+				r.suffixes[strings.ToLower(e.DomainValue())] = target
+			case shunt.EntryDomainFull:
+				r.exact[strings.ToLower(e.DomainValue())] = target
+			case shunt.EntryDomainKeyword:
+				r.keywords = append(r.keywords, keywordRule{keyword: strings.ToLower(e.DomainValue()), target: target})
+			case shunt.EntryDomainRegexp:
+				if re, err := regexp.Compile(e.DomainValue()); err == nil {
+					r.regexps = append(r.regexps, regexpRule{re: re, target: target})
+				}
 			}
 		}
 	}
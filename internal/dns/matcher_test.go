@@ -9,8 +9,8 @@ import (
 func TestMatcherSuffix(t *testing.T) {
 	m := NewMatcher()
 	m.Update([]shunt.Entry{
-		{Value: "example.com"},           // bare → suffix
-		{Value: "domain:google.com"},     // explicit suffix
+		{Value: "example.com"},       // bare → suffix
+		{Value: "domain:google.com"}, // explicit suffix
 	})
 
 	tests := []struct {
@@ -134,6 +134,95 @@ func TestMatcherUpdate(t *testing.T) {
 	}
 }
 
+func TestMatcherTargets(t *testing.T) {
+	m := NewMatcher()
+	proxy := shunt.Target{Port: 1081}
+	tv := shunt.Target{Clients: shunt.ClientKey([]string{"192.168.1.20"}, false)}
+	m.UpdateTargets(map[shunt.Target][]shunt.Entry{
+		{}:    {{Value: "example.com"}, {Value: "keyword:tube"}},
+		proxy: {{Value: "video.example.com"}, {Value: "full:exact.example.com"}},
+		tv:    {{Value: "tv.example.com"}},
+	})
+
+	tests := []struct {
+		domain string
+		target shunt.Target
+		ok     bool
+	}{
+		{"example.com", shunt.Target{}, true},
+		{"www.example.com", shunt.Target{}, true},
+		{"video.example.com", proxy, true},
+		{"cdn.video.example.com", proxy, true},
+		{"exact.example.com", proxy, true},
+		{"tv.example.com", tv, true},
+		{"youtube.com", shunt.Target{}, true},
+		{"other.com", shunt.Target{}, false},
+	}
+
+	for _, tt := range tests {
+		target, ok := m.MatchTarget(tt.domain)
+		if target != tt.target || ok != tt.ok {
+			t.Errorf("MatchTarget(%q) = (%+v, %v), want (%+v, %v)", tt.domain, target, ok, tt.target, tt.ok)
+		}
+	}
+}
+
+func TestMatcherPortQualifiers(t *testing.T) {
+	m := NewMatcher()
+	https := shunt.Target{Ports: "tcp:443"}
+	m.UpdateTargets(map[shunt.Target][]shunt.Entry{
+		{}:    {{Value: "example.com"}},
+		https: {{Value: "tcp:443@cdn.com"}, {Value: "tcp:443@full:api.example.com"}},
+	})
+
+	tests := []struct {
+		domain string
+		target shunt.Target
+	}{
+		{"www.cdn.com", https},
+		{"api.example.com", https},
+		{"www.example.com", shunt.Target{}},
+	}
+
+	for _, tt := range tests {
+		target, ok := m.MatchTarget(tt.domain)
+		if target != tt.target || !ok {
+			t.Errorf("MatchTarget(%q) = (%+v, %v), want %+v", tt.domain, target, ok, tt.target)
+		}
+	}
+}
+
+func TestMatcherActions(t *testing.T) {
+	m := NewMatcher()
+	direct := shunt.Target{Action: shunt.ActionDirect}
+	block := shunt.Target{Action: shunt.ActionBlock}
+	m.UpdateTargets(map[shunt.Target][]shunt.Entry{
+		{}:     {{Value: "example.com"}, {Value: "full:ads.example.com"}, {Value: "keyword:tube"}},
+		direct: {{Value: "bank.example.com"}, {Value: "regexp:^music\\."}},
+		block:  {{Value: "tracker.com"}, {Value: "keyword:ads"}},
+	})
+
+	tests := []struct {
+		domain string
+		target shunt.Target
+	}{
+		{"www.example.com", shunt.Target{}},
+		{"login.bank.example.com", direct},
+		// A less specific direct exception still wins over a proxy rule.
+		{"music.youtube.com", direct},
+		// Block wins over the more specific exact proxy rule.
+		{"ads.example.com", block},
+		{"tracker.com", block},
+	}
+
+	for _, tt := range tests {
+		target, ok := m.MatchTarget(tt.domain)
+		if target != tt.target || !ok {
+			t.Errorf("MatchTarget(%q) = (%+v, %v), want %+v", tt.domain, target, ok, tt.target)
+		}
+	}
+}
+
 func TestMatcherStats(t *testing.T) {
 	m := NewMatcher()
 	m.Update([]shunt.Entry{
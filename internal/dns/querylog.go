@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// QueryLogEntry is one client query as answered by the forwarder.
+type QueryLogEntry struct {
+	Time    time.Time     `json:"time"`
+	Client  string        `json:"client"`
+	Name    string        `json:"name"`
+	Type    string        `json:"type"`
+	Rcode   string        `json:"rcode"`
+	Latency time.Duration `json:"latency"`
+	// Shunt is the enabled shunt the name matched, empty if none; Action
+	// is its action for the name (proxy, direct or block).
+	Shunt  string `json:"shunt,omitempty"`
+	Action string `json:"action,omitempty"`
+	// IPs are the addresses of the answer added to the shunt's ipsets.
+	IPs []string `json:"ips,omitempty"`
+}
+
+// QueryLogFilter selects query log entries. Zero fields match everything.
+type QueryLogFilter struct {
+	Client  string // client address, exact
+	Domain  string // substring of the name
+	Matched bool   // only names that matched a shunt
+	Limit   int    // at most this many entries, newest first
+}
+
+func (f QueryLogFilter) match(e *QueryLogEntry) bool {
+	return (f.Client == "" || e.Client == f.Client) &&
+		(f.Domain == "" || strings.Contains(e.Name, f.Domain)) &&
+		(!f.Matched || e.Action != "")
+}
+
+// QueryLog is a bounded in-memory log of the queries the forwarder
+// answered; the oldest entries are dropped beyond its size.
+type QueryLog struct {
+	mu      sync.Mutex
+	entries []QueryLogEntry // ring buffer, next is the oldest once full
+	next    int
+	full    bool
+
+	shunts atomic.Pointer[[]namedMatcher]
+}
+
+// namedMatcher matches the domain entries of one shunt.
+type namedMatcher struct {
+	name    string
+	matcher *Matcher
+}
+
+// NewQueryLog creates a log of the latest size queries; 0 disables it.
+func NewQueryLog(size int) *QueryLog {
+	l := &QueryLog{}
+	l.Configure(size)
+	return l
+}
+
+// Configure resizes the log, keeping the newest entries; 0 disables it.
+func (l *QueryLog) Configure(size int) {
+	size = max(size, 0)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size == len(l.entries) {
+		return
+	}
+	kept := l.ordered()
+	if len(kept) > size {
+		kept = kept[len(kept)-size:]
+	}
+	l.entries = make([]QueryLogEntry, size)
+	copy(l.entries, kept)
+	l.next = len(kept)
+	l.full = len(kept) == size
+	if l.full {
+		l.next = 0
+	}
+}
+
+// SetShunts sets the shunts whose names are logged for matching queries.
+// Disabled shunts are ignored.
+func (l *QueryLog) SetShunts(shunts []shunt.Shunt) {
+	var named []namedMatcher
+	for _, sh := range shunts {
+		if !sh.Enabled {
+			continue
+		}
+		byTarget := make(map[shunt.Target][]shunt.Entry)
+		for _, e := range sh.Entries {
+			if e.IsDomain() {
+				t := sh.EntryTarget(e)
+				byTarget[t] = append(byTarget[t], e)
+			}
+		}
+		if len(byTarget) == 0 {
+			continue
+		}
+		m := NewMatcher()
+		m.UpdateTargets(byTarget)
+		named = append(named, namedMatcher{name: sh.Name, matcher: m})
+	}
+	l.shunts.Store(&named)
+}
+
+// shuntFor returns the name of the first shunt routing domain to target.
+func (l *QueryLog) shuntFor(domain string, target shunt.Target) string {
+	named := l.shunts.Load()
+	if named == nil {
+		return ""
+	}
+	for _, n := range *named {
+		if t, ok := n.matcher.MatchTarget(domain); ok && t == target {
+			return n.name
+		}
+	}
+	return ""
+}
+
+// Add appends an entry, dropping the oldest one if the log is full.
+func (l *QueryLog) Add(e QueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) == 0 {
+		return
+	}
+	l.entries[l.next] = e
+	l.next++
+	if l.next == len(l.entries) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Enabled reports whether the log keeps any entries.
+func (l *QueryLog) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries) > 0
+}
+
+// Entries returns the entries matching filter, newest first.
+func (l *QueryLog) Entries(filter QueryLogFilter) []QueryLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	all := l.ordered()
+	var out []QueryLogEntry
+	for i := len(all) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(out) == filter.Limit {
+			break
+		}
+		if filter.match(&all[i]) {
+			out = append(out, all[i])
+		}
+	}
+	return out
+}
+
+// Clients returns the distinct client addresses in the log.
+func (l *QueryLog) Clients() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]struct{})
+	for _, e := range l.ordered() {
+		seen[e.Client] = struct{}{}
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// ordered returns the entries oldest first. The caller holds l.mu.
+func (l *QueryLog) ordered() []QueryLogEntry {
+	if !l.full {
+		return l.entries[:l.next]
+	}
+	return append(l.entries[l.next:len(l.entries):len(l.entries)], l.entries[:l.next]...)
+}
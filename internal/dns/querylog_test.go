@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+func names(entries []QueryLogEntry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Name)
+	}
+	return out
+}
+
+func TestQueryLogDropsOldest(t *testing.T) {
+	l := NewQueryLog(3)
+	for i := range 5 {
+		l.Add(QueryLogEntry{Name: fmt.Sprintf("q%d.com", i)})
+	}
+	if got, want := names(l.Entries(QueryLogFilter{})), []string{"q4.com", "q3.com", "q2.com"}; !slices.Equal(got, want) {
+		t.Errorf("Entries = %v, want %v", got, want)
+	}
+
+	l.Configure(2)
+	if got, want := names(l.Entries(QueryLogFilter{})), []string{"q4.com", "q3.com"}; !slices.Equal(got, want) {
+		t.Errorf("after shrinking, Entries = %v, want %v", got, want)
+	}
+	l.Configure(4)
+	l.Add(QueryLogEntry{Name: "q5.com"})
+	if got, want := names(l.Entries(QueryLogFilter{})), []string{"q5.com", "q4.com", "q3.com"}; !slices.Equal(got, want) {
+		t.Errorf("after growing, Entries = %v, want %v", got, want)
+	}
+
+	l.Configure(0)
+	l.Add(QueryLogEntry{Name: "q6.com"})
+	if l.Enabled() || len(l.Entries(QueryLogFilter{})) != 0 {
+		t.Error("disabled log kept entries")
+	}
+}
+
+func TestQueryLogFilter(t *testing.T) {
+	l := NewQueryLog(10)
+	l.Add(QueryLogEntry{Client: "192.168.1.5", Name: "www.youtube.com", Action: shunt.ActionProxy})
+	l.Add(QueryLogEntry{Client: "192.168.1.5", Name: "example.com"})
+	l.Add(QueryLogEntry{Client: "192.168.1.6", Name: "youtube.com", Action: shunt.ActionProxy})
+	l.Add(QueryLogEntry{Client: "192.168.1.6", Name: "ads.example.com", Action: shunt.ActionBlock})
+
+	tests := []struct {
+		filter QueryLogFilter
+		want   []string
+	}{
+		{QueryLogFilter{Client: "192.168.1.5"}, []string{"example.com", "www.youtube.com"}},
+		{QueryLogFilter{Matched: true}, []string{"ads.example.com", "youtube.com", "www.youtube.com"}},
+		{QueryLogFilter{Domain: "example"}, []string{"ads.example.com", "example.com"}},
+		{QueryLogFilter{Client: "192.168.1.6", Domain: "youtube"}, []string{"youtube.com"}},
+		{QueryLogFilter{Limit: 1}, []string{"ads.example.com"}},
+	}
+	for _, tt := range tests {
+		if got := names(l.Entries(tt.filter)); !slices.Equal(got, tt.want) {
+			t.Errorf("Entries(%+v) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	if got, want := l.Clients(), []string{"192.168.1.5", "192.168.1.6"}; !slices.Equal(got, want) {
+		t.Errorf("Clients = %v, want %v", got, want)
+	}
+}
+
+func TestQueryLogShuntFor(t *testing.T) {
+	l := NewQueryLog(10)
+	l.SetShunts([]shunt.Shunt{
+		{Name: "video", Enabled: true, Entries: []shunt.Entry{{Value: "youtube.com"}}},
+		{Name: "off", Enabled: false, Entries: []shunt.Entry{{Value: "example.com"}}},
+		{Name: "ads", Enabled: true, Action: shunt.ActionBlock, Entries: []shunt.Entry{{Value: "ads.youtube.com"}}},
+	})
+
+	tests := []struct {
+		domain string
+		target shunt.Target
+		want   string
+	}{
+		{"www.youtube.com", shunt.Target{}, "video"},
+		{"ads.youtube.com", shunt.Target{Action: shunt.ActionBlock}, "ads"},
+		{"example.com", shunt.Target{}, ""},
+	}
+	for _, tt := range tests {
+		if got := l.shuntFor(tt.domain, tt.target); got != tt.want {
+			t.Errorf("shuntFor(%q) = %q, want %q", tt.domain, got, tt.want)
+		}
+	}
+}
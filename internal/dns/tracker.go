@@ -2,46 +2,158 @@ package dns
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"maps"
 	"net"
+	"os"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
+// targetSets holds the v4/v6 ipset pair of one routing target.
+type targetSets struct {
+	ipset4 netfilter.Set
+	ipset6 netfilter.Set
+}
+
 // Tracker maps domains to their resolved IPs and keeps the kernel ipsets in
 // sync. Reference counting ensures an IP is only removed from ipset when no
-// domain needs it. IPs are retained until the domain is explicitly removed or
-// the tracker is flushed — DNS TTL is intentionally ignored to prevent
-// long-lived connections from losing routing mid-session.
+// domain needs it. By default IPs are retained until the domain is explicitly
+// removed or the tracker is flushed — DNS TTL is ignored to prevent
+// long-lived connections from losing routing mid-session. With expiry on
+// (see SetExpiry), a domain's IP is dropped once its TTL plus a grace period
+// has passed without a new answer for it. With a state file (see
+// SetStateFile), the tracked IPs survive daemon restarts.
 //
-// IPv4 and IPv6 addresses are routed to separate ipset tables automatically.
+// Each domain belongs to one routing target (the zero Target is the default),
+// and its IPs go into that target's ipsets. IPv4 and IPv6 addresses are routed
+// to separate ipset tables automatically.
 type Tracker struct {
 	mu      sync.RWMutex
-	forward map[string][]string // domain → IPs (typically 1-4)
-	reverse map[string][]string // IP → domains (typically 1-2)
-	ipset4  *netfilter.IPSet
-	ipset6  *netfilter.IPSet
+	forward map[string][]string         // domain → IPs (typically 1-4)
+	reverse map[string][]string         // IP → domains (typically 1-2)
+	targets map[string]shunt.Target     // domain → target
+	sets    map[shunt.Target]targetSets // target → ipsets
 	logger  *slog.Logger
+
+	// expires holds when each expiring domain → IP association ends;
+	// associations without an entry never expire.
+	expires map[string]map[string]time.Time
+	expiry  bool
+	grace   time.Duration
+	now     func() time.Time
+
+	// path is the state file, empty if none; dirty is set when the tracked
+	// IPs changed since the last save.
+	path  string
+	dirty bool
 }
 
-// NewTracker creates a Tracker that manages the given ipset tables.
-func NewTracker(ipset4, ipset6 *netfilter.IPSet, logger *slog.Logger) *Tracker {
+// trackerSweepInterval is how often expired IPs are dropped and the state
+// file is saved.
+const trackerSweepInterval = time.Minute
+
+// NewTracker creates a Tracker that manages the given ipset tables for the
+// default target.
+func NewTracker(ipset4, ipset6 netfilter.Set, logger *slog.Logger) *Tracker {
 	return &Tracker{
 		forward: make(map[string][]string),
 		reverse: make(map[string][]string),
-		ipset4:  ipset4,
-		ipset6:  ipset6,
+		targets: make(map[string]shunt.Target),
+		sets:    map[shunt.Target]targetSets{{}: {ipset4: ipset4, ipset6: ipset6}},
 		logger:  logger,
+		expires: make(map[string]map[string]time.Time),
+		now:     time.Now,
 	}
 }
 
-// Track records an IP for a domain. The IP is added to the appropriate kernel
-// ipset (v4 or v6) and retained until the domain is removed or the tracker is
-// flushed.
+// SetExpiry switches TTL-based expiry on or off. With expiry on, IPs
+// tracked with a TTL expire grace after it; switching it off keeps every IP
+// until its domain is removed.
+func (t *Tracker) SetExpiry(on bool, grace time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expiry = on
+	t.grace = max(grace, 0)
+	if !on {
+		clear(t.expires)
+	}
+}
+
+// SetTarget registers the ipset tables for a routing target. ipset6 may be
+// nil when IPv6 is disabled.
+func (t *Tracker) SetTarget(target shunt.Target, ipset4, ipset6 netfilter.Set) {
+	t.mu.Lock()
+	t.sets[target] = targetSets{ipset4: ipset4, ipset6: ipset6}
+	t.mu.Unlock()
+}
+
+// RemoveTarget unregisters a non-default routing target. Domains still
+// tracked for it should be removed first.
+func (t *Tracker) RemoveTarget(target shunt.Target) {
+	if target.IsDefault() {
+		return
+	}
+	t.mu.Lock()
+	delete(t.sets, target)
+	t.mu.Unlock()
+}
+
+// Track records an IP for a domain of the default target.
 func (t *Tracker) Track(ctx context.Context, domain, ip string) {
+	t.TrackTarget(ctx, shunt.Target{}, domain, ip, 0)
+}
+
+// TrackTarget records an IP for a domain routed to the given target. The IP
+// is added to the target's ipset (v4 or v6) and retained until the domain is
+// removed or the tracker is flushed, or with expiry on until ttl plus the
+// grace period has passed without the IP being tracked again; a zero ttl
+// never expires. A domain that moves to a different target drops its
+// previous IPs first.
+func (t *Tracker) TrackTarget(ctx context.Context, target shunt.Target, domain, ip string, ttl time.Duration) {
+	t.track(ctx, target, domain, ip, ttl, time.Time{})
+}
+
+// AnswerIP is an address of a DNS answer with the TTL of its record.
+type AnswerIP struct {
+	IP  string
+	TTL time.Duration
+}
+
+// TrackAll records the IPs of one answer for a domain like TrackTarget,
+// adding them to the ipsets in one transaction per ipset.
+func (t *Tracker) TrackAll(ctx context.Context, target shunt.Target, domain string, ips []AnswerIP) {
+	adds := make(map[netfilter.Set][]string)
+	for _, ip := range ips {
+		set := t.record(ctx, target, domain, ip.IP, ip.TTL, time.Time{})
+		adds[set] = append(adds[set], ip.IP)
+	}
+	t.addAll(ctx, adds)
+}
+
+// track records an IP like TrackTarget, expiring at until if it is set.
+func (t *Tracker) track(ctx context.Context, target shunt.Target, domain, ip string, ttl time.Duration, until time.Time) {
+	ipset := t.record(ctx, target, domain, ip, ttl, until)
+	if err := ipset.Add(ctx, ip); err != nil {
+		t.logger.Warn("tracker: ipset add failed", "ip", ip, "error", err)
+	}
+}
+
+// record records an IP like track and returns the ipset it belongs in,
+// leaving the add to the caller.
+func (t *Tracker) record(ctx context.Context, target shunt.Target, domain, ip string, ttl time.Duration, until time.Time) netfilter.Set {
+	if prev, ok := t.targetOf(domain); ok && prev != target {
+		t.RemoveDomain(ctx, domain)
+	}
+
 	t.mu.Lock()
+	t.targets[domain] = target
 	ips := t.forward[domain]
 	if !slices.Contains(ips, ip) {
 		t.forward[domain] = append(ips, ip)
@@ -50,53 +162,204 @@ func (t *Tracker) Track(ctx context.Context, domain, ip string) {
 			t.reverse[ip] = append(refs, domain)
 		}
 	}
-	t.mu.Unlock()
-
-	if err := t.ipsetFor(ip).Add(ctx, ip); err != nil {
-		t.logger.Warn("tracker: ipset add failed", "ip", ip, "error", err)
+	if until.IsZero() && ttl > 0 {
+		until = t.now().Add(ttl + t.grace)
 	}
+	t.setExpiry(domain, ip, until)
+	t.dirty = true
+	ipset := t.ipsetFor(target, ip)
+	t.mu.Unlock()
+	return ipset
 }
 
 // RemoveDomain removes all IPs associated with a domain. IPs that are no
-// longer referenced by any domain are removed from ipset.
+// longer referenced by any domain of the same target are removed from that
+// target's ipset.
 func (t *Tracker) RemoveDomain(ctx context.Context, domain string) {
 	t.mu.Lock()
 	ips := t.forward[domain]
+	target := t.targets[domain]
 	delete(t.forward, domain)
+	delete(t.targets, domain)
+	delete(t.expires, domain)
+	t.dirty = true
 
-	var toRemove []string
+	var dels []ipsetDel
 	for _, ip := range ips {
-		refs := t.reverse[ip]
-		refs = slices.DeleteFunc(refs, func(d string) bool { return d == domain })
-		if len(refs) == 0 {
-			delete(t.reverse, ip)
-			toRemove = append(toRemove, ip)
-		} else {
-			t.reverse[ip] = refs
+		if set, ok := t.unref(domain, target, ip); ok {
+			dels = append(dels, ipsetDel{set: set, ip: ip})
 		}
 	}
 	t.mu.Unlock()
 
-	for _, ip := range toRemove {
-		if err := t.ipsetFor(ip).Del(ctx, ip); err != nil {
+	t.del(ctx, dels)
+}
+
+// Sweep drops the IPs whose expiry has passed, removing them from the
+// ipsets once no domain of the same target needs them.
+func (t *Tracker) Sweep(ctx context.Context) {
+	t.mu.Lock()
+	now := t.now()
+	var dels []ipsetDel
+	expired := 0
+	for domain, byIP := range t.expires {
+		for ip, at := range byIP {
+			if now.Before(at) {
+				continue
+			}
+			delete(byIP, ip)
+			expired++
+			if set, ok := t.forget(domain, ip); ok {
+				dels = append(dels, ipsetDel{set: set, ip: ip})
+			}
+		}
+		if len(byIP) == 0 {
+			delete(t.expires, domain)
+		}
+	}
+	if expired > 0 {
+		t.dirty = true
+	}
+	t.mu.Unlock()
+
+	if expired > 0 {
+		t.logger.Debug("tracker: expired ips", "associations", expired, "removed", len(dels))
+	}
+	t.del(ctx, dels)
+}
+
+// Untrack drops ip from the IPs of domain, removing it from the ipset once
+// no domain of the same target needs it.
+func (t *Tracker) Untrack(ctx context.Context, domain, ip string) {
+	t.mu.Lock()
+	if !slices.Contains(t.forward[domain], ip) {
+		t.mu.Unlock()
+		return
+	}
+	if byIP, ok := t.expires[domain]; ok {
+		delete(byIP, ip)
+		if len(byIP) == 0 {
+			delete(t.expires, domain)
+		}
+	}
+	t.dirty = true
+	var dels []ipsetDel
+	if set, ok := t.forget(domain, ip); ok {
+		dels = append(dels, ipsetDel{set: set, ip: ip})
+	}
+	t.mu.Unlock()
+
+	t.del(ctx, dels)
+}
+
+// Run sweeps expired IPs and saves the state file every minute until ctx
+// is done.
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(trackerSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Sweep(ctx)
+			t.Save()
+		}
+	}
+}
+
+// ipsetDel is an IP to delete from an ipset.
+type ipsetDel struct {
+	set netfilter.Set
+	ip  string
+}
+
+// forget drops ip from the IPs of domain and returns the ipset ip must be
+// deleted from, see unref. Caller must hold t.mu.
+func (t *Tracker) forget(domain, ip string) (netfilter.Set, bool) {
+	target := t.targets[domain]
+	ips := slices.DeleteFunc(t.forward[domain], func(i string) bool { return i == ip })
+	if len(ips) == 0 {
+		delete(t.forward, domain)
+		delete(t.targets, domain)
+	} else {
+		t.forward[domain] = ips
+	}
+	return t.unref(domain, target, ip)
+}
+
+// unref drops domain from the domains of ip and returns the ipset ip must
+// be deleted from if no other domain of target needs it. Caller must hold
+// t.mu, with domain already removed from t.targets if it is gone.
+func (t *Tracker) unref(domain string, target shunt.Target, ip string) (netfilter.Set, bool) {
+	refs := slices.DeleteFunc(t.reverse[ip], func(d string) bool { return d == domain })
+	if len(refs) == 0 {
+		delete(t.reverse, ip)
+	} else {
+		t.reverse[ip] = refs
+	}
+	if slices.ContainsFunc(refs, func(d string) bool { return t.targets[d] == target }) {
+		return nil, false
+	}
+	return t.ipsetFor(target, ip), true
+}
+
+// del deletes IPs from their ipsets, one transaction per ipset.
+func (t *Tracker) del(ctx context.Context, dels []ipsetDel) {
+	ips := make(map[netfilter.Set][]string)
+	for _, d := range dels {
+		ips[d.set] = append(ips[d.set], d.ip)
+	}
+	for set, entries := range ips {
+		for ip, err := range set.DelAll(ctx, entries) {
 			t.logger.Warn("tracker: ipset del failed", "ip", ip, "error", err)
 		}
 	}
 }
 
-// Flush clears all tracked state and flushes both ipsets.
+// setExpiry records when the association of domain and ip ends, never for
+// a zero at. A later expiry already recorded is kept. Caller must hold t.mu.
+func (t *Tracker) setExpiry(domain, ip string, at time.Time) {
+	if !t.expiry {
+		return
+	}
+	byIP := t.expires[domain]
+	if at.IsZero() {
+		delete(byIP, ip)
+		return
+	}
+	if prev, ok := byIP[ip]; ok && prev.After(at) {
+		return
+	}
+	if byIP == nil {
+		byIP = make(map[string]time.Time)
+		t.expires[domain] = byIP
+	}
+	byIP[ip] = at
+}
+
+// Flush clears all tracked state and flushes the ipsets of every target.
 func (t *Tracker) Flush(ctx context.Context) {
 	t.mu.Lock()
 	t.forward = make(map[string][]string)
 	t.reverse = make(map[string][]string)
+	t.targets = make(map[string]shunt.Target)
+	t.expires = make(map[string]map[string]time.Time)
+	t.dirty = true
+	sets := make([]targetSets, 0, len(t.sets))
+	for _, s := range t.sets {
+		sets = append(sets, s)
+	}
 	t.mu.Unlock()
 
-	if err := t.ipset4.Flush(ctx); err != nil {
-		t.logger.Warn("tracker: ipset4 flush failed", "error", err)
-	}
-	if t.ipset6 != nil {
-		if err := t.ipset6.Flush(ctx); err != nil {
-			t.logger.Warn("tracker: ipset6 flush failed", "error", err)
+	for _, s := range sets {
+		if err := s.ipset4.Flush(ctx); err != nil {
+			t.logger.Warn("tracker: ipset4 flush failed", "ipset", s.ipset4.Name(), "error", err)
+		}
+		if s.ipset6 != nil {
+			if err := s.ipset6.Flush(ctx); err != nil {
+				t.logger.Warn("tracker: ipset6 flush failed", "ipset", s.ipset6.Name(), "error", err)
+			}
 		}
 	}
 }
@@ -108,12 +371,209 @@ func (t *Tracker) Count() (domains int, ips int) {
 	return len(t.forward), len(t.reverse)
 }
 
-// ipsetFor returns the appropriate ipset for the given IP address.
-func (t *Tracker) ipsetFor(ip string) *netfilter.IPSet {
-	if isIPv6(ip) && t.ipset6 != nil {
-		return t.ipset6
+// trackedDomain is the on-disk form of the IPs of one domain.
+type trackedDomain struct {
+	Domain string      `json:"domain"`
+	IPs    []trackedIP `json:"ips"`
+}
+
+type trackedIP struct {
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// SetStateFile sets the file Save writes the tracked IPs to and Restore
+// reads them from.
+func (t *Tracker) SetStateFile(path string) {
+	t.mu.Lock()
+	t.path = path
+	t.mu.Unlock()
+}
+
+// Save writes the tracked IPs to the state file if they changed since the
+// last save.
+func (t *Tracker) Save() {
+	t.mu.Lock()
+	path := t.path
+	if path == "" || !t.dirty {
+		t.mu.Unlock()
+		return
+	}
+	t.dirty = false
+	snapshot := t.snapshot()
+	t.mu.Unlock()
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		t.logger.Warn("tracker: failed to save state", "file", path, "error", err)
+		t.mu.Lock()
+		t.dirty = true
+		t.mu.Unlock()
+	}
+}
+
+// Restore tracks the IPs saved in the state file again, under the target
+// match returns for their domain now. Domains that no longer match, or are
+// blocked, are dropped, as are IPs that have expired. It returns the number
+// of domains restored.
+func (t *Tracker) Restore(ctx context.Context, match func(domain string) (shunt.Target, bool)) (int, error) {
+	t.mu.RLock()
+	path := t.path
+	t.mu.RUnlock()
+	if path == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var snapshot []trackedDomain
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return t.retrack(ctx, snapshot, match), nil
+}
+
+// Refresh tracks the IPs tracked so far again, under the target match
+// returns for their domain now, dropping them like Restore does, and then
+// deletes from the ipsets the IPs no domain needs anymore. The ipsets are
+// never emptied, so matched traffic keeps its route throughout. The full
+// reconcile refreshes instead of flushing. It returns the number of domains
+// tracked again.
+func (t *Tracker) Refresh(ctx context.Context, match func(domain string) (shunt.Target, bool)) int {
+	t.mu.Lock()
+	snapshot := t.snapshot()
+	var prev []ipsetDel
+	for ip, domains := range t.reverse {
+		var sets []netfilter.Set
+		for _, domain := range domains {
+			if set := t.ipsetFor(t.targets[domain], ip); !slices.Contains(sets, set) {
+				sets = append(sets, set)
+				prev = append(prev, ipsetDel{set: set, ip: ip})
+			}
+		}
+	}
+	t.forward = make(map[string][]string)
+	t.reverse = make(map[string][]string)
+	t.targets = make(map[string]shunt.Target)
+	t.expires = make(map[string]map[string]time.Time)
+	t.dirty = true
+	t.mu.Unlock()
+
+	n := t.retrack(ctx, snapshot, match)
+
+	var dels []ipsetDel
+	for _, d := range prev {
+		if !t.Tracks(d.set, d.ip) {
+			dels = append(dels, d)
+		}
+	}
+	t.del(ctx, dels)
+	return n
+}
+
+// Tracks reports whether ip is tracked for a domain whose target puts it in
+// set.
+func (t *Tracker) Tracks(set netfilter.Set, ip string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, domain := range t.reverse[ip] {
+		if t.ipsetFor(t.targets[domain], ip) == set {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns the tracked IPs by domain. Caller must hold t.mu.
+func (t *Tracker) snapshot() []trackedDomain {
+	snapshot := make([]trackedDomain, 0, len(t.forward))
+	for _, domain := range slices.Sorted(maps.Keys(t.forward)) {
+		d := trackedDomain{Domain: domain}
+		for _, ip := range t.forward[domain] {
+			d.IPs = append(d.IPs, trackedIP{IP: ip, Expires: t.expires[domain][ip]})
+		}
+		snapshot = append(snapshot, d)
+	}
+	return snapshot
+}
+
+// retrack tracks the IPs of snapshot for the domains match still matches,
+// adding them to the ipsets in one transaction per ipset. It returns the
+// number of domains tracked.
+func (t *Tracker) retrack(ctx context.Context, snapshot []trackedDomain, match func(domain string) (shunt.Target, bool)) int {
+	now := t.now()
+	restored := 0
+	adds := make(map[netfilter.Set][]string)
+	for _, d := range snapshot {
+		target, ok := match(d.Domain)
+		if !ok || target.Action == shunt.ActionBlock {
+			continue
+		}
+		n := 0
+		for _, ip := range d.IPs {
+			if net.ParseIP(ip.IP) == nil || (!ip.Expires.IsZero() && !now.Before(ip.Expires)) {
+				continue
+			}
+			if isIPv6(ip.IP) && !t.hasIPv6(target) {
+				continue
+			}
+			set := t.record(ctx, target, d.Domain, ip.IP, 0, ip.Expires)
+			adds[set] = append(adds[set], ip.IP)
+			n++
+		}
+		if n > 0 {
+			restored++
+		}
+	}
+	t.addAll(ctx, adds)
+	return restored
+}
+
+// addAll adds IPs to their ipsets, one transaction per ipset.
+func (t *Tracker) addAll(ctx context.Context, adds map[netfilter.Set][]string) {
+	for set, entries := range adds {
+		for ip, err := range set.AddAll(ctx, entries) {
+			t.logger.Warn("tracker: ipset add failed", "ip", ip, "error", err)
+		}
+	}
+}
+
+// hasIPv6 reports whether target has an IPv6 ipset.
+func (t *Tracker) hasIPv6(target shunt.Target) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s, ok := t.sets[target]
+	if !ok {
+		s = t.sets[shunt.Target{}]
+	}
+	return s.ipset6 != nil
+}
+
+func (t *Tracker) targetOf(domain string) (shunt.Target, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	target, ok := t.targets[domain]
+	return target, ok
+}
+
+// ipsetFor returns the ipset of the given target for an IP address. Unknown
+// targets fall back to the default target. Caller must hold t.mu.
+func (t *Tracker) ipsetFor(target shunt.Target, ip string) netfilter.Set {
+	s, ok := t.sets[target]
+	if !ok {
+		s = t.sets[shunt.Target{}]
+	}
+	if isIPv6(ip) && s.ipset6 != nil {
+		return s.ipset6
 	}
-	return t.ipset4
+	return s.ipset4
 }
 
 // isIPv6 reports whether the given IP string is an IPv6 address.
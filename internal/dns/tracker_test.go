@@ -2,10 +2,17 @@ package dns
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
 // newTestTracker returns a tracker with dummy ipset names.
@@ -17,6 +24,78 @@ func newTestTracker() *Tracker {
 	return NewTracker(ipset4, ipset6, slog.Default())
 }
 
+// fakeSet is an in-memory netfilter.Set. Like the kernel sets it fails to
+// delete an entry it doesn't hold.
+type fakeSet struct {
+	name string
+
+	mu      sync.Mutex
+	entries map[string]bool
+	dels    []string // entries deleted
+	failed  []string // entries whose delete failed
+	flushes int
+}
+
+func newFakeSet(name string) *fakeSet {
+	return &fakeSet{name: name, entries: make(map[string]bool)}
+}
+
+func (s *fakeSet) Name() string                      { return s.name }
+func (s *fakeSet) EnsureTable(context.Context) error { return nil }
+func (s *fakeSet) Destroy(context.Context) error     { return nil }
+
+func (s *fakeSet) Flush(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.entries)
+	s.flushes++
+	return nil
+}
+
+func (s *fakeSet) Add(ctx context.Context, entry string) error {
+	return s.AddAll(ctx, []string{entry})[entry]
+}
+
+func (s *fakeSet) Del(ctx context.Context, entry string) error {
+	return s.DelAll(ctx, []string{entry})[entry]
+}
+
+func (s *fakeSet) AddAll(_ context.Context, entries []string) map[string]error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.entries[e] = true
+	}
+	return nil
+}
+
+func (s *fakeSet) DelAll(_ context.Context, entries []string) map[string]error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed := make(map[string]error)
+	for _, e := range entries {
+		s.dels = append(s.dels, e)
+		if !s.entries[e] {
+			s.failed = append(s.failed, e)
+			failed[e] = fmt.Errorf("%s: no element %s", s.name, e)
+			continue
+		}
+		delete(s.entries, e)
+	}
+	return failed
+}
+
+func (s *fakeSet) List(context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Sorted(maps.Keys(s.entries)), nil
+}
+
+func (s *fakeSet) Count(ctx context.Context) (int, error) {
+	entries, err := s.List(ctx)
+	return len(entries), err
+}
+
 func TestTrackerTrackAndCount(t *testing.T) {
 	tr := newTestTracker()
 	ctx := context.Background()
@@ -155,6 +234,240 @@ func TestTrackerNilIPv6(t *testing.T) {
 	}
 }
 
+func TestTrackerTargets(t *testing.T) {
+	tr := newTestTracker()
+	proxy := shunt.Target{Port: 1081}
+	tr.SetTarget(proxy, netfilter.NewIPSet("test_tracker_1081"), netfilter.NewIPSet6("test_tracker6_1081"))
+	ctx := context.Background()
+
+	tr.Track(ctx, "a.com", "1.2.3.4")
+	tr.TrackTarget(ctx, proxy, "b.com", "1.2.3.4", 0) // same IP, different target
+
+	if got := tr.ipsetFor(proxy, "1.2.3.4").Name(); got != "test_tracker_1081" {
+		t.Errorf("ipsetFor(1081) = %q, want test_tracker_1081", got)
+	}
+	if got := tr.ipsetFor(shunt.Target{Port: 9999}, "1.2.3.4").Name(); got != "test_tracker" {
+		t.Errorf("unknown target should fall back to default, got %q", got)
+	}
+
+	domains, ips := tr.Count()
+	if domains != 2 || ips != 1 {
+		t.Errorf("domains=%d, ips=%d, want 2,1", domains, ips)
+	}
+
+	// Re-targeting a domain drops its previous association.
+	tr.TrackTarget(ctx, shunt.Target{}, "b.com", "5.6.7.8", 0)
+	if target, _ := tr.targetOf("b.com"); !target.IsDefault() {
+		t.Errorf("b.com target = %+v, want default", target)
+	}
+	domains, ips = tr.Count()
+	if domains != 2 || ips != 2 {
+		t.Errorf("after retarget: domains=%d, ips=%d, want 2,2", domains, ips)
+	}
+}
+
+func TestTrackerTrackAll(t *testing.T) {
+	tr := newTestTracker()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time { return now }
+	tr.SetExpiry(true, 0)
+	ctx := context.Background()
+
+	tr.TrackAll(ctx, shunt.Target{}, "a.com", []AnswerIP{
+		{IP: "1.2.3.4", TTL: time.Minute},
+		{IP: "2001:db8::1", TTL: time.Hour},
+		{IP: "1.2.3.4", TTL: time.Minute}, // duplicate record
+	})
+	if ips := tr.forward["a.com"]; !slices.Equal(ips, []string{"1.2.3.4", "2001:db8::1"}) {
+		t.Errorf("a.com IPs = %v, want [1.2.3.4 2001:db8::1]", ips)
+	}
+	if got, want := tr.expires["a.com"]["2001:db8::1"], now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("2001:db8::1 expires at %v, want %v", got, want)
+	}
+}
+
+func TestTrackerExpiry(t *testing.T) {
+	tr := newTestTracker()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time { return now }
+	tr.SetExpiry(true, time.Minute)
+	ctx := context.Background()
+
+	tr.TrackTarget(ctx, shunt.Target{}, "a.com", "1.2.3.4", 5*time.Minute)
+	tr.TrackTarget(ctx, shunt.Target{}, "a.com", "1.2.3.5", time.Minute)
+	tr.TrackTarget(ctx, shunt.Target{}, "b.com", "1.2.3.4", time.Minute) // shared IP
+	tr.TrackTarget(ctx, shunt.Target{}, "c.com", "1.2.3.6", 0)           // never expires
+
+	// Past TTL plus grace of the short associations: a.com keeps 1.2.3.4,
+	// which stays referenced, b.com is gone.
+	now = now.Add(3 * time.Minute)
+	tr.Sweep(ctx)
+	if domains, ips := tr.Count(); domains != 2 || ips != 2 {
+		t.Errorf("after first sweep: domains=%d, ips=%d, want 2,2", domains, ips)
+	}
+	if refs := tr.reverse["1.2.3.4"]; len(refs) != 1 || refs[0] != "a.com" {
+		t.Errorf("1.2.3.4 referenced by %v, want [a.com]", refs)
+	}
+
+	// A new answer refreshes the expiry.
+	tr.TrackTarget(ctx, shunt.Target{}, "a.com", "1.2.3.4", 5*time.Minute)
+	now = now.Add(4 * time.Minute)
+	tr.Sweep(ctx)
+	if domains, ips := tr.Count(); domains != 2 || ips != 2 {
+		t.Errorf("after refresh: domains=%d, ips=%d, want 2,2", domains, ips)
+	}
+
+	now = now.Add(3 * time.Minute)
+	tr.Sweep(ctx)
+	if domains, ips := tr.Count(); domains != 1 || ips != 1 {
+		t.Errorf("after expiry: domains=%d, ips=%d, want 1,1 (c.com)", domains, ips)
+	}
+
+	// Without expiry nothing is dropped.
+	tr.SetExpiry(false, 0)
+	tr.TrackTarget(ctx, shunt.Target{}, "d.com", "1.2.3.7", time.Second)
+	now = now.Add(time.Hour)
+	tr.Sweep(ctx)
+	if domains, _ := tr.Count(); domains != 2 {
+		t.Errorf("with expiry off: domains=%d, want 2", domains)
+	}
+}
+
+func TestTrackerSaveRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracker.json")
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	tr := newTestTracker()
+	tr.now = func() time.Time { return now }
+	tr.SetStateFile(path)
+	tr.SetExpiry(true, 0)
+	tr.Track(ctx, "a.com", "1.2.3.4")
+	tr.Track(ctx, "a.com", "2001:db8::1")
+	tr.TrackTarget(ctx, shunt.Target{}, "b.com", "1.2.3.5", time.Minute)
+	tr.TrackTarget(ctx, shunt.Target{}, "c.com", "1.2.3.6", time.Hour)
+	tr.Track(ctx, "gone.com", "1.2.3.7")
+	tr.Save()
+
+	restored := newTestTracker()
+	restored.now = func() time.Time { return now.Add(10 * time.Minute) }
+	restored.SetStateFile(path)
+	restored.SetExpiry(true, 0)
+	m := NewMatcher()
+	m.Update([]shunt.Entry{{Value: "a.com"}, {Value: "b.com"}, {Value: "c.com"}})
+	n, err := restored.Restore(ctx, m.MatchTarget)
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	// gone.com no longer matches and b.com has expired.
+	if n != 2 {
+		t.Errorf("restored %d domains, want 2", n)
+	}
+	if ips := restored.forward["a.com"]; !slices.Equal(ips, []string{"1.2.3.4", "2001:db8::1"}) {
+		t.Errorf("a.com IPs = %v, want both", ips)
+	}
+	if _, ok := restored.forward["gone.com"]; ok {
+		t.Error("gone.com was restored")
+	}
+	if got, want := restored.expires["c.com"]["1.2.3.6"], now.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("c.com expires at %v, want %v", got, want)
+	}
+
+	// A missing state file restores nothing.
+	empty := newTestTracker()
+	empty.SetStateFile(filepath.Join(t.TempDir(), "none.json"))
+	if n, err := empty.Restore(ctx, m.MatchTarget); n != 0 || err != nil {
+		t.Errorf("Restore without a file = %d, %v", n, err)
+	}
+}
+
+func TestTrackerRefresh(t *testing.T) {
+	ctx := context.Background()
+	proxy := shunt.Target{Port: 1081}
+	set4, proxy4 := newFakeSet("test_tracker"), newFakeSet("test_tracker_1081")
+	tr := NewTracker(set4, newFakeSet("test_tracker6"), slog.Default())
+	tr.SetTarget(proxy, proxy4, newFakeSet("test_tracker6_1081"))
+	tr.Track(ctx, "a.com", "1.2.3.4")
+	tr.Track(ctx, "moved.com", "1.2.3.5")
+	tr.Track(ctx, "gone.com", "1.2.3.6")
+	tr.Track(ctx, "gone.com", "1.2.3.4") // shared with a.com
+
+	m := NewMatcher()
+	m.UpdateTargets(map[shunt.Target][]shunt.Entry{
+		{}:    {{Value: "a.com"}},
+		proxy: {{Value: "moved.com"}},
+	})
+	if n := tr.Refresh(ctx, m.MatchTarget); n != 2 {
+		t.Errorf("refreshed %d domains, want 2", n)
+	}
+	if ips := tr.forward["a.com"]; !slices.Equal(ips, []string{"1.2.3.4"}) {
+		t.Errorf("a.com IPs = %v, want [1.2.3.4]", ips)
+	}
+	if target := tr.targets["moved.com"]; target != proxy {
+		t.Errorf("moved.com target = %+v, want %+v", target, proxy)
+	}
+	if _, ok := tr.forward["gone.com"]; ok {
+		t.Error("gone.com is still tracked")
+	}
+
+	// The ipsets are never flushed: only the IPs that are gone from them
+	// are deleted.
+	if set4.flushes+proxy4.flushes != 0 {
+		t.Errorf("ipsets flushed %d times", set4.flushes+proxy4.flushes)
+	}
+	if entries, _ := set4.List(ctx); !slices.Equal(entries, []string{"1.2.3.4"}) {
+		t.Errorf("default ipset = %v, want [1.2.3.4]", entries)
+	}
+	if entries, _ := proxy4.List(ctx); !slices.Equal(entries, []string{"1.2.3.5"}) {
+		t.Errorf("proxy ipset = %v, want [1.2.3.5]", entries)
+	}
+	if dels := slices.Sorted(slices.Values(set4.dels)); !slices.Equal(dels, []string{"1.2.3.5", "1.2.3.6"}) {
+		t.Errorf("deleted %v from the default ipset, want [1.2.3.5 1.2.3.6]", dels)
+	}
+}
+
+func TestTrackerRemovesFromSet(t *testing.T) {
+	ctx := context.Background()
+	set4, set6 := newFakeSet("test_tracker"), newFakeSet("test_tracker6")
+	tr := NewTracker(set4, set6, slog.Default())
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tr.now = func() time.Time { return now }
+	tr.SetExpiry(true, time.Minute)
+
+	tr.TrackAll(ctx, shunt.Target{}, "a.com", []AnswerIP{
+		{IP: "1.2.3.4", TTL: time.Minute},
+		{IP: "1.2.3.5", TTL: time.Minute},
+		{IP: "2001:db8::1", TTL: time.Minute},
+	})
+	tr.TrackTarget(ctx, shunt.Target{}, "b.com", "1.2.3.5", 0) // shared, never expires
+	tr.Track(ctx, "c.com", "1.2.3.6")
+	tr.Track(ctx, "d.com", "1.2.3.7")
+
+	// Expired: 1.2.3.5 stays for b.com.
+	now = now.Add(3 * time.Minute)
+	tr.Sweep(ctx)
+	if entries, _ := set4.List(ctx); !slices.Equal(entries, []string{"1.2.3.5", "1.2.3.6", "1.2.3.7"}) {
+		t.Errorf("after sweep: ipset = %v", entries)
+	}
+	if entries, _ := set6.List(ctx); len(entries) != 0 {
+		t.Errorf("after sweep: ipset6 = %v, want empty", entries)
+	}
+
+	tr.Untrack(ctx, "c.com", "1.2.3.6")
+	tr.RemoveDomain(ctx, "b.com")
+	tr.RemoveDomain(ctx, "d.com")
+	if entries, _ := set4.List(ctx); len(entries) != 0 {
+		t.Errorf("after removal: ipset = %v, want empty", entries)
+	}
+	if want := []string{"1.2.3.4", "1.2.3.6", "1.2.3.5", "1.2.3.7"}; !slices.Equal(set4.dels, want) {
+		t.Errorf("deleted %v, want %v", set4.dels, want)
+	}
+	if len(set4.failed)+len(set6.failed) != 0 {
+		t.Errorf("deletes of missing entries: %v %v", set4.failed, set6.failed)
+	}
+}
+
 func TestIsIPv6(t *testing.T) {
 	tests := []struct {
 		ip   string
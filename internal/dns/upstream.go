@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// upstreamRules is an immutable snapshot of the split upstream settings:
+// domains of proxied shunts are resolved with their shunt's upstream, else
+// with matched, so CDNs answer with addresses near the proxy exit.
+type upstreamRules struct {
+	matched *UpstreamGroup // nil uses the default upstream
+	shunts  []shuntUpstream
+	// groups holds every group above by address, for reuse while the
+	// bootstrap stays the same.
+	groups    map[string]*UpstreamGroup
+	bootstrap *Bootstrap
+}
+
+// shuntUpstream is the upstream of the domains of some proxied shunts.
+type shuntUpstream struct {
+	upstream *UpstreamGroup
+	matcher  *Matcher
+}
+
+// SetUpstream sets the upstreams queries are forwarded to, healthiest first
+// (see UpstreamGroup), and the bootstrap servers resolving their host
+// names. Unchanged settings keep the current upstreams and their
+// connections.
+func (f *Forwarder) SetUpstream(addrs, bootstrap []string) error {
+	f.upstreamMu.Lock()
+	defer f.upstreamMu.Unlock()
+
+	key := strings.Join(addrs, ",") + "|" + strings.Join(bootstrap, ",")
+	if key == f.upstreamKey && f.upstream.Load() != nil {
+		return nil
+	}
+	b := NewBootstrap(bootstrap)
+	g, err := NewUpstreamGroup(addrs, b, f.logger)
+	if err != nil {
+		return err
+	}
+	f.upstreamKey = key
+	f.bootstrap = b
+	if old := f.upstream.Swap(g); old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// SetMatchedUpstreams sets the upstream of queries for proxied domains: the
+// domains in byUpstream go to their upstream, the others to matched. An
+// empty matched leaves them on the default upstream. Upstreams that stay
+// in use keep their connections.
+func (f *Forwarder) SetMatchedUpstreams(matched string, byUpstream map[string][]shunt.Entry) error {
+	f.upstreamMu.Lock()
+	defer f.upstreamMu.Unlock()
+
+	prev := f.upstreams.Load()
+	r := &upstreamRules{groups: make(map[string]*UpstreamGroup), bootstrap: f.bootstrap}
+	group := func(addr string) (*UpstreamGroup, error) {
+		if g, ok := r.groups[addr]; ok {
+			return g, nil
+		}
+		if prev != nil && prev.bootstrap == f.bootstrap {
+			if g, ok := prev.groups[addr]; ok {
+				r.groups[addr] = g
+				return g, nil
+			}
+		}
+		g, err := NewUpstreamGroup([]string{addr}, f.bootstrap, f.logger)
+		if err != nil {
+			return nil, err
+		}
+		r.groups[addr] = g
+		return g, nil
+	}
+
+	if matched != "" {
+		g, err := group(matched)
+		if err != nil {
+			return err
+		}
+		r.matched = g
+	}
+	for _, addr := range slices.Sorted(maps.Keys(byUpstream)) {
+		g, err := group(addr)
+		if err != nil {
+			return err
+		}
+		m := NewMatcher()
+		m.Update(byUpstream[addr])
+		r.shunts = append(r.shunts, shuntUpstream{upstream: g, matcher: m})
+	}
+	f.upstreams.Store(r)
+
+	if prev != nil {
+		for addr, g := range prev.groups {
+			if r.groups[addr] != g {
+				g.Close()
+			}
+		}
+	}
+	return nil
+}
+
+// UpstreamStatus returns the health of the upstreams: the default ones
+// first, then those of proxied domains.
+func (f *Forwarder) UpstreamStatus() []UpstreamStatus {
+	var out []UpstreamStatus
+	if g := f.upstream.Load(); g != nil {
+		out = append(out, g.Status()...)
+	}
+	if r := f.upstreams.Load(); r != nil {
+		for _, addr := range slices.Sorted(maps.Keys(r.groups)) {
+			out = append(out, r.groups[addr].Status()...)
+		}
+	}
+	return out
+}
+
+// upstreamFor returns the upstream a query for domain is forwarded to. Only
+// proxied domains leave the default upstream.
+func (f *Forwarder) upstreamFor(domain string, target shunt.Target, matched bool) *UpstreamGroup {
+	r := f.upstreams.Load()
+	if !matched || !target.IsProxy() || r == nil {
+		return f.upstream.Load()
+	}
+	for _, u := range r.shunts {
+		if u.matcher.Match(domain) {
+			return u.upstream
+		}
+	}
+	if r.matched != nil {
+		return r.matched
+	}
+	return f.upstream.Load()
+}
@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+func TestUpstreamFor(t *testing.T) {
+	f := NewForwarder(":0", false, nil, slog.Default())
+	if err := f.SetUpstream([]string{"127.0.0.1:9153"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	proxy := shunt.Target{}
+	direct := shunt.Target{Action: shunt.ActionDirect}
+
+	if got := f.upstreamFor("example.com", proxy, true).String(); got != "127.0.0.1:9153" {
+		t.Errorf("before SetMatchedUpstreams: %s, want the default upstream", got)
+	}
+
+	err := f.SetMatchedUpstreams("10.8.0.1:53", map[string][]shunt.Entry{
+		"tls://10.9.0.1": {{Value: "video.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain  string
+		target  shunt.Target
+		matched bool
+		want    string
+	}{
+		{"cdn.video.com", proxy, true, "tls://10.9.0.1"},
+		{"example.com", proxy, true, "10.8.0.1:53"},
+		{"example.com", direct, true, "127.0.0.1:9153"},
+		{"other.com", proxy, false, "127.0.0.1:9153"},
+	}
+	for _, tt := range tests {
+		if got := f.upstreamFor(tt.domain, tt.target, tt.matched).String(); got != tt.want {
+			t.Errorf("upstreamFor(%s, %+v, %v) = %s, want %s", tt.domain, tt.target, tt.matched, got, tt.want)
+		}
+	}
+
+	// Upstreams still in use are kept.
+	matched := f.upstreamFor("example.com", proxy, true)
+	if err := f.SetMatchedUpstreams("10.8.0.1:53", nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.upstreamFor("example.com", proxy, true) != matched {
+		t.Error("unchanged matched upstream was recreated")
+	}
+	if n := len(f.UpstreamStatus()); n != 2 {
+		t.Errorf("UpstreamStatus has %d entries, want 2", n)
+	}
+}
@@ -2,15 +2,20 @@ package healthcheck
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/egorlepa/netshunt/internal/config"
 	"github.com/egorlepa/netshunt/internal/dns"
 	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/platform"
+	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/service"
 	"github.com/egorlepa/netshunt/internal/shunt"
 )
@@ -33,17 +38,25 @@ type ProbeResult struct {
 func RunChecks(ctx context.Context, cfg *config.Config, shunts *shunt.Store) []Result {
 	var results []Result
 
-	// 1. dnscrypt-proxy
-	results = append(results, checkService(ctx, service.DNSCrypt))
+	// 1. dnscrypt-proxy, unless the built-in upstreams replace it
+	if cfg.DNS.UsesDNSCrypt() {
+		results = append(results, checkService(ctx, service.DNSCrypt))
+	}
 
 	// 2. Daemon
 	results = append(results, checkService(ctx, service.Daemon))
 
-	// 3. DNS forwarder
+	// 3. DNS forwarder and its upstreams
 	results = append(results, checkForwarder(ctx, cfg))
+	results = append(results, checkUpstreams(ctx, cfg))
 
-	// 4. Transparent proxy listening
-	results = append(results, checkProxy(cfg))
+	// 4. Transparent proxy listening (default + per-shunt targets), or the
+	// outbound interface in policy routing mode
+	if cfg.Routing.Mode == routing.ModeInterface {
+		results = append(results, checkInterface(cfg))
+	} else {
+		results = append(results, checkProxy(cfg, shunts))
+	}
 
 	// 5. Internet connectivity
 	results = append(results, checkConnectivity(ctx))
@@ -51,39 +64,75 @@ func RunChecks(ctx context.Context, cfg *config.Config, shunts *shunt.Store) []R
 	// 6. IPSet v4
 	results = append(results, checkIPSet4(ctx, cfg))
 
-	// 7. IPTables v4
-	results = append(results, checkIPTables4(ctx, cfg))
+	// 7. IPTables v4 (or the whole nftables ruleset), down while routing is
+	// paused
+	nft := netfilter.ResolveBackend(cfg.Netfilter.Backend) == netfilter.BackendNFTables
+	until, paused := platform.PausedUntil()
+	switch {
+	case paused:
+		results = append(results, Result{Name: "routing", Passed: true, Detail: "paused until " + until.Format("15:04:05")})
+	case nft:
+		results = append(results, checkNFTables(ctx, cfg))
+	case cfg.Routing.Mode == routing.ModeInterface:
+		results = append(results, checkPolicyRouting(ctx, cfg, false))
+	case cfg.Routing.Mode == routing.ModeTproxy:
+		results = append(results, checkTproxy(ctx, cfg, false))
+	default:
+		results = append(results, checkIPTables4(ctx, cfg))
+	}
 
 	if cfg.IPv6 {
 		// 8. IPSet v6
 		results = append(results, checkIPSet6(ctx, cfg))
 
-		// 9. IPTables v6
-		results = append(results, checkIPTables6(ctx, cfg))
+		// 9. IPTables v6 (covered by the nftables check)
+		switch {
+		case paused, nft:
+		case cfg.Routing.Mode == routing.ModeInterface:
+			results = append(results, checkPolicyRouting(ctx, cfg, true))
+		case cfg.Routing.Mode == routing.ModeTproxy:
+			results = append(results, checkTproxy(ctx, cfg, true))
+		default:
+			results = append(results, checkIPTables6(ctx, cfg))
+		}
 	}
 
 	// 10. Shunts
 	results = append(results, checkShunts(shunts))
 
+	// 11. Active routing mode
+	results = append(results, Result{Name: "routing mode", Passed: true, Detail: routing.Label(cfg)})
+
+	// 12. Rule drift, as last checked by the daemon
+	results = append(results, checkDrift(ctx, cfg))
+
 	return results
 }
 
 // ProbeDomain resolves a domain (A + AAAA) and checks if the resolved IPs are
-// in the appropriate ipset (v4 or v6).
-func ProbeDomain(ctx context.Context, cfg *config.Config, domain string) (*ProbeResult, error) {
+// in the appropriate ipset (v4 or v6) of any proxy target.
+func ProbeDomain(ctx context.Context, cfg *config.Config, shunts *shunt.Store, domain string) (*ProbeResult, error) {
 	resolver := dns.NewResolver("127.0.0.1:53")
 	ips, err := resolver.ResolveToStrings(ctx, domain)
 	if err != nil {
 		return nil, fmt.Errorf("resolve %s: %w", domain, err)
 	}
 
-	// Collect entries from ipset tables.
-	ipset4 := netfilter.NewIPSet(cfg.IPSet.TableName)
-	allEntries, _ := ipset4.List(ctx)
-	if cfg.IPv6 {
-		ipset6 := netfilter.NewIPSet6(cfg.IPSet.TableName + "6")
-		entries6, _ := ipset6.List(ctx)
-		allEntries = append(allEntries, entries6...)
+	// Collect entries from the ipset tables of every proxy target.
+	targets, _ := shunts.Targets()
+	backend := netfilter.ResolveBackend(cfg.Netfilter.Backend)
+	var allEntries []string
+	for _, t := range append([]shunt.Target{{}}, targets...) {
+		if !t.IsProxy() {
+			continue
+		}
+		name4, name6 := cfg.IPSet.Names(t.Suffix())
+		entries4, _ := netfilter.NewSet(backend, name4).List(ctx)
+		allEntries = append(allEntries, entries4...)
+		if cfg.IPv6 {
+			entries6, _ := netfilter.NewSet6(backend, name6).List(ctx)
+			allEntries = append(allEntries, entries6...)
+		}
 	}
 
 	// Parse ipset entries into nets for CIDR containment checks.
@@ -139,17 +188,97 @@ func checkService(ctx context.Context, svc service.Service) Result {
 	return r
 }
 
-func checkProxy(cfg *config.Config) Result {
+func checkProxy(cfg *config.Config, shunts *shunt.Store) Result {
 	r := Result{Name: "proxy"}
-	addr := fmt.Sprintf("127.0.0.1:%d", cfg.Routing.LocalPort)
+	targets, _ := shunts.Targets()
+	ports := []int{cfg.Routing.LocalPort}
+	for _, t := range targets {
+		if t.Port != 0 && !slices.Contains(ports, t.Port) {
+			ports = append(ports, t.Port)
+		}
+	}
+
+	var listening, down []string
+	for _, port := range ports {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		if !dialPort(addr) {
+			// A failover backup takes over a dead routing.local_port.
+			if port == cfg.Routing.LocalPort {
+				if backup := listeningBackup(cfg); backup != "" {
+					listening = append(listening, backup+" (failover)")
+					continue
+				}
+			}
+			down = append(down, addr)
+			continue
+		}
+		listening = append(listening, addr)
+	}
+
+	if len(down) > 0 {
+		r.Detail = fmt.Sprintf("nothing listening on %s", strings.Join(down, ", "))
+		return r
+	}
+	r.Passed = true
+	r.Detail = fmt.Sprintf("listening on %s", strings.Join(listening, ", "))
+	return r
+}
+
+// listeningBackup returns the address of the first failover backup port
+// something listens on, or "".
+func listeningBackup(cfg *config.Config) string {
+	for _, port := range cfg.Routing.Failover.Ports {
+		if addr := fmt.Sprintf("127.0.0.1:%d", port); dialPort(addr) {
+			return addr
+		}
+	}
+	return ""
+}
+
+func dialPort(addr string) bool {
 	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
 	if err != nil {
-		r.Detail = fmt.Sprintf("nothing listening on %s", addr)
-		return r
+		return false
 	}
 	conn.Close()
+	return true
+}
+
+// anyProxyPort runs check for routing.local_port and then each failover
+// backup port, since the daemon may have moved the rules to a backup. It
+// returns nil as soon as the rules of one port are complete, otherwise what
+// is missing for routing.local_port.
+func anyProxyPort(cfg *config.Config, check func(port string) []string) []string {
+	missing := check(strconv.Itoa(cfg.Routing.LocalPort))
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, port := range cfg.Routing.Failover.Ports {
+		if len(check(strconv.Itoa(port))) == 0 {
+			return nil
+		}
+	}
+	return missing
+}
+
+func checkInterface(cfg *config.Config) Result {
+	r := Result{Name: "interface"}
+	name := cfg.Routing.Interface
+	if name == "" {
+		r.Detail = "routing.interface is not set"
+		return r
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		r.Detail = fmt.Sprintf("%s not found", name)
+		return r
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		r.Detail = fmt.Sprintf("%s is down", name)
+		return r
+	}
 	r.Passed = true
-	r.Detail = fmt.Sprintf("listening on %s", addr)
+	r.Detail = fmt.Sprintf("%s is up", name)
 	return r
 }
 
@@ -175,7 +304,7 @@ func checkConnectivity(ctx context.Context) Result {
 
 func checkIPSet4(ctx context.Context, cfg *config.Config) Result {
 	r := Result{Name: "ipset v4"}
-	ipset := netfilter.NewIPSet(cfg.IPSet.TableName)
+	ipset := netfilter.NewSet(netfilter.ResolveBackend(cfg.Netfilter.Backend), cfg.IPSet.TableName)
 	count, err := ipset.Count(ctx)
 	if err != nil {
 		r.Detail = fmt.Sprintf("table %q: %v", cfg.IPSet.TableName, err)
@@ -189,7 +318,7 @@ func checkIPSet4(ctx context.Context, cfg *config.Config) Result {
 func checkIPSet6(ctx context.Context, cfg *config.Config) Result {
 	name := cfg.IPSet.TableName + "6"
 	r := Result{Name: "ipset v6"}
-	ipset := netfilter.NewIPSet6(name)
+	ipset := netfilter.NewSet6(netfilter.ResolveBackend(cfg.Netfilter.Backend), name)
 	count, err := ipset.Count(ctx)
 	if err != nil {
 		r.Detail = fmt.Sprintf("table %q: %v", name, err)
@@ -204,9 +333,7 @@ func checkIPTables4(ctx context.Context, cfg *config.Config) Result {
 	r := Result{Name: "iptables v4"}
 	ipt := netfilter.NewIPTables()
 
-	port := fmt.Sprintf("%d", cfg.Routing.LocalPort)
 	ipsetName := cfg.IPSet.TableName
-	iface := cfg.Network.EntwareInterface
 
 	var missing []string
 
@@ -214,29 +341,16 @@ func checkIPTables4(ctx context.Context, cfg *config.Config) Result {
 		missing = append(missing, "NSHUNT chain")
 	}
 
-	if !ipt.RuleExists(ctx, "nat", "NSHUNT", "-p", "tcp",
-		"-m", "set", "--match-set", ipsetName, "dst",
-		"-j", "REDIRECT", "--to-port", port) {
-		missing = append(missing, "tcp redirect")
-	}
-
-	if iface != "" {
-		if !ipt.RuleExists(ctx, "nat", "PREROUTING", "-i", iface, "-j", "NSHUNT") {
-			missing = append(missing, "prerouting jump")
-		}
-	} else {
-		if !ipt.RuleExists(ctx, "nat", "PREROUTING", "-j", "NSHUNT") {
-			missing = append(missing, "prerouting jump")
-		}
-	}
+	missing = append(missing, anyProxyPort(cfg, func(port string) []string {
+		return checkRedirectRules(ctx, ipt, cfg, "NSHUNT", ipsetName, port)
+	})...)
 
-	dnsIface := iface
-	if dnsIface == "" {
-		dnsIface = "br0"
+	if !ipt.HasJumpRule(ctx, "nat", "PREROUTING", "NSHUNT") {
+		missing = append(missing, "prerouting jump")
 	}
-	if !ipt.RuleExists(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to", "127.0.0.1") {
-		missing = append(missing, "dns dnat")
+	missing = append(missing, checkDNSRedirect(ctx, ipt, cfg)...)
+	if localTraffic(cfg) && !ipt.HasJumpRule(ctx, "nat", "OUTPUT", "NSHUNT_OUT") {
+		missing = append(missing, "output jump")
 	}
 
 	if len(missing) == 0 {
@@ -252,14 +366,7 @@ func checkIPTables6(ctx context.Context, cfg *config.Config) Result {
 	r := Result{Name: "iptables v6"}
 	ipt6 := netfilter.NewIP6Tables()
 
-	port := fmt.Sprintf("%d", cfg.Routing.LocalPort)
 	ipset6Name := cfg.IPSet.TableName + "6"
-	iface := cfg.Network.EntwareInterface
-
-	dnsIface := iface
-	if dnsIface == "" {
-		dnsIface = "br0"
-	}
 
 	var missing []string
 
@@ -267,17 +374,224 @@ func checkIPTables6(ctx context.Context, cfg *config.Config) Result {
 		missing = append(missing, "NSHUNT6 chain")
 	}
 
-	if !ipt6.RuleExists(ctx, "nat", "NSHUNT6", "-p", "tcp",
-		"-m", "set", "--match-set", ipset6Name, "dst",
+	missing = append(missing, anyProxyPort(cfg, func(port string) []string {
+		return checkRedirectRules(ctx, ipt6, cfg, "NSHUNT6", ipset6Name, port)
+	})...)
+
+	missing = append(missing, checkDNSRedirect(ctx, ipt6, cfg)...)
+	if localTraffic(cfg) && !ipt6.HasJumpRule(ctx, "nat", "OUTPUT", "NSHUNT6_OUT") {
+		missing = append(missing, "output jump")
+	}
+
+	if len(missing) == 0 {
+		r.Passed = true
+		r.Detail = "all rules present"
+	} else {
+		r.Detail = fmt.Sprintf("missing: %s", strings.Join(missing, ", "))
+	}
+	return r
+}
+
+// checkDNSRedirect verifies the DNS DNAT jump of every interface whose DNS
+// is intercepted.
+func checkDNSRedirect(ctx context.Context, ipt *netfilter.IPTables, cfg *config.Config) []string {
+	var missing []string
+	for _, iface := range cfg.Network.DNSInterfaces() {
+		if !ipt.RuleExists(ctx, "nat", "PREROUTING",
+			"-i", iface, "-p", "udp", "--dport", "53", "-j", "NSHUNT_DNS") {
+			missing = append(missing, "dns dnat "+iface)
+		}
+	}
+	return missing
+}
+
+// localTraffic reports whether redirect mode should have set up the nat
+// OUTPUT rules for router-originated traffic.
+func localTraffic(cfg *config.Config) bool {
+	return cfg.Routing.Local.Enabled && !cfg.Routing.Inverse
+}
+
+// checkRedirectRules verifies the TCP rules of a redirect chain: the ipset
+// redirect normally, or the ipset RETURN plus catch-all redirect in inverse mode.
+func checkRedirectRules(ctx context.Context, ipt *netfilter.IPTables, cfg *config.Config, chain, ipsetName, port string) []string {
+	var missing []string
+	if cfg.Routing.Inverse {
+		if !ipt.RuleExists(ctx, "nat", chain, "-m", "set", "--match-set", ipsetName, "dst", "-j", "RETURN") {
+			missing = append(missing, "shunt return")
+		}
+		if !ipt.RuleExists(ctx, "nat", chain, "-p", "tcp", "-j", "REDIRECT", "--to-port", port) {
+			missing = append(missing, "tcp catch-all redirect")
+		}
+		return missing
+	}
+	if !ipt.RuleExists(ctx, "nat", chain, "-p", "tcp",
+		"-m", "set", "--match-set", ipsetName, "dst",
 		"-j", "REDIRECT", "--to-port", port) {
 		missing = append(missing, "tcp redirect")
 	}
+	return missing
+}
+
+// checkPolicyRouting verifies the mark, masquerade and ip rule setup of
+// interface mode for one address family.
+func checkPolicyRouting(ctx context.Context, cfg *config.Config, v6 bool) Result {
+	r := Result{Name: "iptables v4"}
+	ipt := netfilter.NewIPTables()
+	markChain, masqChain := "NSHUNT_MARK", "NSHUNT_MASQ"
+	ipsetName, _ := cfg.IPSet.Names("")
+	ipArgs := []string{"rule", "show"}
+	if v6 {
+		r.Name = "iptables v6"
+		ipt = netfilter.NewIP6Tables()
+		markChain, masqChain = "NSHUNT6_MARK", "NSHUNT6_MASQ"
+		_, ipsetName = cfg.IPSet.Names("")
+		ipArgs = append([]string{"-6"}, ipArgs...)
+	}
+
+	var missing []string
+
+	if exists, _ := ipt.ChainExists(ctx, "mangle", markChain); !exists {
+		missing = append(missing, markChain+" chain")
+	}
+
+	if !ipt.RuleExists(ctx, "mangle", markChain,
+		"-m", "set", "--match-set", ipsetName, "dst",
+		"-j", "MARK", "--set-xmark", "0x2/0x2") {
+		missing = append(missing, "mark rule")
+	}
+
+	if !ipt.HasJumpRule(ctx, "mangle", "PREROUTING", markChain) {
+		missing = append(missing, "prerouting jump")
+	}
+
+	if !ipt.RuleExists(ctx, "nat", "POSTROUTING", "-o", cfg.Routing.Interface, "-j", masqChain) {
+		missing = append(missing, "masquerade")
+	}
+
+	if out, err := platform.Run(ctx, "ip", ipArgs...); err != nil || !strings.Contains(out, "lookup 101") {
+		missing = append(missing, "ip rule")
+	}
+
+	missing = append(missing, checkDNSRedirect(ctx, ipt, cfg)...)
+
+	if len(missing) == 0 {
+		r.Passed = true
+		r.Detail = "all rules present"
+	} else {
+		r.Detail = fmt.Sprintf("missing: %s", strings.Join(missing, ", "))
+	}
+	return r
+}
+
+// checkTproxy verifies the mangle TPROXY chain, policy routing and DNS DNAT
+// of tproxy mode for one address family.
+func checkTproxy(ctx context.Context, cfg *config.Config, v6 bool) Result {
+	r := Result{Name: "iptables v4"}
+	ipt := netfilter.NewIPTables()
+	chain := "NSHUNT_TPROXY"
+	ipsetName, _ := cfg.IPSet.Names("")
+	ipArgs := []string{"rule", "show"}
+	if v6 {
+		r.Name = "iptables v6"
+		ipt = netfilter.NewIP6Tables()
+		chain = "NSHUNT6_TPROXY"
+		_, ipsetName = cfg.IPSet.Names("")
+		ipArgs = append([]string{"-6"}, ipArgs...)
+	}
+
+	var missing []string
+
+	if exists, _ := ipt.ChainExists(ctx, "mangle", chain); !exists {
+		missing = append(missing, chain+" chain")
+	}
+
+	missing = append(missing, anyProxyPort(cfg, func(port string) []string {
+		var missing []string
+		for _, proto := range []string{"tcp", "udp"} {
+			if !ipt.RuleExists(ctx, "mangle", chain, "-p", proto,
+				"-m", "set", "--match-set", ipsetName, "dst",
+				"-j", "TPROXY", "--on-port", port, "--tproxy-mark", "0x1/0x1") {
+				missing = append(missing, proto+" tproxy")
+			}
+		}
+		return missing
+	})...)
+
+	if !ipt.HasJumpRule(ctx, "mangle", "PREROUTING", chain) {
+		missing = append(missing, "prerouting jump")
+	}
+
+	if out, err := platform.Run(ctx, "ip", ipArgs...); err != nil || !strings.Contains(out, "lookup 100") {
+		missing = append(missing, "ip rule")
+	}
+
+	missing = append(missing, checkDNSRedirect(ctx, ipt, cfg)...)
+
+	if len(missing) == 0 {
+		r.Passed = true
+		r.Detail = "all rules present"
+	} else {
+		r.Detail = fmt.Sprintf("missing: %s", strings.Join(missing, ", "))
+	}
+	return r
+}
+
+// checkNFTables verifies the netshunt nftables table: the chains of the
+// configured mode exist and match the default set of every enabled family.
+func checkNFTables(ctx context.Context, cfg *config.Config) Result {
+	r := Result{Name: "nftables"}
+	nft := netfilter.NewNFTables()
+
+	var chains []string
+	ipRule := "lookup 100"
+	switch cfg.Routing.Mode {
+	case routing.ModeInterface:
+		chains = []string{"NSHUNT_MARK"}
+		ipRule = "lookup 101"
+	case routing.ModeTproxy:
+		chains = []string{"NSHUNT_TPROXY"}
+	default:
+		chains = []string{"NSHUNT", "NSHUNT_UDP"}
+		if localTraffic(cfg) {
+			chains = append(chains, "NSHUNT_OUT")
+		}
+	}
+
+	var missing []string
 
-	if !ipt6.RuleExists(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to", "[::1]") {
+	existing, err := nft.ListChains(ctx)
+	if err != nil {
+		r.Detail = fmt.Sprintf("table inet %s not found", netfilter.NFTTable)
+		return r
+	}
+	for _, c := range append([]string{"prerouting_nat"}, chains...) {
+		if !slices.Contains(existing, c) {
+			missing = append(missing, c+" chain")
+		}
+	}
+
+	set4, set6 := cfg.IPSet.Names("")
+	sets := []string{set4}
+	if cfg.IPv6 {
+		sets = append(sets, set6)
+	}
+	for _, c := range chains {
+		out, _ := nft.ListChain(ctx, c)
+		for _, set := range sets {
+			if !strings.Contains(out, "@"+set+" ") {
+				missing = append(missing, c+" @"+set)
+			}
+		}
+	}
+
+	if out, _ := nft.ListChain(ctx, "prerouting_nat"); !strings.Contains(out, "dport 53") {
 		missing = append(missing, "dns dnat")
 	}
 
+	if out, err := platform.Run(ctx, "ip", "rule", "show"); err != nil || !strings.Contains(out, ipRule) {
+		missing = append(missing, "ip rule")
+	}
+
 	if len(missing) == 0 {
 		r.Passed = true
 		r.Detail = "all rules present"
@@ -287,6 +601,47 @@ func checkIPTables6(ctx context.Context, cfg *config.Config) Result {
 	return r
 }
 
+// checkDrift reads the result of the daemon's last rule drift check from its
+// HTTP API. Drift the daemon repaired passes; a failed repair does not.
+func checkDrift(ctx context.Context, cfg *config.Config) Result {
+	r := Result{Name: "rule drift"}
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1%s/api/drift", cfg.Daemon.WebListen), nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		r.Detail = "daemon not reachable"
+		return r
+	}
+	defer resp.Body.Close()
+	var status routing.DriftStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		r.Detail = fmt.Sprintf("read status: %v", err)
+		return r
+	}
+
+	switch {
+	case status.Failed():
+		var failed []string
+		for _, d := range status.Drifts {
+			if d.Error != "" {
+				failed = append(failed, fmt.Sprintf("%s (%s: %s)", d.Part, d.Detail, d.Error))
+			}
+		}
+		r.Detail = fmt.Sprintf("repair failed: %s", strings.Join(failed, ", "))
+		return r
+	case !status.Enabled:
+		r.Detail = "check disabled"
+	case status.Checked.IsZero():
+		r.Detail = "not checked yet"
+	case status.Repairs > 0:
+		r.Detail = fmt.Sprintf("%d repaired, last drift at %s", status.Repairs, status.LastDrift.Format("15:04:05"))
+	default:
+		r.Detail = fmt.Sprintf("no drift, checked at %s", status.Checked.Format("15:04:05"))
+	}
+	r.Passed = true
+	return r
+}
+
 func checkForwarder(ctx context.Context, cfg *config.Config) Result {
 	r := Result{Name: "dns forwarder"}
 	resolver := dns.NewResolver(cfg.DNS.ListenAddr)
@@ -300,6 +655,47 @@ func checkForwarder(ctx context.Context, cfg *config.Config) Result {
 	return r
 }
 
+// checkUpstreams reads the health of the forwarder's upstreams from the
+// daemon's HTTP API. It fails only when none of them answers.
+func checkUpstreams(ctx context.Context, cfg *config.Config) Result {
+	r := Result{Name: "dns upstreams"}
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://127.0.0.1%s/api/upstreams", cfg.Daemon.WebListen), nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		r.Detail = "daemon not reachable"
+		return r
+	}
+	defer resp.Body.Close()
+	var status []dns.UpstreamStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		r.Detail = fmt.Sprintf("read status: %v", err)
+		return r
+	}
+	if len(status) == 0 {
+		r.Detail = "none configured"
+		return r
+	}
+
+	var down []string
+	for _, u := range status {
+		if !u.Healthy {
+			down = append(down, fmt.Sprintf("%s (%s)", u.Address, u.LastError))
+		}
+	}
+	switch {
+	case len(down) == len(status):
+		r.Detail = fmt.Sprintf("all down: %s", strings.Join(down, ", "))
+		return r
+	case len(down) > 0:
+		r.Detail = fmt.Sprintf("%d of %d up, down: %s", len(status)-len(down), len(status), strings.Join(down, ", "))
+	default:
+		r.Detail = fmt.Sprintf("%d up", len(status))
+	}
+	r.Passed = true
+	return r
+}
+
 func checkShunts(shunts *shunt.Store) Result {
 	r := Result{Name: "shunts"}
 	list, err := shunts.List()
@@ -0,0 +1,84 @@
+package netfilter
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Backend identifies the packet filtering tooling used for sets and rules.
+type Backend string
+
+const (
+	// BackendIPTables uses iptables/ip6tables chains and ipset tables.
+	BackendIPTables Backend = "iptables"
+	// BackendNFTables uses one nftables table with native named sets.
+	BackendNFTables Backend = "nftables"
+	// BackendAuto picks iptables when iptables and ipset are installed and
+	// falls back to nftables otherwise.
+	BackendAuto Backend = "auto"
+)
+
+// Set is a kernel address set that routing rules match destinations against:
+// an ipset hash:net table or a named set in the netshunt nftables table.
+// Concurrent adds and deletes are coalesced into shared transactions.
+type Set interface {
+	// Name returns the set name.
+	Name() string
+	// EnsureTable creates the set if it doesn't exist.
+	EnsureTable(ctx context.Context) error
+	// Flush removes all entries from the set.
+	Flush(ctx context.Context) error
+	// Add adds an IP or CIDR to the set.
+	Add(ctx context.Context, entry string) error
+	// Del removes an IP or CIDR from the set.
+	Del(ctx context.Context, entry string) error
+	// AddAll adds IPs and CIDRs to the set in one transaction, returning
+	// the error of each entry that failed.
+	AddAll(ctx context.Context, entries []string) map[string]error
+	// DelAll removes IPs and CIDRs from the set in one transaction,
+	// returning the error of each entry that failed.
+	DelAll(ctx context.Context, entries []string) map[string]error
+	// List returns all entries in the set.
+	List(ctx context.Context) ([]string, error)
+	// Count returns the number of entries in the set.
+	Count(ctx context.Context) (int, error)
+	// Destroy removes the set entirely.
+	Destroy(ctx context.Context) error
+}
+
+// ResolveBackend maps a configured backend name to a concrete backend.
+// "auto" and unknown values are resolved by probing for the binaries.
+func ResolveBackend(name string) Backend {
+	switch Backend(name) {
+	case BackendIPTables, BackendNFTables:
+		return Backend(name)
+	}
+	if hasBinary("iptables") && hasBinary("ipset") {
+		return BackendIPTables
+	}
+	if hasBinary("nft") {
+		return BackendNFTables
+	}
+	return BackendIPTables
+}
+
+// NewSet returns an IPv4 address set on the given backend.
+func NewSet(b Backend, name string) Set {
+	if b == BackendNFTables {
+		return NewNFTSet(name)
+	}
+	return NewIPSet(name)
+}
+
+// NewSet6 returns an IPv6 address set on the given backend.
+func NewSet6(b Backend, name string) Set {
+	if b == BackendNFTables {
+		return NewNFTSet6(name)
+	}
+	return NewIPSet6(name)
+}
+
+func hasBinary(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
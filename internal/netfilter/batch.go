@@ -0,0 +1,125 @@
+package netfilter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/egorlepa/netshunt/internal/platform"
+)
+
+// runInput and runSilent run the commands of the batched set backends;
+// tests replace them.
+var (
+	runInput  = platform.RunInput
+	runSilent = platform.RunSilent
+)
+
+// setOp is one element update of a set.
+type setOp struct {
+	del   bool
+	set   string
+	entry string
+}
+
+func (op setOp) verb() string {
+	if op.del {
+		return "del"
+	}
+	return "add"
+}
+
+func (op setOp) nftVerb() string {
+	if op.del {
+		return "delete"
+	}
+	return "add"
+}
+
+// batcher coalesces set updates into transactions run by one process each.
+// The first caller to arrive applies the updates pending at that time;
+// updates from callers arriving meanwhile wait for the next transaction, so
+// a burst of DNS answers costs a few forks instead of one per address. A
+// lone update is applied right away.
+type batcher struct {
+	// exec applies ops in order and returns the error of each op.
+	exec func(ctx context.Context, ops []setOp) []error
+
+	mu      sync.Mutex
+	pending []*batchReq
+	running bool
+}
+
+type batchReq struct {
+	ops  []setOp
+	done chan []error
+}
+
+// do applies ops in one transaction, possibly together with the ops of
+// concurrent callers, and returns the error of each op.
+func (b *batcher) do(ctx context.Context, ops []setOp) []error {
+	if len(ops) == 0 {
+		return nil
+	}
+	req := &batchReq{ops: ops, done: make(chan []error, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, req)
+	lead := !b.running
+	b.running = true
+	b.mu.Unlock()
+
+	if lead {
+		// The transaction applies the ops of other callers too; it must
+		// not be cut short by this caller's cancellation.
+		b.flush(context.WithoutCancel(ctx))
+	}
+	return <-req.done
+}
+
+// apply applies ops and returns the error of each entry that failed.
+func (b *batcher) apply(ctx context.Context, ops []setOp) map[string]error {
+	failed := make(map[string]error)
+	for i, err := range b.do(ctx, ops) {
+		if err != nil {
+			failed[ops[i].entry] = err
+		}
+	}
+	return failed
+}
+
+// setOps returns the ops adding (or deleting) entries to (from) set.
+func setOps(del bool, set string, entries []string) []setOp {
+	ops := make([]setOp, len(entries))
+	for i, e := range entries {
+		ops[i] = setOp{del: del, set: set, entry: e}
+	}
+	return ops
+}
+
+// flush runs one transaction with all pending ops. Ops queued while it ran
+// are flushed in the background, so the leading caller is not held up by
+// a steady stream of updates.
+func (b *batcher) flush(ctx context.Context) {
+	b.mu.Lock()
+	reqs := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	var ops []setOp
+	for _, r := range reqs {
+		ops = append(ops, r.ops...)
+	}
+	errs := b.exec(ctx, ops)
+	for _, r := range reqs {
+		n := len(r.ops)
+		r.done <- errs[:n:n]
+		errs = errs[n:]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		b.running = false
+		return
+	}
+	go b.flush(ctx)
+}
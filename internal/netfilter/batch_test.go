@@ -0,0 +1,114 @@
+package netfilter
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failEntry is the entry the fake transactions reject.
+const failEntry = "10.0.0.300"
+
+func failing(ops []setOp) []error {
+	errs := make([]error, len(ops))
+	for i, op := range ops {
+		if op.entry == failEntry {
+			errs[i] = errors.New("invalid entry " + op.entry)
+		}
+	}
+	return errs
+}
+
+func TestBatcherApply(t *testing.T) {
+	var got [][]setOp
+	b := &batcher{exec: func(_ context.Context, ops []setOp) []error {
+		got = append(got, ops)
+		return failing(ops)
+	}}
+
+	failed := b.apply(context.Background(), setOps(true, "bypass", []string{"10.0.0.1", failEntry, "10.0.0.3"}))
+	if len(failed) != 1 || failed[failEntry] == nil {
+		t.Errorf("failed = %v, want only %s", failed, failEntry)
+	}
+	want := [][]setOp{{
+		{del: true, set: "bypass", entry: "10.0.0.1"},
+		{del: true, set: "bypass", entry: failEntry},
+		{del: true, set: "bypass", entry: "10.0.0.3"},
+	}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("transactions = %v, want %v", got, want)
+	}
+	if failed := b.apply(context.Background(), nil); len(failed) != 0 || len(got) != 1 {
+		t.Errorf("empty apply ran %d transactions and failed %v", len(got)-1, failed)
+	}
+}
+
+func TestBatcherCoalesces(t *testing.T) {
+	ctx := context.Background()
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var got [][]setOp
+	b := &batcher{exec: func(_ context.Context, ops []setOp) []error {
+		mu.Lock()
+		got = append(got, ops)
+		first := len(got) == 1
+		mu.Unlock()
+		if first {
+			close(started)
+			<-release
+		}
+		return failing(ops)
+	}}
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		if errs := b.do(ctx, []setOp{{set: "bypass", entry: "10.0.0.1"}}); len(errs) != 1 || errs[0] != nil {
+			t.Errorf("leading add errors = %v", errs)
+		}
+	})
+	<-started
+
+	// While the first transaction runs, three more adds arrive.
+	entries := []string{"10.0.0.2", failEntry, "10.0.0.4"}
+	for _, e := range entries {
+		wg.Go(func() {
+			errs := b.do(ctx, []setOp{{set: "bypass", entry: e}, {set: "bypass6", entry: "::" + e}})
+			if len(errs) != 2 || (errs[0] != nil) != (e == failEntry) || errs[1] != nil {
+				t.Errorf("errors of %s = %v", e, errs)
+			}
+		})
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		b.mu.Lock()
+		n := len(b.pending)
+		b.mu.Unlock()
+		if n == len(entries) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d adds pending, want %d", n, len(entries))
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if len(got) != 2 {
+		t.Fatalf("%d transactions, want 2: %v", len(got), got)
+	}
+	var second []string
+	for _, op := range got[1] {
+		second = append(second, op.entry)
+	}
+	slices.Sort(second)
+	want := []string{"10.0.0.2", failEntry, "10.0.0.4"}
+	for _, e := range want {
+		want = append(want, "::"+e)
+	}
+	slices.Sort(want)
+	if !slices.Equal(second, want) {
+		t.Errorf("second transaction = %v, want %v", second, want)
+	}
+}
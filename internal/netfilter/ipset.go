@@ -3,34 +3,39 @@ package netfilter
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/egorlepa/netshunt/internal/platform"
 )
 
-// IPSet manages an ipset hash:net table.
+// IPSet manages an ipset hash:net table. Adds and deletes of all ipsets
+// are batched into "ipset restore" transactions.
 type IPSet struct {
-	Name   string
+	name   string
 	family string // "inet" or "inet6"; empty defaults to inet
 }
 
 // NewIPSet creates an IPSet manager for the given table name (IPv4).
 func NewIPSet(name string) *IPSet {
-	return &IPSet{Name: name}
+	return &IPSet{name: name}
 }
 
 // NewIPSet6 creates an IPSet manager for IPv6 (hash:net family inet6).
 func NewIPSet6(name string) *IPSet {
-	return &IPSet{Name: name, family: "inet6"}
+	return &IPSet{name: name, family: "inet6"}
 }
 
+func (s *IPSet) Name() string { return s.name }
+
 // EnsureTable creates the ipset table if it doesn't exist.
 func (s *IPSet) EnsureTable(ctx context.Context) error {
-	_, err := platform.Run(ctx, "ipset", "list", s.Name)
+	_, err := platform.Run(ctx, "ipset", "list", s.name)
 	if err == nil {
 		return nil // already exists
 	}
-	args := []string{"create", s.Name, "hash:net"}
+	args := []string{"create", s.name, "hash:net"}
 	if s.family != "" {
 		args = append(args, "family", s.family)
 	}
@@ -39,22 +44,34 @@ func (s *IPSet) EnsureTable(ctx context.Context) error {
 
 // Flush removes all entries from the table.
 func (s *IPSet) Flush(ctx context.Context) error {
-	return platform.RunSilent(ctx, "ipset", "flush", s.Name)
+	return platform.RunSilent(ctx, "ipset", "flush", s.name)
 }
 
 // Add adds an IP or CIDR to the table.
 func (s *IPSet) Add(ctx context.Context, entry string) error {
-	return platform.RunSilent(ctx, "ipset", "add", s.Name, entry, "-exist")
+	return ipsetBatch.do(ctx, []setOp{{set: s.name, entry: entry}})[0]
 }
 
 // Del removes an IP or CIDR from the table.
 func (s *IPSet) Del(ctx context.Context, entry string) error {
-	return platform.RunSilent(ctx, "ipset", "del", s.Name, entry, "-exist")
+	return ipsetBatch.do(ctx, []setOp{{del: true, set: s.name, entry: entry}})[0]
+}
+
+// AddAll adds IPs and CIDRs to the table in one transaction, returning the
+// error of each entry that failed.
+func (s *IPSet) AddAll(ctx context.Context, entries []string) map[string]error {
+	return ipsetBatch.apply(ctx, setOps(false, s.name, entries))
+}
+
+// DelAll removes IPs and CIDRs from the table in one transaction, returning
+// the error of each entry that failed.
+func (s *IPSet) DelAll(ctx context.Context, entries []string) map[string]error {
+	return ipsetBatch.apply(ctx, setOps(true, s.name, entries))
 }
 
 // List returns all entries in the table.
 func (s *IPSet) List(ctx context.Context) ([]string, error) {
-	out, err := platform.Run(ctx, "ipset", "list", s.Name, "-output", "plain")
+	out, err := platform.Run(ctx, "ipset", "list", s.name, "-output", "plain")
 	if err != nil {
 		return nil, fmt.Errorf("ipset list: %w", err)
 	}
@@ -85,5 +102,53 @@ func (s *IPSet) Count(ctx context.Context) (int, error) {
 
 // Destroy removes the table entirely.
 func (s *IPSet) Destroy(ctx context.Context) error {
-	return platform.RunSilent(ctx, "ipset", "destroy", s.Name)
+	return platform.RunSilent(ctx, "ipset", "destroy", s.name)
+}
+
+var ipsetBatch = &batcher{exec: ipsetRestore}
+
+// restoreError matches the line an "ipset restore" stopped at.
+var restoreError = regexp.MustCompile(`Error in line (\d+): (.*)`)
+
+// ipsetRestore applies ops with "ipset restore". A restore stops at the
+// first failing line with the lines before it applied, so the failing op
+// gets the error and the ops after it go into another restore.
+func ipsetRestore(ctx context.Context, ops []setOp) []error {
+	errs := make([]error, len(ops))
+	if len(ops) == 1 {
+		errs[0] = ipsetRun(ctx, ops[0])
+		return errs
+	}
+	for start := 0; start < len(ops); {
+		var script strings.Builder
+		for _, op := range ops[start:] {
+			fmt.Fprintf(&script, "%s %s %s\n", op.verb(), op.set, op.entry)
+		}
+		err := runInput(ctx, script.String(), "ipset", "-exist", "restore")
+		if err == nil {
+			break
+		}
+		var line int
+		m := restoreError.FindStringSubmatch(err.Error())
+		if m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		if line < 1 || start+line > len(ops) {
+			// The failure can't be placed on a line: apply the rest one
+			// by one.
+			for i := start; i < len(ops); i++ {
+				errs[i] = ipsetRun(ctx, ops[i])
+			}
+			break
+		}
+		i := start + line - 1
+		errs[i] = fmt.Errorf("ipset %s %s %s: %s", ops[i].verb(), ops[i].set, ops[i].entry, strings.TrimSpace(m[2]))
+		start = i + 1
+	}
+	return errs
+}
+
+// ipsetRun applies a single op with its own ipset command.
+func ipsetRun(ctx context.Context, op setOp) error {
+	return runSilent(ctx, "ipset", op.verb(), op.set, op.entry, "-exist")
 }
@@ -0,0 +1,135 @@
+package netfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeIPSet stands in for the ipset command. Restores apply their lines in
+// order and stop at the first rejected entry, as ipset does.
+type fakeIPSet struct {
+	bad     []string // entries ipset rejects
+	garbled bool     // restores fail without naming the line
+
+	restores [][]string // entries of each restore
+	singles  []string   // entries applied by their own command
+	applied  []string
+}
+
+// install makes the batched backends run f until the test ends.
+func (f *fakeIPSet) install(t *testing.T) {
+	input, silent := runInput, runSilent
+	t.Cleanup(func() { runInput, runSilent = input, silent })
+
+	runInput = func(_ context.Context, input, name string, args ...string) error {
+		var entries []string
+		for _, line := range strings.Split(strings.TrimSpace(input), "\n") {
+			entries = append(entries, strings.Fields(line)[2])
+		}
+		f.restores = append(f.restores, entries)
+		if f.garbled {
+			return errors.New("ipset -exist restore: signal: killed: ")
+		}
+		for i, e := range entries {
+			if slices.Contains(f.bad, e) {
+				return fmt.Errorf("ipset -exist restore: exit status 1: ipset v7.15: Error in line %d: Syntax error: '%s' is invalid\n", i+1, e)
+			}
+			f.applied = append(f.applied, e)
+		}
+		return nil
+	}
+	runSilent = func(_ context.Context, name string, args ...string) error {
+		e := args[2]
+		f.singles = append(f.singles, e)
+		if slices.Contains(f.bad, e) {
+			return fmt.Errorf("ipset %s: exit status 1: ipset v7.15: Syntax error: '%s' is invalid", strings.Join(args, " "), e)
+		}
+		f.applied = append(f.applied, e)
+		return nil
+	}
+}
+
+func TestIPSetRestore(t *testing.T) {
+	tests := []struct {
+		name         string
+		entries      []string
+		bad          []string
+		garbled      bool
+		wantRestores [][]string
+		wantSingles  []string
+	}{
+		{
+			name:        "single entry",
+			entries:     []string{"10.0.0.1"},
+			wantSingles: []string{"10.0.0.1"},
+		},
+		{
+			name:         "all applied",
+			entries:      []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			wantRestores: [][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		},
+		{
+			name:         "first line fails",
+			entries:      []string{"10.0.0.300", "10.0.0.2", "10.0.0.3"},
+			bad:          []string{"10.0.0.300"},
+			wantRestores: [][]string{{"10.0.0.300", "10.0.0.2", "10.0.0.3"}, {"10.0.0.2", "10.0.0.3"}},
+		},
+		{
+			name:         "middle line fails",
+			entries:      []string{"10.0.0.1", "10.0.0.300", "10.0.0.3"},
+			bad:          []string{"10.0.0.300"},
+			wantRestores: [][]string{{"10.0.0.1", "10.0.0.300", "10.0.0.3"}, {"10.0.0.3"}},
+		},
+		{
+			name:         "last line fails",
+			entries:      []string{"10.0.0.1", "10.0.0.2", "10.0.0.300"},
+			bad:          []string{"10.0.0.300"},
+			wantRestores: [][]string{{"10.0.0.1", "10.0.0.2", "10.0.0.300"}},
+		},
+		{
+			name:         "several lines fail",
+			entries:      []string{"10.0.0.300", "10.0.0.2", "10.0.0.301", "10.0.0.4"},
+			bad:          []string{"10.0.0.300", "10.0.0.301"},
+			wantRestores: [][]string{{"10.0.0.300", "10.0.0.2", "10.0.0.301", "10.0.0.4"}, {"10.0.0.2", "10.0.0.301", "10.0.0.4"}, {"10.0.0.4"}},
+		},
+		{
+			name:         "unparseable error",
+			entries:      []string{"10.0.0.1", "10.0.0.300", "10.0.0.3"},
+			bad:          []string{"10.0.0.300"},
+			garbled:      true,
+			wantRestores: [][]string{{"10.0.0.1", "10.0.0.300", "10.0.0.3"}},
+			wantSingles:  []string{"10.0.0.1", "10.0.0.300", "10.0.0.3"},
+		},
+	}
+	for _, tt := range tests {
+		f := &fakeIPSet{bad: tt.bad, garbled: tt.garbled}
+		f.install(t)
+
+		ops := make([]setOp, len(tt.entries))
+		for i, e := range tt.entries {
+			ops[i] = setOp{set: "bypass", entry: e}
+		}
+		errs := ipsetRestore(context.Background(), ops)
+
+		if !slices.EqualFunc(f.restores, tt.wantRestores, slices.Equal) {
+			t.Errorf("%s: restores = %v, want %v", tt.name, f.restores, tt.wantRestores)
+		}
+		if !slices.Equal(f.singles, tt.wantSingles) {
+			t.Errorf("%s: single commands = %v, want %v", tt.name, f.singles, tt.wantSingles)
+		}
+		for i, e := range tt.entries {
+			switch failed := slices.Contains(tt.bad, e); {
+			case failed && (errs[i] == nil || !strings.Contains(errs[i].Error(), e)):
+				t.Errorf("%s: error of %s = %v, want one naming it", tt.name, e, errs[i])
+			case !failed && errs[i] != nil:
+				t.Errorf("%s: error of %s = %v, want nil", tt.name, e, errs[i])
+			case !failed && !slices.Contains(f.applied, e):
+				t.Errorf("%s: %s not applied", tt.name, e)
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package netfilter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/platform"
+)
+
+// NFTTable is the nftables table (family inet) holding all netshunt sets and
+// chains when the nftables backend is used.
+const NFTTable = "netshunt"
+
+// NFTSet manages a named set in the netshunt nftables table. It is backed by
+// two kernel sets: <name>_ip holds single addresses and <name> is an
+// interval set with auto-merge holding prefixes. An interval set merges
+// adjacent addresses into ranges, out of which a single address can't be
+// deleted again, so the addresses tracked from DNS answers are kept apart.
+// Rules look the set up in both, see NFTSetNames.
+type NFTSet struct {
+	name string
+	v6   bool
+}
+
+// nftAddrSuffix names the kernel set holding the single addresses of an
+// NFTSet.
+const nftAddrSuffix = "_ip"
+
+// NewNFTSet creates an NFTSet manager for the given set name (IPv4).
+func NewNFTSet(name string) *NFTSet {
+	return &NFTSet{name: name}
+}
+
+// NewNFTSet6 creates an NFTSet manager for IPv6 (type ipv6_addr).
+func NewNFTSet6(name string) *NFTSet {
+	return &NFTSet{name: name, v6: true}
+}
+
+// NFTSetNames returns the kernel sets backing the NFTSet called name: the
+// address set and the prefix set.
+func NFTSetNames(name string) []string {
+	return []string{name + nftAddrSuffix, name}
+}
+
+func (s *NFTSet) Name() string { return s.name }
+
+// Decls returns the declarations ("<name> { ... }") of the kernel sets
+// backing s, used by EnsureTable and rulesets.
+func (s *NFTSet) Decls() []string {
+	typ := "ipv4_addr"
+	if s.v6 {
+		typ = "ipv6_addr"
+	}
+	return []string{
+		fmt.Sprintf("%s%s { type %s; }", s.name, nftAddrSuffix, typ),
+		fmt.Sprintf("%s { type %s; flags interval; auto-merge; }", s.name, typ),
+	}
+}
+
+// EnsureTable creates the netshunt table and the sets if they don't exist.
+func (s *NFTSet) EnsureTable(ctx context.Context) error {
+	if err := platform.RunSilent(ctx, "nft", "add", "table", "inet", NFTTable); err != nil {
+		return err
+	}
+	for _, decl := range s.Decls() {
+		if err := platform.RunSilent(ctx, "nft", "add", "set", "inet", NFTTable, decl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush removes all elements from the set.
+func (s *NFTSet) Flush(ctx context.Context) error {
+	for _, name := range NFTSetNames(s.name) {
+		if err := platform.RunSilent(ctx, "nft", "flush", "set", "inet", NFTTable, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add adds an IP or CIDR to the set. Overlapping prefixes are merged.
+func (s *NFTSet) Add(ctx context.Context, entry string) error {
+	return nftBatch.do(ctx, s.ops(false, []string{entry}))[0]
+}
+
+// Del removes an IP or CIDR from the set.
+func (s *NFTSet) Del(ctx context.Context, entry string) error {
+	return nftBatch.do(ctx, s.ops(true, []string{entry}))[0]
+}
+
+// AddAll adds IPs and CIDRs to the set in one transaction, returning the
+// error of each entry that failed.
+func (s *NFTSet) AddAll(ctx context.Context, entries []string) map[string]error {
+	return nftBatch.apply(ctx, s.ops(false, entries))
+}
+
+// DelAll removes IPs and CIDRs from the set in one transaction, returning
+// the error of each entry that failed.
+func (s *NFTSet) DelAll(ctx context.Context, entries []string) map[string]error {
+	return nftBatch.apply(ctx, s.ops(true, entries))
+}
+
+// ops returns the ops updating entries, each in the kernel set holding its
+// kind of entry.
+func (s *NFTSet) ops(del bool, entries []string) []setOp {
+	ops := make([]setOp, len(entries))
+	for i, e := range entries {
+		set := s.name
+		if !strings.Contains(e, "/") {
+			set += nftAddrSuffix
+		}
+		ops[i] = setOp{del: del, set: set, entry: e}
+	}
+	return ops
+}
+
+var nftBatch = &batcher{exec: nftApply}
+
+// nftApply applies ops as one "nft -f" transaction. A transaction is all or
+// nothing, so when it fails the ops are applied one by one to find the
+// failing ones.
+func nftApply(ctx context.Context, ops []setOp) []error {
+	errs := make([]error, len(ops))
+	if len(ops) > 1 {
+		var script strings.Builder
+		for _, op := range ops {
+			fmt.Fprintf(&script, "%s element inet %s %s { %s }\n", op.nftVerb(), NFTTable, op.set, op.entry)
+		}
+		if runInput(ctx, script.String(), "nft", "-f", "-") == nil {
+			return errs
+		}
+	}
+	for i, op := range ops {
+		errs[i] = nftRun(ctx, op)
+	}
+	return errs
+}
+
+// nftRun applies a single op with its own nft command.
+func nftRun(ctx context.Context, op setOp) error {
+	return runSilent(ctx, "nft", op.nftVerb(), "element", "inet", NFTTable, op.set, "{ "+op.entry+" }")
+}
+
+// List returns all elements of the set.
+func (s *NFTSet) List(ctx context.Context) ([]string, error) {
+	var entries []string
+	for _, name := range NFTSetNames(s.name) {
+		out, err := platform.Run(ctx, "nft", "list", "set", "inet", NFTTable, name)
+		if err != nil {
+			return nil, fmt.Errorf("nft list set: %w", err)
+		}
+		entries = append(entries, parseNFTElements(out)...)
+	}
+	return entries, nil
+}
+
+// Count returns the number of elements in the set.
+func (s *NFTSet) Count(ctx context.Context) (int, error) {
+	entries, err := s.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// Destroy removes the set entirely.
+func (s *NFTSet) Destroy(ctx context.Context) error {
+	var errs []error
+	for _, name := range NFTSetNames(s.name) {
+		errs = append(errs, platform.RunSilent(ctx, "nft", "delete", "set", "inet", NFTTable, name))
+	}
+	return errors.Join(errs...)
+}
+
+// parseNFTElements extracts the members of "elements = { a, b, ... }" from
+// nft list set output. The list may span several lines.
+func parseNFTElements(out string) []string {
+	_, rest, ok := strings.Cut(out, "elements = {")
+	if !ok {
+		return nil
+	}
+	body, _, _ := strings.Cut(rest, "}")
+
+	return strings.FieldsFunc(body, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// NFTables manages chains in the netshunt nftables table. Rulesets are
+// applied atomically with nft -f: either the whole script takes effect or
+// none of it does.
+type NFTables struct{}
+
+// NewNFTables creates an NFTables manager.
+func NewNFTables() *NFTables {
+	return &NFTables{}
+}
+
+// Apply loads an nft script in a single transaction.
+func (n *NFTables) Apply(ctx context.Context, script string) error {
+	f, err := os.CreateTemp("", "netshunt-*.nft")
+	if err != nil {
+		return fmt.Errorf("create nft script: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		return fmt.Errorf("write nft script: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write nft script: %w", err)
+	}
+	return platform.RunSilent(ctx, "nft", "-f", f.Name())
+}
+
+// ListChains returns the names of all chains in the netshunt table.
+func (n *NFTables) ListChains(ctx context.Context) ([]string, error) {
+	out, err := platform.Run(ctx, "nft", "list", "table", "inet", NFTTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var chains []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "chain" {
+			chains = append(chains, fields[1])
+		}
+	}
+	return chains, nil
+}
+
+// ListChain returns the nft listing of a single chain.
+func (n *NFTables) ListChain(ctx context.Context, chain string) (string, error) {
+	return platform.Run(ctx, "nft", "list", "chain", "inet", NFTTable, chain)
+}
+
+// Check compares the netshunt table with the chains and rules script added
+// when it was applied and describes each difference: missing and stale
+// chains and chains whose rule count changed. It returns nil if nothing
+// drifted.
+func (n *NFTables) Check(ctx context.Context, script string) ([]string, error) {
+	var chains []string
+	want := make(map[string]int)
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "add" || fields[2] != "inet" || fields[3] != NFTTable {
+			continue
+		}
+		switch fields[1] {
+		case "chain":
+			chains = append(chains, fields[4])
+		case "rule":
+			want[fields[4]]++
+		}
+	}
+
+	out, err := platform.Run(ctx, "nft", "list", "table", "inet", NFTTable)
+	if err != nil {
+		return []string{fmt.Sprintf("table inet %s missing", NFTTable)}, nil
+	}
+	var existing []string
+	have := make(map[string]int)
+	cur := ""
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "chain":
+			cur = fields[1]
+			existing = append(existing, cur)
+		case cur == "":
+		case line == "}":
+			cur = ""
+		case line != "" && !strings.HasPrefix(line, "type "):
+			have[cur]++
+		}
+	}
+
+	var drift []string
+	for _, c := range chains {
+		switch {
+		case !slices.Contains(existing, c):
+			drift = append(drift, fmt.Sprintf("chain %s missing", c))
+		case have[c] != want[c]:
+			drift = append(drift, fmt.Sprintf("chain %s has %d rules, want %d", c, have[c], want[c]))
+		}
+	}
+	for _, c := range existing {
+		if !slices.Contains(chains, c) {
+			drift = append(drift, fmt.Sprintf("stale chain %s", c))
+		}
+	}
+	return drift, nil
+}
+
+// DeleteChains flushes and removes every chain in the netshunt table,
+// leaving the sets and their elements in place.
+func (n *NFTables) DeleteChains(ctx context.Context) error {
+	chains, err := n.ListChains(ctx)
+	if err != nil || len(chains) == 0 {
+		return nil // Table doesn't exist or holds no chains.
+	}
+
+	var b strings.Builder
+	for _, c := range chains {
+		fmt.Fprintf(&b, "flush chain inet %s %s\n", NFTTable, c)
+	}
+	for _, c := range chains {
+		fmt.Fprintf(&b, "delete chain inet %s %s\n", NFTTable, c)
+	}
+	return n.Apply(ctx, b.String())
+}
+
+// DeleteTable removes the netshunt table with all its chains and sets.
+func (n *NFTables) DeleteTable(ctx context.Context) error {
+	return platform.RunSilent(ctx, "nft", "delete", "table", "inet", NFTTable)
+}
@@ -0,0 +1,43 @@
+package netfilter
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNFTSetKeepsAddressesApart(t *testing.T) {
+	input, silent := runInput, runSilent
+	t.Cleanup(func() { runInput, runSilent = input, silent })
+
+	var scripts []string
+	runInput = func(_ context.Context, input, name string, args ...string) error {
+		scripts = append(scripts, input)
+		return errors.New("nft -f -: exit status 1: Error: Could not process rule: No such file or directory")
+	}
+	runSilent = func(_ context.Context, name string, args ...string) error {
+		if args[0] == "delete" && args[5] == "{ 10.0.0.2 }" {
+			return errors.New("nft delete element: exit status 1: Error: Could not process rule: No such file or directory")
+		}
+		return nil
+	}
+
+	s := NewNFTSet("bypass")
+	failed := s.DelAll(context.Background(), []string{"10.0.0.1", "10.0.0.2", "10.1.0.0/16"})
+
+	want := "delete element inet netshunt bypass_ip { 10.0.0.1 }\n" +
+		"delete element inet netshunt bypass_ip { 10.0.0.2 }\n" +
+		"delete element inet netshunt bypass { 10.1.0.0/16 }\n"
+	if !slices.Equal(scripts, []string{want}) {
+		t.Errorf("scripts = %q, want %q", scripts, want)
+	}
+	// A missing element is reported: the entry was not in the set.
+	if len(failed) != 1 || failed["10.0.0.2"] == nil {
+		t.Errorf("failed = %v, want only 10.0.0.2", failed)
+	}
+	if decls := s.Decls(); !strings.Contains(decls[0], "bypass_ip { type ipv4_addr; }") || !strings.Contains(decls[1], "flags interval") {
+		t.Errorf("decls = %q", decls)
+	}
+}
@@ -0,0 +1,403 @@
+package netfilter
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/platform"
+)
+
+// ChainPrefix starts the name of every iptables chain netshunt owns.
+const ChainPrefix = "NSHUNT"
+
+// Ruleset is the complete set of iptables chains and rules netshunt wants in
+// place for one address family. IPTables.Restore applies it in a single
+// iptables-restore transaction that replaces whatever netshunt installed
+// before and leaves foreign chains and rules alone.
+//
+// Chains and rules belong to the mandatory core or to a named optional group
+// (see Optional), which Restore leaves out if the kernel rejects it.
+type Ruleset struct {
+	group string
+	rules *ruleset
+}
+
+type ruleset struct {
+	tables []*restoreTable
+	groups []string
+	kept   []string // optional groups the last Restore applied
+
+	// applied is what iptables-save showed right after the last Restore,
+	// in the form iptables normalizes rules to.
+	applied map[string]*installedTable
+}
+
+type restoreTable struct {
+	name   string
+	chains []restoreLine
+	rules  []restoreLine
+}
+
+// restoreLine is a chain name or rule spec tagged with its group.
+type restoreLine struct {
+	group string
+	args  []string
+}
+
+// NewRuleset returns an empty ruleset. Restoring it removes every chain and
+// rule netshunt installed.
+func NewRuleset() *Ruleset {
+	return &Ruleset{rules: &ruleset{}}
+}
+
+// Optional returns a view of rs whose chains and rules form the named
+// optional group, e.g. UDP TPROXY rules that need a kernel module the router
+// may lack.
+func (rs *Ruleset) Optional(group string) *Ruleset {
+	if !slices.Contains(rs.rules.groups, group) {
+		rs.rules.groups = append(rs.rules.groups, group)
+	}
+	return &Ruleset{group: group, rules: rs.rules}
+}
+
+// CreateChain declares a netshunt chain. The name must start with
+// ChainPrefix.
+func (rs *Ruleset) CreateChain(table, chain string) {
+	t := rs.table(table)
+	t.chains = append(t.chains, restoreLine{group: rs.group, args: []string{chain}})
+}
+
+// AppendRule appends a rule. ruleSpec starts with the chain name, as with
+// "iptables -A". Rules in built-in chains must jump to a netshunt chain, so
+// the next Restore recognizes and replaces them.
+func (rs *Ruleset) AppendRule(table string, ruleSpec ...string) {
+	t := rs.table(table)
+	t.rules = append(t.rules, restoreLine{group: rs.group, args: ruleSpec})
+}
+
+func (rs *Ruleset) table(name string) *restoreTable {
+	for _, t := range rs.rules.tables {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &restoreTable{name: name}
+	rs.rules.tables = append(rs.rules.tables, t)
+	return t
+}
+
+// installedTable is what netshunt currently has in one kernel table: its
+// chains, the rules of each, and its rules in foreign (built-in) chains, all
+// as iptables-save rule specs without the leading "-A".
+type installedTable struct {
+	chains []string
+	owned  map[string][]string
+	rules  []string
+}
+
+// script renders the iptables-restore input that turns installed into the
+// core of rs plus the groups in keep. Per table, chains of the ruleset and
+// stale netshunt chains are declared (which flushes them with --noflush),
+// installed rules in built-in chains are deleted, the ruleset's rules are
+// appended and stale chains are removed.
+func (rs *Ruleset) script(installed map[string]*installedTable, keep []string) string {
+	kept := func(l restoreLine) bool { return l.group == "" || slices.Contains(keep, l.group) }
+
+	names := make([]string, 0, len(rs.rules.tables))
+	for _, t := range rs.rules.tables {
+		names = append(names, t.name)
+	}
+	for _, name := range slices.Sorted(maps.Keys(installed)) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		var chains []string
+		var rules [][]string
+		for _, t := range rs.rules.tables {
+			if t.name != name {
+				continue
+			}
+			for _, c := range t.chains {
+				if kept(c) && !slices.Contains(chains, c.args[0]) {
+					chains = append(chains, c.args[0])
+				}
+			}
+			for _, r := range t.rules {
+				if kept(r) {
+					rules = append(rules, r.args)
+				}
+			}
+		}
+
+		inst := installed[name]
+		if inst == nil {
+			inst = &installedTable{}
+		}
+		var stale []string
+		for _, c := range inst.chains {
+			if !slices.Contains(chains, c) {
+				stale = append(stale, c)
+			}
+		}
+		if len(chains)+len(rules)+len(inst.chains)+len(inst.rules) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "*%s\n", name)
+		for _, c := range append(chains, stale...) {
+			fmt.Fprintf(&b, ":%s - [0:0]\n", c)
+		}
+		for _, r := range inst.rules {
+			fmt.Fprintf(&b, "-D %s\n", r)
+		}
+		for _, r := range rules {
+			fmt.Fprintf(&b, "-A %s\n", quoteArgs(r))
+		}
+		for _, c := range stale {
+			fmt.Fprintf(&b, "-X %s\n", c)
+		}
+		b.WriteString("COMMIT\n")
+	}
+	return b.String()
+}
+
+// Restore replaces netshunt's chains and rules with rs in one
+// iptables-restore --noflush transaction: chains of rs are flushed and
+// refilled, netshunt rules in built-in chains are swapped for those of rs and
+// netshunt chains missing from rs are deleted. Traffic never sees a state
+// without rules, and restoring the same ruleset again changes nothing.
+//
+// If the transaction fails, each optional group is tested on top of the core
+// and the groups the kernel rejects are left out; their errors are returned
+// in skipped. err is set only when the core itself fails.
+func (ipt *IPTables) Restore(ctx context.Context, rs *Ruleset) (skipped map[string]error, err error) {
+	installed, err := ipt.installed(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := rs.rules.groups
+	err = ipt.restore(ctx, rs.script(installed, groups), false)
+	if err == nil || len(groups) == 0 {
+		if err == nil {
+			rs.rules.kept = groups
+			ipt.saveApplied(ctx, rs)
+		}
+		return nil, err
+	}
+
+	if err := ipt.restore(ctx, rs.script(installed, nil), true); err != nil {
+		return nil, err
+	}
+	var keep []string
+	skipped = make(map[string]error)
+	for _, g := range groups {
+		if err := ipt.restore(ctx, rs.script(installed, []string{g}), true); err != nil {
+			skipped[g] = err
+			continue
+		}
+		keep = append(keep, g)
+	}
+	if err := ipt.restore(ctx, rs.script(installed, keep), false); err != nil {
+		return nil, err
+	}
+	rs.rules.kept = keep
+	ipt.saveApplied(ctx, rs)
+	return skipped, nil
+}
+
+// saveApplied records the rules the kernel holds right after a Restore of
+// rs, which Check compares later rule sets against. Without them Check only
+// compares chains and rule counts.
+func (ipt *IPTables) saveApplied(ctx context.Context, rs *Ruleset) {
+	rs.rules.applied, _ = ipt.installed(ctx)
+}
+
+// Check compares netshunt's chains and rules in the kernel with rs as the
+// last Restore applied it (the core plus the optional groups it kept) and
+// describes each difference: missing and stale chains, chains whose rule
+// count changed and missing rules. It returns nil if nothing drifted. It
+// reads the kernel's rules with a single iptables-save.
+func (ipt *IPTables) Check(ctx context.Context, rs *Ruleset) ([]string, error) {
+	installed, err := ipt.installed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rs.check(installed), nil
+}
+
+// check describes how installed differs from rs, see Check.
+func (rs *Ruleset) check(installed map[string]*installedTable) []string {
+	kept := func(l restoreLine) bool { return l.group == "" || slices.Contains(rs.rules.kept, l.group) }
+
+	var drift []string
+	wanted := make(map[string][]string) // table -> chains of rs
+	for _, t := range rs.rules.tables {
+		inst := installed[t.name]
+		if inst == nil {
+			inst = &installedTable{}
+		}
+		want := make(map[string]int) // chain -> rules of rs
+		for _, c := range t.chains {
+			if kept(c) && !slices.Contains(wanted[t.name], c.args[0]) {
+				wanted[t.name] = append(wanted[t.name], c.args[0])
+			}
+		}
+		for _, r := range t.rules {
+			if kept(r) {
+				want[r.args[0]]++
+			}
+		}
+
+		for _, c := range wanted[t.name] {
+			if !slices.Contains(inst.chains, c) {
+				drift = append(drift, fmt.Sprintf("%s: chain %s missing", t.name, c))
+			} else if have := len(inst.owned[c]); have != want[c] {
+				drift = append(drift, fmt.Sprintf("%s: chain %s has %d rules, want %d", t.name, c, have, want[c]))
+			}
+		}
+		for _, chain := range slices.Sorted(maps.Keys(want)) {
+			if isOwnedChain(chain) {
+				continue
+			}
+			have := 0
+			for _, r := range inst.rules {
+				if fields := strings.Fields(r); fields[0] == chain {
+					have++
+				}
+			}
+			if have != want[chain] {
+				drift = append(drift, fmt.Sprintf("%s: chain %s has %d netshunt rules, want %d", t.name, chain, have, want[chain]))
+			}
+		}
+		// Rules are compared in the form iptables-save gave them after the
+		// last Restore.
+		applied := rs.rules.applied[t.name]
+		if applied == nil {
+			continue
+		}
+		for _, chain := range slices.Sorted(maps.Keys(applied.owned)) {
+			if !slices.Contains(inst.chains, chain) {
+				continue // already reported as a missing chain
+			}
+			for _, r := range applied.owned[chain] {
+				if !slices.Contains(inst.owned[chain], r) {
+					drift = append(drift, fmt.Sprintf("%s: rule missing: -A %s", t.name, r))
+				}
+			}
+		}
+		for _, r := range applied.rules {
+			if !slices.Contains(inst.rules, r) {
+				drift = append(drift, fmt.Sprintf("%s: rule missing: -A %s", t.name, r))
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(installed)) {
+		for _, c := range installed[name].chains {
+			if !slices.Contains(wanted[name], c) {
+				drift = append(drift, fmt.Sprintf("%s: stale chain %s", name, c))
+			}
+		}
+	}
+	return drift
+}
+
+// restore feeds script to iptables-restore without flushing the tables.
+// With test set the ruleset is only checked, not committed.
+func (ipt *IPTables) restore(ctx context.Context, script string, test bool) error {
+	args := []string{"-w", "--noflush"}
+	if test {
+		args = append(args, "--test")
+	}
+	return platform.RunInput(ctx, script, ipt.cmd+"-restore", args...)
+}
+
+// installed reads the netshunt chains and rules currently in the kernel from
+// iptables-save.
+func (ipt *IPTables) installed(ctx context.Context) (map[string]*installedTable, error) {
+	out, err := platform.Run(ctx, ipt.cmd+"-save")
+	if err != nil {
+		return nil, fmt.Errorf("read current rules: %w", err)
+	}
+	return parseSave(out), nil
+}
+
+// parseSave extracts the netshunt chains and rules of each table from
+// iptables-save output. Tables without any are left out.
+func parseSave(out string) map[string]*installedTable {
+	tables := make(map[string]*installedTable)
+	var cur *installedTable
+	for _, line := range strings.Split(out, "\n") {
+		switch {
+		case strings.HasPrefix(line, "*"):
+			cur = &installedTable{owned: make(map[string][]string)}
+			tables[line[1:]] = cur
+		case cur == nil:
+		case strings.HasPrefix(line, ":"):
+			if chain, _, _ := strings.Cut(line[1:], " "); isOwnedChain(chain) {
+				cur.chains = append(cur.chains, chain)
+			}
+		case strings.HasPrefix(line, "-A "):
+			spec := line[len("-A "):]
+			fields := strings.Fields(spec)
+			switch {
+			case len(fields) == 0:
+			case isOwnedChain(fields[0]):
+				cur.owned[fields[0]] = append(cur.owned[fields[0]], spec)
+			case isOwnedRule(fields):
+				cur.rules = append(cur.rules, spec)
+			}
+		}
+	}
+	for name, t := range tables {
+		if len(t.chains)+len(t.rules) == 0 {
+			delete(tables, name)
+		}
+	}
+	return tables
+}
+
+func isOwnedChain(chain string) bool {
+	return strings.HasPrefix(chain, ChainPrefix)
+}
+
+// isOwnedRule reports whether a rule of a foreign chain belongs to netshunt:
+// it jumps to a netshunt chain, or it is a DNS DNAT to the local forwarder as
+// installed directly into PREROUTING by earlier versions.
+func isOwnedRule(fields []string) bool {
+	var dns, dnat bool
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "-j", "-g":
+			if isOwnedChain(fields[i+1]) {
+				return true
+			}
+		case "--dport":
+			dns = fields[i+1] == "53"
+		case "--to-destination":
+			dnat = fields[i+1] == "127.0.0.1" || fields[i+1] == "::1"
+		}
+	}
+	return dns && dnat
+}
+
+// quoteArgs joins rule arguments for iptables-restore, quoting those that
+// contain whitespace or quotes.
+func quoteArgs(args []string) string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		if a == "" || strings.ContainsAny(a, " \t\"'") {
+			a = strconv.Quote(a)
+		}
+		out[i] = a
+	}
+	return strings.Join(out, " ")
+}
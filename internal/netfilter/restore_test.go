@@ -0,0 +1,219 @@
+package netfilter
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testRuleset is a TPROXY-like ruleset: a mangle chain with an optional UDP
+// group, and a DNS DNAT chain, each hooked into PREROUTING.
+func testRuleset() *Ruleset {
+	rs := NewRuleset()
+	rs.CreateChain("mangle", "NSHUNT_TPROXY")
+	rs.AppendRule("mangle", "NSHUNT_TPROXY", "-d", "10.0.0.0/8", "-j", "RETURN")
+	rs.AppendRule("mangle", "NSHUNT_TPROXY", "-p", "tcp", "-m", "set", "--match-set", "bypass", "dst", "-j", "TPROXY", "--on-port", "1181")
+	udp := rs.Optional("udp")
+	udp.AppendRule("mangle", "NSHUNT_TPROXY", "-p", "udp", "-m", "set", "--match-set", "bypass", "dst", "-j", "TPROXY", "--on-port", "1181")
+	rs.AppendRule("mangle", "PREROUTING", "-i", "br0", "-j", "NSHUNT_TPROXY")
+	rs.CreateChain("nat", "NSHUNT_DNS")
+	rs.AppendRule("nat", "NSHUNT_DNS", "-j", "DNAT", "--to-destination", "127.0.0.1")
+	rs.AppendRule("nat", "PREROUTING", "-i", "br0", "-p", "udp", "--dport", "53", "-j", "NSHUNT_DNS")
+	rs.AppendRule("nat", "PREROUTING", "-m", "comment", "--comment", "netshunt dns", "-j", "NSHUNT_DNS")
+	return rs
+}
+
+func TestRulesetScript(t *testing.T) {
+	tests := []struct {
+		name      string
+		installed map[string]*installedTable
+		keep      []string
+		want      string
+	}{
+		{
+			name: "fresh install",
+			keep: []string{"udp"},
+			want: `*mangle
+:NSHUNT_TPROXY - [0:0]
+-A NSHUNT_TPROXY -d 10.0.0.0/8 -j RETURN
+-A NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181
+-A NSHUNT_TPROXY -p udp -m set --match-set bypass dst -j TPROXY --on-port 1181
+-A PREROUTING -i br0 -j NSHUNT_TPROXY
+COMMIT
+*nat
+:NSHUNT_DNS - [0:0]
+-A NSHUNT_DNS -j DNAT --to-destination 127.0.0.1
+-A PREROUTING -i br0 -p udp --dport 53 -j NSHUNT_DNS
+-A PREROUTING -m comment --comment "netshunt dns" -j NSHUNT_DNS
+COMMIT
+`,
+		},
+		{
+			name: "optional group left out",
+			want: `*mangle
+:NSHUNT_TPROXY - [0:0]
+-A NSHUNT_TPROXY -d 10.0.0.0/8 -j RETURN
+-A NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181
+-A PREROUTING -i br0 -j NSHUNT_TPROXY
+COMMIT
+*nat
+:NSHUNT_DNS - [0:0]
+-A NSHUNT_DNS -j DNAT --to-destination 127.0.0.1
+-A PREROUTING -i br0 -p udp --dport 53 -j NSHUNT_DNS
+-A PREROUTING -m comment --comment "netshunt dns" -j NSHUNT_DNS
+COMMIT
+`,
+		},
+		{
+			// The previous ruleset's jumps are swapped for the new ones, its
+			// stale chain is flushed and deleted, and the filter table it
+			// alone used is cleaned up.
+			name: "replace",
+			keep: []string{"udp"},
+			installed: map[string]*installedTable{
+				"mangle": {
+					chains: []string{"NSHUNT_TPROXY", "NSHUNT_TPROXY_1081"},
+					rules:  []string{"PREROUTING -i br0 -j NSHUNT_TPROXY"},
+				},
+				"filter": {
+					chains: []string{"NSHUNT_KILL"},
+					rules:  []string{"FORWARD -i br0 -j NSHUNT_KILL"},
+				},
+			},
+			want: `*mangle
+:NSHUNT_TPROXY - [0:0]
+:NSHUNT_TPROXY_1081 - [0:0]
+-D PREROUTING -i br0 -j NSHUNT_TPROXY
+-A NSHUNT_TPROXY -d 10.0.0.0/8 -j RETURN
+-A NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181
+-A NSHUNT_TPROXY -p udp -m set --match-set bypass dst -j TPROXY --on-port 1181
+-A PREROUTING -i br0 -j NSHUNT_TPROXY
+-X NSHUNT_TPROXY_1081
+COMMIT
+*nat
+:NSHUNT_DNS - [0:0]
+-A NSHUNT_DNS -j DNAT --to-destination 127.0.0.1
+-A PREROUTING -i br0 -p udp --dport 53 -j NSHUNT_DNS
+-A PREROUTING -m comment --comment "netshunt dns" -j NSHUNT_DNS
+COMMIT
+*filter
+:NSHUNT_KILL - [0:0]
+-D FORWARD -i br0 -j NSHUNT_KILL
+-X NSHUNT_KILL
+COMMIT
+`,
+		},
+	}
+	for _, tt := range tests {
+		if got := testRuleset().script(tt.installed, tt.keep); got != tt.want {
+			t.Errorf("%s: script =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+
+	// The empty ruleset removes everything netshunt installed.
+	installed := map[string]*installedTable{
+		"nat": {rules: []string{"PREROUTING -i br0 -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1"}},
+	}
+	want := "*nat\n-D PREROUTING -i br0 -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1\nCOMMIT\n"
+	if got := NewRuleset().script(installed, nil); got != want {
+		t.Errorf("empty ruleset: script =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// testSave is iptables-save output with netshunt's chains next to the
+// firmware's, and a DNS DNAT an earlier version put into PREROUTING.
+const testSave = `# Generated by iptables-save v1.8.7 on Thu Jan  1 12:00:00 2025
+*mangle
+:PREROUTING ACCEPT [1520:301234]
+:INPUT ACCEPT [1210:90012]
+:NSHUNT_TPROXY - [0:0]
+:_NDM_HOTSPOT_PRERT - [0:0]
+-A PREROUTING -i br0 -j NSHUNT_TPROXY
+-A PREROUTING -j _NDM_HOTSPOT_PRERT
+-A NSHUNT_TPROXY -d 10.0.0.0/8 -j RETURN
+-A NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1
+-A _NDM_HOTSPOT_PRERT -j RETURN
+COMMIT
+# Completed on Thu Jan  1 12:00:00 2025
+*nat
+:PREROUTING ACCEPT [310:20011]
+:_NDM_DNAT - [0:0]
+-A PREROUTING -i br0 -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1
+-A PREROUTING -i br0 -p tcp -m tcp --dport 53 -j DNAT --to-destination 192.168.1.1
+-A PREROUTING -j _NDM_DNAT
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+-A FORWARD -j ACCEPT
+COMMIT
+`
+
+func TestParseSave(t *testing.T) {
+	got := parseSave(testSave)
+
+	if names := slices.Sorted(maps.Keys(got)); !slices.Equal(names, []string{"mangle", "nat"}) {
+		t.Fatalf("tables = %v, want [mangle nat]", names)
+	}
+	mangle := got["mangle"]
+	if !slices.Equal(mangle.chains, []string{"NSHUNT_TPROXY"}) {
+		t.Errorf("mangle chains = %v", mangle.chains)
+	}
+	if rules := mangle.owned["NSHUNT_TPROXY"]; len(rules) != 2 || len(mangle.owned) != 1 ||
+		rules[1] != "NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1" {
+		t.Errorf("mangle rules by chain = %v", mangle.owned)
+	}
+	if !slices.Equal(mangle.rules, []string{"PREROUTING -i br0 -j NSHUNT_TPROXY"}) {
+		t.Errorf("mangle rules = %v", mangle.rules)
+	}
+	nat := got["nat"]
+	if len(nat.chains) != 0 {
+		t.Errorf("nat chains = %v, want none", nat.chains)
+	}
+	// The firmware's own DNAT is not netshunt's.
+	if want := []string{"PREROUTING -i br0 -p udp -m udp --dport 53 -j DNAT --to-destination 127.0.0.1"}; !slices.Equal(nat.rules, want) {
+		t.Errorf("nat rules = %v, want %v", nat.rules, want)
+	}
+}
+
+func TestRulesetCheck(t *testing.T) {
+	// testRuleset without its UDP group, as iptables-save shows it.
+	const save = `*mangle
+:PREROUTING ACCEPT [0:0]
+:NSHUNT_TPROXY - [0:0]
+-A PREROUTING -i br0 -j NSHUNT_TPROXY
+-A NSHUNT_TPROXY -d 10.0.0.0/8 -j RETURN
+-A NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:NSHUNT_DNS - [0:0]
+-A PREROUTING -i br0 -p udp -m udp --dport 53 -j NSHUNT_DNS
+-A PREROUTING -m comment --comment "netshunt dns" -j NSHUNT_DNS
+-A NSHUNT_DNS -j DNAT --to-destination 127.0.0.1
+COMMIT
+`
+	rs := testRuleset()
+	rs.rules.applied = parseSave(save)
+
+	if drift := rs.check(parseSave(save)); len(drift) != 0 {
+		t.Errorf("unchanged rules drifted: %v", drift)
+	}
+
+	// Another program changed the TPROXY port, removed the DNS chain and
+	// left a chain of an older ruleset.
+	changed := strings.NewReplacer(
+		"--on-port 1181", "--on-port 1182",
+		":NSHUNT_DNS - [0:0]\n", ":NSHUNT_OLD - [0:0]\n",
+		"-A NSHUNT_DNS -j DNAT --to-destination 127.0.0.1\n", "",
+	).Replace(save)
+	want := []string{
+		"mangle: rule missing: -A NSHUNT_TPROXY -p tcp -m set --match-set bypass dst -j TPROXY --on-port 1181 --on-ip 0.0.0.0 --tproxy-mark 0x1/0x1",
+		"nat: chain NSHUNT_DNS missing",
+		"nat: stale chain NSHUNT_OLD",
+	}
+	if drift := rs.check(parseSave(changed)); !slices.Equal(drift, want) {
+		t.Errorf("drift = %q, want %q", drift, want)
+	}
+}
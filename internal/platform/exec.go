@@ -25,3 +25,16 @@ func RunSilent(ctx context.Context, name string, args ...string) error {
 	_, err := Run(ctx, name, args...)
 	return err
 }
+
+// RunInput executes a command with input on stdin and only returns an error
+// if it fails.
+func RunInput(ctx context.Context, input, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w: %s", name, strings.Join(args, " "), err, stderr.String())
+	}
+	return nil
+}
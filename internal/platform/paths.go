@@ -11,11 +11,17 @@ const (
 	ShuntsFile  = ConfigDir + "/shunts.yaml"
 	GeositeFile = ConfigDir + "/dlc.dat"
 
+	// State files.
+	StateDir    = OptDir + "/var/lib/netshunt"
+	FakeIPFile  = StateDir + "/fakeip.json"
+	TrackerFile = StateDir + "/tracker.json"
+
 	// dnscrypt-proxy.
 	DnscryptConfFile = OptDir + "/etc/dnscrypt-proxy.toml"
 
 	// Daemon.
 	PidFile       = "/var/run/netshunt.pid"
+	PauseFile     = "/var/run/netshunt.pause"
 	DefaultListen = ":8080"
 
 	// NDM directories.
@@ -0,0 +1,22 @@
+package platform
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// PausedUntil returns the end of the routing pause the daemon recorded in
+// PauseFile, for processes other than the daemon. ok is false if routing is
+// not paused or the pause is over.
+func PausedUntil() (until time.Time, ok bool) {
+	data, err := os.ReadFile(PauseFile)
+	if err != nil {
+		return time.Time{}, false
+	}
+	until, err = time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil || !time.Now().Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
@@ -80,7 +80,7 @@ type Interface struct {
 	Type        string `json:"type"`
 	Description string `json:"description"`
 	Connected   bool   `json:"connected"`
-	Link        string `json:"link"`   // "up" or "down"
+	Link        string `json:"link"` // "up" or "down"
 	SystemName  string `json:"system-name"`
 }
 
@@ -173,3 +173,61 @@ func (c *Client) saveConfig(ctx context.Context) error {
 	return nil
 }
 
+// Host is a LAN client known to the router.
+type Host struct {
+	MAC      string `json:"mac"`
+	IP       string `json:"ip"`
+	Name     string `json:"name"`     // user-assigned name in the router UI
+	Hostname string `json:"hostname"` // DHCP hostname
+	Active   bool   `json:"active"`
+}
+
+// Label returns the most descriptive name of the host, falling back to its
+// IP address.
+func (h Host) Label() string {
+	switch {
+	case h.Name != "":
+		return h.Name
+	case h.Hostname != "":
+		return h.Hostname
+	}
+	return h.IP
+}
+
+// GetHosts returns the LAN clients registered on the router (show ip hotspot).
+func (c *Client) GetHosts(ctx context.Context) ([]Host, error) {
+	data, err := c.rciGet(ctx, "show/ip/hotspot")
+	if err != nil {
+		return nil, err
+	}
+
+	list, _ := data["host"].([]any)
+	var hosts []Host
+	for _, val := range list {
+		m, ok := val.(map[string]any)
+		if !ok {
+			continue
+		}
+		var h Host
+		if v, ok := m["mac"].(string); ok {
+			h.MAC = strings.ToLower(v)
+		}
+		if v, ok := m["ip"].(string); ok && v != "0.0.0.0" {
+			h.IP = v
+		}
+		if v, ok := m["name"].(string); ok {
+			h.Name = v
+		}
+		if v, ok := m["hostname"].(string); ok {
+			h.Hostname = v
+		}
+		if v, ok := m["active"].(bool); ok {
+			h.Active = v
+		}
+		if h.MAC == "" {
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
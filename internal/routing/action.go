@@ -0,0 +1,115 @@
+package routing
+
+import (
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+const (
+	blockChainName  = "NSHUNT_BLOCK"
+	block6ChainName = "NSHUNT6_BLOCK"
+)
+
+// actionSets holds the ipset names of the direct and block targets of one
+// address family. A name is empty when no enabled shunt uses the action.
+//
+// Members of both sets are exceptions: every proxy, mark and OUTPUT chain
+// RETURNs them before its proxy rules. Traffic to block set members then
+// reaches the filter FORWARD chain, where NSHUNT_BLOCK rejects it unless the
+// destination is also a direct exception.
+type actionSets struct {
+	direct string
+	block  string
+}
+
+// familyActionSets returns the direct and block ipsets among targets.
+func familyActionSets(cfg *config.Config, targets []shunt.Target, v6 bool) actionSets {
+	var out actionSets
+	for _, t := range targets {
+		set4, set6 := cfg.IPSet.Names(t.Suffix())
+		name := set4
+		if v6 {
+			name = set6
+		}
+		switch t.Action {
+		case shunt.ActionDirect:
+			out.direct = name
+		case shunt.ActionBlock:
+			out.block = name
+		}
+	}
+	return out
+}
+
+// exceptions returns the sets whose members are never proxied, direct first.
+func (a actionSets) exceptions() []string {
+	var out []string
+	for _, set := range []string{a.direct, a.block} {
+		if set != "" {
+			out = append(out, set)
+		}
+	}
+	return out
+}
+
+// excludeSets RETURNs traffic to members of the given ipsets.
+func excludeSets(rs *netfilter.Ruleset, table, chain string, sets []string) {
+	for _, set := range sets {
+		rs.AppendRule(table, chain, "-m", "set", "--match-set", set, "dst", "-j", "RETURN")
+	}
+}
+
+// blockRules hooks NSHUNT_BLOCK (NSHUNT6_BLOCK for IPv6) into the filter
+// FORWARD chain for traffic entering on ifaces: it rejects forwarded traffic
+// of the globally selected clients to members of the block set, TCP with a
+// reset so connections fail fast. Nothing is added without block shunts.
+func blockRules(rs *netfilter.Ruleset, cfg *config.Config, sets actionSets, ifaces []string, v6 bool) {
+	if sets.block == "" {
+		return
+	}
+	chain := blockChainName
+	if v6 {
+		chain = block6ChainName
+	}
+	clients := globalClients(cfg)
+
+	rs.CreateChain("filter", chain)
+	excludeClients(rs, "filter", chain, clients, v6)
+	if sets.direct != "" {
+		excludeSets(rs, "filter", chain, []string{sets.direct})
+	}
+	rs.AppendRule("filter", chain, "-p", "tcp", "-m", "set", "--match-set", sets.block, "dst",
+		"-j", "REJECT", "--reject-with", "tcp-reset")
+	rs.AppendRule("filter", chain, "-m", "set", "--match-set", sets.block, "dst", "-j", "REJECT")
+	addJump(rs, "filter", "FORWARD", ifaces, chain, clients, v6)
+}
+
+// block adds the nftables equivalent of blockRules to s.
+func (s *nftScript) block(ifaces []string) {
+	blocked := false
+	for _, f := range s.fams {
+		blocked = blocked || f.actions.block != ""
+	}
+	if !blocked {
+		return
+	}
+
+	s.chain(nftForwardFilter)
+	s.chain(blockChainName)
+	for _, c := range s.clients.nftExcluded(s.fams) {
+		s.rule(blockChainName, "%sreturn", c)
+	}
+	for _, f := range s.fams {
+		if f.actions.direct != "" {
+			s.rule(blockChainName, "%s daddr @%s return", f.proto, f.actions.direct)
+		}
+	}
+	for _, f := range s.fams {
+		if f.actions.block != "" {
+			s.rule(blockChainName, "meta l4proto tcp %s daddr @%s reject with tcp reset", f.proto, f.actions.block)
+			s.rule(blockChainName, "%s daddr @%s reject", f.proto, f.actions.block)
+		}
+	}
+	s.jump(nftForwardFilter, ifaces, blockChainName)
+}
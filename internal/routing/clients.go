@@ -0,0 +1,149 @@
+package routing
+
+import (
+	"net"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// clientSel is a selection of LAN clients (by source address or MAC) whose
+// traffic a rule applies to. The zero value selects every client.
+type clientSel struct {
+	exclude bool
+	v4, v6  []string // source IPs/CIDRs by address family
+	macs    []string
+	set     bool // false selects every client
+}
+
+// newClientSel builds a selection from normalized IP, CIDR or MAC clients.
+// An empty list selects every client.
+func newClientSel(clients []string, exclude bool) clientSel {
+	if len(clients) == 0 {
+		return clientSel{}
+	}
+	c := clientSel{exclude: exclude, set: true}
+	for _, cl := range clients {
+		switch {
+		case isMAC(cl):
+			c.macs = append(c.macs, cl)
+		case isIPv6Client(cl):
+			c.v6 = append(c.v6, cl)
+		default:
+			c.v4 = append(c.v4, cl)
+		}
+	}
+	return c
+}
+
+// globalClients returns the client selection configured for all shunts.
+func globalClients(cfg *config.Config) clientSel {
+	return newClientSel(cfg.Clients.List, cfg.Clients.Exclude)
+}
+
+// targetClients returns the per-shunt client selection of a target.
+func targetClients(t shunt.Target) clientSel {
+	exclude, clients := t.ClientSelection()
+	return newClientSel(clients, exclude)
+}
+
+func (c clientSel) addrs(v6 bool) []string {
+	if v6 {
+		return c.v6
+	}
+	return c.v4
+}
+
+// iptIncluded returns the iptables matches of rules that apply to the
+// selection: one per listed client in include mode, otherwise a single
+// empty match. Include mode with no clients of the family yields none.
+func (c clientSel) iptIncluded(v6 bool) [][]string {
+	if !c.set || c.exclude {
+		return [][]string{nil}
+	}
+	return c.iptMatches(v6)
+}
+
+// iptExcluded returns the iptables matches of clients to RETURN early in
+// exclude mode.
+func (c clientSel) iptExcluded(v6 bool) [][]string {
+	if !c.set || !c.exclude {
+		return nil
+	}
+	return c.iptMatches(v6)
+}
+
+func (c clientSel) iptMatches(v6 bool) [][]string {
+	var out [][]string
+	for _, a := range c.addrs(v6) {
+		out = append(out, []string{"-s", a})
+	}
+	for _, m := range c.macs {
+		out = append(out, []string{"-m", "mac", "--mac-source", m})
+	}
+	return out
+}
+
+// nftIncluded returns nft rule prefixes that apply a family-independent rule
+// to the selection: one per client kind in include mode, otherwise a single
+// empty prefix. fams limits the address families rendered.
+func (c clientSel) nftIncluded(fams []nftFamily) []string {
+	if !c.set || c.exclude {
+		return []string{""}
+	}
+	return c.nftMatches(fams, "")
+}
+
+// nftExcluded returns nft rule prefixes matching excluded clients, for
+// RETURN rules in exclude mode.
+func (c clientSel) nftExcluded(fams []nftFamily) []string {
+	if !c.set || !c.exclude {
+		return nil
+	}
+	return c.nftMatches(fams, "")
+}
+
+// nftTarget returns the nft rule prefixes of a rule of family f restricted
+// to the selection. Exclude mode negates the matches in a single prefix, which
+// is safe because the rule already matches only family f.
+func (c clientSel) nftTarget(f nftFamily) []string {
+	if !c.set {
+		return []string{""}
+	}
+	if c.exclude {
+		return []string{strings.Join(c.nftMatches([]nftFamily{f}, "!= "), "")}
+	}
+	return c.nftMatches([]nftFamily{f}, "")
+}
+
+func (c clientSel) nftMatches(fams []nftFamily, op string) []string {
+	var out []string
+	for _, f := range fams {
+		if addrs := c.addrs(f.proto == "ip6"); len(addrs) > 0 {
+			out = append(out, f.proto+" saddr "+op+nftElements(addrs)+" ")
+		}
+	}
+	if len(c.macs) > 0 {
+		out = append(out, "ether saddr "+op+nftElements(c.macs)+" ")
+	}
+	return out
+}
+
+// nftElements renders an anonymous nft set.
+func nftElements(elems []string) string {
+	return "{ " + strings.Join(elems, ", ") + " }"
+}
+
+func isMAC(s string) bool {
+	_, err := net.ParseMAC(s)
+	return err == nil
+}
+
+func isIPv6Client(s string) bool {
+	if _, cidr, err := net.ParseCIDR(s); err == nil {
+		return cidr.IP.To4() == nil
+	}
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() == nil
+}
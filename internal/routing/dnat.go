@@ -0,0 +1,28 @@
+package routing
+
+import (
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+)
+
+// dnsChainName is the nat chain that DNATs DNS queries to the forwarder.
+const dnsChainName = "NSHUNT_DNS"
+
+// dnsInterfaces returns the LAN interfaces whose DNS queries are
+// intercepted, see config.NetworkConfig.DNSInterfaces.
+func dnsInterfaces(cfg *config.Config) []string {
+	return cfg.Network.DNSInterfaces()
+}
+
+// dnsRedirect DNATs DNS queries (UDP + TCP port 53) arriving on ifaces to the
+// local forwarder at addr ("127.0.0.1" or "[::1]"). The DNAT lives in its own
+// chain so the PREROUTING jumps are recognizable as netshunt's.
+func dnsRedirect(rs *netfilter.Ruleset, ifaces []string, addr string) {
+	rs.CreateChain("nat", dnsChainName)
+	rs.AppendRule("nat", dnsChainName, "-j", "DNAT", "--to-destination", addr)
+	for _, iface := range ifaces {
+		for _, proto := range []string{"udp", "tcp"} {
+			rs.AppendRule("nat", "PREROUTING", "-i", iface, "-p", proto, "--dport", "53", "-j", dnsChainName)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/platform"
+)
+
+// Drift is a part of the routing state that no longer matched what netshunt
+// applied, as found by a drift check.
+type Drift struct {
+	// Part names what drifted, e.g. "IPv4 rules", "IPv6 policy route" or
+	// "ipset bypass".
+	Part string
+	// Detail describes the differences.
+	Detail string
+	// Error is the error of the repair, empty if the part was repaired.
+	Error string
+}
+
+// appliedPart is one part of what SetupRules put in place that can be
+// checked and reapplied on its own.
+type appliedPart struct {
+	name   string
+	check  func(ctx context.Context) ([]string, error)
+	repair func(ctx context.Context) error
+}
+
+// applied records the parts the last SetupRules put in place. Modes reset it
+// at the start of SetupRules and TeardownRules and add each part once it is
+// applied, so RepairRules only looks at what is meant to be there.
+type applied []appliedPart
+
+// rules records an iptables ruleset restored for one address family.
+func (a *applied) rules(ipt *netfilter.IPTables, rs *netfilter.Ruleset, logger *slog.Logger, family string) {
+	*a = append(*a, appliedPart{
+		name:  family + " rules",
+		check: func(ctx context.Context) ([]string, error) { return ipt.Check(ctx, rs) },
+		repair: func(ctx context.Context) error {
+			_, err := restoreRules(ctx, ipt, rs, logger, family)
+			return err
+		},
+	})
+}
+
+// nft records an nftables script applied to the netshunt table.
+func (a *applied) nft(n *netfilter.NFTables, s *nftScript) {
+	*a = append(*a, appliedPart{
+		name:   "nftables",
+		check:  func(ctx context.Context) ([]string, error) { return n.Check(ctx, s.String()) },
+		repair: func(ctx context.Context) error { return s.apply(ctx, n) },
+	})
+}
+
+// route records a policy route: an ip rule sending fwmark to table, and the
+// route of table whose listing contains via (e.g. "dev lo"). v6 selects
+// "ip -6".
+func (a *applied) route(v6 bool, mark, table, via string, repair func(ctx context.Context) error) {
+	family, ip := "IPv4", []string{}
+	if v6 {
+		family, ip = "IPv6", []string{"-6"}
+	}
+	*a = append(*a, appliedPart{
+		name: family + " policy route",
+		check: func(ctx context.Context) ([]string, error) {
+			var drift []string
+			rules, err := platform.Run(ctx, "ip", append(ip, "rule", "show")...)
+			if err != nil {
+				return nil, err
+			}
+			if !hasPolicyRule(rules, mark, table) {
+				drift = append(drift, fmt.Sprintf("ip rule fwmark %s lookup %s missing", mark, table))
+			}
+			routes, err := platform.Run(ctx, "ip", append(ip, "route", "show", "table", table)...)
+			if err != nil || !strings.Contains(routes, via) {
+				drift = append(drift, fmt.Sprintf("route %s in table %s missing", via, table))
+			}
+			return drift, nil
+		},
+		repair: repair,
+	})
+}
+
+// tproxyRoute installs the policy routing of TPROXY (see addTproxyRoute) and
+// records it.
+func (a *applied) tproxyRoute(ctx context.Context, logger *slog.Logger, v6 bool) error {
+	if err := addTproxyRoute(ctx, logger, v6); err != nil {
+		return err
+	}
+	a.route(v6, fwmark, routeTable, "dev lo", func(ctx context.Context) error { return addTproxyRoute(ctx, logger, v6) })
+	return nil
+}
+
+// hasPolicyRule reports whether an "ip rule show" listing has a rule sending
+// fwmark mark to table.
+func hasPolicyRule(rules, mark, table string) bool {
+	for _, line := range strings.Split(rules, "\n") {
+		fields := strings.Fields(line)
+		if slices.Contains(fields, "fwmark") && slices.Contains(fields, mark) &&
+			slices.Contains(fields, "lookup") && slices.Contains(fields, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// repair checks every part and reapplies those that drifted.
+func (a applied) repair(ctx context.Context) []Drift {
+	var drifts []Drift
+	for _, p := range a {
+		detail, err := p.check(ctx)
+		if err != nil {
+			detail = []string{"check failed: " + err.Error()}
+		}
+		if len(detail) == 0 {
+			continue
+		}
+		d := Drift{Part: p.name, Detail: strings.Join(detail, "; ")}
+		if err := p.repair(ctx); err != nil {
+			d.Error = err.Error()
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts
+}
+
+// DriftStatus is a snapshot of the last drift check.
+type DriftStatus struct {
+	// Enabled reports whether the drift check runs (daemon.drift_interval).
+	Enabled bool
+	// Checked is the time of the last check, zero before the first one.
+	Checked time.Time
+	// Drifts holds what the last check found and repaired.
+	Drifts []Drift
+	// LastDrift is the time drift was last found, zero if never.
+	LastDrift time.Time
+	// Repairs counts the parts repaired since the daemon started.
+	Repairs int
+}
+
+// Failed reports whether the last check left a part unrepaired.
+func (s DriftStatus) Failed() bool {
+	return slices.ContainsFunc(s.Drifts, func(d Drift) bool { return d.Error != "" })
+}
+
+// DriftWatch compares the live routing state with what netshunt applied
+// every daemon.drift_interval and repairs what drifted, e.g. after the
+// firmware flushed iptables without running the netfilter hook. The check
+// and repair are done by heal, which returns the parts that drifted.
+type DriftWatch struct {
+	cfg    *config.Live
+	heal   func(ctx context.Context) ([]Drift, error)
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	status DriftStatus
+}
+
+// NewDriftWatch creates a DriftWatch that checks and repairs through heal.
+func NewDriftWatch(cfg *config.Live, heal func(ctx context.Context) ([]Drift, error), logger *slog.Logger) *DriftWatch {
+	return &DriftWatch{cfg: cfg, heal: heal, logger: logger}
+}
+
+// Run checks for drift until ctx is done. The first check runs one interval
+// after the start, when the initial rules are in place.
+func (w *DriftWatch) Run(ctx context.Context) {
+	for {
+		interval := w.cfg.Load().Daemon.DriftCheckInterval()
+		if interval == 0 {
+			interval = time.Minute // disabled: look again for a config change
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		if w.cfg.Load().Daemon.DriftCheckInterval() != 0 {
+			w.check(ctx)
+		}
+	}
+}
+
+// Status returns the result of the last check.
+func (w *DriftWatch) Status() DriftStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.status
+	s.Enabled = w.cfg.Load().Daemon.DriftCheckInterval() != 0
+	s.Drifts = slices.Clone(s.Drifts)
+	return s
+}
+
+// check runs one check and logs each drift and its repair. A repair that
+// keeps failing is logged once, not on every check.
+func (w *DriftWatch) check(ctx context.Context) {
+	drifts, err := w.heal(ctx)
+	if err != nil {
+		w.logger.Warn("rule drift check failed", "error", err)
+		return
+	}
+
+	w.mu.Lock()
+	prev := w.status.Drifts
+	w.mu.Unlock()
+
+	repaired := 0
+	for _, d := range drifts {
+		if d.Error == "" {
+			repaired++
+			w.logger.Warn("rule drift repaired", "part", d.Part, "drift", d.Detail)
+			continue
+		}
+		failedBefore := slices.ContainsFunc(prev, func(p Drift) bool { return p.Part == d.Part && p.Error != "" })
+		if failedBefore {
+			w.logger.Debug("rule drift repair failed", "part", d.Part, "drift", d.Detail, "error", d.Error)
+		} else {
+			w.logger.Error("rule drift repair failed", "part", d.Part, "drift", d.Detail, "error", d.Error)
+		}
+	}
+
+	now := time.Now()
+	w.mu.Lock()
+	w.status.Checked = now
+	w.status.Drifts = drifts
+	w.status.Repairs += repaired
+	if len(drifts) > 0 {
+		w.status.LastDrift = now
+	}
+	w.mu.Unlock()
+}
@@ -0,0 +1,243 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/egorlepa/netshunt/internal/config"
+)
+
+// probeTimeout bounds each TCP connect and probe request.
+const probeTimeout = 3 * time.Second
+
+// FailoverStatus is a snapshot of the proxy failover state.
+type FailoverStatus struct {
+	// Enabled reports whether failover is configured and the routing mode
+	// has a proxy port.
+	Enabled bool
+	// Primary is routing.local_port, Active the port its traffic goes to.
+	Primary int
+	Active  int
+	// Since is the time of the last switch, zero if none happened.
+	Since time.Time
+	// Ports holds the last probe result of each port in order of
+	// preference, the primary first.
+	Ports []PortHealth
+}
+
+// FailedOver reports whether traffic currently goes to a backup port.
+func (s FailoverStatus) FailedOver() bool { return s.Enabled && s.Active != s.Primary }
+
+// PortHealth is the last probe result of one proxy port.
+type PortHealth struct {
+	Port    int
+	Healthy bool
+	Error   string
+}
+
+// Failover probes the proxy ports of routing.failover and moves traffic of
+// routing.local_port to a healthy backup when the active port fails. The
+// switch itself is done by apply, which rewrites the REDIRECT/TPROXY rules
+// (port 0 restores routing.local_port).
+type Failover struct {
+	cfg    *config.Live
+	apply  func(ctx context.Context, port int) error
+	logger *slog.Logger
+
+	// healthySince records when each port last became healthy; ports that
+	// are down have no entry.
+	healthySince map[int]time.Time
+
+	mu     sync.Mutex
+	status FailoverStatus
+}
+
+// NewFailover creates a Failover that switches ports through apply.
+func NewFailover(cfg *config.Live, apply func(ctx context.Context, port int) error, logger *slog.Logger) *Failover {
+	return &Failover{
+		cfg:          cfg,
+		apply:        apply,
+		logger:       logger,
+		healthySince: make(map[int]time.Time),
+	}
+}
+
+// Run probes the ports every routing.failover.interval until ctx is done.
+func (f *Failover) Run(ctx context.Context) {
+	for {
+		f.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.cfg.Load().Routing.Failover.ProbeInterval()):
+		}
+	}
+}
+
+// Status returns the current failover state.
+func (f *Failover) Status() FailoverStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.status
+	s.Ports = slices.Clone(s.Ports)
+	return s
+}
+
+// check runs one probe round and switches ports if needed.
+func (f *Failover) check(ctx context.Context) {
+	cfg := f.cfg.Load()
+	primary := cfg.Routing.LocalPort
+	ports := failoverPorts(cfg)
+
+	f.mu.Lock()
+	active := f.status.Active
+	f.mu.Unlock()
+	if active == 0 {
+		active = primary
+	}
+
+	if ports == nil {
+		// Failover off (again): make sure traffic is back on the primary.
+		if active != primary && f.switchTo(ctx, primary, primary, active, "failover disabled") != nil {
+			return
+		}
+		f.mu.Lock()
+		f.status = FailoverStatus{Primary: primary, Active: primary, Since: f.status.Since}
+		f.mu.Unlock()
+		clear(f.healthySince)
+		return
+	}
+
+	now := time.Now()
+	health := make([]PortHealth, len(ports))
+	for i, port := range ports {
+		health[i] = PortHealth{Port: port, Healthy: true}
+		if err := f.probe(ctx, port); err != nil {
+			health[i] = PortHealth{Port: port, Error: err.Error()}
+			delete(f.healthySince, port)
+			continue
+		}
+		if _, ok := f.healthySince[port]; !ok {
+			f.healthySince[port] = now
+		}
+	}
+
+	f.mu.Lock()
+	f.status.Enabled = true
+	f.status.Primary = primary
+	f.status.Active = active
+	f.status.Ports = health
+	f.mu.Unlock()
+
+	if next := f.choose(ports, active, cfg.Routing.Failover.HoldDownPeriod(), now); next != active {
+		reason := "port recovered"
+		if _, up := f.healthySince[active]; !up {
+			reason = "port down"
+		}
+		f.switchTo(ctx, primary, next, active, reason)
+	}
+}
+
+// failoverPorts returns routing.local_port followed by the backup ports, or
+// nil when failover is off or the routing mode has no proxy port.
+func failoverPorts(cfg *config.Config) []int {
+	if len(cfg.Routing.Failover.Ports) == 0 || cfg.Routing.Mode == ModeInterface {
+		return nil
+	}
+	ports := []int{cfg.Routing.LocalPort}
+	for _, p := range cfg.Routing.Failover.Ports {
+		if p > 0 && !slices.Contains(ports, p) {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) < 2 {
+		return nil
+	}
+	return ports
+}
+
+// choose returns the port traffic should go to. While the active port is
+// healthy, only a more preferred port that has been healthy for the
+// hold-down period replaces it. A failed active port is replaced right away
+// by the most preferred healthy port; without one the active port is kept.
+func (f *Failover) choose(ports []int, active int, holdDown time.Duration, now time.Time) int {
+	_, activeUp := f.healthySince[active]
+	for _, port := range ports {
+		if port == active && activeUp {
+			return active
+		}
+		since, up := f.healthySince[port]
+		if up && (!activeUp || now.Sub(since) >= holdDown) {
+			return port
+		}
+	}
+	return active
+}
+
+// switchTo moves traffic from port from to port to and records the switch.
+func (f *Failover) switchTo(ctx context.Context, primary, to, from int, reason string) error {
+	port := to
+	if to == primary {
+		port = 0
+	}
+	if err := f.apply(ctx, port); err != nil {
+		f.logger.Error("proxy failover: switch failed", "from", from, "to", to, "error", err)
+		return err
+	}
+	if to == primary {
+		f.logger.Info("proxy failover: switched back to primary port", "from", from, "to", to, "reason", reason)
+	} else {
+		f.logger.Warn("proxy failover: switched to backup port", "from", from, "to", to, "reason", reason)
+	}
+
+	f.mu.Lock()
+	f.status.Active = to
+	f.status.Since = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+// probe checks one proxy port: a TCP connect and, if the port has a probe
+// proxy, a request for the probe URL through it.
+func (f *Failover) probe(ctx context.Context, port int) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		return fmt.Errorf("connect %s: %w", addr, err)
+	}
+	conn.Close()
+
+	fc := f.cfg.Load().Routing.Failover
+	proxy := fc.ProbeProxies[port]
+	if fc.ProbeURL == "" || proxy == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("probe proxy %q: %w", proxy, err)
+	}
+	client := &http.Client{
+		Timeout:   probeTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableKeepAlives: true},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fc.ProbeURL, nil)
+	if err != nil {
+		return fmt.Errorf("probe url: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("probe via %s: %w", proxy, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("probe via %s: %s", proxy, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/platform"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+const (
+	markChainName   = "NSHUNT_MARK"
+	mark6ChainName  = "NSHUNT6_MARK"
+	masqChainName   = "NSHUNT_MASQ"
+	masq6ChainName  = "NSHUNT6_MASQ"
+	ifaceMarkBit    = "0x2"
+	ifaceFwmark     = ifaceMarkBit + "/" + ifaceMarkBit // bit 0x2 only: the firmware owns the other bits
+	ifaceRouteTable = "101"
+)
+
+// Interface implements Mode using policy routing: packets to ipset members are
+// fwmarked in the mangle table and an ip rule sends marked packets to a
+// dedicated route table whose default route is the configured interface
+// (e.g. a WireGuard or OpenVPN tunnel). No local proxy is involved.
+//
+// Traffic flow:
+//  1. DNS query resolved → IP added to ipset by DNS forwarder
+//  2. iptables/ip6tables PREROUTING (mangle) marks packets to ipset members
+//  3. ip rule fwmark → table 101 → default dev <interface>
+//  4. POSTROUTING (nat) masquerades marked traffic leaving the interface
+//
+// Per-shunt targets are marked from their own chains (NSHUNT_MARK_<port>,
+// ...) so their client selection and port qualifier apply.
+//
+// While the interface is down, routing.proxy_down.policy replaces the mark
+// chain: fail-closed rejects matched traffic, fail-open routes it through the
+// main table.
+type Interface struct {
+	cfg     *config.Config
+	ipt     *netfilter.IPTables
+	ipt6    *netfilter.IPTables
+	nft     *netfilter.NFTables // non-nil with the nftables backend
+	targets []shunt.Target
+	down    bool // interface down, see SetProxyDown
+	applied applied
+	logger  *slog.Logger
+}
+
+// NewInterface creates an Interface traffic mode handler.
+func NewInterface(cfg *config.Config, logger *slog.Logger) *Interface {
+	return &Interface{
+		cfg:    cfg,
+		ipt:    netfilter.NewIPTables(),
+		ipt6:   netfilter.NewIP6Tables(),
+		nft:    newNFTables(cfg),
+		logger: logger,
+	}
+}
+
+func (m *Interface) Name() string { return ModeInterface }
+
+// SetTargets records the per-shunt targets. Ports are meaningless for policy
+// routing, but their ipsets are still marked so every proxy shunt leaves
+// through the interface.
+func (m *Interface) SetTargets(targets []shunt.Target) { m.targets = targets }
+
+// SetLocalPort does nothing: policy routing has no proxy port to fail over.
+func (m *Interface) SetLocalPort(int) {}
+
+// SetProxyDown records whether the outbound interface is down, see Mode.
+func (m *Interface) SetProxyDown(down bool) { m.down = down }
+
+// SetupRules applies the mark, masquerade and DNS DNAT rules, one atomic
+// iptables-restore transaction per address family, and the policy routing.
+func (m *Interface) SetupRules(ctx context.Context) error {
+	m.applied = nil
+	out := m.cfg.Routing.Interface
+	if out == "" {
+		return fmt.Errorf("routing.interface is not set")
+	}
+	if m.nft != nil {
+		return m.setupNFT(ctx, out)
+	}
+
+	m.logger.Info("setting up policy routing rules",
+		"out", out, "targets", m.targets, "interfaces", m.cfg.Network.RouteInterfaces(), "clients", m.cfg.Clients.List,
+		"proxy_down", downPolicy(m.cfg, m.down))
+
+	rs := m.ruleset(out, false)
+	if _, err := restoreRules(ctx, m.ipt, rs, m.logger, "IPv4"); err != nil {
+		return err
+	}
+	m.applied.rules(m.ipt, rs, m.logger, "IPv4")
+	if err := m.policyRoute(ctx, "ip", out); err != nil {
+		return err
+	}
+	setLooseRPFilter(out, m.logger)
+
+	if !m.cfg.IPv6 {
+		clearRules(ctx, m.ipt6)
+		return nil
+	}
+	rs = m.ruleset(out, true)
+	if _, err := restoreRules(ctx, m.ipt6, rs, m.logger, "IPv6"); err != nil {
+		m.logger.Warn("IPv6 policy routing not available, only IPv4 traffic will be routed", "error", err)
+		return nil
+	}
+	m.applied.rules(m.ipt6, rs, m.logger, "IPv6")
+	if err := m.policyRoute(ctx, "ip -6", out); err != nil {
+		m.logger.Warn("IPv6 policy routing not available, only IPv4 traffic will be routed", "error", err)
+	}
+	return nil
+}
+
+// ruleset builds the rules of one address family: NSHUNT_MARK (mangle) marks
+// packets to matched destinations (or its proxy-down replacement),
+// NSHUNT_MASQ (nat) masquerades them on the way out through out, and
+// NSHUNT_BLOCK (filter) rejects block shunts.
+func (m *Interface) ruleset(out string, v6 bool) *netfilter.Ruleset {
+	set4, set6 := m.cfg.IPSet.Names("")
+	excluded4, excluded6 := classifyNetworks(m.cfg.ExcludedNetworks)
+	markChain, masqChain, ipset, excluded, dnsAddr := markChainName, masqChainName, set4, excluded4, "127.0.0.1"
+	if v6 {
+		markChain, masqChain, ipset, excluded, dnsAddr = mark6ChainName, masq6ChainName, set6, excluded6, "[::1]"
+	}
+	clients := globalClients(m.cfg)
+	actions := familyActionSets(m.cfg, m.targets, v6)
+
+	targets := familyTargets(m.cfg, m.targets, m.cfg.Routing.LocalPort, v6)
+
+	rs := netfilter.NewRuleset()
+
+	switch downPolicy(m.cfg, m.down) {
+	case PolicyFailOpen:
+		// Interface down: matched traffic uses the main table.
+	case PolicyFailClosed:
+		killRules(rs.Optional(groupKill), m.cfg, ipset, targets, excluded, actions, m.cfg.Network.RouteInterfaces(), false, v6)
+	default:
+		// Mark packets to matched destinations.
+		rs.CreateChain("mangle", markChain)
+		excludeNetworks(rs, "mangle", markChain, excluded)
+		excludeClients(rs, "mangle", markChain, clients, v6)
+		excludeSets(rs, "mangle", markChain, actions.exceptions())
+		rs.AppendRule("mangle", markChain, "-m", "set", "--match-set", ipset, "dst", "-j", "MARK", "--set-xmark", ifaceFwmark)
+		for _, t := range targets {
+			setupTarget(rs, "mangle", markChain, t, []string{""}, "-j", "MARK", "--set-xmark", ifaceFwmark)
+		}
+		addJump(rs, "mangle", "PREROUTING", m.cfg.Network.RouteInterfaces(), markChain, clients, v6)
+	}
+
+	// Masquerade marked traffic leaving through the interface.
+	rs.CreateChain("nat", masqChain)
+	rs.AppendRule("nat", masqChain, "-m", "mark", "--mark", ifaceFwmark, "-j", "MASQUERADE")
+	rs.AppendRule("nat", "POSTROUTING", "-o", out, "-j", masqChain)
+
+	blockRules(rs.Optional(groupBlock), m.cfg, actions, m.cfg.Network.RouteInterfaces(), v6)
+	dnsRedirect(rs.Optional(groupDNS), dnsInterfaces(m.cfg), dnsAddr)
+	return rs
+}
+
+// addPolicyRoute sends packets carrying the interface fwmark to a route table
+// whose default route is out. ipCmd is "ip" for IPv4 or "ip -6" for IPv6.
+func (m *Interface) addPolicyRoute(ctx context.Context, ipCmd, out string) error {
+	ip := ipArgs(ipCmd)
+	// ip rule add does not check for an existing rule: adding it on every
+	// setup would stack duplicates.
+	rules, err := platform.Run(ctx, "ip", append(ip, "rule", "show")...)
+	if err != nil || !hasPolicyRule(rules, ifaceFwmark, ifaceRouteTable) {
+		if err := platform.RunSilent(ctx, "ip", append(ip, "rule", "add", "fwmark", ifaceFwmark, "table", ifaceRouteTable)...); err != nil {
+			m.logger.Warn(ipCmd+" rule add failed", "error", err)
+		}
+	}
+	if err := platform.RunSilent(ctx, "ip", append(ip, "route", "replace", "default", "dev", out, "table", ifaceRouteTable)...); err != nil {
+		return fmt.Errorf("%s route replace: %w", ipCmd, err)
+	}
+	return nil
+}
+
+// policyRoute adds the policy routing of addPolicyRoute and records it.
+func (m *Interface) policyRoute(ctx context.Context, ipCmd, out string) error {
+	if err := m.addPolicyRoute(ctx, ipCmd, out); err != nil {
+		return err
+	}
+	m.applied.route(ipCmd != "ip", ifaceFwmark, ifaceRouteTable, "dev "+out, func(ctx context.Context) error {
+		return m.addPolicyRoute(ctx, ipCmd, out)
+	})
+	return nil
+}
+
+// delPolicyRoute removes the rule and route table added by addPolicyRoute.
+func delPolicyRoute(ctx context.Context, ipCmd string) {
+	ip := ipArgs(ipCmd)
+	_ = platform.RunSilent(ctx, "ip", append(ip, "rule", "del", "fwmark", ifaceFwmark, "table", ifaceRouteTable)...)
+	_ = platform.RunSilent(ctx, "ip", append(ip, "route", "flush", "table", ifaceRouteTable)...)
+}
+
+// setupNFT applies the policy routing ruleset to the netshunt nftables
+// table: NSHUNT_MARK (mangle) marks matched packets, NSHUNT_MASQ (nat)
+// masquerades them on the way out.
+func (m *Interface) setupNFT(ctx context.Context, out string) error {
+	fams := nftFamilies(m.cfg, m.targets, m.cfg.Routing.LocalPort)
+	ifaces := m.cfg.Network.RouteInterfaces()
+
+	m.logger.Info("setting up policy routing rules (nftables)", "out", out, "targets", m.targets, "interfaces", ifaces,
+		"clients", m.cfg.Clients.List, "proxy_down", downPolicy(m.cfg, m.down))
+
+	s := newNFTScript(fams, globalClients(m.cfg))
+	s.chain(nftPreroutingNat)
+	s.chain(nftPreroutingMangle)
+	s.chain(nftPostroutingNat)
+	s.chain(masqChainName)
+
+	switch downPolicy(m.cfg, m.down) {
+	case PolicyFailOpen:
+		// Interface down: matched traffic uses the main table.
+	case PolicyFailClosed:
+		s.kill(ifaces, false)
+	default:
+		s.chain(markChainName)
+		s.excluded(markChainName)
+		for _, f := range fams {
+			for _, t := range f.targets {
+				l4, ok := t.ports.nft([]string{""})
+				if !ok {
+					continue
+				}
+				for _, c := range t.clients.nftTarget(f) {
+					s.rule(markChainName, "%s%s%s daddr @%s meta mark set meta mark | %s", c, l4, f.proto, t.ipset, ifaceMarkBit)
+				}
+			}
+		}
+		s.jump(nftPreroutingMangle, ifaces, markChainName)
+	}
+	s.rule(masqChainName, "meta mark & %s == %s masquerade", ifaceMarkBit, ifaceMarkBit)
+	s.rule(nftPostroutingNat, "oifname %q jump %s", out, masqChainName)
+	s.block(ifaces)
+	s.dnsRedirect(dnsInterfaces(m.cfg))
+
+	if err := s.apply(ctx, m.nft); err != nil {
+		return err
+	}
+	m.applied.nft(m.nft, s)
+
+	setLooseRPFilter(out, m.logger)
+	if err := m.policyRoute(ctx, "ip", out); err != nil {
+		return err
+	}
+	if m.cfg.IPv6 {
+		if err := m.policyRoute(ctx, "ip -6", out); err != nil {
+			m.logger.Warn("IPv6 policy routing not available, only IPv4 traffic will be routed", "error", err)
+		}
+	}
+	return nil
+}
+
+// TeardownRules removes mark/masquerade chains, policy routing, and DNS DNAT
+// rules for both IPv4 and IPv6.
+func (m *Interface) TeardownRules(ctx context.Context) error {
+	m.logger.Info("tearing down policy routing rules")
+	m.applied = nil
+
+	if m.nft != nil {
+		_ = m.nft.DeleteChains(ctx)
+	} else {
+		clearRules(ctx, m.ipt)
+		clearRules(ctx, m.ipt6)
+	}
+	delPolicyRoute(ctx, "ip")
+	delPolicyRoute(ctx, "ip -6")
+	return nil
+}
+
+// RepairRules reapplies the parts of the last SetupRules that drifted, see
+// Mode.
+func (m *Interface) RepairRules(ctx context.Context) []Drift { return m.applied.repair(ctx) }
+
+// IsActive reports whether the outbound interface exists and is up.
+func (m *Interface) IsActive(ctx context.Context) (bool, error) {
+	ifi, err := net.InterfaceByName(m.cfg.Routing.Interface)
+	if err != nil {
+		return false, nil
+	}
+	return ifi.Flags&net.FlagUp != 0, nil
+}
+
+// ipArgs converts "ip" / "ip -6" into the leading arguments for the ip binary.
+func ipArgs(ipCmd string) []string {
+	if ipCmd == "ip -6" {
+		return []string{"-6"}
+	}
+	return nil
+}
+
+// setLooseRPFilter switches reverse path filtering on the interface to loose
+// mode. Replies to masqueraded traffic arrive on the tunnel while the main
+// table routes their source out the WAN, which strict mode would drop.
+// IPv6 has no rp_filter sysctl.
+func setLooseRPFilter(iface string, logger *slog.Logger) {
+	path := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/rp_filter", iface)
+	if err := os.WriteFile(path, []byte("2"), 0644); err != nil {
+		logger.Warn("failed to set loose rp_filter", "interface", iface, "error", err)
+	}
+}
@@ -0,0 +1,134 @@
+package routing
+
+import (
+	"slices"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+const (
+	localChainName  = "NSHUNT_OUT"
+	local6ChainName = "NSHUNT6_OUT"
+)
+
+// localTraffic reports whether traffic originating on the router is shunted
+// (cfg.Routing.Local). Inverse mode is not supported: its catch-all would
+// capture every service on the router. Neither is a configuration that
+// cannot tell the proxy's own connections apart, as they would loop back
+// into the proxy.
+func (r *Redirect) localTraffic() bool {
+	l := r.cfg.Routing.Local
+	switch {
+	case !l.Enabled:
+		return false
+	case r.cfg.Routing.Inverse:
+		r.logger.Warn("local traffic routing is not supported in inverse mode")
+		return false
+	case len(localSkips(l)) == 0:
+		r.logger.Warn("local traffic routing needs routing.local.proxy_user, proxy_group or proxy_mark, skipping")
+		return false
+	}
+	return true
+}
+
+// localRules hooks NSHUNT_OUT (NSHUNT6_OUT for IPv6) into the nat OUTPUT
+// chain: the proxy's own traffic RETURNs, DNS queries go to the local
+// forwarder at dnsAddr and TCP to matched destinations is redirected to the
+// target's proxy port. Block shunts do not apply to the router itself; their
+// destinations just go direct.
+func (r *Redirect) localRules(rs *netfilter.Ruleset, dnsAddr string, excluded []string, v6 bool) {
+	chain := localChainName
+	if v6 {
+		chain = local6ChainName
+	}
+
+	rs.CreateChain("nat", chain)
+	for _, m := range localSkips(r.cfg.Routing.Local) {
+		rs.AppendRule("nat", slices.Concat([]string{chain}, m, []string{"-j", "RETURN"})...)
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		rs.AppendRule("nat", chain, "-p", proto, "--dport", "53", "-j", "DNAT", "--to-destination", dnsAddr)
+	}
+	excludeNetworks(rs, "nat", chain, excluded)
+	excludeSets(rs, "nat", chain, familyActionSets(r.cfg, r.targets, v6).exceptions())
+	for _, t := range localTargets(r.cfg, r.targets, r.localPort(), v6) {
+		if len(t.ports.protos([]string{"tcp"})) == 0 {
+			continue
+		}
+		rs.AppendRule("nat", slices.Concat([]string{chain, "-p", "tcp"}, t.ports.ipt(),
+			[]string{"-m", "set", "--match-set", t.ipset, "dst"}, redirectAction(t.port))...)
+	}
+	rs.AppendRule("nat", "OUTPUT", "-j", chain)
+}
+
+// nftLocal adds the nftables equivalent of localRules to s.
+func (r *Redirect) nftLocal(s *nftScript) {
+	s.chain(nftOutputNat)
+	s.chain(localChainName)
+	for _, m := range nftLocalSkips(r.cfg.Routing.Local) {
+		s.rule(localChainName, "%s return", m)
+	}
+	for _, f := range s.fams {
+		s.rule(localChainName, "meta nfproto %s meta l4proto { tcp, udp } th dport 53 dnat %s to %s",
+			f.nfproto, f.proto, f.dnsAddr)
+	}
+	s.excludedNetworks(localChainName)
+	s.exceptions(localChainName)
+	for _, f := range s.fams {
+		for _, t := range f.targets {
+			if l4, ok := t.ports.nft([]string{"tcp"}); ok {
+				s.rule(localChainName, "%s%s daddr @%s redirect to :%d", l4, f.proto, t.ipset, t.port)
+			}
+		}
+	}
+	s.rule(nftOutputNat, "jump %s", localChainName)
+}
+
+// localTargets returns the default target, proxied to port, followed by the
+// non-default targets of one address family. Client selections do not apply
+// to the router's own traffic and are dropped.
+func localTargets(cfg *config.Config, targets []shunt.Target, port int, v6 bool) []target {
+	def4, def6 := cfg.IPSet.Names("")
+	def := target{port: port, ipset: def4, v6: v6}
+	if v6 {
+		def.ipset = def6
+	}
+	out := []target{def}
+	for _, t := range familyTargets(cfg, targets, port, v6) {
+		t.clients = clientSel{}
+		out = append(out, t)
+	}
+	return out
+}
+
+// localSkips returns the iptables matches of the proxy's own traffic.
+func localSkips(l config.LocalTrafficConfig) [][]string {
+	var out [][]string
+	if l.ProxyUser != "" {
+		out = append(out, []string{"-m", "owner", "--uid-owner", l.ProxyUser})
+	}
+	if l.ProxyGroup != "" {
+		out = append(out, []string{"-m", "owner", "--gid-owner", l.ProxyGroup})
+	}
+	if l.ProxyMark != "" {
+		out = append(out, []string{"-m", "mark", "--mark", l.ProxyMark})
+	}
+	return out
+}
+
+// nftLocalSkips returns the nft matches of the proxy's own traffic.
+func nftLocalSkips(l config.LocalTrafficConfig) []string {
+	var out []string
+	if l.ProxyUser != "" {
+		out = append(out, "meta skuid "+l.ProxyUser)
+	}
+	if l.ProxyGroup != "" {
+		out = append(out, "meta skgid "+l.ProxyGroup)
+	}
+	if l.ProxyMark != "" {
+		out = append(out, "meta mark "+l.ProxyMark)
+	}
+	return out
+}
@@ -5,6 +5,15 @@ import (
 	"log/slog"
 
 	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// Routing mode identifiers, as stored in config routing.mode.
+const (
+	ModeRedirect  = "redirect"
+	ModeTproxy    = "tproxy"
+	ModeInterface = "interface"
 )
 
 // Mode abstracts the mechanism for redirecting traffic matching the ipset.
@@ -20,9 +29,81 @@ type Mode interface {
 
 	// IsActive returns true if the proxy appears to be available.
 	IsActive(ctx context.Context) (bool, error)
+
+	// SetTargets sets the non-default routing targets. Each target gets its
+	// own ipsets and chains; traffic not matched by a target goes to the
+	// default port. Takes effect on the next SetupRules.
+	SetTargets(targets []shunt.Target)
+
+	// SetLocalPort sends traffic of the default port to port instead of
+	// routing.local_port, e.g. a backup proxy chosen by Failover. 0 restores
+	// routing.local_port. Takes effect on the next SetupRules.
+	SetLocalPort(port int)
+
+	// RepairRules compares the live rules and policy routing with what the
+	// last SetupRules applied and reapplies only the parts that drifted,
+	// e.g. the IPv4 ruleset after the firmware flushed iptables. It returns
+	// the parts that drifted.
+	RepairRules(ctx context.Context) []Drift
+
+	// SetProxyDown records whether the proxy is down, as seen by
+	// ProxyWatch. While it is, SetupRules applies routing.proxy_down.policy
+	// instead of the proxy rules: fail-closed rejects matched traffic,
+	// fail-open lets it go direct.
+	SetProxyDown(down bool)
 }
 
-// New returns a Mode for the configured routing mode.
+// New returns a Mode for the configured routing mode. Unknown or empty modes
+// fall back to Redirect.
 func New(cfg *config.Config, logger *slog.Logger) Mode {
-	return NewRedirect(cfg, logger)
+	switch cfg.Routing.Mode {
+	case ModeTproxy:
+		return NewTproxy(cfg, logger)
+	case ModeInterface:
+		return NewInterface(cfg, logger)
+	default:
+		return NewRedirect(cfg, logger)
+	}
+}
+
+// Label describes the configured routing mode for status displays,
+// e.g. "redirect", "redirect (inverse)" or "interface via nwg0".
+func Label(cfg *config.Config) string {
+	switch cfg.Routing.Mode {
+	case ModeInterface:
+		return ModeInterface + " via " + cfg.Routing.Interface
+	case ModeTproxy:
+		return ModeTproxy
+	default:
+		if cfg.Routing.Inverse {
+			return ModeRedirect + " (inverse)"
+		}
+		return ModeRedirect
+	}
+}
+
+// FakeIP reports whether the DNS forwarder answers proxied domains with fake
+// IPs (dns.fake_ip): it is enabled and the mode hands connections to a local
+// proxy that can map them back to the domain. Interface mode and inverse
+// routing need the real addresses.
+func FakeIP(cfg *config.Config) bool {
+	return cfg.DNS.FakeIP.Enabled && cfg.Routing.Mode != ModeInterface && !cfg.Routing.Inverse
+}
+
+// activePort returns the port traffic of the default port goes to: override
+// if set, otherwise routing.local_port.
+func activePort(cfg *config.Config, override int) int {
+	if override != 0 {
+		return override
+	}
+	return cfg.Routing.LocalPort
+}
+
+// newNFTables returns an nftables manager when the configured netfilter
+// backend resolves to nftables, nil for iptables.
+func newNFTables(cfg *config.Config) *netfilter.NFTables {
+	if netfilter.ResolveBackend(cfg.Netfilter.Backend) == netfilter.BackendNFTables {
+		return netfilter.NewNFTables()
+	}
+	return nil
 }
@@ -0,0 +1,220 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// Base chains of the netshunt nftables table. Mode chains (NSHUNT,
+// NSHUNT_UDP, ...) hang off these the way the iptables chains hang off the
+// built-in PREROUTING/POSTROUTING chains.
+const (
+	nftPreroutingNat    = "prerouting_nat"
+	nftPreroutingMangle = "prerouting_mangle"
+	nftPostroutingNat   = "postrouting_nat"
+	nftOutputNat        = "output_nat"
+	nftForwardFilter    = "forward_filter"
+)
+
+var nftBaseChains = map[string]string{
+	nftPreroutingNat:    "{ type nat hook prerouting priority dstnat; policy accept; }",
+	nftPreroutingMangle: "{ type filter hook prerouting priority mangle; policy accept; }",
+	nftPostroutingNat:   "{ type nat hook postrouting priority srcnat; policy accept; }",
+	nftOutputNat:        "{ type nat hook output priority -100; policy accept; }",
+	nftForwardFilter:    "{ type filter hook forward priority filter; policy accept; }",
+}
+
+// nftFamily holds the per address family inputs of an nft ruleset. One inet
+// table serves both families; rules select a family with "ip"/"ip6" matches.
+type nftFamily struct {
+	proto    string   // "ip" or "ip6"
+	nfproto  string   // "ipv4" or "ipv6"
+	targets  []target // default target first
+	actions  actionSets
+	excluded []string
+	dnsAddr  string
+}
+
+// nftFamilies returns the families to render: IPv4 always, IPv6 when enabled.
+// Each family lists the default target (proxied to port, the active
+// routing.local_port) followed by the per-shunt proxy targets, and the sets
+// of the direct and block targets.
+func nftFamilies(cfg *config.Config, targets []shunt.Target, port int) []nftFamily {
+	excluded4, excluded6 := classifyNetworks(cfg.ExcludedNetworks)
+	v4 := nftFamily{proto: "ip", nfproto: "ipv4", excluded: excluded4, dnsAddr: "127.0.0.1"}
+	v6 := nftFamily{proto: "ip6", nfproto: "ipv6", excluded: excluded6, dnsAddr: "::1"}
+
+	def4, def6 := cfg.IPSet.Names("")
+	v4.targets = append([]target{{port: port, ipset: def4}}, familyTargets(cfg, targets, port, false)...)
+	v6.targets = append([]target{{port: port, ipset: def6, v6: true}}, familyTargets(cfg, targets, port, true)...)
+	v4.actions = familyActionSets(cfg, targets, false)
+	v6.actions = familyActionSets(cfg, targets, true)
+
+	if cfg.IPv6 {
+		return []nftFamily{v4, v6}
+	}
+	return []nftFamily{v4}
+}
+
+// set returns the nft set declaration for a target of this family.
+func (f nftFamily) set(name string) *netfilter.NFTSet {
+	if f.proto == "ip6" {
+		return netfilter.NewNFTSet6(name)
+	}
+	return netfilter.NewNFTSet(name)
+}
+
+// nftScript builds an nft -f script for the netshunt table. Every chain it
+// touches is declared and flushed first, so applying the same script twice
+// yields the same ruleset.
+type nftScript struct {
+	b       strings.Builder
+	fams    []nftFamily
+	clients clientSel // global client selection
+	chains  []string  // declared chains
+}
+
+// newNFTScript starts a script declaring the table and the sets of every
+// family, so rules can reference sets before the reconciler creates them.
+func newNFTScript(fams []nftFamily, clients clientSel) *nftScript {
+	s := &nftScript{fams: fams, clients: clients}
+	s.line("add table inet %s", netfilter.NFTTable)
+	for _, f := range fams {
+		for _, t := range f.targets {
+			s.sets(f.set(t.ipset))
+		}
+		for _, set := range f.actions.exceptions() {
+			s.sets(f.set(set))
+		}
+	}
+	return s
+}
+
+func (s *nftScript) line(format string, args ...any) {
+	fmt.Fprintf(&s.b, format+"\n", args...)
+}
+
+// chain declares and flushes a chain. Base chains get their hook declaration.
+// Declaring a chain again does nothing, so its rules are kept.
+func (s *nftScript) chain(name string) {
+	if slices.Contains(s.chains, name) {
+		return
+	}
+	s.chains = append(s.chains, name)
+	s.line("add chain inet %s %s %s", netfilter.NFTTable, name, nftBaseChains[name])
+	s.line("flush chain inet %s %s", netfilter.NFTTable, name)
+}
+
+// sets declares the kernel sets backing set.
+func (s *nftScript) sets(set *netfilter.NFTSet) {
+	for _, decl := range set.Decls() {
+		s.line("add set inet %s %s", netfilter.NFTTable, decl)
+	}
+}
+
+// rule appends a rule to a chain. A rule looking up a netshunt set is added
+// once for each kernel set backing it (see netfilter.NFTSetNames).
+func (s *nftScript) rule(chain, format string, args ...any) {
+	rule := fmt.Sprintf(format, args...)
+	set := ""
+	for _, f := range strings.Fields(rule) {
+		if name, ok := strings.CutPrefix(f, "@"); ok {
+			set = name
+			break
+		}
+	}
+	if set == "" {
+		s.line("add rule inet %s %s %s", netfilter.NFTTable, chain, rule)
+		return
+	}
+	for _, name := range netfilter.NFTSetNames(set) {
+		s.line("add rule inet %s %s %s", netfilter.NFTTable, chain, strings.Replace(rule, "@"+set, "@"+name, 1))
+	}
+}
+
+// jump hooks chain into base for traffic from each of ifaces ("" for any
+// interface) and, in include mode, from the globally selected clients.
+func (s *nftScript) jump(base string, ifaces []string, chain string) {
+	for _, iface := range ifaces {
+		for _, c := range s.clients.nftIncluded(s.fams) {
+			if iface != "" {
+				s.rule(base, "iifname %q %sjump %s", iface, c, chain)
+			} else {
+				s.rule(base, "%sjump %s", c, chain)
+			}
+		}
+	}
+}
+
+// excluded adds RETURN rules for the excluded networks of every family, the
+// globally excluded clients and the direct and block exceptions.
+func (s *nftScript) excluded(chain string) {
+	s.excludedNetworks(chain)
+	for _, c := range s.clients.nftExcluded(s.fams) {
+		s.rule(chain, "%sreturn", c)
+	}
+	s.exceptions(chain)
+}
+
+// exceptions adds RETURN rules for members of the direct and block sets of
+// every family.
+func (s *nftScript) exceptions(chain string) {
+	for _, f := range s.fams {
+		for _, set := range f.actions.exceptions() {
+			s.rule(chain, "%s daddr @%s return", f.proto, set)
+		}
+	}
+}
+
+// excludedNetworks adds RETURN rules for the excluded networks of every family.
+func (s *nftScript) excludedNetworks(chain string) {
+	for _, f := range s.fams {
+		for _, n := range f.excluded {
+			s.rule(chain, "%s daddr %s return", f.proto, n)
+		}
+	}
+}
+
+// dnsRedirect DNATs DNS queries arriving on ifaces to the local forwarder.
+func (s *nftScript) dnsRedirect(ifaces []string) {
+	for _, iface := range ifaces {
+		for _, f := range s.fams {
+			s.rule(nftPreroutingNat, "iifname %q meta nfproto %s meta l4proto { tcp, udp } th dport 53 dnat %s to %s",
+				iface, f.nfproto, f.proto, f.dnsAddr)
+		}
+	}
+}
+
+func (s *nftScript) String() string { return s.b.String() }
+
+// apply applies the script in one nft transaction that also deletes the
+// chains of the netshunt table it does not declare, so the ruleset of the
+// previous setup is replaced without a moment of unrouted traffic.
+func (s *nftScript) apply(ctx context.Context, nft *netfilter.NFTables) error {
+	existing, _ := nft.ListChains(ctx)
+	var stale []string
+	for _, c := range existing {
+		if !slices.Contains(s.chains, c) {
+			stale = append(stale, c)
+		}
+	}
+
+	var b strings.Builder
+	for _, c := range stale {
+		fmt.Fprintf(&b, "flush chain inet %s %s\n", netfilter.NFTTable, c)
+	}
+	b.WriteString(s.String())
+	for _, c := range stale {
+		fmt.Fprintf(&b, "delete chain inet %s %s\n", netfilter.NFTTable, c)
+	}
+	if err := nft.Apply(ctx, b.String()); err != nil {
+		return fmt.Errorf("apply nftables ruleset: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package routing
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// portSel restricts a target's rules to a protocol and destination ports,
+// from the port qualifier of its entries. The zero value matches all
+// traffic.
+type portSel struct {
+	proto string   // "tcp", "udp" or "" for both
+	ports []string // ports and "lo-hi" ranges; empty matches every port
+	set   bool     // false matches all traffic
+}
+
+// targetPorts returns the port qualifier of a target.
+func targetPorts(t shunt.Target) portSel {
+	if t.Ports == "" {
+		return portSel{}
+	}
+	proto, ports := t.PortSelection()
+	return portSel{proto: proto, ports: ports, set: true}
+}
+
+// protos narrows the protocols a mode emits rules for to the selection. An
+// empty protocol in protos stands for all traffic; a selection needs a
+// protocol match for its ports, so it is expanded to TCP and UDP.
+func (p portSel) protos(protos []string) []string {
+	if !p.set {
+		return protos
+	}
+	var out []string
+	for _, proto := range protos {
+		switch {
+		case proto == "" && p.proto == "":
+			out = append(out, "tcp", "udp")
+		case proto == "":
+			out = append(out, p.proto)
+		case p.proto == "" || p.proto == proto:
+			out = append(out, proto)
+		}
+	}
+	return slices.Compact(out)
+}
+
+// ipt returns the iptables match of the ports, to follow "-p proto".
+func (p portSel) ipt() []string {
+	if len(p.ports) == 0 {
+		return nil
+	}
+	ports := make([]string, len(p.ports))
+	for i, port := range p.ports {
+		ports[i] = strings.ReplaceAll(port, "-", ":")
+	}
+	return []string{"-m", "multiport", "--dports", strings.Join(ports, ",")}
+}
+
+// nft returns the nft l4proto and port match of a rule for protos ({""} for
+// all traffic) and whether the selection leaves the rule anything to match.
+func (p portSel) nft(protos []string) (string, bool) {
+	protos = p.protos(protos)
+	if len(protos) == 0 {
+		return "", false
+	}
+	var b strings.Builder
+	switch {
+	case len(protos) > 1:
+		b.WriteString("meta l4proto " + nftElements(protos) + " ")
+	case protos[0] != "":
+		b.WriteString("meta l4proto " + protos[0] + " ")
+	}
+	if len(p.ports) > 0 {
+		b.WriteString("th dport " + nftElements(p.ports) + " ")
+	}
+	return b.String(), true
+}
@@ -0,0 +1,219 @@
+package routing
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+)
+
+// Policies of routing.proxy_down.policy.
+const (
+	PolicyFailClosed = "fail-closed" // reject matched traffic while the proxy is down
+	PolicyFailOpen   = "fail-open"   // matched traffic goes direct while the proxy is down
+)
+
+const (
+	killChainName  = "NSHUNT_KILL"
+	kill6ChainName = "NSHUNT6_KILL"
+)
+
+// ValidPolicy reports whether p is a known proxy-down policy. The empty
+// string keeps the rules unchanged.
+func ValidPolicy(p string) bool {
+	return p == "" || p == PolicyFailClosed || p == PolicyFailOpen
+}
+
+// downPolicy returns the policy to enforce: routing.proxy_down.policy while
+// the proxy is down, "" otherwise.
+func downPolicy(cfg *config.Config, down bool) string {
+	if !down || !ValidPolicy(cfg.Routing.ProxyDown.Policy) {
+		return ""
+	}
+	return cfg.Routing.ProxyDown.Policy
+}
+
+// HasPolicy reports whether a proxy-down policy is configured, i.e. whether
+// the rules depend on the proxy state.
+func HasPolicy(cfg *config.Config) bool { return downPolicy(cfg, true) != "" }
+
+// killRules hooks NSHUNT_KILL (NSHUNT6_KILL for IPv6) into the filter FORWARD
+// chain for traffic entering on ifaces. It takes the place of the proxy
+// chains under the fail-closed policy and rejects what they would have
+// proxied: members of ipsetName and of the proxy targets (for the targets'
+// clients and ports), or with inverse everything except those members.
+// Excluded networks and clients and the direct and block exceptions pass.
+func killRules(rs *netfilter.Ruleset, cfg *config.Config, ipsetName string, targets []target, excluded []string, actions actionSets, ifaces []string, inverse, v6 bool) {
+	chain := killChainName
+	if v6 {
+		chain = kill6ChainName
+	}
+	clients := globalClients(cfg)
+
+	rs.CreateChain("filter", chain)
+	excludeNetworks(rs, "filter", chain, excluded)
+	excludeClients(rs, "filter", chain, clients, v6)
+	excludeSets(rs, "filter", chain, actions.exceptions())
+	if inverse {
+		returnSets(rs, "filter", chain, []string{""}, ipsetName, targets)
+		rs.AppendRule("filter", chain, "-j", "REJECT")
+	} else {
+		rs.AppendRule("filter", chain, "-m", "set", "--match-set", ipsetName, "dst", "-j", "REJECT")
+		for _, t := range targets {
+			setupTarget(rs, "filter", chain, t, []string{""}, "-j", "REJECT")
+		}
+	}
+	addJump(rs, "filter", "FORWARD", ifaces, chain, clients, v6)
+}
+
+// kill adds the nftables equivalent of killRules to s. The default target
+// of every family comes first in its targets.
+func (s *nftScript) kill(ifaces []string, inverse bool) {
+	s.chain(nftForwardFilter)
+	s.chain(killChainName)
+	s.excluded(killChainName)
+	for _, f := range s.fams {
+		for _, t := range f.targets {
+			l4, ok := t.ports.nft([]string{""})
+			if !ok {
+				continue
+			}
+			if inverse {
+				s.rule(killChainName, "%s%s daddr @%s return", l4, f.proto, t.ipset)
+				continue
+			}
+			for _, c := range t.clients.nftTarget(f) {
+				s.rule(killChainName, "%s%s%s daddr @%s reject", c, l4, f.proto, t.ipset)
+			}
+		}
+		if inverse {
+			s.rule(killChainName, "meta nfproto %s reject", f.nfproto)
+		}
+	}
+	s.jump(nftForwardFilter, ifaces, killChainName)
+}
+
+// ProxyStatus is a snapshot of the proxy state seen by ProxyWatch.
+type ProxyStatus struct {
+	// Checked is false until the first check completed.
+	Checked bool
+	// Down reports whether the proxy was down at the last check.
+	Down bool
+	// Policy is the configured routing.proxy_down.policy.
+	Policy string
+	// Enforced reports whether the policy currently replaces the proxy
+	// rules.
+	Enforced bool
+	// Since is the time of the last up/down transition, zero if none
+	// happened.
+	Since time.Time
+}
+
+// ProxyWatch checks the routing mode's proxy every
+// routing.proxy_down.interval and reports up/down transitions to apply,
+// which enforces routing.proxy_down.policy (see Mode.SetProxyDown) and
+// restores the normal rules once the proxy is back.
+type ProxyWatch struct {
+	cfg    *config.Live
+	active func(ctx context.Context) (bool, error)
+	apply  func(ctx context.Context, down bool) error
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	status ProxyStatus
+}
+
+// NewProxyWatch creates a ProxyWatch that checks the proxy with active and
+// switches the rules through apply.
+func NewProxyWatch(cfg *config.Live, active func(ctx context.Context) (bool, error), apply func(ctx context.Context, down bool) error, logger *slog.Logger) *ProxyWatch {
+	return &ProxyWatch{cfg: cfg, active: active, apply: apply, logger: logger}
+}
+
+// Run checks the proxy until ctx is done.
+func (w *ProxyWatch) Run(ctx context.Context) {
+	for {
+		w.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.cfg.Load().Routing.ProxyDown.CheckInterval()):
+		}
+	}
+}
+
+// Status returns the current proxy state.
+func (w *ProxyWatch) Status() ProxyStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := w.status
+	cfg := w.cfg.Load()
+	s.Policy = cfg.Routing.ProxyDown.Policy
+	s.Enforced = s.Down && HasPolicy(cfg)
+	return s
+}
+
+// check runs one check and reports a transition to apply. A failed apply is
+// retried on the next check.
+func (w *ProxyWatch) check(ctx context.Context) {
+	active, err := w.active(ctx)
+	if err != nil {
+		w.logger.Warn("proxy check failed", "error", err)
+		return
+	}
+	down := !active
+
+	w.mu.Lock()
+	prev := w.status
+	w.mu.Unlock()
+	if prev.Checked && down == prev.Down {
+		return
+	}
+	if !prev.Checked && !down {
+		// Up from the start: the rules are already the normal ones.
+		w.mu.Lock()
+		w.status.Checked = true
+		w.mu.Unlock()
+		return
+	}
+
+	policy := downPolicy(w.cfg.Load(), true)
+	if err := w.apply(ctx, down); err != nil {
+		w.logger.Error("proxy state change failed", "down", down, "policy", policy, "error", err)
+		return
+	}
+	switch {
+	case down && policy != "":
+		w.logger.Warn("proxy is down, applying " + policy + " policy")
+	case down:
+		w.logger.Warn("proxy is down")
+	case policy != "":
+		w.logger.Info("proxy is back, normal rules restored")
+	default:
+		w.logger.Info("proxy is back")
+	}
+
+	w.mu.Lock()
+	w.status = ProxyStatus{Checked: true, Down: down, Since: time.Now()}
+	w.mu.Unlock()
+}
+
+// returnSets RETURNs traffic to members of ipsetName and of the targets'
+// ipsets; a target with a port qualifier RETURNs only on its ports. protos
+// are the protocols of the chain ({""} for all traffic).
+func returnSets(rs *netfilter.Ruleset, table, chain string, protos []string, ipsetName string, targets []target) {
+	rs.AppendRule(table, chain, "-m", "set", "--match-set", ipsetName, "dst", "-j", "RETURN")
+	for _, t := range targets {
+		if !t.ports.set {
+			rs.AppendRule(table, chain, "-m", "set", "--match-set", t.ipset, "dst", "-j", "RETURN")
+			continue
+		}
+		for _, proto := range t.ports.protos(protos) {
+			rs.AppendRule(table, slices.Concat([]string{chain}, protoMatch(proto), t.ports.ipt(),
+				[]string{"-m", "set", "--match-set", t.ipset, "dst", "-j", "RETURN"})...)
+		}
+	}
+}
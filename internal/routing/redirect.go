@@ -1,24 +1,27 @@
 package routing
 
 import (
+	"cmp"
 	"context"
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
+	"strconv"
 
 	"github.com/egorlepa/netshunt/internal/config"
 	"github.com/egorlepa/netshunt/internal/deploy"
 	"github.com/egorlepa/netshunt/internal/netfilter"
-	"github.com/egorlepa/netshunt/internal/platform"
+	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
 const (
-	redirectChainName      = "NSHUNT"
-	redirectUDPChainName   = "NSHUNT_UDP"
-	redirect6ChainName     = "NSHUNT6"
-	redirect6UDPChainName  = "NSHUNT6_UDP"
-	fwmark                 = "0x1"
-	routeTable             = "100"
+	redirectChainName     = "NSHUNT"
+	redirectUDPChainName  = "NSHUNT_UDP"
+	redirect6ChainName    = "NSHUNT6"
+	redirect6UDPChainName = "NSHUNT6_UDP"
+	fwmark                = "0x1"
+	routeTable            = "100"
 )
 
 // Redirect implements Mode using NAT REDIRECT (TCP) and TPROXY (UDP)
@@ -31,12 +34,53 @@ const (
 //  1. DNS query resolved → IP added to ipset by DNS forwarder
 //  2. TCP: iptables/ip6tables PREROUTING (nat) redirects to cfg.Routing.LocalPort
 //  3. UDP: iptables/ip6tables PREROUTING (mangle) TPROXY to cfg.Routing.LocalPort
+//     (or the backup port picked by Failover, see SetLocalPort)
 //  4. Transparent proxy forwards traffic through the tunnel
+//
+// Shunts with their own proxy port or client list, and entries with a port
+// qualifier, get a separate ipset per target. The main chains dispatch
+// matches of a target ipset to a per-target chain (NSHUNT_<port>,
+// NSHUNT_UDP_c<hash>, NSHUNT_p<hash>, ...) that filters the target's clients
+// and destination ports and redirects to its port.
+//
+// The global client selection (cfg.Clients) restricts the PREROUTING jumps
+// in include mode, and RETURNs excluded clients at the top of the chains.
+//
+// While the proxy is down, routing.proxy_down.policy replaces the proxy
+// chains: fail-closed rejects their traffic in NSHUNT_KILL (filter FORWARD),
+// fail-open drops them so matched traffic goes direct, see killRules.
+//
+// With cfg.Routing.Local the nat OUTPUT chain applies the same ipsets to
+// TCP connections made by the router itself, see localRules.
+//
+// Members of the direct and block ipsets RETURN before any proxy rule; block
+// destinations are then rejected in the filter FORWARD chain, see blockRules.
+//
+// With cfg.Routing.Inverse the logic flips: members of any shunt ipset
+// RETURN (go direct) and a catch-all rule sends everything else to the
+// default port. Target ports and clients are ignored in that case; port
+// qualifiers limit which traffic RETURNs.
 type Redirect struct {
-	cfg    *config.Config
-	ipt    *netfilter.IPTables
-	ipt6   *netfilter.IPTables
-	logger *slog.Logger
+	cfg     *config.Config
+	ipt     *netfilter.IPTables
+	ipt6    *netfilter.IPTables
+	nft     *netfilter.NFTables // non-nil with the nftables backend
+	targets []shunt.Target
+	port    int  // failover override of routing.local_port, 0 if none
+	down    bool // proxy down, see SetProxyDown
+	applied applied
+	logger  *slog.Logger
+}
+
+// target is a routing target of one address family: the proxy port, clients
+// and destination ports its ipset members are routed for.
+type target struct {
+	port    int
+	ipset   string
+	suffix  string // chain name suffix, see shunt.Target.Suffix
+	clients clientSel
+	ports   portSel
+	v6      bool
 }
 
 // NewRedirect creates a Redirect traffic mode handler.
@@ -45,257 +89,388 @@ func NewRedirect(cfg *config.Config, logger *slog.Logger) *Redirect {
 		cfg:    cfg,
 		ipt:    netfilter.NewIPTables(),
 		ipt6:   netfilter.NewIP6Tables(),
+		nft:    newNFTables(cfg),
 		logger: logger,
 	}
 }
 
-func (r *Redirect) Name() string { return "redirect" }
+func (r *Redirect) Name() string { return ModeRedirect }
 
-// SetupRules creates iptables/ip6tables rules for TCP (NAT REDIRECT) and UDP (TPROXY).
-func (r *Redirect) SetupRules(ctx context.Context) error {
-	ipsetName := r.cfg.IPSet.TableName
-	ipset6Name := ipsetName + "6"
-	port := fmt.Sprintf("%d", r.cfg.Routing.LocalPort)
-	iface := r.cfg.Network.EntwareInterface
+// SetTargets sets the non-default routing targets.
+func (r *Redirect) SetTargets(targets []shunt.Target) { r.targets = targets }
 
-	excluded4, excluded6 := classifyNetworks(r.cfg.ExcludedNetworks)
+// SetLocalPort overrides routing.local_port, see Mode.
+func (r *Redirect) SetLocalPort(port int) { r.port = port }
 
-	r.logger.Info("setting up redirect rules",
-		"ipset", ipsetName, "ipset6", ipset6Name, "port", port, "interface", iface)
+// SetProxyDown records the proxy state, see Mode.
+func (r *Redirect) SetProxyDown(down bool) { r.down = down }
 
-	// ── IPv4 ─────────────────────────────────────────────────────────
+// localPort returns the port of the default target.
+func (r *Redirect) localPort() int { return activePort(r.cfg, r.port) }
 
-	// TCP: NAT REDIRECT.
-	if err := r.ipt.CreateChain(ctx, "nat", redirectChainName); err != nil {
-		return fmt.Errorf("create tcp chain: %w", err)
+// SetupRules applies the iptables/ip6tables rules for TCP (NAT REDIRECT) and
+// UDP (TPROXY), one atomic iptables-restore transaction per address family.
+func (r *Redirect) SetupRules(ctx context.Context) error {
+	r.applied = nil
+	if r.nft != nil {
+		return r.setupNFT(ctx)
 	}
 
-	for _, n := range excluded4 {
-		if err := r.ipt.AppendRule(ctx, "nat", redirectChainName, "-d", n, "-j", "RETURN"); err != nil {
-			return fmt.Errorf("tcp exclude network %s: %w", n, err)
-		}
-	}
+	set4, set6 := r.cfg.IPSet.Names("")
+	ifaces := redirectInterfaces(r.cfg)
+	local := r.localTraffic()
 
-	if err := r.ipt.AppendRule(ctx, "nat",
-		redirectChainName, "-p", "tcp",
-		"-m", "set", "--match-set", ipsetName, "dst",
-		"-j", "REDIRECT", "--to-port", port,
-	); err != nil {
-		return fmt.Errorf("tcp redirect rule: %w", err)
-	}
+	r.logger.Info("setting up redirect rules",
+		"ipset", set4, "ipset6", set6, "port", r.localPort(), "targets", r.targets, "interfaces", ifaces,
+		"clients", r.cfg.Clients.List, "inverse", r.cfg.Routing.Inverse, "local", local,
+		"proxy_down", downPolicy(r.cfg, r.down))
 
-	if iface != "" {
-		if err := r.ipt.AppendRule(ctx, "nat", "PREROUTING", "-i", iface, "-j", redirectChainName); err != nil {
-			return fmt.Errorf("tcp prerouting jump: %w", err)
-		}
-	} else {
-		if err := r.ipt.AppendRule(ctx, "nat", "PREROUTING", "-j", redirectChainName); err != nil {
-			return fmt.Errorf("tcp prerouting jump: %w", err)
-		}
-	}
+	deploy.EnsureTproxyModule(ctx)
 
-	// UDP: TPROXY via mangle table (best-effort).
-	if err := r.setupUDPTproxy(ctx, r.ipt, redirectUDPChainName, ipsetName, port, iface, excluded4, "ip"); err != nil {
-		r.logger.Warn("IPv4 UDP TPROXY not available, only TCP will be proxied", "error", err)
-	}
+	// ── IPv4 ─────────────────────────────────────────────────────────
 
-	// DNS DNAT (IPv4).
-	dnsIface := iface
-	if dnsIface == "" {
-		dnsIface = "br0"
-	}
-	if err := r.ipt.AppendRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to", "127.0.0.1"); err != nil {
-		r.logger.Warn("dns dnat udp rule failed", "error", err)
+	rs := r.ruleset(local, false)
+	skipped, err := restoreRules(ctx, r.ipt, rs, r.logger, "IPv4")
+	if err != nil {
+		return err
 	}
-	if err := r.ipt.AppendRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "tcp", "--dport", "53", "-j", "DNAT", "--to", "127.0.0.1"); err != nil {
-		r.logger.Warn("dns dnat tcp rule failed", "error", err)
+	r.applied.rules(r.ipt, rs, r.logger, "IPv4")
+	if _, ok := skipped[groupUDP]; !ok {
+		if err := r.applied.tproxyRoute(ctx, r.logger, false); err != nil {
+			r.logger.Warn("IPv4 UDP TPROXY not available, only TCP will be proxied", "error", err)
+		}
 	}
 
 	// ── IPv6 (opt-in, best-effort — graceful degradation if ip6table_nat is missing) ──
 
-	if r.cfg.IPv6 {
-		if err := r.setupIPv6Rules(ctx, ipset6Name, port, iface, dnsIface, excluded6); err != nil {
-			r.logger.Warn("IPv6 rules not available, only IPv4 traffic will be proxied", "error", err)
+	if !r.cfg.IPv6 {
+		clearRules(ctx, r.ipt6)
+		return nil
+	}
+	rs = r.ruleset(local, true)
+	skipped, err = restoreRules(ctx, r.ipt6, rs, r.logger, "IPv6")
+	if err != nil {
+		r.logger.Warn("IPv6 rules not available, only IPv4 traffic will be proxied", "error", err)
+		return nil
+	}
+	r.applied.rules(r.ipt6, rs, r.logger, "IPv6")
+	if _, ok := skipped[groupUDP]; !ok {
+		if err := r.applied.tproxyRoute(ctx, r.logger, true); err != nil {
+			r.logger.Warn("IPv6 UDP TPROXY not available", "error", err)
 		}
 	}
-
 	return nil
 }
 
-// setupIPv6Rules sets up ip6tables rules mirroring the IPv4 setup.
-func (r *Redirect) setupIPv6Rules(ctx context.Context, ipset6Name, port, iface, dnsIface string, excluded6 []string) error {
-	// TCP: NAT REDIRECT via ip6tables.
-	if err := r.ipt6.CreateChain(ctx, "nat", redirect6ChainName); err != nil {
-		return fmt.Errorf("create ipv6 tcp chain: %w", err)
+// ruleset builds the rules of one address family: NSHUNT/NSHUNT6 (nat) for
+// TCP, NSHUNT_UDP/NSHUNT6_UDP (mangle) for UDP (or their proxy-down
+// replacement), the block rules, the DNS DNAT and, with local, the OUTPUT
+// rules for router-originated traffic.
+func (r *Redirect) ruleset(local, v6 bool) *netfilter.Ruleset {
+	set4, set6 := r.cfg.IPSet.Names("")
+	excluded4, excluded6 := classifyNetworks(r.cfg.ExcludedNetworks)
+	tcpChain, udpChain, ipset, excluded, dnsAddr := redirectChainName, redirectUDPChainName, set4, excluded4, "127.0.0.1"
+	if v6 {
+		tcpChain, udpChain, ipset, excluded, dnsAddr = redirect6ChainName, redirect6UDPChainName, set6, excluded6, "[::1]"
 	}
+	targets := familyTargets(r.cfg, r.targets, r.localPort(), v6)
+	actions := familyActionSets(r.cfg, r.targets, v6)
 
-	for _, n := range excluded6 {
-		if err := r.ipt6.AppendRule(ctx, "nat", redirect6ChainName, "-d", n, "-j", "RETURN"); err != nil {
-			_ = r.ipt6.DeleteChain(ctx, "nat", redirect6ChainName)
-			return fmt.Errorf("ipv6 tcp exclude network %s: %w", n, err)
-		}
-	}
+	policy := downPolicy(r.cfg, r.down)
 
-	if err := r.ipt6.AppendRule(ctx, "nat",
-		redirect6ChainName, "-p", "tcp",
-		"-m", "set", "--match-set", ipset6Name, "dst",
-		"-j", "REDIRECT", "--to-port", port,
-	); err != nil {
-		_ = r.ipt6.DeleteChain(ctx, "nat", redirect6ChainName)
-		return fmt.Errorf("ipv6 tcp redirect rule: %w", err)
-	}
+	rs := netfilter.NewRuleset()
 
-	if iface != "" {
-		if err := r.ipt6.AppendRule(ctx, "nat", "PREROUTING", "-i", iface, "-j", redirect6ChainName); err != nil {
-			_ = r.ipt6.DeleteChain(ctx, "nat", redirect6ChainName)
-			return fmt.Errorf("ipv6 tcp prerouting jump: %w", err)
-		}
-	} else {
-		if err := r.ipt6.AppendRule(ctx, "nat", "PREROUTING", "-j", redirect6ChainName); err != nil {
-			_ = r.ipt6.DeleteChain(ctx, "nat", redirect6ChainName)
-			return fmt.Errorf("ipv6 tcp prerouting jump: %w", err)
-		}
-	}
+	switch policy {
+	case PolicyFailOpen:
+		// Proxy down: matched traffic goes direct.
+	case PolicyFailClosed:
+		// Proxy down: REJECT matched traffic in filter FORWARD.
+		killRules(rs.Optional(groupKill), r.cfg, ipset, targets, excluded, actions, redirectInterfaces(r.cfg), r.cfg.Routing.Inverse, v6)
+	default:
+		// TCP: NAT REDIRECT.
+		r.proxyChain(rs, "nat", tcpChain, "tcp", ipset, excluded, actions.exceptions(), targets, redirectAction, v6)
 
-	// UDP: TPROXY via ip6tables mangle.
-	if err := r.setupUDPTproxy(ctx, r.ipt6, redirect6UDPChainName, ipset6Name, port, iface, excluded6, "ip -6"); err != nil {
-		r.logger.Warn("IPv6 UDP TPROXY not available", "error", err)
+		// UDP: TPROXY via mangle table (best-effort).
+		r.proxyChain(rs.Optional(groupUDP), "mangle", udpChain, "udp", ipset, excluded, actions.exceptions(), targets, tproxyAction, v6)
 	}
 
-	// DNS DNAT (IPv6).
-	if err := r.ipt6.AppendRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to", "[::1]"); err != nil {
-		r.logger.Warn("ipv6 dns dnat udp rule failed", "error", err)
-	}
-	if err := r.ipt6.AppendRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "tcp", "--dport", "53", "-j", "DNAT", "--to", "[::1]"); err != nil {
-		r.logger.Warn("ipv6 dns dnat tcp rule failed", "error", err)
+	// Block shunts: REJECT in filter FORWARD.
+	blockRules(rs.Optional(groupBlock), r.cfg, actions, redirectInterfaces(r.cfg), v6)
+
+	// DNS DNAT.
+	dnsRedirect(rs.Optional(groupDNS), dnsInterfaces(r.cfg), dnsAddr)
+
+	// Router-originated traffic (opt-in). Under fail-closed it keeps being
+	// redirected: the dead local port refuses the connections right away.
+	if local && policy != PolicyFailOpen {
+		r.localRules(rs.Optional(groupLocal), dnsAddr, excluded, v6)
 	}
+	return rs
+}
 
+// proxyChain creates chain, which sends proto traffic to the proxy, and hooks
+// it into PREROUTING of table. Members of the exception sets are never
+// proxied.
+func (r *Redirect) proxyChain(rs *netfilter.Ruleset, table, chain, proto, ipsetName string, excluded, exceptions []string, targets []target, action func(port int) []string, v6 bool) {
+	clients := globalClients(r.cfg)
+
+	rs.CreateChain(table, chain)
+	excludeNetworks(rs, table, chain, excluded)
+	excludeClients(rs, table, chain, clients, v6)
+	excludeSets(rs, table, chain, exceptions)
+	r.proxyRules(rs, table, chain, proto, ipsetName, targets, action)
+	addJump(rs, table, "PREROUTING", redirectInterfaces(r.cfg), chain, clients, v6)
+}
+
+// TeardownRules removes the redirect chains, policy routing and DNS DNAT
+// rules for both IPv4 and IPv6.
+func (r *Redirect) TeardownRules(ctx context.Context) error {
+	r.logger.Info("tearing down redirect rules")
+	r.applied = nil
+
+	if r.nft != nil {
+		_ = r.nft.DeleteChains(ctx)
+	} else {
+		clearRules(ctx, r.ipt)
+		clearRules(ctx, r.ipt6)
+	}
+	delTproxyRoute(ctx, false)
+	delTproxyRoute(ctx, true)
 	return nil
 }
 
-// setupUDPTproxy sets up TPROXY rules for UDP traffic using the given
-// iptables instance and chain name. ipCmd is "ip" for IPv4 or "ip -6" for IPv6.
-func (r *Redirect) setupUDPTproxy(ctx context.Context, ipt *netfilter.IPTables, chainName, ipsetName, port, iface string, excluded []string, ipCmd string) error {
+// setupNFT applies the redirect ruleset to the netshunt nftables table:
+// NSHUNT (nat) redirects TCP, NSHUNT_UDP (mangle) TPROXYs UDP.
+func (r *Redirect) setupNFT(ctx context.Context) error {
+	fams := nftFamilies(r.cfg, r.targets, r.localPort())
+	ifaces := redirectInterfaces(r.cfg)
+
+	r.logger.Info("setting up redirect rules (nftables)", "port", r.localPort(), "targets", r.targets, "interfaces", ifaces,
+		"clients", r.cfg.Clients.List, "inverse", r.cfg.Routing.Inverse, "proxy_down", downPolicy(r.cfg, r.down))
+
 	deploy.EnsureTproxyModule(ctx)
 
-	if err := ipt.CreateChain(ctx, "mangle", chainName); err != nil {
-		return fmt.Errorf("create udp chain: %w", err)
+	s := newNFTScript(fams, globalClients(r.cfg))
+	s.chain(nftPreroutingNat)
+	s.chain(nftPreroutingMangle)
+	policy := downPolicy(r.cfg, r.down)
+	switch policy {
+	case PolicyFailOpen:
+		// Proxy down: matched traffic goes direct.
+	case PolicyFailClosed:
+		s.kill(ifaces, r.cfg.Routing.Inverse)
+	default:
+		r.nftProxy(s, fams, ifaces)
 	}
-
-	for _, n := range excluded {
-		if err := ipt.AppendRule(ctx, "mangle", chainName, "-d", n, "-j", "RETURN"); err != nil {
-			_ = ipt.DeleteChain(ctx, "mangle", chainName)
-			return fmt.Errorf("udp exclude network %s: %w", n, err)
-		}
+	s.block(ifaces)
+	s.dnsRedirect(dnsInterfaces(r.cfg))
+	if r.localTraffic() && policy != PolicyFailOpen {
+		r.nftLocal(s)
 	}
 
-	if err := ipt.AppendRule(ctx, "mangle",
-		chainName, "-p", "udp",
-		"-m", "set", "--match-set", ipsetName, "dst",
-		"-j", "TPROXY", "--on-port", port, "--tproxy-mark", fwmark+"/"+fwmark,
-	); err != nil {
-		_ = ipt.DeleteChain(ctx, "mangle", chainName)
-		return fmt.Errorf("tproxy target not supported: %w", err)
+	if err := s.apply(ctx, r.nft); err != nil {
+		return err
 	}
+	r.applied.nft(r.nft, s)
 
-	if iface != "" {
-		if err := ipt.AppendRule(ctx, "mangle", "PREROUTING", "-i", iface, "-j", chainName); err != nil {
-			_ = ipt.DeleteChain(ctx, "mangle", chainName)
-			return fmt.Errorf("udp prerouting jump: %w", err)
-		}
-	} else {
-		if err := ipt.AppendRule(ctx, "mangle", "PREROUTING", "-j", chainName); err != nil {
-			_ = ipt.DeleteChain(ctx, "mangle", chainName)
-			return fmt.Errorf("udp prerouting jump: %w", err)
+	if err := r.applied.tproxyRoute(ctx, r.logger, false); err != nil {
+		r.logger.Warn("IPv4 UDP TPROXY routing not available, only TCP will be proxied", "error", err)
+	}
+	if r.cfg.IPv6 {
+		if err := r.applied.tproxyRoute(ctx, r.logger, true); err != nil {
+			r.logger.Warn("IPv6 UDP TPROXY routing not available", "error", err)
 		}
 	}
+	return nil
+}
 
-	// Policy routing for TPROXY-marked packets.
-	if ipCmd == "ip -6" {
-		if err := platform.RunSilent(ctx, "ip", "-6", "rule", "add", "fwmark", fwmark, "table", routeTable); err != nil {
-			r.logger.Warn("ip -6 rule add failed (may already exist)", "error", err)
-		}
-		if err := platform.RunSilent(ctx, "ip", "-6", "route", "replace", "local", "::/0", "dev", "lo", "table", routeTable); err != nil {
-			return fmt.Errorf("ip -6 route replace: %w", err)
-		}
-	} else {
-		if err := platform.RunSilent(ctx, "ip", "rule", "add", "fwmark", fwmark, "table", routeTable); err != nil {
-			r.logger.Warn("ip rule add failed (may already exist)", "error", err)
+// nftProxy adds the proxy chains of the nftables ruleset: NSHUNT redirects
+// TCP, NSHUNT_UDP TPROXYs UDP.
+func (r *Redirect) nftProxy(s *nftScript, fams []nftFamily, ifaces []string) {
+	s.chain(redirectChainName)
+	s.chain(redirectUDPChainName)
+
+	s.excluded(redirectChainName)
+	s.excluded(redirectUDPChainName)
+	for _, f := range fams {
+		if r.cfg.Routing.Inverse {
+			for _, t := range f.targets {
+				if l4, ok := t.ports.nft([]string{"tcp"}); ok {
+					s.rule(redirectChainName, "%s%s daddr @%s return", l4, f.proto, t.ipset)
+				}
+				if l4, ok := t.ports.nft([]string{"udp"}); ok {
+					s.rule(redirectUDPChainName, "%s%s daddr @%s return", l4, f.proto, t.ipset)
+				}
+			}
+			port := r.localPort()
+			s.rule(redirectChainName, "meta nfproto %s meta l4proto tcp redirect to :%d", f.nfproto, port)
+			s.rule(redirectUDPChainName, "meta nfproto %s meta l4proto udp meta mark set %s tproxy %s to :%d accept",
+				f.nfproto, fwmark, f.proto, port)
+			continue
 		}
-		if err := platform.RunSilent(ctx, "ip", "route", "replace", "local", "0/0", "dev", "lo", "table", routeTable); err != nil {
-			return fmt.Errorf("ip route replace: %w", err)
+		for _, t := range f.targets {
+			tcp, tcpOK := t.ports.nft([]string{"tcp"})
+			udp, udpOK := t.ports.nft([]string{"udp"})
+			for _, c := range t.clients.nftTarget(f) {
+				if tcpOK {
+					s.rule(redirectChainName, "%s%s%s daddr @%s redirect to :%d", c, tcp, f.proto, t.ipset, t.port)
+				}
+				if udpOK {
+					s.rule(redirectUDPChainName, "%s%s%s daddr @%s meta mark set %s tproxy %s to :%d accept",
+						c, udp, f.proto, t.ipset, fwmark, f.proto, t.port)
+				}
+			}
 		}
 	}
-
-	return nil
+	s.jump(nftPreroutingNat, ifaces, redirectChainName)
+	s.jump(nftPreroutingMangle, ifaces, redirectUDPChainName)
 }
 
-// TeardownRules removes TCP/UDP redirect chains, policy routing, and DNS DNAT rules
-// for both IPv4 and IPv6.
-func (r *Redirect) TeardownRules(ctx context.Context) error {
-	r.logger.Info("tearing down redirect rules")
+// RepairRules reapplies the parts of the last SetupRules that drifted, see
+// Mode.
+func (r *Redirect) RepairRules(ctx context.Context) []Drift { return r.applied.repair(ctx) }
 
-	iface := r.cfg.Network.EntwareInterface
-	dnsIface := iface
-	if dnsIface == "" {
-		dnsIface = "br0"
+// IsActive checks if something is listening on the active local port.
+func (r *Redirect) IsActive(ctx context.Context) (bool, error) {
+	port := fmt.Sprintf(":%d", r.localPort())
+	ok, err := netfilter.CheckListeningPort(ctx, port)
+	if err != nil {
+		return false, nil
 	}
+	return ok, nil
+}
 
-	// ── IPv4 ──
+// proxyRules adds the rules of chain that send proto traffic to the proxy.
+// Normally members of ipsetName go to the default port and members of a
+// proxy target ipset to that target's chain. In inverse mode members of any
+// of these ipsets RETURN (only on the qualified ports of a target with a port
+// qualifier) and all remaining traffic goes to the default port.
+func (r *Redirect) proxyRules(rs *netfilter.Ruleset, table, chain, proto, ipsetName string, targets []target, action func(port int) []string) {
+	port := r.localPort()
+
+	if r.cfg.Routing.Inverse {
+		returnSets(rs, table, chain, []string{proto}, ipsetName, targets)
+		rs.AppendRule(table, append([]string{chain, "-p", proto}, action(port)...)...)
+		return
+	}
 
-	// TCP: nat table.
-	_ = r.ipt.RemoveJumpRules(ctx, "nat", "PREROUTING", redirectChainName)
-	_ = r.ipt.DeleteChain(ctx, "nat", redirectChainName)
+	rs.AppendRule(table, append([]string{chain, "-p", proto,
+		"-m", "set", "--match-set", ipsetName, "dst"}, action(port)...)...)
+	for _, t := range targets {
+		setupTarget(rs, table, chain, t, []string{proto}, action(t.port)...)
+	}
+}
 
-	// UDP: mangle table.
-	_ = r.ipt.RemoveJumpRules(ctx, "mangle", "PREROUTING", redirectUDPChainName)
-	_ = r.ipt.DeleteChain(ctx, "mangle", redirectUDPChainName)
+// redirectAction is the nat REDIRECT action to a proxy port.
+func redirectAction(port int) []string {
+	return []string{"-j", "REDIRECT", "--to-port", strconv.Itoa(port)}
+}
 
-	// Policy routing for TPROXY (IPv4).
-	_ = platform.RunSilent(ctx, "ip", "rule", "del", "fwmark", fwmark, "table", routeTable)
-	_ = platform.RunSilent(ctx, "ip", "route", "del", "local", "0/0", "table", routeTable)
+// tproxyAction is the mangle TPROXY action to a proxy port.
+func tproxyAction(port int) []string {
+	return []string{"-j", "TPROXY", "--on-port", strconv.Itoa(port), "--tproxy-mark", fwmark + "/" + fwmark}
+}
 
-	// DNS DNAT (IPv4).
-	_ = r.ipt.DeleteRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to", "127.0.0.1")
-	_ = r.ipt.DeleteRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "tcp", "--dport", "53", "-j", "DNAT", "--to", "127.0.0.1")
+// redirectInterfaces returns the interfaces whose traffic enters the
+// redirect chains, see config.NetworkConfig.RouteInterfaces. Normally ""
+// stands for all interfaces; in inverse mode the catch-all must never see
+// WAN traffic, so the LAN bridge br0 is used instead.
+func redirectInterfaces(cfg *config.Config) []string {
+	ifaces := cfg.Network.RouteInterfaces()
+	if !cfg.Routing.Inverse {
+		return ifaces
+	}
+	out := make([]string, len(ifaces))
+	for i, iface := range ifaces {
+		out[i] = cmp.Or(iface, "br0")
+	}
+	return out
+}
 
-	// ── IPv6 ──
+// setupTarget creates the per-target chain <parent><suffix> holding the final
+// action for the target's clients and dispatches packets matching the
+// target's ipset to it from the parent chain. The action is applied once per
+// protocol in protos, narrowed by the target's port qualifier; an empty
+// protocol matches every protocol. A qualifier leaving no protocol skips the
+// target.
+func setupTarget(rs *netfilter.Ruleset, table, parent string, t target, protos []string, action ...string) {
+	protos = t.ports.protos(protos)
+	if len(protos) == 0 {
+		return
+	}
+	chain := parent + t.suffix
+	rs.CreateChain(table, chain)
+	excludeClients(rs, table, chain, t.clients, t.v6)
+	for _, m := range t.clients.iptIncluded(t.v6) {
+		for _, proto := range protos {
+			rs.AppendRule(table, slices.Concat([]string{chain}, protoMatch(proto), t.ports.ipt(), m, action)...)
+		}
+	}
 
-	// TCP: nat table.
-	_ = r.ipt6.RemoveJumpRules(ctx, "nat", "PREROUTING", redirect6ChainName)
-	_ = r.ipt6.DeleteChain(ctx, "nat", redirect6ChainName)
+	dispatch := []string{parent}
+	if len(protos) == 1 {
+		dispatch = append(dispatch, protoMatch(protos[0])...)
+	}
+	rs.AppendRule(table, append(dispatch, "-m", "set", "--match-set", t.ipset, "dst", "-j", chain)...)
+}
 
-	// UDP: mangle table.
-	_ = r.ipt6.RemoveJumpRules(ctx, "mangle", "PREROUTING", redirect6UDPChainName)
-	_ = r.ipt6.DeleteChain(ctx, "mangle", redirect6UDPChainName)
+// excludeNetworks RETURNs traffic to the excluded networks.
+func excludeNetworks(rs *netfilter.Ruleset, table, chain string, networks []string) {
+	for _, n := range networks {
+		rs.AppendRule(table, chain, "-d", n, "-j", "RETURN")
+	}
+}
 
-	// Policy routing for TPROXY (IPv6).
-	_ = platform.RunSilent(ctx, "ip", "-6", "rule", "del", "fwmark", fwmark, "table", routeTable)
-	_ = platform.RunSilent(ctx, "ip", "-6", "route", "del", "local", "::/0", "table", routeTable)
+// excludeClients RETURNs traffic from the clients excluded by sel.
+func excludeClients(rs *netfilter.Ruleset, table, chain string, sel clientSel, v6 bool) {
+	for _, m := range sel.iptExcluded(v6) {
+		rs.AppendRule(table, slices.Concat([]string{chain}, m, []string{"-j", "RETURN"})...)
+	}
+}
 
-	// DNS DNAT (IPv6).
-	_ = r.ipt6.DeleteRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "udp", "--dport", "53", "-j", "DNAT", "--to", "[::1]")
-	_ = r.ipt6.DeleteRule(ctx, "nat", "PREROUTING",
-		"-i", dnsIface, "-p", "tcp", "--dport", "53", "-j", "DNAT", "--to", "[::1]")
+// addJump hooks chain into the built-in parent chain for traffic entering on
+// each of ifaces ("" for any interface). In include mode one jump is added
+// per interface and selected client.
+func addJump(rs *netfilter.Ruleset, table, parent string, ifaces []string, chain string, sel clientSel, v6 bool) {
+	for _, iface := range ifaces {
+		jump := []string{parent}
+		if iface != "" {
+			jump = append(jump, "-i", iface)
+		}
+		for _, m := range sel.iptIncluded(v6) {
+			rs.AppendRule(table, slices.Concat(jump, m, []string{"-j", chain})...)
+		}
+	}
+}
 
-	return nil
+// protoMatch returns the -p match for proto, or nothing for an empty proto.
+func protoMatch(proto string) []string {
+	if proto == "" {
+		return nil
+	}
+	return []string{"-p", proto}
 }
 
-// IsActive checks if something is listening on the configured local port.
-func (r *Redirect) IsActive(ctx context.Context) (bool, error) {
-	port := fmt.Sprintf(":%d", r.cfg.Routing.LocalPort)
-	ok, err := netfilter.CheckListeningPort(ctx, port)
-	if err != nil {
-		return false, nil
+// familyTargets returns the non-default proxy targets with their v4 or v6
+// ipset names. Targets without a port of their own go to port, the active
+// routing.local_port. Direct and block targets are left to familyActionSets.
+func familyTargets(cfg *config.Config, targets []shunt.Target, port int, v6 bool) []target {
+	var out []target
+	for _, t := range targets {
+		if !t.IsProxy() {
+			continue
+		}
+		set4, set6 := cfg.IPSet.Names(t.Suffix())
+		tg := target{port: t.Port, ipset: set4, suffix: t.Suffix(), clients: targetClients(t), ports: targetPorts(t), v6: v6}
+		if v6 {
+			tg.ipset = set6
+		}
+		if tg.port == 0 {
+			tg.port = port
+		}
+		out = append(out, tg)
 	}
-	return ok, nil
+	return out
 }
 
 // classifyNetworks splits a list of CIDRs into IPv4 and IPv6 groups.
@@ -0,0 +1,27 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+// maxChainName is the longest chain name iptables accepts.
+const maxChainName = 28
+
+func TestTargetChainNamesFit(t *testing.T) {
+	// The longest suffix: a 5-digit port with both a client selection and a
+	// port qualifier.
+	suffix := shunt.Target{Port: 65535, Clients: "include:192.168.1.10", Ports: "tcp:443"}.Suffix()
+	parents := []string{
+		redirectChainName, redirectUDPChainName, redirect6ChainName, redirect6UDPChainName,
+		tproxyChainName, tproxy6ChainName,
+		killChainName, kill6ChainName,
+		markChainName, mark6ChainName,
+	}
+	for _, parent := range parents {
+		if chain := parent + suffix; len(chain) > maxChainName {
+			t.Errorf("chain %s is %d characters, over the limit of %d", chain, len(chain), maxChainName)
+		}
+	}
+}
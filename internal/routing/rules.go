@@ -0,0 +1,47 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/egorlepa/netshunt/internal/netfilter"
+)
+
+// Optional rule groups of an iptables ruleset. The rules of a group the
+// kernel rejects (missing xt_TPROXY, ip6table_nat, xt_owner, ...) are left
+// out while the rest still applies.
+const (
+	groupUDP   = "udp"
+	groupDNS   = "dns"
+	groupLocal = "local"
+	groupBlock = "block"
+	groupKill  = "kill"
+)
+
+var groupWarnings = map[string]string{
+	groupUDP:   "UDP TPROXY not available, only TCP will be proxied",
+	groupDNS:   "DNS DNAT not available, only clients using the router's DNS are shunted",
+	groupLocal: "local traffic rules not available",
+	groupBlock: "block rules not available, blocked IPs go direct",
+	groupKill:  "kill switch not available, matched traffic goes direct while the proxy is down",
+}
+
+// restoreRules applies the ruleset of one address family (family is "IPv4"
+// or "IPv6" for log messages) and logs the optional groups that were left
+// out.
+func restoreRules(ctx context.Context, ipt *netfilter.IPTables, rs *netfilter.Ruleset, logger *slog.Logger, family string) (map[string]error, error) {
+	skipped, err := ipt.Restore(ctx, rs)
+	if err != nil {
+		return nil, fmt.Errorf("apply %s rules: %w", family, err)
+	}
+	for group, err := range skipped {
+		logger.Warn(family+" "+groupWarnings[group], "error", err)
+	}
+	return skipped, nil
+}
+
+// clearRules removes every netshunt chain and rule of one address family.
+func clearRules(ctx context.Context, ipt *netfilter.IPTables) {
+	_, _ = ipt.Restore(ctx, netfilter.NewRuleset())
+}
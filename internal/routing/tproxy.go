@@ -0,0 +1,276 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/deploy"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/platform"
+	"github.com/egorlepa/netshunt/internal/shunt"
+)
+
+const (
+	tproxyChainName  = "NSHUNT_TPROXY"
+	tproxy6ChainName = "NSHUNT6_TPROXY"
+)
+
+// Tproxy implements Mode using TPROXY in the mangle table for both TCP and
+// UDP. Unlike Redirect it does not need the nat table for proxied traffic,
+// so it works on IPv6 without ip6table_nat, and the proxy always sees the
+// original destination address.
+//
+// The transparent proxy must accept TPROXY connections (e.g. xray
+// dokodemo-door with tproxy, sing-box tproxy inbound, ss-redir -T -u).
+//
+// Traffic flow:
+//  1. DNS query resolved → IP added to ipset by DNS forwarder
+//  2. iptables/ip6tables PREROUTING (mangle) TPROXY tcp+udp to cfg.Routing.LocalPort
+//     (or the backup port picked by Failover, see SetLocalPort)
+//  3. ip rule fwmark → table 100 → local route via lo
+//  4. Transparent proxy forwards traffic through the tunnel
+//
+// While the proxy is down, routing.proxy_down.policy replaces the TPROXY
+// chain, see Redirect.
+type Tproxy struct {
+	cfg     *config.Config
+	ipt     *netfilter.IPTables
+	ipt6    *netfilter.IPTables
+	nft     *netfilter.NFTables // non-nil with the nftables backend
+	targets []shunt.Target
+	port    int  // failover override of routing.local_port, 0 if none
+	down    bool // proxy down, see SetProxyDown
+	applied applied
+	logger  *slog.Logger
+}
+
+// NewTproxy creates a Tproxy traffic mode handler.
+func NewTproxy(cfg *config.Config, logger *slog.Logger) *Tproxy {
+	return &Tproxy{
+		cfg:    cfg,
+		ipt:    netfilter.NewIPTables(),
+		ipt6:   netfilter.NewIP6Tables(),
+		nft:    newNFTables(cfg),
+		logger: logger,
+	}
+}
+
+func (t *Tproxy) Name() string { return ModeTproxy }
+
+// SetTargets sets the non-default routing targets.
+func (t *Tproxy) SetTargets(targets []shunt.Target) { t.targets = targets }
+
+// SetLocalPort overrides routing.local_port, see Mode.
+func (t *Tproxy) SetLocalPort(port int) { t.port = port }
+
+// SetProxyDown records the proxy state, see Mode.
+func (t *Tproxy) SetProxyDown(down bool) { t.down = down }
+
+// localPort returns the port of the default target.
+func (t *Tproxy) localPort() int { return activePort(t.cfg, t.port) }
+
+// SetupRules applies the mangle TPROXY rules and DNS DNAT, one atomic
+// iptables-restore transaction per address family, and the policy routing.
+func (t *Tproxy) SetupRules(ctx context.Context) error {
+	t.applied = nil
+	if t.nft != nil {
+		return t.setupNFT(ctx)
+	}
+
+	set4, set6 := t.cfg.IPSet.Names("")
+	ifaces := t.cfg.Network.RouteInterfaces()
+
+	t.logger.Info("setting up tproxy rules",
+		"ipset", set4, "ipset6", set6, "port", t.localPort(), "targets", t.targets, "interfaces", ifaces,
+		"clients", t.cfg.Clients.List, "proxy_down", downPolicy(t.cfg, t.down))
+
+	deploy.EnsureTproxyModule(ctx)
+
+	// ── IPv4 ─────────────────────────────────────────────────────────
+
+	rs := t.ruleset(false)
+	if _, err := restoreRules(ctx, t.ipt, rs, t.logger, "IPv4"); err != nil {
+		return err
+	}
+	t.applied.rules(t.ipt, rs, t.logger, "IPv4")
+	if err := t.applied.tproxyRoute(ctx, t.logger, false); err != nil {
+		return err
+	}
+
+	// ── IPv6 (opt-in, best-effort) ───────────────────────────────────
+
+	if !t.cfg.IPv6 {
+		clearRules(ctx, t.ipt6)
+		return nil
+	}
+	rs = t.ruleset(true)
+	if _, err := restoreRules(ctx, t.ipt6, rs, t.logger, "IPv6"); err != nil {
+		t.logger.Warn("IPv6 TPROXY not available, only IPv4 traffic will be proxied", "error", err)
+		return nil
+	}
+	t.applied.rules(t.ipt6, rs, t.logger, "IPv6")
+	if err := t.applied.tproxyRoute(ctx, t.logger, true); err != nil {
+		t.logger.Warn("IPv6 TPROXY routing not available", "error", err)
+	}
+	return nil
+}
+
+// ruleset builds the TPROXY chain of one address family, hooked into mangle
+// PREROUTING (or its proxy-down replacement), the block rules and the DNS
+// DNAT.
+func (t *Tproxy) ruleset(v6 bool) *netfilter.Ruleset {
+	set4, set6 := t.cfg.IPSet.Names("")
+	excluded4, excluded6 := classifyNetworks(t.cfg.ExcludedNetworks)
+	chain, ipset, excluded, dnsAddr := tproxyChainName, set4, excluded4, "127.0.0.1"
+	if v6 {
+		chain, ipset, excluded, dnsAddr = tproxy6ChainName, set6, excluded6, "[::1]"
+	}
+	clients := globalClients(t.cfg)
+	actions := familyActionSets(t.cfg, t.targets, v6)
+
+	targets := familyTargets(t.cfg, t.targets, t.localPort(), v6)
+
+	rs := netfilter.NewRuleset()
+	switch downPolicy(t.cfg, t.down) {
+	case PolicyFailOpen:
+		// Proxy down: matched traffic goes direct.
+	case PolicyFailClosed:
+		killRules(rs.Optional(groupKill), t.cfg, ipset, targets, excluded, actions, t.cfg.Network.RouteInterfaces(), false, v6)
+	default:
+		rs.CreateChain("mangle", chain)
+		excludeNetworks(rs, "mangle", chain, excluded)
+		excludeClients(rs, "mangle", chain, clients, v6)
+		excludeSets(rs, "mangle", chain, actions.exceptions())
+		for _, proto := range []string{"tcp", "udp"} {
+			rs.AppendRule("mangle", append([]string{chain, "-p", proto,
+				"-m", "set", "--match-set", ipset, "dst"}, tproxyAction(t.localPort())...)...)
+		}
+		for _, tg := range targets {
+			setupTarget(rs, "mangle", chain, tg, []string{"tcp", "udp"}, tproxyAction(tg.port)...)
+		}
+		addJump(rs, "mangle", "PREROUTING", t.cfg.Network.RouteInterfaces(), chain, clients, v6)
+	}
+
+	blockRules(rs.Optional(groupBlock), t.cfg, actions, t.cfg.Network.RouteInterfaces(), v6)
+	dnsRedirect(rs.Optional(groupDNS), dnsInterfaces(t.cfg), dnsAddr)
+	return rs
+}
+
+// TeardownRules removes the TPROXY chains, policy routing and DNS DNAT rules
+// for both IPv4 and IPv6.
+func (t *Tproxy) TeardownRules(ctx context.Context) error {
+	t.logger.Info("tearing down tproxy rules")
+	t.applied = nil
+
+	if t.nft != nil {
+		_ = t.nft.DeleteChains(ctx)
+	} else {
+		clearRules(ctx, t.ipt)
+		clearRules(ctx, t.ipt6)
+	}
+	delTproxyRoute(ctx, false)
+	delTproxyRoute(ctx, true)
+	return nil
+}
+
+// setupNFT applies the tproxy ruleset to the netshunt nftables table.
+func (t *Tproxy) setupNFT(ctx context.Context) error {
+	fams := nftFamilies(t.cfg, t.targets, t.localPort())
+	ifaces := t.cfg.Network.RouteInterfaces()
+
+	t.logger.Info("setting up tproxy rules (nftables)", "port", t.localPort(), "targets", t.targets, "interfaces", ifaces,
+		"clients", t.cfg.Clients.List, "proxy_down", downPolicy(t.cfg, t.down))
+
+	deploy.EnsureTproxyModule(ctx)
+
+	s := newNFTScript(fams, globalClients(t.cfg))
+	s.chain(nftPreroutingNat)
+	s.chain(nftPreroutingMangle)
+	switch downPolicy(t.cfg, t.down) {
+	case PolicyFailOpen:
+		// Proxy down: matched traffic goes direct.
+	case PolicyFailClosed:
+		s.kill(ifaces, false)
+	default:
+		s.chain(tproxyChainName)
+		s.excluded(tproxyChainName)
+		for _, f := range fams {
+			for _, tg := range f.targets {
+				l4, ok := tg.ports.nft([]string{"tcp", "udp"})
+				if !ok {
+					continue
+				}
+				for _, c := range tg.clients.nftTarget(f) {
+					s.rule(tproxyChainName, "%s%s%s daddr @%s meta mark set %s tproxy %s to :%d accept",
+						c, l4, f.proto, tg.ipset, fwmark, f.proto, tg.port)
+				}
+			}
+		}
+		s.jump(nftPreroutingMangle, ifaces, tproxyChainName)
+	}
+	s.block(ifaces)
+	s.dnsRedirect(dnsInterfaces(t.cfg))
+
+	if err := s.apply(ctx, t.nft); err != nil {
+		return err
+	}
+	t.applied.nft(t.nft, s)
+
+	if err := t.applied.tproxyRoute(ctx, t.logger, false); err != nil {
+		return err
+	}
+	if t.cfg.IPv6 {
+		if err := t.applied.tproxyRoute(ctx, t.logger, true); err != nil {
+			t.logger.Warn("IPv6 TPROXY routing not available", "error", err)
+		}
+	}
+	return nil
+}
+
+// RepairRules reapplies the parts of the last SetupRules that drifted, see
+// Mode.
+func (t *Tproxy) RepairRules(ctx context.Context) []Drift { return t.applied.repair(ctx) }
+
+// IsActive checks if something is listening on the active local port.
+func (t *Tproxy) IsActive(ctx context.Context) (bool, error) {
+	port := fmt.Sprintf(":%d", t.localPort())
+	ok, err := netfilter.CheckListeningPort(ctx, port)
+	if err != nil {
+		return false, nil
+	}
+	return ok, nil
+}
+
+// addTproxyRoute installs the policy routing that delivers TPROXY-marked
+// packets to the local stack: ip rule fwmark → table 100 → local default via lo.
+func addTproxyRoute(ctx context.Context, logger *slog.Logger, v6 bool) error {
+	if v6 {
+		if err := platform.RunSilent(ctx, "ip", "-6", "rule", "add", "fwmark", fwmark, "table", routeTable); err != nil {
+			logger.Warn("ip -6 rule add failed (may already exist)", "error", err)
+		}
+		if err := platform.RunSilent(ctx, "ip", "-6", "route", "replace", "local", "::/0", "dev", "lo", "table", routeTable); err != nil {
+			return fmt.Errorf("ip -6 route replace: %w", err)
+		}
+		return nil
+	}
+	if err := platform.RunSilent(ctx, "ip", "rule", "add", "fwmark", fwmark, "table", routeTable); err != nil {
+		logger.Warn("ip rule add failed (may already exist)", "error", err)
+	}
+	if err := platform.RunSilent(ctx, "ip", "route", "replace", "local", "0/0", "dev", "lo", "table", routeTable); err != nil {
+		return fmt.Errorf("ip route replace: %w", err)
+	}
+	return nil
+}
+
+// delTproxyRoute removes the policy routing added by addTproxyRoute.
+func delTproxyRoute(ctx context.Context, v6 bool) {
+	if v6 {
+		_ = platform.RunSilent(ctx, "ip", "-6", "rule", "del", "fwmark", fwmark, "table", routeTable)
+		_ = platform.RunSilent(ctx, "ip", "-6", "route", "del", "local", "::/0", "table", routeTable)
+		return
+	}
+	_ = platform.RunSilent(ctx, "ip", "rule", "del", "fwmark", fwmark, "table", routeTable)
+	_ = platform.RunSilent(ctx, "ip", "route", "del", "local", "0/0", "table", routeTable)
+}
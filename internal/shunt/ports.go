@@ -0,0 +1,131 @@
+package shunt
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// QualifierSeparator separates a port qualifier from the entry it restricts,
+// as in tcp:443@1.2.3.0/24.
+const QualifierSeparator = "@"
+
+// maxPortItems is the iptables multiport limit: at most 15 ports per rule,
+// a range counting as two.
+const maxPortItems = 15
+
+// ParsePorts validates a port qualifier and returns its canonical form.
+// A qualifier is a protocol ("tcp" or "udp"), a list of ports and ranges
+// ("443", "80,8000-8100") or both ("tcp:443"). Without a protocol the ports
+// apply to TCP and UDP. The canonical form is lowercase with the ports
+// sorted and deduplicated.
+func ParsePorts(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	proto, list := "", s
+	if p, rest, ok := strings.Cut(s, ":"); ok {
+		proto, list = p, rest
+	} else if s == "tcp" || s == "udp" {
+		proto, list = s, ""
+	}
+	if proto != "" && proto != "tcp" && proto != "udp" {
+		return "", fmt.Errorf("invalid protocol %q: expected tcp or udp", proto)
+	}
+	if proto == "" && list == "" {
+		return "", fmt.Errorf("empty port qualifier")
+	}
+	if list == "" {
+		return proto, nil
+	}
+
+	type portRange struct{ lo, hi int }
+	var ranges []portRange
+	items := 0
+	for _, item := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(item), "-")
+		if !isRange {
+			hi = lo
+		}
+		l, err := parsePort(lo)
+		if err != nil {
+			return "", err
+		}
+		h, err := parsePort(hi)
+		if err != nil {
+			return "", err
+		}
+		if l > h {
+			return "", fmt.Errorf("invalid port range %q", item)
+		}
+		r := portRange{l, h}
+		if !slices.Contains(ranges, r) {
+			ranges = append(ranges, r)
+			items += 1 + min(h-l, 1)
+		}
+	}
+	if items > maxPortItems {
+		return "", fmt.Errorf("too many ports in %q: at most %d, a range counts as two", list, maxPortItems)
+	}
+	slices.SortFunc(ranges, func(a, b portRange) int {
+		return cmp.Or(cmp.Compare(a.lo, b.lo), cmp.Compare(a.hi, b.hi))
+	})
+
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = strconv.Itoa(r.lo)
+		if r.hi != r.lo {
+			parts[i] += "-" + strconv.Itoa(r.hi)
+		}
+	}
+	out := strings.Join(parts, ",")
+	if proto != "" {
+		out = proto + ":" + out
+	}
+	return out, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// splitQualifier splits an entry into its port qualifier and the host part.
+// Text before the first QualifierSeparator is a qualifier only if it looks
+// like one (a protocol, digits, commas and dashes), so regexps containing the
+// separator stay intact.
+func splitQualifier(s string) (qualifier, host string) {
+	q, h, ok := strings.Cut(s, QualifierSeparator)
+	if !ok || !looksLikeQualifier(q) {
+		return "", s
+	}
+	return q, h
+}
+
+func looksLikeQualifier(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, proto := range []string{"tcp", "udp"} {
+		if s == proto {
+			return true
+		}
+		s = strings.TrimPrefix(s, proto+":")
+	}
+	return s != "" && strings.Trim(s, "0123456789,- ") == ""
+}
+
+// portSelection splits a canonical qualifier into protocol and ports.
+func portSelection(qualifier string) (proto string, ports []string) {
+	if qualifier == "tcp" || qualifier == "udp" {
+		return qualifier, nil
+	}
+	if p, list, ok := strings.Cut(qualifier, ":"); ok {
+		proto, qualifier = p, list
+	}
+	if qualifier == "" {
+		return proto, nil
+	}
+	return proto, strings.Split(qualifier, ",")
+}
@@ -0,0 +1,282 @@
+package shunt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule turns a shunt on and off at fixed times of the week, in the
+// router's local time. It is a list of rules separated by ";", each
+// optionally starting with the days it applies to:
+//
+//	09:00-18:00          enabled from 09:00 to 18:00 every day
+//	mon-fri 09:00-18:00  the same on weekdays only
+//	sat,sun 22:00-02:00  a window may cross midnight
+//	off 23:00            disabled at 23:00, enabled again by hand
+//	weekdays on 07:30    enabled at 07:30 on weekdays
+//
+// Days are mon to sun, ranges (mon-fri), lists (sat,sun), weekdays,
+// weekends or daily (the default). The schedule only acts at its
+// boundaries: a shunt switched by hand stays so until the next one.
+type Schedule struct {
+	rules []scheduleRule
+}
+
+// scheduleRule is one rule of a Schedule.
+type scheduleRule struct {
+	days [7]bool // indexed by time.Weekday
+	on   int     // minute of the day the shunt is enabled, -1 for none
+	off  int     // minute of the day the shunt is disabled, -1 for none
+}
+
+// Transition is a point where a schedule enables or disables its shunt.
+type Transition struct {
+	At      time.Time
+	Enabled bool
+}
+
+var dayNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule parses a schedule. The empty string is no schedule.
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	for _, part := range strings.Split(strings.ToLower(s), ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		r, err := parseScheduleRule(fields)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("schedule rule %q: %w", strings.Join(fields, " "), err)
+		}
+		sched.rules = append(sched.rules, r)
+	}
+	return sched, nil
+}
+
+// NormalizeSchedule validates a schedule and returns its canonical form.
+func NormalizeSchedule(s string) (string, error) {
+	sched, err := ParseSchedule(s)
+	if err != nil {
+		return "", err
+	}
+	return sched.String(), nil
+}
+
+func parseScheduleRule(fields []string) (scheduleRule, error) {
+	r := scheduleRule{on: -1, off: -1}
+	days := "daily"
+	if len(fields) > 1 && fields[0] != "on" && fields[0] != "off" {
+		days, fields = fields[0], fields[1:]
+	}
+	if err := r.parseDays(days); err != nil {
+		return r, err
+	}
+
+	switch {
+	case len(fields) == 1:
+		start, end, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return r, fmt.Errorf("expected a time window like 09:00-18:00, or on/off and a time")
+		}
+		var err error
+		if r.on, err = parseClock(start); err != nil {
+			return r, err
+		}
+		if r.off, err = parseClock(end); err != nil {
+			return r, err
+		}
+		if r.on == r.off {
+			return r, fmt.Errorf("empty time window")
+		}
+	case len(fields) == 2 && (fields[0] == "on" || fields[0] == "off"):
+		at, err := parseClock(fields[1])
+		if err != nil {
+			return r, err
+		}
+		if fields[0] == "on" {
+			r.on = at
+		} else {
+			r.off = at
+		}
+	default:
+		return r, fmt.Errorf("expected a time window like 09:00-18:00, or on/off and a time")
+	}
+	return r, nil
+}
+
+// parseDays parses the day part of a rule.
+func (r *scheduleRule) parseDays(s string) error {
+	switch s {
+	case "daily":
+		r.days = [7]bool{true, true, true, true, true, true, true}
+		return nil
+	case "weekdays":
+		s = "mon-fri"
+	case "weekends":
+		s = "sat,sun"
+	}
+	for _, item := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		from, err := parseDay(first)
+		if err != nil {
+			return err
+		}
+		to, err := parseDay(last)
+		if err != nil {
+			return err
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			r.days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseDay(s string) (int, error) {
+	for i, name := range dayNames {
+		if s == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q: expected mon, tue, wed, thu, fri, sat or sun", s)
+}
+
+// parseClock parses "HH:MM" into the minute of the day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func formatClock(minute int) string {
+	return fmt.Sprintf("%02d:%02d", minute/60, minute%60)
+}
+
+// IsZero reports whether the schedule has no rules.
+func (s Schedule) IsZero() bool {
+	return len(s.rules) == 0
+}
+
+// String returns the canonical form of the schedule.
+func (s Schedule) String() string {
+	parts := make([]string, len(s.rules))
+	for i, r := range s.rules {
+		var b strings.Builder
+		if days := r.formatDays(); days != "daily" {
+			b.WriteString(days + " ")
+		}
+		switch {
+		case r.on >= 0 && r.off >= 0:
+			b.WriteString(formatClock(r.on) + "-" + formatClock(r.off))
+		case r.on >= 0:
+			b.WriteString("on " + formatClock(r.on))
+		default:
+			b.WriteString("off " + formatClock(r.off))
+		}
+		parts[i] = b.String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// formatDays renders the days of a rule, Monday first, with runs of three
+// or more days as ranges.
+func (r scheduleRule) formatDays() string {
+	if r.days == [7]bool{true, true, true, true, true, true, true} {
+		return "daily"
+	}
+	var items []string
+	for i := 0; i < 7; {
+		if !r.days[(i+1)%7] {
+			i++
+			continue
+		}
+		j := i
+		for j+1 < 7 && r.days[(j+2)%7] {
+			j++
+		}
+		first, last := dayNames[(i+1)%7], dayNames[(j+1)%7]
+		switch j - i {
+		case 0:
+			items = append(items, first)
+		case 1:
+			items = append(items, first, last)
+		default:
+			items = append(items, first+"-"+last)
+		}
+		i = j + 1
+	}
+	return strings.Join(items, ",")
+}
+
+// transitions returns the transitions of the rules on the days from
+// t's day + from to t's day + to, in t's location.
+func (s Schedule) transitions(t time.Time, from, to int) []Transition {
+	var out []Transition
+	y, m, d := t.Date()
+	for offset := from; offset <= to; offset++ {
+		day := time.Date(y, m, d+offset, 0, 0, 0, 0, t.Location())
+		for _, r := range s.rules {
+			if !r.days[day.Weekday()] {
+				continue
+			}
+			if r.on >= 0 {
+				out = append(out, Transition{At: atMinute(day, r.on), Enabled: true})
+			}
+			if r.off >= 0 {
+				off := day
+				if r.on >= 0 && r.off < r.on {
+					off = day.AddDate(0, 0, 1) // window crossing midnight
+				}
+				out = append(out, Transition{At: atMinute(off, r.off), Enabled: false})
+			}
+		}
+	}
+	return out
+}
+
+func atMinute(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minute/60, minute%60, 0, 0, day.Location())
+}
+
+// Next returns the first transition after t, if the schedule has any.
+func (s Schedule) Next(t time.Time) (Transition, bool) {
+	var next Transition
+	found := false
+	for _, tr := range s.transitions(t, -1, 7) {
+		if tr.At.After(t) && (!found || tr.At.Before(next.At)) {
+			next, found = tr, true
+		}
+	}
+	return next, found
+}
+
+// Last returns the latest transition at or before t, if the schedule has
+// any. When an enable and a disable fall on the same minute, the disable
+// wins.
+func (s Schedule) Last(t time.Time) (Transition, bool) {
+	var last Transition
+	found := false
+	for _, tr := range s.transitions(t, -8, 0) {
+		if tr.At.After(t) || (found && tr.At.Before(last.At)) {
+			continue
+		}
+		if found && tr.At.Equal(last.At) && tr.Enabled {
+			continue
+		}
+		last, found = tr, true
+	}
+	return last, found
+}
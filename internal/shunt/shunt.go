@@ -1,6 +1,7 @@
 package shunt
 
 import (
+	"fmt"
 	"net"
 	"strings"
 )
@@ -25,27 +26,44 @@ const (
 	PrefixRegexp       = "regexp:"
 )
 
-// Entry is a single host entry (domain, IP, or CIDR).
+// Entry is a single host entry (domain, IP, or CIDR), optionally restricted
+// to some destination ports by a qualifier: tcp:443@1.2.3.0/24,
+// 80,443@domain:example.com or udp@full:stun.example.com.
 type Entry struct {
 	Value string `yaml:"value"`
 }
 
+// Host returns the entry without its port qualifier.
+func (e Entry) Host() string {
+	_, host := splitQualifier(e.Value)
+	return host
+}
+
+// Ports returns the port qualifier of the entry, e.g. "tcp:443", or "" if
+// the entry applies to every port. Normalized entries carry the canonical
+// form built by ParsePorts.
+func (e Entry) Ports() string {
+	q, _ := splitQualifier(e.Value)
+	return q
+}
+
 // Type returns the detected type of this entry.
 func (e Entry) Type() EntryType {
+	host := e.Host()
 	switch {
-	case strings.HasPrefix(e.Value, PrefixDomainFull):
+	case strings.HasPrefix(host, PrefixDomainFull):
 		return EntryDomainFull
-	case strings.HasPrefix(e.Value, PrefixDomainSuffix):
+	case strings.HasPrefix(host, PrefixDomainSuffix):
 		return EntryDomainSuffix
-	case strings.HasPrefix(e.Value, PrefixKeyword):
+	case strings.HasPrefix(host, PrefixKeyword):
 		return EntryDomainKeyword
-	case strings.HasPrefix(e.Value, PrefixRegexp):
+	case strings.HasPrefix(host, PrefixRegexp):
 		return EntryDomainRegexp
 	}
-	if _, _, err := net.ParseCIDR(e.Value); err == nil {
+	if _, _, err := net.ParseCIDR(host); err == nil {
 		return EntryCIDR
 	}
-	if ip := net.ParseIP(e.Value); ip != nil {
+	if ip := net.ParseIP(host); ip != nil {
 		return EntryIP
 	}
 	return EntryDomainSuffix
@@ -57,14 +75,31 @@ func (e Entry) IsDomain() bool {
 	return t == EntryDomainSuffix || t == EntryDomainFull || t == EntryDomainKeyword || t == EntryDomainRegexp
 }
 
-// DomainValue returns the raw domain/pattern string with the prefix stripped.
+// DomainValue returns the raw domain/pattern string with the port qualifier
+// and prefix stripped.
 func (e Entry) DomainValue() string {
+	host := e.Host()
 	for _, prefix := range []string{PrefixDomainFull, PrefixDomainSuffix, PrefixKeyword, PrefixRegexp} {
-		if strings.HasPrefix(e.Value, prefix) {
-			return e.Value[len(prefix):]
+		if strings.HasPrefix(host, prefix) {
+			return host[len(prefix):]
 		}
 	}
-	return e.Value
+	return host
+}
+
+// ValidateEntry checks the port qualifier of an entry value, if any.
+func ValidateEntry(value string) error {
+	q, host := splitQualifier(strings.TrimSpace(value))
+	if q == "" {
+		return nil
+	}
+	if _, err := ParsePorts(q); err != nil {
+		return fmt.Errorf("entry %q: %w", value, err)
+	}
+	if strings.TrimSpace(host) == "" {
+		return fmt.Errorf("entry %q: missing host after %s", value, QualifierSeparator)
+	}
+	return nil
 }
 
 // Shunt is a named collection of host entries.
@@ -73,7 +108,46 @@ type Shunt struct {
 	Description string  `yaml:"description,omitempty"`
 	Enabled     bool    `yaml:"enabled"`
 	Source      string  `yaml:"source,omitempty"` // e.g. "geosite:netflix"
+	Action      string  `yaml:"action,omitempty"` // proxy (default), direct or block
+	Port        int     `yaml:"port,omitempty"`   // proxy target port; 0 uses routing.local_port
 	Entries     []Entry `yaml:"entries"`
+
+	// Clients limits the shunt to these LAN clients (IP, CIDR or MAC), or
+	// excludes them when ExcludeClients is set. Empty applies the global
+	// client selection.
+	Clients        []string `yaml:"clients,omitempty"`
+	ExcludeClients bool     `yaml:"exclude_clients,omitempty"`
+
+	// Schedule enables and disables the shunt at fixed times (see
+	// Schedule), e.g. "mon-fri 09:00-18:00". Empty leaves Enabled alone.
+	Schedule string `yaml:"schedule,omitempty"`
+
+	// Upstream is the DNS resolver the shunt's domains are resolved with
+	// (ip:port, https:// or tls://, see NormalizeUpstream), e.g. one
+	// reachable through the tunnel. Empty uses dns.matched_upstream. Only
+	// for proxied shunts.
+	Upstream string `yaml:"upstream,omitempty"`
+}
+
+// Target returns the routing target of the shunt. Port and clients only
+// apply to proxied shunts; direct and block shunts affect every client.
+func (s *Shunt) Target() Target {
+	if s.Action != "" && s.Action != ActionProxy {
+		return Target{Action: s.Action}
+	}
+	return Target{Port: s.Port, Clients: ClientKey(s.Clients, s.ExcludeClients)}
+}
+
+// EntryTarget returns the routing target of one entry of the shunt: the
+// shunt's target, narrowed to the entry's ports if it has a qualifier.
+// Qualifiers only apply to proxied shunts; direct and block entries cover
+// every port.
+func (s *Shunt) EntryTarget(e Entry) Target {
+	t := s.Target()
+	if t.IsProxy() {
+		t.Ports = e.Ports()
+	}
+	return t
 }
 
 // HasEntry returns true if the shunt contains the given value.
@@ -109,8 +183,21 @@ func (s *Shunt) RemoveEntry(value string) bool {
 	return false
 }
 
+// normalizeEntry returns the canonical form of an entry value. A valid port
+// qualifier is kept in the form built by ParsePorts in front of the
+// normalized host.
 func normalizeEntry(s string) string {
 	s = strings.TrimSpace(s)
+	if q, host := splitQualifier(s); q != "" {
+		if ports, err := ParsePorts(q); err == nil {
+			return ports + QualifierSeparator + normalizeHost(host)
+		}
+	}
+	return normalizeHost(s)
+}
+
+func normalizeHost(s string) string {
+	s = strings.TrimSpace(s)
 
 	// If entry has a recognized prefix, normalize only the value portion.
 	for _, prefix := range []string{PrefixDomainFull, PrefixDomainSuffix, PrefixKeyword, PrefixRegexp} {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -115,6 +116,10 @@ func (s *Store) Delete(name string) error {
 
 // AddEntry adds an entry to a shunt. Deduplicates by value.
 func (s *Store) AddEntry(shuntName, value string) error {
+	if err := ValidateEntry(value); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -155,20 +160,78 @@ func (s *Store) RemoveEntry(shuntName, value string) error {
 
 // SetEnabled enables or disables a shunt.
 func (s *Store) SetEnabled(name string, enabled bool) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.update(name, func(sh *Shunt) error {
+		sh.Enabled = enabled
+		return nil
+	})
+}
 
-	shunts, err := s.load()
+// SetPort sets the proxy target port of a shunt. Port 0 routes the shunt
+// through the default routing.local_port.
+func (s *Store) SetPort(name string, port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	return s.update(name, func(sh *Shunt) error {
+		sh.Port = port
+		return nil
+	})
+}
+
+// SetAction sets what happens to traffic matching a shunt: ActionProxy,
+// ActionDirect or ActionBlock.
+func (s *Store) SetAction(name, action string) error {
+	if !ValidAction(action) {
+		return fmt.Errorf("invalid action %q: expected %s, %s or %s", action, ActionProxy, ActionDirect, ActionBlock)
+	}
+	if action == ActionProxy {
+		action = ""
+	}
+	return s.update(name, func(sh *Shunt) error {
+		sh.Action = action
+		return nil
+	})
+}
+
+// SetClients sets the per-shunt client selection. An empty list reverts the
+// shunt to the global client selection.
+func (s *Store) SetClients(name string, clients []string, exclude bool) error {
+	clients, err := NormalizeClients(clients)
 	if err != nil {
 		return err
 	}
-	for i := range shunts {
-		if shunts[i].Name == name {
-			shunts[i].Enabled = enabled
-			return s.save(shunts)
-		}
+	if len(clients) == 0 {
+		exclude = false
 	}
-	return fmt.Errorf("shunt %q not found", name)
+	return s.update(name, func(sh *Shunt) error {
+		sh.Clients, sh.ExcludeClients = clients, exclude
+		return nil
+	})
+}
+
+// SetSchedule sets the schedule of a shunt. An empty schedule removes it.
+func (s *Store) SetSchedule(name, schedule string) error {
+	schedule, err := NormalizeSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	return s.update(name, func(sh *Shunt) error {
+		sh.Schedule = schedule
+		return nil
+	})
+}
+
+// SetUpstream sets the DNS upstream of a shunt; an empty upstream removes
+// it.
+func (s *Store) SetUpstream(name, upstream string) error {
+	upstream, err := NormalizeUpstream(upstream)
+	if err != nil {
+		return err
+	}
+	return s.update(name, func(sh *Shunt) error {
+		sh.Upstream = upstream
+		return nil
+	})
 }
 
 // EnabledEntries returns all entries from all enabled shunts, deduplicated.
@@ -199,6 +262,107 @@ func (s *Store) EnabledEntries() ([]Entry, error) {
 	return entries, nil
 }
 
+// EnabledEntriesByTarget returns entries from all enabled shunts grouped by
+// routing target. Every target used by an enabled shunt has a key, even if it
+// has no entries; entries with a port qualifier form targets of their own
+// (see Shunt.EntryTarget). An entry present in several shunts is assigned to
+// the shunt with the strongest action (direct, then block, then proxy), and
+// among equal actions to the first shunt that lists it.
+func (s *Store) EnabledEntriesByTarget() (map[Target][]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shunts, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	type assignment struct {
+		entry  Entry
+		target Target
+	}
+	var order []string
+	assigned := make(map[string]assignment)
+	byTarget := make(map[Target][]Entry)
+	for _, sh := range shunts {
+		if !sh.Enabled {
+			continue
+		}
+		byTarget[sh.Target()] = nil
+		for _, e := range sh.Entries {
+			t := sh.EntryTarget(e)
+			key := normalizeEntry(e.Value)
+			prev, seen := assigned[key]
+			if !seen {
+				order = append(order, key)
+			} else if !t.Outranks(prev.target) {
+				continue
+			}
+			assigned[key] = assignment{entry: e, target: t}
+		}
+	}
+	for _, key := range order {
+		a := assigned[key]
+		byTarget[a.target] = append(byTarget[a.target], a.entry)
+	}
+	return byTarget, nil
+}
+
+// EnabledUpstreams returns the domain entries of enabled proxied shunts
+// that have their own DNS upstream, grouped by upstream.
+func (s *Store) EnabledUpstreams() (map[string][]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shunts, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	byUpstream := make(map[string][]Entry)
+	for _, sh := range shunts {
+		if !sh.Enabled || sh.Upstream == "" || !sh.Target().IsProxy() {
+			continue
+		}
+		for _, e := range sh.Entries {
+			if e.IsDomain() {
+				byUpstream[sh.Upstream] = append(byUpstream[sh.Upstream], e)
+			}
+		}
+	}
+	return byUpstream, nil
+}
+
+// Targets returns the sorted, distinct non-default targets used by enabled
+// shunts and their port-qualified entries.
+func (s *Store) Targets() ([]Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shunts, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []Target
+	add := func(t Target) {
+		if !t.IsDefault() && !slices.Contains(targets, t) {
+			targets = append(targets, t)
+		}
+	}
+	for _, sh := range shunts {
+		if !sh.Enabled {
+			continue
+		}
+		add(sh.Target())
+		for _, e := range sh.Entries {
+			add(sh.EntryTarget(e))
+		}
+	}
+	slices.SortFunc(targets, CompareTargets)
+	return targets, nil
+}
+
 // ExportShunt exports a single shunt as YAML bytes.
 func (s *Store) ExportShunt(name string) ([]byte, error) {
 	sh, err := s.Get(name)
@@ -323,6 +487,27 @@ func (s *Store) GeositeShunts() ([]Shunt, error) {
 	return result, nil
 }
 
+// update applies fn to the shunt named name and saves the store. An error
+// from fn leaves the store unchanged.
+func (s *Store) update(name string, fn func(*Shunt) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	shunts, err := s.load()
+	if err != nil {
+		return err
+	}
+	for i := range shunts {
+		if shunts[i].Name == name {
+			if err := fn(&shunts[i]); err != nil {
+				return err
+			}
+			return s.save(shunts)
+		}
+	}
+	return fmt.Errorf("shunt %q not found", name)
+}
+
 func (s *Store) load() ([]Shunt, error) {
 	data, err := os.ReadFile(s.path)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/egorlepa/netshunt/internal/shunt"
 )
@@ -90,6 +91,183 @@ func TestEnabledEntries(t *testing.T) {
 	}
 }
 
+func TestEnabledEntriesByTarget(t *testing.T) {
+	s := tempStore(t)
+
+	_ = s.Create(shunt.Shunt{Name: "A", Enabled: true, Entries: []shunt.Entry{{Value: "a.com"}, {Value: "shared.com"}}})
+	_ = s.Create(shunt.Shunt{Name: "B", Enabled: true, Port: 1081, Entries: []shunt.Entry{{Value: "b.com"}, {Value: "shared.com"}}})
+	_ = s.Create(shunt.Shunt{Name: "C", Enabled: false, Port: 1082, Entries: []shunt.Entry{{Value: "c.com"}}})
+
+	byTarget, err := s.EnabledEntriesByTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shared.com stays with A (first shunt listing it); C is disabled.
+	b := shunt.Target{Port: 1081}
+	if len(byTarget) != 2 || len(byTarget[shunt.Target{}]) != 2 || len(byTarget[b]) != 1 {
+		t.Fatalf("unexpected grouping: %+v", byTarget)
+	}
+	if byTarget[b][0].Value != "b.com" {
+		t.Fatalf("expected b.com on port 1081, got %+v", byTarget[b])
+	}
+
+	targets, err := s.Targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || targets[0] != b {
+		t.Fatalf("Targets() = %v, want [%v]", targets, b)
+	}
+}
+
+func TestEnabledEntriesByTargetPorts(t *testing.T) {
+	s := tempStore(t)
+
+	_ = s.Create(shunt.Shunt{Name: "CDN", Enabled: true, Port: 1081, Entries: []shunt.Entry{
+		{Value: "tcp:443@1.2.3.0/24"}, {Value: "cdn.com"}, {Value: "tcp:443@cdn.com"},
+	}})
+	_ = s.Create(shunt.Shunt{Name: "LAN", Enabled: true, Action: shunt.ActionDirect, Entries: []shunt.Entry{
+		{Value: "udp:53@10.0.0.0/8"},
+	}})
+
+	byTarget, err := s.EnabledEntriesByTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Qualified entries get their own target; the qualifier is dropped for
+	// direct shunts.
+	https := shunt.Target{Port: 1081, Ports: "tcp:443"}
+	direct := shunt.Target{Action: shunt.ActionDirect}
+	if len(byTarget) != 3 || len(byTarget[shunt.Target{Port: 1081}]) != 1 || len(byTarget[https]) != 2 || len(byTarget[direct]) != 1 {
+		t.Fatalf("unexpected grouping: %+v", byTarget)
+	}
+	if byTarget[https][0].Host() != "1.2.3.0/24" {
+		t.Fatalf("expected 1.2.3.0/24 on %v, got %+v", https, byTarget[https])
+	}
+
+	targets, err := s.Targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 || targets[1] != https {
+		t.Fatalf("Targets() = %v", targets)
+	}
+}
+
+func TestEnabledEntriesByTargetActions(t *testing.T) {
+	s := tempStore(t)
+
+	_ = s.Create(shunt.Shunt{Name: "Proxy", Enabled: true, Entries: []shunt.Entry{{Value: "a.com"}, {Value: "both.com"}, {Value: "all.com"}}})
+	_ = s.Create(shunt.Shunt{Name: "Block", Enabled: true, Action: shunt.ActionBlock, Port: 1081, Entries: []shunt.Entry{{Value: "ads.com"}, {Value: "all.com"}}})
+	_ = s.Create(shunt.Shunt{Name: "Direct", Enabled: true, Action: shunt.ActionDirect, Entries: []shunt.Entry{{Value: "both.com"}, {Value: "all.com"}}})
+
+	byTarget, err := s.EnabledEntriesByTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Direct wins over block and proxy, block over proxy; the port of a
+	// block shunt is ignored.
+	direct := shunt.Target{Action: shunt.ActionDirect}
+	block := shunt.Target{Action: shunt.ActionBlock}
+	if got := byTarget[shunt.Target{}]; len(got) != 1 || got[0].Value != "a.com" {
+		t.Fatalf("proxy entries = %+v", got)
+	}
+	if got := byTarget[block]; len(got) != 1 || got[0].Value != "ads.com" {
+		t.Fatalf("block entries = %+v", got)
+	}
+	if got := byTarget[direct]; len(got) != 2 {
+		t.Fatalf("direct entries = %+v", got)
+	}
+	if direct.Suffix() != "_direct" || block.Suffix() != "_block" {
+		t.Fatalf("suffixes = %q, %q", direct.Suffix(), block.Suffix())
+	}
+
+	targets, err := s.Targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 || targets[0] != block || targets[1] != direct {
+		t.Fatalf("Targets() = %v", targets)
+	}
+}
+
+func TestSetAction(t *testing.T) {
+	s := tempStore(t)
+	_ = s.Create(shunt.Shunt{Name: "Test", Enabled: true})
+
+	if err := s.SetAction("Test", shunt.ActionBlock); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ := s.Get("Test")
+	if sh.Action != shunt.ActionBlock {
+		t.Fatalf("action = %q, want block", sh.Action)
+	}
+
+	// Proxy is stored as the empty default.
+	_ = s.SetAction("Test", shunt.ActionProxy)
+	sh, _ = s.Get("Test")
+	if sh.Action != "" || !sh.Target().IsDefault() {
+		t.Fatalf("action = %q, target = %+v", sh.Action, sh.Target())
+	}
+
+	if err := s.SetAction("Test", "drop"); err == nil {
+		t.Fatal("expected error for invalid action")
+	}
+}
+
+func TestSetClients(t *testing.T) {
+	s := tempStore(t)
+	_ = s.Create(shunt.Shunt{Name: "TV", Enabled: true, Entries: []shunt.Entry{{Value: "tv.com"}}})
+
+	if err := s.SetClients("TV", []string{"192.168.1.20", "AA-BB-CC-DD-EE-FF", " ", "192.168.1.20"}, true); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ := s.Get("TV")
+	if len(sh.Clients) != 2 || sh.Clients[1] != "aa:bb:cc:dd:ee:ff" || !sh.ExcludeClients {
+		t.Fatalf("clients = %v exclude=%v", sh.Clients, sh.ExcludeClients)
+	}
+
+	target := sh.Target()
+	if target.IsDefault() || target.Suffix() == "" {
+		t.Fatalf("client-restricted shunt should have its own target, got %+v", target)
+	}
+	exclude, clients := target.ClientSelection()
+	if !exclude || len(clients) != 2 {
+		t.Fatalf("ClientSelection() = %v, %v", exclude, clients)
+	}
+
+	if err := s.SetClients("TV", []string{"not-a-client"}, false); err == nil {
+		t.Fatal("expected error for invalid client")
+	}
+
+	// Clearing the list reverts to the default target.
+	_ = s.SetClients("TV", nil, true)
+	sh, _ = s.Get("TV")
+	if !sh.Target().IsDefault() {
+		t.Fatalf("expected default target, got %+v", sh.Target())
+	}
+}
+
+func TestSetPort(t *testing.T) {
+	s := tempStore(t)
+	_ = s.Create(shunt.Shunt{Name: "Test", Enabled: true})
+
+	if err := s.SetPort("Test", 1081); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ := s.Get("Test")
+	if sh.Port != 1081 {
+		t.Fatalf("port = %d, want 1081", sh.Port)
+	}
+
+	if err := s.SetPort("Test", 70000); err == nil {
+		t.Fatal("expected error for invalid port")
+	}
+}
+
 func TestSetEnabled(t *testing.T) {
 	s := tempStore(t)
 	_ = s.Create(shunt.Shunt{Name: "Test", Enabled: true})
@@ -182,6 +360,13 @@ func TestEntryType(t *testing.T) {
 		{"10.0.0.0/8", shunt.EntryCIDR},
 		{"2001:db8::/32", shunt.EntryCIDR},
 		{"::1", shunt.EntryIP},
+
+		// Port-qualified entries.
+		{"tcp:443@1.2.3.0/24", shunt.EntryCIDR},
+		{"80,443@1.2.3.4", shunt.EntryIP},
+		{"udp@full:stun.example.com", shunt.EntryDomainFull},
+		{"tcp:443@example.com", shunt.EntryDomainSuffix},
+		{"regexp:^a@b\\.com$", shunt.EntryDomainRegexp},
 	}
 
 	for _, tt := range tests {
@@ -225,6 +410,8 @@ func TestDomainValue(t *testing.T) {
 		{"keyword:tube", "tube"},
 		{"regexp:^.+\\.google\\.", "^.+\\.google\\."},
 		{"1.2.3.4", "1.2.3.4"},
+		{"tcp:443@domain:example.com", "example.com"},
+		{"443@fast.com", "fast.com"},
 	}
 
 	for _, tt := range tests {
@@ -267,6 +454,191 @@ func TestNormalizeEntry(t *testing.T) {
 	}
 }
 
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"443", "443", true},
+		{"TCP:443", "tcp:443", true},
+		{"udp", "udp", true},
+		{"tcp:8443,443,443,8000-8100", "tcp:443,8000-8100,8443", true},
+		{"icmp:1", "", false},
+		{"0", "", false},
+		{"65536", "", false},
+		{"200-100", "", false},
+		{"1-2,3-4,5-6,7-8,9-10,11-12,13-14,15,16", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := shunt.ParsePorts(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParsePorts(%q) = (%q, %v), want %q (ok %v)", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeSchedule(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"", "", true},
+		{"9:00-18:00", "09:00-18:00", true},
+		{"Mon-Fri 09:00-18:00", "mon-fri 09:00-18:00", true},
+		{"weekends 22:00-02:00; off 23:30", "sat,sun 22:00-02:00; off 23:30", true},
+		{"weekdays on 07:30", "mon-fri on 07:30", true},
+		{"fri-mon 10:00-11:00", "mon,fri-sun 10:00-11:00", true},
+		{"daily off 23:00", "off 23:00", true},
+		{"mon,wed 10:00-11:00", "mon,wed 10:00-11:00", true},
+		{"10:00-10:00", "", false},
+		{"25:00-26:00", "", false},
+		{"funday 10:00-11:00", "", false},
+		{"sometimes", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := shunt.NormalizeSchedule(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("NormalizeSchedule(%q) = (%q, %v), want %q (ok %v)", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestScheduleTransitions(t *testing.T) {
+	sched, err := shunt.ParseSchedule("mon-fri 09:00-18:00; sat 22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour, minute int) time.Time {
+		// 2024-01-01 is a Monday.
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		now         time.Time
+		next        time.Time
+		nextEnabled bool
+		last        time.Time
+		lastEnabled bool
+	}{
+		{at(1, 8, 0), at(1, 9, 0), true, at(1, 0, 0).Add(-22 * time.Hour), false},
+		{at(1, 9, 0), at(1, 18, 0), false, at(1, 9, 0), true},
+		{at(5, 20, 0), at(6, 22, 0), true, at(5, 18, 0), false},
+		{at(7, 1, 0), at(7, 2, 0), false, at(6, 22, 0), true},
+	}
+
+	for _, tt := range tests {
+		next, ok := sched.Next(tt.now)
+		if !ok || !next.At.Equal(tt.next) || next.Enabled != tt.nextEnabled {
+			t.Errorf("Next(%v) = %v %v, want %v %v", tt.now, next.At, next.Enabled, tt.next, tt.nextEnabled)
+		}
+		last, ok := sched.Last(tt.now)
+		if !ok || !last.At.Equal(tt.last) || last.Enabled != tt.lastEnabled {
+			t.Errorf("Last(%v) = %v %v, want %v %v", tt.now, last.At, last.Enabled, tt.last, tt.lastEnabled)
+		}
+	}
+
+	if _, ok := (shunt.Schedule{}).Next(at(1, 0, 0)); ok {
+		t.Error("empty schedule has a next transition")
+	}
+}
+
+func TestSetSchedule(t *testing.T) {
+	s := tempStore(t)
+	_ = s.Create(shunt.Shunt{Name: "Test", Enabled: true})
+
+	if err := s.SetSchedule("Test", "Weekdays 9:00-18:00"); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ := s.Get("Test")
+	if sh.Schedule != "mon-fri 09:00-18:00" {
+		t.Fatalf("schedule = %q, want mon-fri 09:00-18:00", sh.Schedule)
+	}
+
+	if err := s.SetSchedule("Test", "noon"); err == nil {
+		t.Fatal("expected error for invalid schedule")
+	}
+	if err := s.SetSchedule("Test", ""); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ = s.Get("Test")
+	if sh.Schedule != "" {
+		t.Fatalf("schedule = %q, want empty", sh.Schedule)
+	}
+}
+
+func TestSetUpstream(t *testing.T) {
+	s := tempStore(t)
+	_ = s.Create(shunt.Shunt{Name: "Tunnel", Enabled: true, Entries: []shunt.Entry{{Value: "example.com"}, {Value: "1.2.3.4"}}})
+	_ = s.Create(shunt.Shunt{Name: "Direct", Enabled: true, Action: shunt.ActionDirect, Upstream: "1.1.1.1:53", Entries: []shunt.Entry{{Value: "local.com"}}})
+
+	if err := s.SetUpstream("Tunnel", "10.8.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ := s.Get("Tunnel")
+	if sh.Upstream != "10.8.0.1:53" {
+		t.Fatalf("upstream = %q, want 10.8.0.1:53", sh.Upstream)
+	}
+	if err := s.SetUpstream("Tunnel", "dns.example.com"); err == nil {
+		t.Fatal("expected error for a host name")
+	}
+
+	byUpstream, err := s.EnabledUpstreams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byUpstream) != 1 || len(byUpstream["10.8.0.1:53"]) != 1 || byUpstream["10.8.0.1:53"][0].Value != "example.com" {
+		t.Errorf("EnabledUpstreams = %v, want only the proxied domain under 10.8.0.1:53", byUpstream)
+	}
+
+	for in, want := range map[string]string{
+		"[2001:db8::1]:5353":           "[2001:db8::1]:5353",
+		"2001:db8::1":                  "[2001:db8::1]:53",
+		"TLS://Dns.Quad9.net":          "tls://dns.quad9.net",
+		"https://dns.google/dns-query": "https://dns.google/dns-query",
+		"":                             "",
+	} {
+		if got, err := shunt.NormalizeUpstream(in); err != nil || got != want {
+			t.Errorf("NormalizeUpstream(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"ftp://dns.example.com", "tls://1.1.1.1/path", "https:///dns-query"} {
+		if _, err := shunt.NormalizeUpstream(in); err == nil {
+			t.Errorf("NormalizeUpstream(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestAddQualifiedEntry(t *testing.T) {
+	s := tempStore(t)
+	_ = s.Create(shunt.Shunt{Name: "Test", Enabled: true})
+
+	if err := s.AddEntry("Test", "TCP:443,80@Example.COM"); err != nil {
+		t.Fatal(err)
+	}
+	sh, _ := s.Get("Test")
+	e := sh.Entries[0]
+	if e.Value != "tcp:80,443@example.com" || e.Ports() != "tcp:80,443" || e.Host() != "example.com" {
+		t.Errorf("unexpected entry %q (ports %q, host %q)", e.Value, e.Ports(), e.Host())
+	}
+
+	// The same host without a qualifier is a different entry.
+	if err := s.AddEntry("Test", "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddEntry("Test", "tcp:80,443@example.com"); err == nil {
+		t.Error("expected error for duplicate qualified entry")
+	}
+	if err := s.AddEntry("Test", "tcp:99999@example.com"); err == nil {
+		t.Error("expected error for invalid port")
+	}
+	if err := s.AddEntry("Test", "tcp:443@"); err == nil {
+		t.Error("expected error for missing host")
+	}
+}
+
 func TestImportExportFile(t *testing.T) {
 	s := tempStore(t)
 	_ = s.Create(shunt.Shunt{Name: "A", Enabled: true, Entries: []shunt.Entry{{Value: "a.com"}}})
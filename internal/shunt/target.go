@@ -0,0 +1,178 @@
+package shunt
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Shunt actions: what happens to traffic matching a shunt.
+const (
+	ActionProxy  = "proxy"  // route through the proxy (default)
+	ActionDirect = "direct" // exception: bypass the proxy, wins over other shunts
+	ActionBlock  = "block"  // refuse: NXDOMAIN for domains, REJECT for IPs
+)
+
+// ValidAction reports whether a is a known shunt action. The empty string is
+// the default, ActionProxy.
+func ValidAction(a string) bool {
+	return a == "" || a == ActionProxy || a == ActionDirect || a == ActionBlock
+}
+
+// actionRank orders actions by precedence when several shunts match the same
+// destination: direct exceptions win, then block, then proxy.
+func actionRank(a string) int {
+	switch a {
+	case ActionDirect:
+		return 2
+	case ActionBlock:
+		return 1
+	}
+	return 0
+}
+
+// Target describes where traffic to a shunt's destinations goes. Shunts with
+// equal targets share ipsets and rules; the zero Target is the default one
+// (proxy through routing.local_port, global client selection).
+type Target struct {
+	// Action is ActionDirect or ActionBlock; empty proxies the traffic.
+	// Direct and block targets carry no port or client selection.
+	Action string
+	// Port is the proxy port; 0 uses routing.local_port.
+	Port int
+	// Clients is the canonical per-shunt client selection as built by
+	// ClientKey, e.g. "include:192.168.1.5,aa:bb:cc:dd:ee:ff". Empty means
+	// the global client selection applies.
+	Clients string
+	// Ports is the canonical port qualifier of the entries routed to this
+	// target as built by ParsePorts, e.g. "tcp:443". Empty matches every
+	// port.
+	Ports string
+}
+
+// IsDefault reports whether t is the default target.
+func (t Target) IsDefault() bool { return t == Target{} }
+
+// IsProxy reports whether traffic to t is proxied.
+func (t Target) IsProxy() bool { return t.Action == "" || t.Action == ActionProxy }
+
+// Outranks reports whether t takes precedence over o when both match the
+// same destination.
+func (t Target) Outranks(o Target) bool { return actionRank(t.Action) > actionRank(o.Action) }
+
+// Suffix returns the suffix of the target's ipset and chain names: "" for
+// the default target, "_direct" or "_block" for those actions, otherwise
+// "_<port>" followed by a hash of the client selection ("_c<hash>"), the
+// port qualifier ("_p<hash>") or both ("_cp<hash>"). The hash is kept to 5
+// hex digits so the longest chain name, NSHUNT6_TPROXY_65535_cp<hash>, fits
+// the 28 characters iptables allows.
+func (t Target) Suffix() string {
+	if !t.IsProxy() {
+		return "_" + t.Action
+	}
+	var b strings.Builder
+	if t.Port != 0 {
+		b.WriteString("_" + strconv.Itoa(t.Port))
+	}
+	switch {
+	case t.Clients != "" && t.Ports != "":
+		fmt.Fprintf(&b, "_cp%05x", shortHash(t.Clients+QualifierSeparator+t.Ports))
+	case t.Clients != "":
+		fmt.Fprintf(&b, "_c%05x", shortHash(t.Clients))
+	case t.Ports != "":
+		fmt.Fprintf(&b, "_p%05x", shortHash(t.Ports))
+	}
+	return b.String()
+}
+
+func shortHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32() & 0xfffff
+}
+
+// ClientSelection returns the per-shunt client selection of t. exclude is
+// true when the listed clients are excluded rather than the only ones routed.
+func (t Target) ClientSelection() (exclude bool, clients []string) {
+	mode, list, ok := strings.Cut(t.Clients, ":")
+	if !ok || list == "" {
+		return false, nil
+	}
+	return mode == "exclude", strings.Split(list, ",")
+}
+
+// PortSelection returns the port qualifier of t: the protocol ("tcp", "udp"
+// or "" for both) and the destination ports, ranges given as "lo-hi". No
+// ports means every port of the protocol; an empty qualifier matches all
+// traffic.
+func (t Target) PortSelection() (proto string, ports []string) {
+	return portSelection(t.Ports)
+}
+
+// CompareTargets orders targets by action (proxy first), port, client
+// selection, then port qualifier.
+func CompareTargets(a, b Target) int {
+	if c := cmp.Compare(actionRank(a.Action), actionRank(b.Action)); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Port, b.Port); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(a.Clients, b.Clients); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Ports, b.Ports)
+}
+
+// ClientKey builds the canonical Target.Clients value for a client list.
+// Returns "" for an empty list.
+func ClientKey(clients []string, exclude bool) string {
+	if len(clients) == 0 {
+		return ""
+	}
+	sorted := slices.Clone(clients)
+	slices.Sort(sorted)
+	mode := "include"
+	if exclude {
+		mode = "exclude"
+	}
+	return mode + ":" + strings.Join(slices.Compact(sorted), ",")
+}
+
+// NormalizeClient validates a client given as IP, CIDR or MAC address and
+// returns its canonical form.
+func NormalizeClient(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String(), nil
+	}
+	if _, cidr, err := net.ParseCIDR(s); err == nil {
+		return cidr.String(), nil
+	}
+	if mac, err := net.ParseMAC(s); err == nil && len(mac) == 6 {
+		return mac.String(), nil
+	}
+	return "", fmt.Errorf("invalid client %q: expected IP, CIDR or MAC address", s)
+}
+
+// NormalizeClients normalizes a client list, dropping blanks and duplicates.
+func NormalizeClients(list []string) ([]string, error) {
+	var out []string
+	for _, c := range list {
+		if strings.TrimSpace(c) == "" {
+			continue
+		}
+		n, err := NormalizeClient(c)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(out, n) {
+			out = append(out, n)
+		}
+	}
+	return out, nil
+}
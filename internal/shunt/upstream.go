@@ -0,0 +1,51 @@
+package shunt
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// NormalizeUpstream validates a DNS upstream address and returns its
+// canonical form. An upstream is one of:
+//
+//	https://dns.google/dns-query  DNS-over-HTTPS
+//	tls://dns.quad9.net[:853]     DNS-over-TLS, by host name or IP
+//	10.8.0.1[:53]                 plain DNS, by IP
+//
+// Plain upstreams are returned as ip:port, port 53 if none was given. The
+// empty string is no upstream.
+func NormalizeUpstream(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if scheme, _, ok := strings.Cut(s, "://"); ok {
+		u, err := url.Parse(s)
+		if err != nil || u.Hostname() == "" {
+			return "", fmt.Errorf("invalid DNS upstream %q: missing host", s)
+		}
+		switch strings.ToLower(scheme) {
+		case "https":
+		case "tls":
+			if u.Path != "" && u.Path != "/" {
+				return "", fmt.Errorf("invalid DNS upstream %q: tls:// takes no path", s)
+			}
+			u.Path = ""
+		default:
+			return "", fmt.Errorf("invalid DNS upstream %q: expected https:// or tls://", s)
+		}
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		return u.String(), nil
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return netip.AddrPortFrom(addr, 53).String(), nil
+	}
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil || ap.Port() == 0 {
+		return "", fmt.Errorf("invalid DNS upstream %q: expected an IP address with an optional port, https:// or tls://", s)
+	}
+	return ap.String(), nil
+}
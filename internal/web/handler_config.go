@@ -3,10 +3,16 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/dns"
+	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/service"
+	"github.com/egorlepa/netshunt/internal/shunt"
 	"github.com/egorlepa/netshunt/internal/web/templates"
 )
 
@@ -16,7 +22,7 @@ func (s *Server) handleSettingsPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	templates.SettingsPage(cfg).Render(r.Context(), w)
+	templates.SettingsPage(cfg, s.lanHosts(r.Context())).Render(r.Context(), w)
 }
 
 func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
@@ -30,9 +36,43 @@ func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Routing.
+	if v := r.FormValue("routing_mode"); v != "" {
+		cfg.Routing.Mode = v
+	}
 	if v := r.FormValue("routing_local_port"); v != "" {
 		fmt.Sscanf(v, "%d", &cfg.Routing.LocalPort)
 	}
+	cfg.Routing.Interface = strings.TrimSpace(r.FormValue("routing_interface"))
+	cfg.Routing.Inverse = r.FormValue("routing_inverse") == "on"
+	if cfg.Routing.Mode == routing.ModeInterface && cfg.Routing.Interface == "" {
+		errorResponse(w, "Outbound interface is required in interface mode", http.StatusBadRequest)
+		return
+	}
+	var failoverPorts []int
+	for _, v := range strings.Fields(strings.ReplaceAll(r.FormValue("routing_failover_ports"), ",", " ")) {
+		port, err := parsePort(v)
+		if err != nil || port == 0 {
+			errorResponse(w, fmt.Sprintf("invalid failover port %q", v), http.StatusBadRequest)
+			return
+		}
+		failoverPorts = append(failoverPorts, port)
+	}
+	cfg.Routing.Failover.Ports = failoverPorts
+	if v := r.FormValue("routing_failover_hold_down"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.Routing.Failover.HoldDown)
+	}
+	if v := r.FormValue("routing_proxy_down"); routing.ValidPolicy(v) {
+		cfg.Routing.ProxyDown.Policy = v
+	}
+	cfg.Routing.Local.Enabled = r.FormValue("routing_local") == "on"
+	cfg.Routing.Local.ProxyUser = strings.TrimSpace(r.FormValue("routing_proxy_user"))
+	cfg.Routing.Local.ProxyGroup = strings.TrimSpace(r.FormValue("routing_proxy_group"))
+	cfg.Routing.Local.ProxyMark = strings.TrimSpace(r.FormValue("routing_proxy_mark"))
+	if cfg.Routing.Local.Enabled && cfg.Routing.Local.ProxyUser == "" &&
+		cfg.Routing.Local.ProxyGroup == "" && cfg.Routing.Local.ProxyMark == "" {
+		errorResponse(w, "Router traffic needs the proxy user, group or mark to avoid routing loops", http.StatusBadRequest)
+		return
+	}
 
 	// DNS.
 	if v := r.FormValue("dnscrypt_port"); v != "" {
@@ -41,6 +81,61 @@ func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
 	if v := r.FormValue("dns_listen_addr"); v != "" {
 		cfg.DNS.ListenAddr = v
 	}
+	cfg.DNS.BlockResponse = ""
+	if r.FormValue("dns_block_response") == dns.BlockZero {
+		cfg.DNS.BlockResponse = dns.BlockZero
+	}
+	cfg.DNS.FakeIP.Enabled = r.FormValue("dns_fake_ip") == "on"
+	cfg.DNS.FakeIP.Range = strings.TrimSpace(r.FormValue("dns_fake_ip_range"))
+	if _, err := cfg.DNS.FakeIP.Pool(); err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	matchedUpstream, err := shunt.NormalizeUpstream(r.FormValue("dns_matched_upstream"))
+	if err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.DNS.MatchedUpstream = matchedUpstream
+	cfg.DNS.Upstreams = nil
+	for _, v := range strings.Fields(strings.ReplaceAll(r.FormValue("dns_upstreams"), ",", " ")) {
+		u, err := shunt.NormalizeUpstream(v)
+		if err != nil {
+			errorResponse(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cfg.DNS.Upstreams = append(cfg.DNS.Upstreams, u)
+	}
+	cfg.DNS.Bootstrap = nil
+	for _, v := range strings.Fields(strings.ReplaceAll(r.FormValue("dns_bootstrap"), ",", " ")) {
+		u, err := shunt.NormalizeUpstream(v)
+		if err != nil || strings.Contains(u, "://") {
+			errorResponse(w, fmt.Sprintf("invalid bootstrap server %q: expected an IP address with an optional port", v), http.StatusBadRequest)
+			return
+		}
+		cfg.DNS.Bootstrap = append(cfg.DNS.Bootstrap, u)
+	}
+	if v := r.FormValue("dns_cache_size"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.DNS.Cache.Size)
+		if cfg.DNS.Cache.Size <= 0 {
+			cfg.DNS.Cache.Size = -1
+		}
+	}
+	cfg.DNS.Cache.ServeStale = r.FormValue("dns_cache_serve_stale") == "on"
+	cfg.DNS.TrackExpiry.Enabled = r.FormValue("dns_track_expiry") == "on"
+	if v := r.FormValue("dns_track_expiry_grace"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.DNS.TrackExpiry.Grace)
+		if cfg.DNS.TrackExpiry.Grace <= 0 {
+			cfg.DNS.TrackExpiry.Grace = -1
+		}
+	}
+	if v := r.FormValue("dns_query_log_size"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.DNS.QueryLog.Size)
+		if cfg.DNS.QueryLog.Size <= 0 {
+			cfg.DNS.QueryLog.Size = -1
+		}
+	}
 
 	// IPSet.
 	if v := r.FormValue("ipset_table"); v != "" {
@@ -48,7 +143,22 @@ func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Network.
-	cfg.Network.EntwareInterface = r.FormValue("net_interface")
+	lan, err := parseLANInterfaces(r.FormValue("net_interfaces"))
+	if err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.Network.Interfaces = lan
+	cfg.Network.EntwareInterface = ""
+
+	// Clients.
+	clients, err := shunt.NormalizeClients(splitClients(r.FormValue("clients")))
+	if err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg.Clients.List = clients
+	cfg.Clients.Exclude = r.FormValue("clients_exclude") == "on" && len(clients) > 0
 
 	// Excluded networks.
 	if v := r.FormValue("excluded_networks"); v != "" {
@@ -74,17 +184,32 @@ func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request) {
 	if v := r.FormValue("log_level"); v != "" {
 		cfg.Daemon.LogLevel = v
 	}
+	if v := r.FormValue("drift_interval"); v != "" {
+		fmt.Sscanf(v, "%d", &cfg.Daemon.DriftInterval)
+		if cfg.Daemon.DriftInterval <= 0 {
+			cfg.Daemon.DriftInterval = -1
+		}
+	}
+
+	// The daemon's sets live on the backend it started with, so the rules
+	// can't move to another one until a restart.
+	from := netfilter.ResolveBackend(s.Config.Load().Netfilter.Backend)
+	if to := netfilter.ResolveBackend(cfg.Netfilter.Backend); to != from {
+		errorResponse(w, fmt.Sprintf("Netfilter backend changed from %s to %s in the config file: restart the daemon to apply it", from, to), http.StatusConflict)
+		return
+	}
 
 	if err := config.Save(cfg); err != nil {
 		errorResponse(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Update the server's config reference.
-	*s.Config = *cfg
+	// Hand the new config to the daemon; the reconcile below applies it.
+	s.Config.Store(cfg)
 
-	// Apply changes: restart dnscrypt-proxy and reconcile routing rules.
-	if service.DNSCrypt.IsInstalled() {
+	// Apply changes: restart dnscrypt-proxy if it is the upstream and
+	// reconcile routing rules.
+	if cfg.DNS.UsesDNSCrypt() && service.DNSCrypt.IsInstalled() {
 		if err := service.DNSCrypt.Restart(ctx); err != nil {
 			s.Logger.Warn("failed to restart dnscrypt-proxy", "error", err)
 		}
@@ -110,6 +235,38 @@ func (s *Server) handleActionReconcile(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleActionRules sets the routing rules up again, for the NDM hooks.
+func (s *Server) handleActionRules(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reconciler.ApplyRules(r.Context()); err != nil {
+		s.Logger.Error("apply rules failed", "error", err)
+		errorResponse(w, "Apply rules failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleActionSetup sets the routing rules up when a LAN interface comes
+// up, for the NDM hooks.
+func (s *Server) handleActionSetup(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reconciler.SetupRules(r.Context()); err != nil {
+		s.Logger.Error("setup rules failed", "error", err)
+		errorResponse(w, "Setup rules failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleActionTeardown tears the routing rules down while the LAN
+// interfaces are down, for the NDM hooks.
+func (s *Server) handleActionTeardown(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reconciler.TeardownRules(r.Context()); err != nil {
+		s.Logger.Error("teardown rules failed", "error", err)
+		errorResponse(w, "Teardown rules failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (s *Server) handleActionRestart(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -122,3 +279,62 @@ func (s *Server) handleActionRestart(w http.ResponseWriter, r *http.Request) {
 	toastTrigger(w, "Services restarted", "success")
 	w.WriteHeader(http.StatusOK)
 }
+
+// handleActionPause pauses routing for the form's duration (e.g. "10m",
+// default 10 minutes).
+func (s *Server) handleActionPause(w http.ResponseWriter, r *http.Request) {
+	d := 10 * time.Minute
+	if v := r.FormValue("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+			errorResponse(w, fmt.Sprintf("invalid duration %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.Reconciler.Pause(r.Context(), d); err != nil {
+		s.Logger.Error("pause failed", "error", err)
+		errorResponse(w, "Pause failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	toastTrigger(w, "Routing paused for "+d.String(), "success")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleActionResume(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reconciler.Resume(r.Context()); err != nil {
+		s.Logger.Error("resume failed", "error", err)
+		errorResponse(w, "Resume failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	toastTrigger(w, "Routing resumed", "success")
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseLANInterfaces parses the LAN interface list of the settings form: one
+// interface per line, its name followed by "route" and/or "dns". A bare name
+// enables both.
+func parseLANInterfaces(v string) ([]config.LANInterface, error) {
+	var ifaces []config.LANInterface
+	for _, line := range strings.Split(v, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		iface := config.LANInterface{Name: fields[0], Route: len(fields) == 1, DNS: len(fields) == 1}
+		for _, f := range fields[1:] {
+			switch strings.ToLower(f) {
+			case "route":
+				iface.Route = true
+			case "dns":
+				iface.DNS = true
+			default:
+				return nil, fmt.Errorf("interface %s: unknown switch %q, expected route or dns", iface.Name, f)
+			}
+		}
+		if slices.ContainsFunc(ifaces, func(i config.LANInterface) bool { return i.Name == iface.Name }) {
+			return nil, fmt.Errorf("interface %s listed twice", iface.Name)
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
@@ -4,8 +4,8 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/egorlepa/netshunt/internal/shunt"
 	"github.com/egorlepa/netshunt/internal/healthcheck"
+	"github.com/egorlepa/netshunt/internal/shunt"
 	"github.com/egorlepa/netshunt/internal/web/templates"
 )
 
@@ -18,7 +18,7 @@ func (s *Server) handleDiagnosticsLogs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleDiagnosticsRun(w http.ResponseWriter, r *http.Request) {
-	results := healthcheck.RunChecks(r.Context(), s.Config, s.Shunts)
+	results := healthcheck.RunChecks(r.Context(), s.Config.Load(), s.Shunts)
 	templates.DiagnosticsResults(results).Render(r.Context(), w)
 }
 
@@ -37,7 +37,7 @@ func (s *Server) handleDiagnosticsProbe(w http.ResponseWriter, r *http.Request)
 		_ = s.Reconciler.ApplyMutation(r.Context())
 	}
 
-	probe, err := healthcheck.ProbeDomain(r.Context(), s.Config, domain)
+	probe, err := healthcheck.ProbeDomain(r.Context(), s.Config.Load(), s.Shunts, domain)
 	if err != nil {
 		templates.DiagnosticsProbeError(domain, err.Error()).Render(r.Context(), w)
 		return
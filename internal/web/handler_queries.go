@@ -0,0 +1,55 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/egorlepa/netshunt/internal/dns"
+	"github.com/egorlepa/netshunt/internal/web/templates"
+)
+
+// queryPageLimit is how many queries the live view shows.
+const queryPageLimit = 200
+
+func (s *Server) handleQueriesPage(w http.ResponseWriter, r *http.Request) {
+	templates.QueriesPage(s.Queries.Clients(), s.Queries.Enabled()).Render(r.Context(), w)
+}
+
+// handleQueryEntries renders the latest queries matching the filter form.
+func (s *Server) handleQueryEntries(w http.ResponseWriter, r *http.Request) {
+	filter := queryFilter(r)
+	filter.Limit = queryPageLimit
+	templates.QueryLines(s.Queries.Entries(filter)).Render(r.Context(), w)
+}
+
+// handleQueryLog returns the query log as JSON, newest first. It takes the
+// filters client, domain, matched and limit as query parameters.
+func (s *Server) handleQueryLog(w http.ResponseWriter, r *http.Request) {
+	filter := queryFilter(r)
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errorResponse(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = n
+	}
+	entries := s.Queries.Entries(filter)
+	if entries == nil {
+		entries = []dns.QueryLogEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// queryFilter reads the query log filters of a request.
+func queryFilter(r *http.Request) dns.QueryLogFilter {
+	matched := r.FormValue("matched")
+	return dns.QueryLogFilter{
+		Client:  strings.TrimSpace(r.FormValue("client")),
+		Domain:  strings.ToLower(strings.TrimSpace(r.FormValue("domain"))),
+		Matched: matched == "on" || matched == "true" || matched == "1",
+	}
+}
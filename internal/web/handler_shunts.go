@@ -1,10 +1,14 @@
 package web
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/egorlepa/netshunt/internal/router"
 	"github.com/egorlepa/netshunt/internal/shunt"
 	"github.com/egorlepa/netshunt/internal/web/templates"
 )
@@ -15,7 +19,7 @@ func (s *Server) handleShuntsPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	templates.ShuntsPage(shunts).Render(r.Context(), w)
+	templates.ShuntsPage(shunts, s.lanHosts(r.Context())).Render(r.Context(), w)
 }
 
 func (s *Server) handleShuntDetail(w http.ResponseWriter, r *http.Request) {
@@ -38,10 +42,26 @@ func (s *Server) handleCreateShunt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	port, err := parsePort(r.FormValue("port"))
+	if err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.FormValue("action")
+	if !shunt.ValidAction(action) {
+		errorResponse(w, fmt.Sprintf("invalid action %q", action), http.StatusBadRequest)
+		return
+	}
+	if action == shunt.ActionProxy {
+		action = ""
+	}
+
 	sh := shunt.Shunt{
 		Name:        name,
 		Description: desc,
 		Enabled:     true,
+		Action:      action,
+		Port:        port,
 	}
 	if err := s.Shunts.Create(sh); err != nil {
 		errorResponse(w, err.Error(), http.StatusConflict)
@@ -83,6 +103,85 @@ func (s *Server) handleDisableShunt(w http.ResponseWriter, r *http.Request) {
 	s.renderShuntToggle(w, r, name)
 }
 
+func (s *Server) handleSetShuntPort(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	r.ParseForm()
+	port, err := parsePort(r.FormValue("port"))
+	if err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.Shunts.SetPort(name, port); err != nil {
+		errorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s.triggerMutation(r.Context())
+	if port == 0 {
+		toastTrigger(w, "Shunt uses the default port", "success")
+	} else {
+		toastTrigger(w, fmt.Sprintf("Shunt routed to port %d", port), "success")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleSetShuntClients(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	r.ParseForm()
+	clients := splitClients(r.FormValue("clients"))
+	exclude := r.FormValue("clients_mode") == "exclude"
+	if err := s.Shunts.SetClients(name, clients, exclude); err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.triggerMutation(r.Context())
+	if len(clients) == 0 {
+		toastTrigger(w, "Shunt uses the global client selection", "success")
+	} else {
+		toastTrigger(w, "Shunt clients updated", "success")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleSetShuntAction(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	r.ParseForm()
+	action := r.FormValue("action")
+	if err := s.Shunts.SetAction(name, action); err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.triggerMutation(r.Context())
+	toastTrigger(w, "Shunt action set to "+action, "success")
+	s.renderShuntCard(w, r, name)
+}
+
+// handleSetShuntSchedule sets the schedule of a shunt; an empty schedule
+// removes it. The daemon's scheduler acts on it from its next check.
+func (s *Server) handleSetShuntSchedule(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	r.ParseForm()
+	if err := s.Shunts.SetSchedule(name, r.FormValue("schedule")); err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	toastTrigger(w, "Shunt schedule saved", "success")
+	s.renderShuntCard(w, r, name)
+}
+
+// handleSetShuntUpstream sets the DNS upstream of a shunt's domains; an
+// empty upstream uses dns.matched_upstream.
+func (s *Server) handleSetShuntUpstream(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	r.ParseForm()
+	if err := s.Shunts.SetUpstream(name, r.FormValue("upstream")); err != nil {
+		errorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.triggerMutation(r.Context())
+	toastTrigger(w, "Shunt upstream saved", "success")
+	s.renderShuntCard(w, r, name)
+}
+
 func (s *Server) handleAddEntry(w http.ResponseWriter, r *http.Request) {
 	name := r.PathValue("name")
 	r.ParseForm()
@@ -172,6 +271,39 @@ func (s *Server) handleImportShunts(w http.ResponseWriter, r *http.Request) {
 	s.renderShuntList(w, r)
 }
 
+// parsePort parses an optional proxy port form value; empty means default (0).
+func parsePort(v string) (int, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(v)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", v)
+	}
+	return port, nil
+}
+
+// splitClients splits a client list separated by commas, spaces or newlines.
+func splitClients(v string) []string {
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+}
+
+// lanHosts returns the LAN clients known to the router for client pickers.
+// The list is best-effort: it is empty when the RCI API is unavailable.
+func (s *Server) lanHosts(ctx context.Context) []router.Host {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	hosts, err := router.NewClient().GetHosts(ctx)
+	if err != nil {
+		s.Logger.Debug("failed to load router hosts", "error", err)
+		return nil
+	}
+	return hosts
+}
+
 func (s *Server) renderShuntToggle(w http.ResponseWriter, r *http.Request, name string) {
 	sh, err := s.Shunts.Get(name)
 	if err != nil {
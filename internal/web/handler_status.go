@@ -2,19 +2,26 @@ package web
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"net/netip"
+	"time"
 
+	"github.com/egorlepa/netshunt/internal/dns"
 	"github.com/egorlepa/netshunt/internal/netfilter"
+	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/web/templates"
 )
 
 func (s *Server) dashboardData(ctx context.Context) templates.DashboardData {
-	ipset4 := netfilter.NewIPSet(s.Config.IPSet.TableName)
+	cfg := s.Config.Load()
+	backend := netfilter.ResolveBackend(cfg.Netfilter.Backend)
+	ipset4 := netfilter.NewSet(backend, cfg.IPSet.TableName)
 	ipset4Count, _ := ipset4.Count(ctx)
 
 	var ipset6Count int
-	if s.Config.IPv6 {
-		ipset6 := netfilter.NewIPSet6(s.Config.IPSet.TableName + "6")
+	if cfg.IPv6 {
+		ipset6 := netfilter.NewSet6(backend, cfg.IPSet.TableName+"6")
 		ipset6Count, _ = ipset6.Count(ctx)
 	}
 
@@ -30,7 +37,8 @@ func (s *Server) dashboardData(ctx context.Context) templates.DashboardData {
 	trackedDomains, trackedIPs := s.Tracker.Count()
 
 	return templates.DashboardData{
-		IPv6:              s.Config.IPv6,
+		IPv6:              cfg.IPv6,
+		RoutingMode:       routing.Label(cfg),
 		IPSet4Count:       ipset4Count,
 		IPSet6Count:       ipset6Count,
 		ShuntCount:        len(shunts),
@@ -38,6 +46,12 @@ func (s *Server) dashboardData(ctx context.Context) templates.DashboardData {
 		EntryCount:        entryCount,
 		TrackedDomains:    trackedDomains,
 		TrackedIPs:        trackedIPs,
+		Failover:          s.Failover.Status(),
+		Proxy:             s.Proxy.Status(),
+		Drift:             s.Drift.Status(),
+		DNSCache:          s.DNS.CacheStats(),
+		DNSUpstreams:      s.DNS.UpstreamStatus(),
+		PausedUntil:       s.Reconciler.PausedUntil(),
 		Version:           s.Version,
 	}
 }
@@ -53,3 +67,55 @@ func (s *Server) handleDashboardContent(w http.ResponseWriter, r *http.Request)
 	data := s.dashboardData(ctx)
 	templates.DashboardContent(data).Render(ctx, w)
 }
+
+// handleDriftStatus returns the result of the last rule drift check as JSON,
+// for the healthcheck.
+func (s *Server) handleDriftStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Drift.Status())
+}
+
+// handleUpstreamStatus returns the health of the DNS upstreams as JSON, for
+// the healthcheck.
+func (s *Server) handleUpstreamStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.DNS.UpstreamStatus())
+}
+
+// handlePauseStatus returns whether routing is paused and until when as JSON.
+func (s *Server) handlePauseStatus(w http.ResponseWriter, r *http.Request) {
+	until := s.Reconciler.PausedUntil()
+	status := struct {
+		Paused    bool      `json:"paused"`
+		Until     time.Time `json:"until,omitzero"`
+		Remaining int       `json:"remaining_seconds,omitempty"`
+	}{Paused: !until.IsZero(), Until: until}
+	if status.Paused {
+		status.Remaining = max(int(time.Until(until).Seconds()), 0)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleFakeIPList returns every fake IP and its domain as JSON.
+func (s *Server) handleFakeIPList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.FakeIP.Mappings())
+}
+
+// handleFakeIPLookup returns the domain of one fake IP as JSON, so the proxy
+// can connect to the domain a client meant.
+func (s *Server) handleFakeIPLookup(w http.ResponseWriter, r *http.Request) {
+	addr, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid IP address", http.StatusBadRequest)
+		return
+	}
+	domain, ok := s.FakeIP.Lookup(addr.Unmap())
+	if !ok {
+		http.Error(w, "not a fake IP", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dns.FakeIPMapping{IP: addr.Unmap().String(), Domain: domain})
+}
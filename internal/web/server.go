@@ -7,9 +7,13 @@ import (
 	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/netip"
+	"time"
 
 	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/dns"
 	"github.com/egorlepa/netshunt/internal/platform"
+	"github.com/egorlepa/netshunt/internal/routing"
 	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
@@ -22,6 +26,12 @@ var staticFS embed.FS
 type Reconciler interface {
 	Reconcile(ctx context.Context) error
 	ApplyMutation(ctx context.Context) error
+	ApplyRules(ctx context.Context) error
+	SetupRules(ctx context.Context) error
+	TeardownRules(ctx context.Context) error
+	Pause(ctx context.Context, d time.Duration) error
+	Resume(ctx context.Context) error
+	PausedUntil() time.Time
 }
 
 // TrackerStats is the interface the web server uses to read DNS tracker state.
@@ -29,22 +39,73 @@ type TrackerStats interface {
 	Count() (domains int, ips int)
 }
 
+// FailoverStatus is the interface the web server uses to read the proxy
+// failover state.
+type FailoverStatus interface {
+	Status() routing.FailoverStatus
+}
+
+// ProxyStatus is the interface the web server uses to read the proxy state
+// seen by the proxy watch.
+type ProxyStatus interface {
+	Status() routing.ProxyStatus
+}
+
+// DriftStatus is the interface the web server uses to read the result of
+// the last rule drift check.
+type DriftStatus interface {
+	Status() routing.DriftStatus
+}
+
+// FakeIPTable is the interface the web server uses to look up the domains
+// of fake IPs for the proxy.
+type FakeIPTable interface {
+	Lookup(addr netip.Addr) (string, bool)
+	Mappings() []dns.FakeIPMapping
+}
+
+// DNSStatus is the interface the web server uses to read the DNS response
+// cache counters and the health of the DNS upstreams.
+type DNSStatus interface {
+	CacheStats() dns.CacheStats
+	UpstreamStatus() []dns.UpstreamStatus
+}
+
+// QueryLogReader is the interface the web server uses to read the DNS
+// query log.
+type QueryLogReader interface {
+	Enabled() bool
+	Entries(filter dns.QueryLogFilter) []dns.QueryLogEntry
+	Clients() []string
+}
+
 // LogReader is the interface the web server uses to read recent log entries.
 type LogReader interface {
 	Entries() []platform.LogEntry
 }
 
-// Server is the web UI HTTP server.
-type Server struct {
-	Config     *config.Config
+// Deps are the daemon components the web server reads and drives.
+type Deps struct {
+	Config     *config.Live
 	Shunts     *shunt.Store
 	Reconciler Reconciler
 	Tracker    TrackerStats
+	Failover   FailoverStatus
+	Proxy      ProxyStatus
+	Drift      DriftStatus
+	FakeIP     FakeIPTable
+	DNS        DNSStatus
+	Queries    QueryLogReader
 	Logs       LogReader
 	Logger     *slog.Logger
 	Version    string
-	mux        *http.ServeMux
-	ready      bool
+}
+
+// Server is the web UI HTTP server.
+type Server struct {
+	Deps
+	mux   *http.ServeMux
+	ready bool
 }
 
 // MarkReady signals that the daemon has finished initial setup.
@@ -53,17 +114,8 @@ func (s *Server) MarkReady() {
 }
 
 // NewServer creates a web server with all routes registered.
-func NewServer(cfg *config.Config, shunts *shunt.Store, reconciler Reconciler, tracker TrackerStats, logs LogReader, logger *slog.Logger, version string) *Server {
-	s := &Server{
-		Config:     cfg,
-		Shunts:     shunts,
-		Reconciler: reconciler,
-		Tracker:    tracker,
-		Logs:       logs,
-		Logger:     logger,
-		Version:    version,
-		mux:        http.NewServeMux(),
-	}
+func NewServer(deps Deps) *Server {
+	s := &Server{Deps: deps, mux: http.NewServeMux()}
 	s.routes()
 	return s
 }
@@ -79,6 +131,8 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("GET /shunts", s.handleShuntsPage)
 	s.mux.HandleFunc("GET /shunts/{name}", s.handleShuntDetail)
 	s.mux.HandleFunc("GET /settings", s.handleSettingsPage)
+	s.mux.HandleFunc("GET /queries", s.handleQueriesPage)
+	s.mux.HandleFunc("GET /queries/entries", s.handleQueryEntries)
 	s.mux.HandleFunc("GET /diagnostics", s.handleDiagnosticsPage)
 	s.mux.HandleFunc("GET /diagnostics/run", s.handleDiagnosticsRun)
 	s.mux.HandleFunc("POST /diagnostics/probe", s.handleDiagnosticsProbe)
@@ -89,6 +143,11 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("DELETE /shunts/{name}", s.handleDeleteShunt)
 	s.mux.HandleFunc("PUT /shunts/{name}/enable", s.handleEnableShunt)
 	s.mux.HandleFunc("PUT /shunts/{name}/disable", s.handleDisableShunt)
+	s.mux.HandleFunc("PUT /shunts/{name}/port", s.handleSetShuntPort)
+	s.mux.HandleFunc("PUT /shunts/{name}/clients", s.handleSetShuntClients)
+	s.mux.HandleFunc("PUT /shunts/{name}/action", s.handleSetShuntAction)
+	s.mux.HandleFunc("PUT /shunts/{name}/schedule", s.handleSetShuntSchedule)
+	s.mux.HandleFunc("PUT /shunts/{name}/upstream", s.handleSetShuntUpstream)
 	s.mux.HandleFunc("POST /shunts/{name}/entries", s.handleAddEntry)
 	s.mux.HandleFunc("DELETE /shunts/{name}/entries/{value...}", s.handleDeleteEntry)
 	s.mux.HandleFunc("POST /shunts/{name}/entries/bulk", s.handleBulkAddEntries)
@@ -107,7 +166,22 @@ func (s *Server) routes() {
 
 	// Actions.
 	s.mux.HandleFunc("POST /actions/reconcile", s.handleActionReconcile)
+	s.mux.HandleFunc("POST /actions/rules", s.handleActionRules)
+	s.mux.HandleFunc("POST /actions/setup", s.handleActionSetup)
+	s.mux.HandleFunc("POST /actions/teardown", s.handleActionTeardown)
 	s.mux.HandleFunc("POST /actions/restart", s.handleActionRestart)
+	s.mux.HandleFunc("POST /actions/pause", s.handleActionPause)
+	s.mux.HandleFunc("POST /actions/resume", s.handleActionResume)
+
+	// Status API.
+	s.mux.HandleFunc("GET /api/drift", s.handleDriftStatus)
+	s.mux.HandleFunc("GET /api/pause", s.handlePauseStatus)
+	s.mux.HandleFunc("GET /api/upstreams", s.handleUpstreamStatus)
+	s.mux.HandleFunc("GET /api/querylog", s.handleQueryLog)
+
+	// Fake-IP lookup API for the proxy.
+	s.mux.HandleFunc("GET /api/fakeip", s.handleFakeIPList)
+	s.mux.HandleFunc("GET /api/fakeip/{ip}", s.handleFakeIPLookup)
 
 	// Readiness probe.
 	s.mux.HandleFunc("GET /ready", func(w http.ResponseWriter, r *http.Request) {
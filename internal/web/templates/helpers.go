@@ -5,7 +5,10 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/egorlepa/netshunt/internal/config"
+	"github.com/egorlepa/netshunt/internal/dns"
 	"github.com/egorlepa/netshunt/internal/shunt"
 )
 
@@ -18,10 +21,73 @@ func itoa(n int) string {
 	return strconv.Itoa(n)
 }
 
+func utoa(n uint64) string {
+	return strconv.FormatUint(n, 10)
+}
+
+// portValue renders a shunt's proxy port, leaving it empty for the default.
+func portValue(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(port)
+}
+
 func joinLines(ss []string) string {
 	return strings.Join(ss, "\n")
 }
 
+// lanLines renders LAN interfaces one per line as "name route dns", leaving
+// out switches that are off.
+func lanLines(ifaces []config.LANInterface) string {
+	lines := make([]string, len(ifaces))
+	for i, iface := range ifaces {
+		lines[i] = iface.Name
+		if iface.Route {
+			lines[i] += " route"
+		}
+		if iface.DNS {
+			lines[i] += " dns"
+		}
+	}
+	return joinLines(lines)
+}
+
+// nextTransition describes the next transition of a shunt's schedule, e.g.
+// "off Mon 18:00", or "" without a schedule.
+func nextTransition(s shunt.Shunt) string {
+	sched, err := shunt.ParseSchedule(s.Schedule)
+	if err != nil {
+		return "invalid schedule"
+	}
+	next, ok := sched.Next(time.Now())
+	if !ok {
+		return ""
+	}
+	state := "off"
+	if next.Enabled {
+		state = "on"
+	}
+	return state + " " + next.At.Format("Mon 15:04")
+}
+
+// remaining formats the time left until t to the second, e.g. "9m41s".
+func remaining(t time.Time) string {
+	return max(time.Until(t), 0).Round(time.Second).String()
+}
+
+func joinComma(ss []string) string {
+	return strings.Join(ss, ", ")
+}
+
+func joinInts(ns []int) string {
+	ss := make([]string, len(ns))
+	for i, n := range ns {
+		ss[i] = strconv.Itoa(n)
+	}
+	return joinComma(ss)
+}
+
 // sortedEntries returns entries sorted by type: domains, IPs, CIDRs.
 func sortedEntries(entries []shunt.Entry) []shunt.Entry {
 	sorted := make([]shunt.Entry, len(entries))
@@ -50,3 +116,24 @@ func logLevelClass(level string) string {
 		return "log-level text-muted"
 	}
 }
+
+// queryActionClass returns the badge class of the shunt action of a query,
+// colored like the shunt cards.
+func queryActionClass(action string) string {
+	switch action {
+	case shunt.ActionDirect:
+		return "badge badge-green"
+	case shunt.ActionBlock:
+		return "badge badge-red"
+	}
+	return "badge"
+}
+
+// queryShunt returns the label of the shunt a query matched, its action if
+// the shunt is unknown.
+func queryShunt(e dns.QueryLogEntry) string {
+	if e.Shunt == "" {
+		return e.Action
+	}
+	return e.Shunt
+}